@@ -30,21 +30,29 @@ import (
 var (
 	configFile string
 	listenAddr string
+	httpAddr   string
+	redirAddr  string
+	tproxy     bool
 	serverAddr string
 	obfsType   string
 	obfsHost   string
 	psk        string
 	snellVer   string
+	method     string
 	version    bool
 )
 
 func init() {
 	flag.StringVar(&configFile, "c", "", "configuration file path")
 	flag.StringVar(&listenAddr, "l", "0.0.0.0:18888", "client listen address")
+	flag.StringVar(&httpAddr, "http", "", "http proxy listen address, disabled if empty")
+	flag.StringVar(&redirAddr, "redir", "", "transparent proxy listen address, disabled if empty")
+	flag.BoolVar(&tproxy, "tproxy", false, "use TPROXY instead of REDIRECT for the transparent proxy")
 	flag.StringVar(&serverAddr, "s", "", "snell server address")
 	flag.StringVar(&obfsType, "obfs", "", "obfs type")
 	flag.StringVar(&obfsHost, "obfs-host", "bing.com", "obfs host")
 	flag.StringVar(&psk, "k", "", "pre-shared key")
+	flag.StringVar(&method, "cipher", "", "cipher method, empty for the one of the snell version")
 	flag.BoolVar(&version, "version", false, "show open-snell version")
 
 	flag.Parse()
@@ -67,11 +75,15 @@ func init() {
 		}
 
 		listenAddr = sec.Key("listen").String()
+		httpAddr = sec.Key("http-listen").String()
+		redirAddr = sec.Key("redir-listen").String()
+		tproxy = sec.Key("tproxy").MustBool(false)
 		serverAddr = sec.Key("server").String()
 		obfsType = sec.Key("obfs").String()
 		obfsHost = sec.Key("obfs-host").String()
 		psk = sec.Key("psk").String()
 		snellVer = sec.Key("version").String()
+		method = sec.Key("cipher").String()
 	}
 
 	if serverAddr == "" {
@@ -93,7 +105,18 @@ func init() {
 }
 
 func main() {
-	sn, err := snell.NewSnellClient(listenAddr, serverAddr, obfsType, obfsHost, psk, snellVer == "2")
+	var opts []snell.ClientOption
+	if httpAddr != "" {
+		opts = append(opts, snell.WithHTTPProxy(httpAddr))
+	}
+	if redirAddr != "" {
+		opts = append(opts, snell.WithRedirProxy(redirAddr, tproxy))
+	}
+	if method != "" {
+		opts = append(opts, snell.WithCipherMethod(method))
+	}
+
+	sn, err := snell.NewSnellClient(listenAddr, serverAddr, obfsType, obfsHost, psk, snellVer == "2", opts...)
 	if err != nil {
 		log.Fatalf("Failed to initialize snell client %v\n", err)
 	}
@@ -15,7 +15,9 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
@@ -23,6 +25,8 @@ import (
 	log "github.com/golang/glog"
 	"gopkg.in/ini.v1"
 
+	"github.com/icpz/open-snell/components/acl"
+	"github.com/icpz/open-snell/components/aead"
 	"github.com/icpz/open-snell/components/snell"
 	"github.com/icpz/open-snell/constants"
 )
@@ -32,7 +36,10 @@ var (
 	listenAddr string
 	obfsType   string
 	psk        string
+	aclFile    string
+	method     string
 	version    bool
+	benchmark  bool
 )
 
 func init() {
@@ -40,7 +47,10 @@ func init() {
 	flag.StringVar(&listenAddr, "l", "0.0.0.0:18888", "server listen address")
 	flag.StringVar(&obfsType, "obfs", "", "obfs type")
 	flag.StringVar(&psk, "k", "", "pre-shared key")
+	flag.StringVar(&aclFile, "acl", "", "destination ACL file, reloaded on SIGHUP")
+	flag.StringVar(&method, "cipher", "", "cipher method accepted besides aes-128-gcm, empty for stock snell")
 	flag.BoolVar(&version, "version", false, "show open-snell version")
+	flag.BoolVar(&benchmark, "bench-ciphers", false, "print the throughput of every cipher method as JSON and exit")
 
 	flag.Parse()
 	flag.Set("logtostderr", "true")
@@ -49,6 +59,14 @@ func init() {
 	if version {
 		os.Exit(0)
 	}
+	if benchmark {
+		results, err := aead.BenchmarkCiphers(256 << 20)
+		if err != nil {
+			log.Fatalf("Cipher benchmark failed: %v\n", err)
+		}
+		json.NewEncoder(os.Stdout).Encode(results)
+		os.Exit(0)
+	}
 
 	if configFile != "" {
 		log.Infof("Configuration file specified, ignoring other flags\n")
@@ -64,6 +82,8 @@ func init() {
 		listenAddr = sec.Key("listen").String()
 		obfsType = sec.Key("obfs").String()
 		psk = sec.Key("psk").String()
+		aclFile = sec.Key("acl").String()
+		method = sec.Key("cipher").String()
 	}
 
 	if obfsType == "none" || obfsType == "off" {
@@ -72,14 +92,38 @@ func init() {
 }
 
 func main() {
-	sn, err := snell.NewSnellServer(listenAddr, psk, obfsType)
+	var opts []snell.ServerOption
+	var rules *acl.ACL
+	if aclFile != "" {
+		rules = acl.New()
+		if err := rules.LoadFile(aclFile); err != nil {
+			log.Fatalf("Failed to load acl %s, %v\n", aclFile, err)
+		}
+		opts = append(opts, snell.WithUpstreamDialer(acl.NewDialer(rules, &net.Dialer{}, "")))
+	}
+	if method != "" {
+		opts = append(opts, snell.WithAcceptCipherMethod(method))
+	}
+
+	sn, err := snell.NewSnellServer(listenAddr, psk, obfsType, opts...)
 	if err != nil {
 		log.Fatalf("Failed to initialize snell server %v\n", err)
 	}
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if rules != nil {
+			if err := rules.LoadFile(aclFile); err != nil {
+				log.Errorf("Failed to reload acl %s, keeping the old rules: %v\n", aclFile, err)
+			} else {
+				log.Infof("Reloaded acl %s\n", aclFile)
+			}
+		}
+	}
 
 	sn.Close()
 }
@@ -0,0 +1,215 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type Action int
+
+const (
+	Allow Action = iota
+	Deny
+)
+
+func (a Action) String() string {
+	if a == Deny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// rule matches a destination when all of its set conditions hold.
+type rule struct {
+	action Action
+	suffix string
+	cidr   *net.IPNet
+	ports  map[int]bool
+}
+
+func (r *rule) match(host string, ip net.IP, port int) bool {
+	if r.ports != nil && !r.ports[port] {
+		return false
+	}
+	if r.suffix != "" {
+		if !(host == r.suffix || strings.HasSuffix(host, "."+r.suffix)) {
+			return false
+		}
+	}
+	if r.cidr != nil && (ip == nil || !r.cidr.Contains(ip)) {
+		return false
+	}
+	return true
+}
+
+type ruleSet struct {
+	rules []rule
+	final Action
+}
+
+// ACL evaluates destinations against an ordered list of rules, the first
+// matching rule decides. Rules can be replaced at any time, concurrent
+// evaluations see either the old or the new set.
+type ACL struct {
+	set atomic.Value // *ruleSet
+}
+
+// New returns an ACL allowing everything until rules are loaded.
+func New() *ACL {
+	a := &ACL{}
+	a.set.Store(&ruleSet{final: Allow})
+	return a
+}
+
+// Load replaces the rules with the ones read from r. One rule per line:
+//
+//	allow|deny [domain <suffix>] [cidr <prefix>] [port <p>[,<p>...]]
+//	final allow|deny
+//
+// A rule without conditions matches everything. final sets the decision
+// when no rule matched, allow by default. '#' starts a comment.
+func (a *ACL) Load(r io.Reader) error {
+	set := &ruleSet{final: Allow}
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "final" {
+			if len(fields) != 2 {
+				return fmt.Errorf("acl line %d: final wants one action", ln)
+			}
+			act, err := parseAction(fields[1])
+			if err != nil {
+				return fmt.Errorf("acl line %d: %v", ln, err)
+			}
+			set.final = act
+			continue
+		}
+
+		rl, err := parseRule(fields)
+		if err != nil {
+			return fmt.Errorf("acl line %d: %v", ln, err)
+		}
+		set.rules = append(set.rules, rl)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	a.set.Store(set)
+	return nil
+}
+
+// LoadFile is Load reading from the file at path.
+func (a *ACL) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return a.Load(f)
+}
+
+func parseAction(s string) (Action, error) {
+	switch s {
+	case "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	}
+	return Allow, fmt.Errorf("unknown action %q", s)
+}
+
+func parseRule(fields []string) (rule, error) {
+	var rl rule
+	var err error
+	if rl.action, err = parseAction(fields[0]); err != nil {
+		return rl, err
+	}
+
+	args := fields[1:]
+	if len(args)%2 != 0 {
+		return rl, fmt.Errorf("condition %q without value", args[len(args)-1])
+	}
+	for i := 0; i < len(args); i += 2 {
+		val := args[i+1]
+		switch args[i] {
+		case "domain":
+			rl.suffix = strings.ToLower(strings.Trim(val, "."))
+		case "cidr":
+			if _, rl.cidr, err = net.ParseCIDR(val); err != nil {
+				return rl, err
+			}
+		case "port":
+			rl.ports = map[int]bool{}
+			for _, p := range strings.Split(val, ",") {
+				port, err := strconv.Atoi(p)
+				if err != nil || port <= 0 || port > 65535 {
+					return rl, fmt.Errorf("invalid port %q", p)
+				}
+				rl.ports[port] = true
+			}
+		default:
+			return rl, fmt.Errorf("unknown condition %q", args[i])
+		}
+	}
+	return rl, nil
+}
+
+// Decide returns the decision for the "host:port" target. CIDR rules never
+// match a domain target here, see DecideResolved.
+func (a *ACL) Decide(target string) Action {
+	return a.DecideResolved(target, nil)
+}
+
+// DecideResolved is Decide for a domain target known to resolve to ip, so
+// that both domain and CIDR rules apply.
+func (a *ACL) DecideResolved(target string, ip net.IP) Action {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return Deny
+	}
+	iport, _ := strconv.Atoi(port)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if hip := net.ParseIP(host); hip != nil {
+		ip = hip
+	}
+	return a.decide(host, ip, iport)
+}
+
+func (a *ACL) decide(host string, ip net.IP, port int) Action {
+	set := a.set.Load().(*ruleSet)
+	for i := range set.rules {
+		if set.rules[i].match(host, ip, port) {
+			return set.rules[i].action
+		}
+	}
+	return set.final
+}
@@ -0,0 +1,232 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package acl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func load(t *testing.T, rules string) *ACL {
+	t.Helper()
+	a := New()
+	if err := a.Load(strings.NewReader(rules)); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestSuffixMatching(t *testing.T) {
+	a := load(t, `
+deny domain example.com
+deny domain .Internal.
+`)
+	for target, want := range map[string]Action{
+		"example.com:443":          Deny,
+		"www.example.com:443":      Deny,
+		"a.b.example.com:80":       Deny,
+		"WWW.Example.COM:80":       Deny,
+		"www.example.com.:80":      Deny,
+		"notexample.com:443":       Allow,
+		"example.com.evil.net:443": Allow,
+		"host.internal:22":         Deny,
+		"internal:22":              Deny,
+		"internals:22":             Allow,
+		"1.2.3.4:80":               Allow,
+	} {
+		if got := a.Decide(target); got != want {
+			t.Errorf("%s: got %s, want %s", target, got, want)
+		}
+	}
+}
+
+func TestCIDRMembership(t *testing.T) {
+	a := load(t, `
+deny cidr 10.0.0.0/8
+deny cidr 192.168.1.0/24
+deny cidr fd00::/8
+allow cidr 127.0.0.1/32
+final deny
+`)
+	for target, want := range map[string]Action{
+		"10.0.0.1:80":          Deny,
+		"10.255.255.255:80":    Deny,
+		"11.0.0.1:80":          Deny, // final
+		"192.168.1.7:80":       Deny,
+		"192.168.2.7:80":       Deny,
+		"[fd12::1]:80":         Deny,
+		"127.0.0.1:80":         Allow,
+		"127.0.0.2:80":         Deny,
+		"[::ffff:10.1.2.3]:80": Deny,
+	} {
+		if got := a.Decide(target); got != want {
+			t.Errorf("%s: got %s, want %s", target, got, want)
+		}
+	}
+
+	b := load(t, "deny cidr 10.0.0.0/8")
+	for target, want := range map[string]Action{
+		"10.1.2.3:80":     Deny,
+		"172.16.0.1:80":   Allow,
+		"[fd00::1]:80":    Allow,
+		"internal.lan:80": Allow, // CIDR rules skip unresolved domains
+	} {
+		if got := b.Decide(target); got != want {
+			t.Errorf("%s: got %s, want %s", target, got, want)
+		}
+	}
+	if got := b.DecideResolved("internal.lan:80", net.ParseIP("10.9.9.9")); got != Deny {
+		t.Errorf("resolved into 10/8: got %s, want deny", got)
+	}
+}
+
+func TestRuleConditionsCombine(t *testing.T) {
+	a := load(t, `
+allow domain example.com port 443
+deny domain example.com          # everything else of example.com
+allow cidr 10.0.0.0/8 port 22,80
+deny cidr 10.0.0.0/8
+`)
+	for target, want := range map[string]Action{
+		"example.com:443":     Allow,
+		"www.example.com:443": Allow,
+		"example.com:80":      Deny,
+		"10.0.0.1:22":         Allow,
+		"10.0.0.1:80":         Allow,
+		"10.0.0.1:443":        Deny,
+		"other.com:80":        Allow,
+	} {
+		if got := a.Decide(target); got != want {
+			t.Errorf("%s: got %s, want %s", target, got, want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, rules := range []string{
+		"block domain example.com",
+		"deny domain",
+		"deny cidr 10.0.0.0/33",
+		"deny port 0",
+		"deny port 65536",
+		"deny host example.com",
+		"final",
+		"final maybe",
+	} {
+		a := load(t, "deny domain kept.com")
+		if err := a.Load(strings.NewReader(rules)); err == nil {
+			t.Errorf("%q: loaded", rules)
+		}
+		if a.Decide("kept.com:80") != Deny {
+			t.Errorf("%q: failed load replaced the rules", rules)
+		}
+	}
+}
+
+type fakeDialer struct {
+	dialed []string
+	fail   map[string]bool // addresses refusing connections
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dialed = append(d.dialed, addr)
+	if d.fail[addr] {
+		return nil, errors.New("connection refused")
+	}
+	a, b := net.Pipe()
+	b.Close()
+	return a, nil
+}
+
+// stubResolver answers from a fixed table, counting lookups.
+type stubResolver struct {
+	hosts   map[string][]string
+	lookups int
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups++
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestDialer(t *testing.T) {
+	a := load(t, `
+deny domain blocked.com
+allow domain trusted.com port 22
+deny cidr 10.0.0.0/8
+`)
+	res := &stubResolver{hosts: map[string][]string{
+		"www.blocked.com": {"8.8.8.8"},
+		"sneaky.com":      {"10.1.1.1", "10.2.2.2"},
+		"fine.com":        {"10.0.0.5", "192.0.2.1", "192.0.2.2"},
+		"trusted.com":     {"10.3.3.3"},
+	}}
+	next := &fakeDialer{fail: map[string]bool{"192.0.2.1:80": true}}
+	d := NewDialerWithResolver(a, next, res, "")
+
+	dial := func(target string) error {
+		c, err := d.DialContext(context.Background(), "tcp", target)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	if err := dial("www.blocked.com:80"); err == nil {
+		t.Fatal("denied domain dialed")
+	}
+	if len(next.dialed) != 0 || res.lookups != 0 {
+		t.Fatalf("denied domain resolved %d times and dialed %v", res.lookups, next.dialed)
+	}
+
+	// the domain is allowed but resolves into a denied network: nothing
+	// is dialed
+	if err := dial("sneaky.com:80"); err == nil || err.Error() != "destination denied by policy" {
+		t.Fatalf("domain resolving to a denied network got %v", err)
+	}
+	if len(next.dialed) != 0 {
+		t.Fatalf("dialed %v in a denied network", next.dialed)
+	}
+
+	// the denied address is skipped, a refusing one passed over
+	if err := dial("fine.com:80"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.0.2.1:80", "192.0.2.2:80"}; len(next.dialed) != 2 || next.dialed[0] != want[0] || next.dialed[1] != want[1] {
+		t.Fatalf("dialed %v, want %v", next.dialed, want)
+	}
+
+	// a domain rule decides for the addresses of the name
+	next.dialed = nil
+	if err := dial("trusted.com:22"); err != nil || len(next.dialed) != 1 || next.dialed[0] != "10.3.3.3:22" {
+		t.Fatalf("allowed domain in a denied network: %v, dialed %v", err, next.dialed)
+	}
+	if err := dial("trusted.com:80"); err == nil {
+		t.Fatal("denied network dialed for another port")
+	}
+
+	if err := dial("10.0.0.1:80"); err == nil {
+		t.Fatal("denied address dialed")
+	}
+	if err := dial("missing.com:80"); err == nil {
+		t.Fatal("unresolved domain dialed")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package acl
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Dialer is the dialing interface the ACL dialer wraps and implements.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Resolver looks up the addresses of a host, as net.Resolver does.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type aclDialer struct {
+	acl      *ACL
+	next     Dialer
+	resolver Resolver
+	err      error
+}
+
+// NewDialer returns a Dialer refusing targets denied by a with an error
+// carrying msg, and dialing the others with next. Domain targets are
+// resolved first, with the default resolver, and only the addresses the
+// rules allow for the name are dialed.
+func NewDialer(a *ACL, next Dialer, msg string) Dialer {
+	return NewDialerWithResolver(a, next, net.DefaultResolver, msg)
+}
+
+// NewDialerWithResolver is NewDialer resolving domain targets with r.
+func NewDialerWithResolver(a *ACL, next Dialer, r Resolver, msg string) Dialer {
+	if msg == "" {
+		msg = "destination denied by policy"
+	}
+	return &aclDialer{acl: a, next: next, resolver: r, err: errors.New(msg)}
+}
+
+// Check returns the error refusing addr if the rules deny it by its name
+// or port alone, nil otherwise.
+func (d *aclDialer) Check(addr string) error {
+	if d.acl.Decide(addr) == Deny {
+		return d.err
+	}
+	return nil
+}
+
+// DialResolved dials addr, a "host:port" target whose host resolved to
+// ip, at ip if the rules allow ip for the name. Callers resolving names
+// themselves, such as a server caching DNS answers, thereby keep domain
+// rules in effect.
+func (d *aclDialer) DialResolved(ctx context.Context, network, addr string, ip net.IP) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.acl.DecideResolved(addr, ip) == Deny {
+		return nil, d.err
+	}
+	return d.next.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+func (d *aclDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := d.Check(addr); err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.next.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// the addresses denied are skipped, the others dialed in turn
+	err = d.err
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil || d.acl.DecideResolved(addr, ip) == Deny {
+			continue
+		}
+		var c net.Conn
+		c, err = d.next.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err == nil || ctx.Err() != nil {
+			return c, err
+		}
+	}
+	return nil, err
+}
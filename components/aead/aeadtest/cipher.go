@@ -0,0 +1,57 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package aeadtest provides helpers for testing code built on the aead
+// package. Nothing in here is meant for production use.
+package aeadtest
+
+import (
+	"crypto/cipher"
+	"flag"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+type passthroughCipher struct{}
+
+// NewPassthroughCipher returns a cipher whose AEAD neither encrypts nor
+// authenticates anything and adds no overhead, while the stream still runs
+// the salt exchange and record framing. It provides NO security at all and
+// panics when called outside of a test binary.
+func NewPassthroughCipher() aead.Cipher {
+	if flag.Lookup("test.v") == nil {
+		panic("aeadtest: passthrough cipher used outside of tests")
+	}
+	return passthroughCipher{}
+}
+
+func (passthroughCipher) KeySize() int  { return 0 }
+func (passthroughCipher) SaltSize() int { return 16 }
+func (passthroughCipher) Encrypter(salt []byte) (cipher.AEAD, error) {
+	return identityAEAD{}, nil
+}
+func (passthroughCipher) Decrypter(salt []byte) (cipher.AEAD, error) {
+	return identityAEAD{}, nil
+}
+
+type identityAEAD struct{}
+
+func (identityAEAD) NonceSize() int { return 12 }
+func (identityAEAD) Overhead() int  { return 0 }
+func (identityAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	return append(dst, plaintext...)
+}
+func (identityAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	return append(dst, ciphertext...), nil
+}
@@ -0,0 +1,64 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aeadtest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+func TestPassthroughFraming(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := aead.NewConn(a, NewPassthroughCipher())
+
+	msg := []byte("no secrets here")
+	go c.Write(msg)
+
+	// salt, then a 2 bytes length and the payload, both in clear
+	wire := make([]byte, 16+2+len(msg))
+	if _, err := io.ReadFull(b, wire); err != nil {
+		t.Fatal(err)
+	}
+	if n := int(wire[16])<<8 | int(wire[17]); n != len(msg) {
+		t.Fatalf("record length %d, want %d", n, len(msg))
+	}
+	if !bytes.Equal(wire[18:], msg) {
+		t.Fatalf("payload %q, want %q", wire[18:], msg)
+	}
+}
+
+func TestPassthroughRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ciph := NewPassthroughCipher()
+	c, s := aead.NewConn(a, ciph), aead.NewConn(b, ciph)
+
+	msg := bytes.Repeat([]byte("0123456789"), 5000) // several records
+	go c.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload altered")
+	}
+}
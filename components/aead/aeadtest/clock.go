@@ -0,0 +1,151 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aeadtest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// FakeClock is an aead.Clock whose time only moves on Advance and Jump.
+// Timers fire synchronously from Advance, in deadline order.
+type FakeClock struct {
+	mux    sync.Mutex
+	now    time.Time     // elapsed time, what timers run on
+	skew   time.Duration // wall clock steps, see Jump
+	timers []*fakeTimer
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (fc *FakeClock) Now() time.Time {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	return fc.now.Add(fc.skew)
+}
+
+func (fc *FakeClock) After(d time.Duration) <-chan time.Time {
+	return fc.NewTimer(d).Chan()
+}
+
+func (fc *FakeClock) NewTimer(d time.Duration) aead.Timer {
+	t := &fakeTimer{clock: fc, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (fc *FakeClock) AfterFunc(d time.Duration, f func()) aead.Timer {
+	t := &fakeTimer{clock: fc, fn: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the time forward by d, firing the timers due meanwhile.
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.mux.Lock()
+	end := fc.now.Add(d)
+	for {
+		sort.Slice(fc.timers, func(i, j int) bool {
+			return fc.timers[i].when.Before(fc.timers[j].when)
+		})
+		if len(fc.timers) == 0 || fc.timers[0].when.After(end) {
+			break
+		}
+		t := fc.timers[0]
+		fc.timers = fc.timers[1:]
+		if t.when.After(fc.now) {
+			fc.now = t.when
+		}
+		now := fc.now.Add(fc.skew)
+		fc.mux.Unlock()
+		t.fire(now)
+		fc.mux.Lock()
+	}
+	fc.now = end
+	fc.mux.Unlock()
+}
+
+// Jump steps the wall clock by d, forward or backward, as NTP or a resume
+// from suspend would: Now moves but no time elapses, so no timer fires nor
+// moves. Unlike time.Now, Now carries no monotonic reading, so code
+// measuring durations with Now().Sub sees the step.
+func (fc *FakeClock) Jump(d time.Duration) {
+	fc.mux.Lock()
+	fc.skew += d
+	fc.mux.Unlock()
+}
+
+// Pending returns the number of timers not fired nor stopped yet, handy to
+// wait until the code under test armed its timer.
+func (fc *FakeClock) Pending() int {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	return len(fc.timers)
+}
+
+// remove t from the pending timers, reporting whether it was pending.
+func (fc *FakeClock) remove(t *fakeTimer) bool {
+	for i, pt := range fc.timers {
+		if pt == t {
+			fc.timers = append(fc.timers[:i], fc.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	c     chan time.Time
+	fn    func()
+}
+
+func (t *fakeTimer) fire(now time.Time) {
+	if t.fn != nil {
+		t.fn()
+		return
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+func (t *fakeTimer) Chan() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mux.Lock()
+	defer t.clock.mux.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	fc := t.clock
+	fc.mux.Lock()
+	active := fc.remove(t)
+	t.when = fc.now.Add(d)
+	fc.timers = append(fc.timers, t)
+	fc.mux.Unlock()
+	if d <= 0 {
+		fc.Advance(0)
+	}
+	return active
+}
@@ -0,0 +1,279 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aeadtest
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+func TestFakeClockTimers(t *testing.T) {
+	start := time.Unix(1000, 0)
+	fc := NewFakeClock(start)
+
+	var fired []int
+	fc.AfterFunc(30*time.Millisecond, func() { fired = append(fired, 3) })
+	fc.AfterFunc(10*time.Millisecond, func() { fired = append(fired, 1) })
+	stopped := fc.AfterFunc(20*time.Millisecond, func() { fired = append(fired, 2) })
+	ch := fc.After(25 * time.Millisecond)
+
+	if !stopped.Stop() {
+		t.Fatal("pending timer not stopped")
+	}
+	fc.Advance(15 * time.Millisecond)
+	if len(fired) != 1 || fired[0] != 1 {
+		t.Fatalf("fired %v after 15ms", fired)
+	}
+	select {
+	case <-ch:
+		t.Fatal("25ms timer fired after 15ms")
+	default:
+	}
+
+	fc.Advance(time.Second)
+	if len(fired) != 2 || fired[1] != 3 {
+		t.Fatalf("fired %v", fired)
+	}
+	if now := <-ch; !now.Equal(start.Add(25 * time.Millisecond)) {
+		t.Fatalf("timer fired at %v", now.Sub(start))
+	}
+	if got := fc.Now().Sub(start); got != 1015*time.Millisecond {
+		t.Fatalf("now %v after the advances", got)
+	}
+	if fc.Pending() != 0 {
+		t.Fatalf("%d timers pending", fc.Pending())
+	}
+}
+
+func TestFakeClockJump(t *testing.T) {
+	start := time.Unix(1000, 0)
+	fc := NewFakeClock(start)
+	fired := false
+	fc.AfterFunc(time.Second, func() { fired = true })
+
+	fc.Jump(time.Hour)
+	if fired {
+		t.Fatal("a wall clock step fired a timer")
+	}
+	if got := fc.Now().Sub(start); got != time.Hour {
+		t.Fatalf("now %v after the jump", got)
+	}
+	fc.Advance(time.Second)
+	if !fired {
+		t.Fatal("timer not fired once its time elapsed")
+	}
+}
+
+// TestFakeClockDrivesLinger checks a coalesced record goes out when the
+// fake clock says the linger expired, not before.
+func TestFakeClockDrivesLinger(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	fc := NewFakeClock(time.Unix(0, 0))
+	ciph := NewPassthroughCipher()
+	c := aead.NewConn(a, ciph, aead.WithClock(fc), aead.WithWriteCoalescing(time.Second))
+	s := aead.NewConn(b, ciph)
+
+	if _, err := c.Write([]byte("later")); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(s, buf)
+		got <- string(buf)
+	}()
+
+	fc.Advance(999 * time.Millisecond)
+	select {
+	case msg := <-got:
+		t.Fatalf("got %q before the linger expired", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+	go fc.Advance(time.Millisecond)
+	if msg := <-got; msg != "later" {
+		t.Fatalf("got %q", msg)
+	}
+}
+
+// TestFakeClockDrivesRecordTimeout checks the record timeout runs on the
+// injected clock while the socket deadline stays on real time, whatever
+// the fake clock says.
+func TestFakeClockDrivesRecordTimeout(t *testing.T) {
+	wire := append(make([]byte, 16), 0, 5, 'h', 'e', 'l', 'l', 'o')
+	head, rest := wire[:17], wire[17:]
+
+	trickle := func(t *testing.T) (*FakeClock, net.Conn, net.Conn) {
+		a, b := net.Pipe()
+		t.Cleanup(func() { a.Close(); b.Close() })
+		fc := NewFakeClock(time.Unix(0, 0)) // decades behind real time
+		s := aead.NewConn(b, NewPassthroughCipher(), aead.WithClock(fc), aead.WithRecordTimeout(time.Hour))
+		go a.Write(head)
+		return fc, a, s
+	}
+
+	t.Run("completes", func(t *testing.T) {
+		_, a, s := trickle(t)
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			a.Write(rest)
+		}()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("got %q, %v", buf, err)
+		}
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		fc, _, s := trickle(t)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := s.Read(make([]byte, 5))
+			errc <- err
+		}()
+		for i := 0; fc.Pending() == 0; i++ { // the record started
+			if i == 2000 {
+				t.Fatal("record timeout not armed on the fake clock")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		fc.Jump(2 * time.Hour) // a wall clock step, no time elapsed
+		fc.Advance(time.Hour - time.Second)
+		select {
+		case err := <-errc:
+			t.Fatalf("read ended before the record timeout: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		fc.Advance(time.Second)
+		select {
+		case err := <-errc:
+			if !errors.Is(err, aead.ErrSlowRecord) {
+				t.Fatalf("got %v, want ErrSlowRecord", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("record timeout did not fire on the fake clock")
+		}
+	})
+}
+
+// TestClockJumpKeepsLifetime steps the wall clock of a stream with a
+// maximum lifetime both ways: the stream ends once the lifetime elapsed,
+// not when the wall clock says it did.
+func TestClockJumpKeepsLifetime(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	fc := NewFakeClock(time.Unix(1000, 0))
+	ciph := NewPassthroughCipher()
+	c := aead.NewConn(a, ciph)
+	s := aead.NewConn(b, ciph, aead.WithClock(fc), aead.WithMaxLifetime(time.Minute))
+
+	go c.Write([]byte("hi"))
+	if _, err := io.ReadFull(s, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(c)
+		read <- err
+	}()
+
+	for _, step := range []time.Duration{2 * time.Hour, -4 * time.Hour} {
+		fc.Jump(step)
+		if _, err := s.Write([]byte("alive")); err != nil {
+			t.Fatalf("after a %v step: %v", step, err)
+		}
+	}
+	fc.Advance(time.Minute - time.Second)
+	if _, err := s.Write([]byte("alive")); err != nil {
+		t.Fatalf("before the lifetime elapsed: %v", err)
+	}
+
+	fc.Advance(time.Second)
+	select {
+	case err := <-read:
+		if !errors.Is(err, aead.ErrZeroChunk) {
+			t.Fatalf("got %v, want the stream ended cleanly", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lifetime did not expire once elapsed")
+	}
+	if _, err := s.Write([]byte("late")); !errors.Is(err, aead.ErrMaxLifetime) {
+		t.Fatalf("got %v, want ErrMaxLifetime", err)
+	}
+}
+
+// TestFakeClockDrivesCloseTimeout closes a stream whose peer stopped
+// reading: CloseGracefully gives up when its timeout elapsed on the fake
+// clock, and the reset frees the writer the close was blocked on.
+func TestFakeClockDrivesCloseTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	fc := NewFakeClock(time.Unix(0, 0))
+	ciph := NewPassthroughCipher()
+	c := aead.NewConn(a, ciph, aead.WithClock(fc))
+	s := aead.NewConn(b, ciph)
+	go c.Write([]byte("hi"))
+	if _, err := io.ReadFull(s, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer reads no more, the ZERO_CHUNK blocks on the pipe
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.(interface{ CloseGracefully(time.Duration) error }).CloseGracefully(time.Minute)
+	}()
+	for i := 0; fc.Pending() == 0; i++ {
+		if i == 2000 {
+			t.Fatal("close timeout not armed on the fake clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	fc.Advance(time.Minute - time.Second)
+	select {
+	case err := <-closed:
+		t.Fatalf("close ended before its timeout: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	fc.Advance(time.Second)
+	select {
+	case err := <-closed:
+		if !errors.Is(err, aead.ErrCloseTimeout) {
+			t.Fatalf("got %v, want ErrCloseTimeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("close timeout did not fire on the fake clock")
+	}
+
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("late"))
+		wrote <- err
+	}()
+	select {
+	case err := <-wrote:
+		if err == nil {
+			t.Fatal("write succeeded after the reset")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("writer still held after the reset")
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aeadtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// tap records what is written to its conn.
+type tap struct {
+	net.Conn
+	mux  sync.Mutex
+	wire bytes.Buffer
+}
+
+func (t *tap) Write(b []byte) (int, error) {
+	t.mux.Lock()
+	t.wire.Write(b)
+	t.mux.Unlock()
+	return t.Conn.Write(b)
+}
+
+// records splits what a stream keyed with the passthrough cipher wrote
+// into records: 'd' for data, 'p' for padding and 'k' for keepalive, along
+// with their sizes.
+func (t *tap) records(tb testing.TB) (kinds string, sizes []int) {
+	tb.Helper()
+	t.mux.Lock()
+	wire := append([]byte(nil), t.wire.Bytes()...)
+	t.mux.Unlock()
+	wire = wire[16:] // the salt
+	for len(wire) > 0 {
+		if len(wire) < 2 {
+			tb.Fatalf("%d bytes left, not a record", len(wire))
+		}
+		hdr := binary.BigEndian.Uint16(wire)
+		n := int(hdr & 0x3FFF)
+		switch {
+		case hdr&0x8000 == 0:
+			kinds += "d"
+		case n == 0:
+			kinds += "k"
+		default:
+			kinds += "p"
+		}
+		if len(wire) < 2+n {
+			tb.Fatalf("record of %d bytes cut at %d", n, len(wire)-2)
+		}
+		sizes = append(sizes, n)
+		wire = wire[2+n:]
+	}
+	return kinds, sizes
+}
+
+type negotiator interface {
+	SetNegotiated(aead.Features)
+}
+
+// coverPair returns a client stream sending cover traffic on fc as ct
+// says, with features negotiated, its wire tapped, and the server end.
+func coverPair(t *testing.T, fc *FakeClock, ct aead.CoverTraffic, f aead.Features) (net.Conn, *tap, net.Conn) {
+	t.Helper()
+	a, b := tcpPair(t)
+	ciph := NewPassthroughCipher()
+	w := &tap{Conn: a}
+	c := aead.NewConn(w, ciph, aead.WithClock(fc), aead.WithCoverTraffic(ct))
+	s := aead.NewConn(b, ciph)
+	c.(negotiator).SetNegotiated(f)
+	s.(negotiator).SetNegotiated(f)
+
+	// the timer starts once the client read the salt of the server
+	go c.Write([]byte("hello"))
+	if _, err := io.ReadFull(s, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	go s.Write([]byte("ok"))
+	if _, err := io.ReadFull(c, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Pending() != 1 {
+		t.Fatal("cover timer not armed once established")
+	}
+	return c, w, s
+}
+
+// TestCoverTrafficIdle ticks the cover timer of an idle stream: it sends
+// padding records, keepalives without padding negotiated, or nothing, and
+// the peer reads none of it.
+func TestCoverTrafficIdle(t *testing.T) {
+	ct := aead.CoverTraffic{Interval: time.Second, Jitter: 0.5, MinSize: 10, MaxSize: 100}
+	for _, tc := range []struct {
+		name     string
+		features aead.Features
+		kind     byte
+	}{
+		{"padding", aead.FeaturePadding | aead.FeatureKeepalive, 'p'},
+		{"keepalive", aead.FeatureKeepalive, 'k'},
+		{"neither", 0, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fc := NewFakeClock(time.Unix(0, 0))
+			c, w, s := coverPair(t, fc, ct, tc.features)
+			read := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(s)
+				read <- b
+			}()
+
+			// 4 to 12 gaps of 0.5s to 1.5s, the first skipped for the
+			// data of the handshake
+			fc.Advance(6 * time.Second)
+			kinds, sizes := w.records(t)
+			if kinds[0] != 'd' {
+				t.Fatalf("records %q, want the data first", kinds)
+			}
+			cover := kinds[1:]
+			if tc.kind == 0 {
+				if cover != "" {
+					t.Fatalf("records %q sent without padding nor keepalive", cover)
+				}
+			} else if len(cover) < 3 || len(cover) > 11 || bytes.Count([]byte(cover), []byte{tc.kind}) != len(cover) {
+				t.Fatalf("records %q over 6s idle, want 3 to 11 of %q", cover, tc.kind)
+			}
+			for _, n := range sizes[1:] {
+				if tc.kind == 'p' && (n < ct.MinSize || n > ct.MaxSize) {
+					t.Fatalf("padding of %d bytes, want [%d, %d]", n, ct.MinSize, ct.MaxSize)
+				}
+			}
+
+			c.Write([]byte("data"))
+			c.Close()
+			if fc.Pending() != 0 {
+				t.Fatal("cover timer left after Close")
+			}
+			select {
+			case b := <-read:
+				if string(b) != "data" {
+					t.Fatalf("server read %q, want only the data", b)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("server did not see the end")
+			}
+		})
+	}
+}
+
+// TestCoverTrafficInterleaves writes data between ticks: no padding goes
+// out while data flows, padding resumes once idle, and the peer reads the
+// data whole.
+func TestCoverTrafficInterleaves(t *testing.T) {
+	fc := NewFakeClock(time.Unix(0, 0))
+	ct := aead.CoverTraffic{Interval: time.Second, MinSize: 1, MaxSize: 64}
+	c, w, s := coverPair(t, fc, ct, aead.FeaturePadding)
+	read := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(s)
+		read <- b
+	}()
+
+	var want bytes.Buffer
+	step := func(busy bool) {
+		if busy {
+			msg := []byte{'a' + byte(want.Len()%26)}
+			want.Write(msg)
+			if _, err := c.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fc.Advance(time.Second)
+	}
+	for _, busy := range []bool{false, false, true, true, true, false, false, true, false} {
+		step(busy)
+	}
+
+	// a tick after a data record skips, hello's included, the next idle
+	// one pads
+	kinds, _ := w.records(t)
+	if want := "d" + "p" + "ddd" + "pp" + "d" + "p"; kinds != want {
+		t.Fatalf("records %q, want %q", kinds, want)
+	}
+
+	c.Close()
+	select {
+	case b := <-read:
+		if !bytes.Equal(b, want.Bytes()) {
+			t.Fatalf("server read %q, want %q", b, want.Bytes())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not see the end")
+	}
+}
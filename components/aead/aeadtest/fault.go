@@ -0,0 +1,166 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aeadtest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// Direction selects the reads or the writes of a FaultConn.
+type Direction int
+
+const (
+	DirRead Direction = iota
+	DirWrite
+)
+
+// Fault is an error a FaultConn injects once the bytes or calls in Dir
+// reach a point. With Call > 0, the Call-th call, counted from 1, fails
+// with Err moving no bytes. Otherwise Offset bytes go through and the call
+// crossing it is cut there, returning the bytes before it with Err: a
+// partial write, or a read ending early. A fault fires once, unless
+// Sticky, in which case every later call fails too.
+type Fault struct {
+	Dir    Direction
+	Offset int64
+	Call   int
+	Err    error
+	Sticky bool
+}
+
+// FaultConn injects the faults it is programmed with into the reads and
+// writes of the wrapped conn, to drive error paths of the stream above it
+// deterministically.
+type FaultConn struct {
+	net.Conn
+	mux    sync.Mutex
+	faults []*Fault
+	fired  []*Fault // sticky faults that fired
+	bytes  [2]int64
+	calls  [2]int
+}
+
+func NewFaultConn(c net.Conn) *FaultConn {
+	return &FaultConn{Conn: c}
+}
+
+// Inject adds f, faults fire in the order they were injected.
+func (fc *FaultConn) Inject(f Fault) {
+	if f.Call > 0 {
+		f.Offset = -1
+	}
+	fc.mux.Lock()
+	fc.faults = append(fc.faults, &f)
+	fc.mux.Unlock()
+}
+
+// Counts reports the bytes that went through and the calls made in dir.
+func (fc *FaultConn) Counts(dir Direction) (bytes int64, calls int) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	return fc.bytes[dir], fc.calls[dir]
+}
+
+// plan returns how many of n bytes the next call in dir may move and the
+// fault cutting it, if any.
+func (fc *FaultConn) plan(dir Direction, n int) (int, *Fault) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	fc.calls[dir]++
+	for _, f := range fc.fired {
+		if f.Dir == dir {
+			return 0, f
+		}
+	}
+	for _, f := range fc.faults {
+		if f.Dir != dir {
+			continue
+		}
+		if f.Call > 0 && fc.calls[dir] == f.Call {
+			return 0, f
+		}
+		if f.Offset >= 0 && n > 0 && fc.bytes[dir]+int64(n) >= f.Offset {
+			limit := f.Offset - fc.bytes[dir]
+			if limit < 0 {
+				limit = 0
+			}
+			return int(limit), f
+		}
+	}
+	return n, nil
+}
+
+// done accounts for n bytes moved in dir, firing f if its point was
+// reached: a read may return before the cut.
+func (fc *FaultConn) done(dir Direction, n int, f *Fault) error {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	fc.bytes[dir] += int64(n)
+	if f == nil || (f.Call == 0 && fc.bytes[dir] < f.Offset) {
+		return nil
+	}
+	for i, pf := range fc.faults {
+		if pf == f {
+			fc.faults = append(fc.faults[:i], fc.faults[i+1:]...)
+			if f.Sticky {
+				fc.fired = append(fc.fired, f)
+			}
+			break
+		}
+	}
+	return f.Err
+}
+
+func (fc *FaultConn) Read(b []byte) (int, error) {
+	limit, f := fc.plan(DirRead, len(b))
+	if limit == 0 && f != nil {
+		return 0, fc.done(DirRead, 0, f)
+	}
+	n, err := fc.Conn.Read(b[:limit])
+	if ferr := fc.done(DirRead, n, f); err == nil {
+		err = ferr
+	}
+	return n, err
+}
+
+func (fc *FaultConn) Write(b []byte) (int, error) {
+	limit, f := fc.plan(DirWrite, len(b))
+	if limit == 0 && f != nil {
+		return 0, fc.done(DirWrite, 0, f)
+	}
+	n, err := fc.Conn.Write(b[:limit])
+	if ferr := fc.done(DirWrite, n, f); err == nil {
+		err = ferr
+	}
+	return n, err
+}
+
+// CheckNonces returns an error unless the directions of the stream c used
+// up read and write nonces, see aead.NonceCounters: after a failure, it
+// tells whether the stream stayed in step with its peer.
+func CheckNonces(c net.Conn, read, write uint64) error {
+	r, w, ok := aead.NonceCounters(c)
+	if !ok {
+		return fmt.Errorf("%T is not an aead stream", c)
+	}
+	if r != read || w != write {
+		return fmt.Errorf("nonces used read %d write %d, want %d and %d", r, w, read, write)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aeadtest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// FragmentConn splits reads and writes of the wrapped conn into random
+// sized pieces of 1 to maxChunk bytes, like a transport with a random MTU
+// would, to exercise the reassembly of records.
+type FragmentConn struct {
+	net.Conn
+	maxChunk int
+	mux      sync.Mutex
+	rnd      *rand.Rand
+}
+
+// NewFragmentConn wraps c, seed makes the fragmentation reproducible.
+func NewFragmentConn(c net.Conn, maxChunk int, seed int64) *FragmentConn {
+	if maxChunk < 1 {
+		maxChunk = 1
+	}
+	return &FragmentConn{Conn: c, maxChunk: maxChunk, rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (fc *FragmentConn) chunk(n int) int {
+	fc.mux.Lock()
+	m := 1 + fc.rnd.Intn(fc.maxChunk)
+	fc.mux.Unlock()
+	if m > n {
+		m = n
+	}
+	return m
+}
+
+func (fc *FragmentConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return fc.Conn.Read(b)
+	}
+	return fc.Conn.Read(b[:fc.chunk(len(b))])
+}
+
+func (fc *FragmentConn) Write(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		nw, err := fc.Conn.Write(b[n : n+fc.chunk(len(b)-n)])
+		n += nw
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
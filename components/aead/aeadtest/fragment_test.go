@@ -0,0 +1,116 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aeadtest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+var fragmentPSK = []byte("open-snell fragment psk")
+
+// fragmentRoundTrip sends payload over a pipe fragmented at random MTUs of
+// up to mtu bytes on both ends and returns what the other end read up to
+// the ZERO_CHUNK.
+func fragmentRoundTrip(payload []byte, mtu int, seed int64) ([]byte, error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ciph := aead.NewAES128GCM(fragmentPSK)
+	c := aead.NewConn(NewFragmentConn(a, mtu, seed), ciph)
+	s := aead.NewConn(NewFragmentConn(b, mtu, seed+1), ciph)
+
+	errc := make(chan error, 1)
+	go func() {
+		if len(payload) > 0 { // an empty write would be the ZERO_CHUNK
+			if _, err := c.Write(payload); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- c.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+	got, err := io.ReadAll(s)
+	if !errors.Is(err, aead.ErrZeroChunk) {
+		return got, err
+	}
+	return got, <-errc
+}
+
+func TestFragmentedRoundTripQuick(t *testing.T) {
+	f := func(payload []byte, mtu uint16, seed int64) bool {
+		got, err := fragmentRoundTrip(payload, 1+int(mtu)%1500, seed)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		return bytes.Equal(got, payload)
+	}
+	cfg := &quick.Config{
+		MaxCount: 200,
+		// payloads spanning up to three records, quick's own stay tiny
+		Values: func(args []reflect.Value, rnd *rand.Rand) {
+			payload := make([]byte, rnd.Intn(3*aead.MaxPayloadSize+1))
+			rnd.Read(payload)
+			args[0] = reflect.ValueOf(payload)
+			args[1] = reflect.ValueOf(uint16(rnd.Intn(1 << 16)))
+			args[2] = reflect.ValueOf(rnd.Int63())
+		},
+	}
+	if testing.Short() {
+		cfg.MaxCount = 50
+	}
+	if err := quick.Check(f, cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFragmentedRoundTripSizes(t *testing.T) {
+	big := 4 << 20
+	if testing.Short() {
+		big = 1 << 20
+	}
+	sizes := []int{
+		0, 1,
+		aead.MaxPayloadSize - 1, aead.MaxPayloadSize, aead.MaxPayloadSize + 1,
+		2 * aead.MaxPayloadSize,
+		big,
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for _, size := range sizes {
+		for _, mtu := range []int{1, 7, 576, 1500, 65535} {
+			if size >= big && mtu < 576 {
+				continue // byte by byte through the pipe takes too long
+			}
+			payload := make([]byte, size)
+			rnd.Read(payload)
+			got, err := fragmentRoundTrip(payload, mtu, int64(size+mtu))
+			if err != nil {
+				t.Fatalf("size %d mtu %d: %v", size, mtu, err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("size %d mtu %d: read %d bytes altered", size, mtu, len(got))
+			}
+		}
+	}
+}
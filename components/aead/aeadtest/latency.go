@@ -0,0 +1,92 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aeadtest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// LatencyConn delays every read after it returned and every write before
+// it starts by delay plus a random jitter in [0, jitter), and lets tests
+// inject stalls, to exercise timeouts at record boundaries.
+type LatencyConn struct {
+	net.Conn
+	delay  time.Duration
+	jitter time.Duration
+	clock  aead.Clock
+
+	mux   sync.Mutex
+	rnd   *rand.Rand
+	stall time.Duration
+}
+
+// NewLatencyConn wraps c, seed makes the jitter reproducible. Delays are
+// waited on aead.RealClock, see SetClock.
+func NewLatencyConn(c net.Conn, delay, jitter time.Duration, seed int64) *LatencyConn {
+	return &LatencyConn{
+		Conn:   c,
+		delay:  delay,
+		jitter: jitter,
+		clock:  aead.RealClock,
+		rnd:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+// NewFragmentLatencyConn combines FragmentConn and LatencyConn: every
+// fragment is delayed on its own, the worst case for partial records.
+func NewFragmentLatencyConn(c net.Conn, maxChunk int, delay, jitter time.Duration, seed int64) *FragmentConn {
+	return NewFragmentConn(NewLatencyConn(c, delay, jitter, seed), maxChunk, seed)
+}
+
+// SetClock makes the conn wait on clk, e.g. a FakeClock.
+func (lc *LatencyConn) SetClock(clk aead.Clock) {
+	lc.clock = clk
+}
+
+// Stall adds d to the wait of the next read or write.
+func (lc *LatencyConn) Stall(d time.Duration) {
+	lc.mux.Lock()
+	lc.stall += d
+	lc.mux.Unlock()
+}
+
+func (lc *LatencyConn) wait() {
+	lc.mux.Lock()
+	d := lc.delay + lc.stall
+	lc.stall = 0
+	if lc.jitter > 0 {
+		d += time.Duration(lc.rnd.Int63n(int64(lc.jitter)))
+	}
+	lc.mux.Unlock()
+	if d > 0 {
+		<-lc.clock.After(d)
+	}
+}
+
+func (lc *LatencyConn) Read(b []byte) (int, error) {
+	n, err := lc.Conn.Read(b)
+	lc.wait()
+	return n, err
+}
+
+func (lc *LatencyConn) Write(b []byte) (int, error) {
+	lc.wait()
+	return lc.Conn.Write(b)
+}
@@ -0,0 +1,91 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aeadtest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// slowWriter takes delay to accept every write, a downstream as slow as
+// the link.
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (w slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	return len(b), nil
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		a.Close()
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// BenchmarkPrefetchHighLatency receives a bulk transfer over a link where
+// every read waits a millisecond, delivering each record to a downstream
+// as slow. Without prefetch the two waits add up, prefetching overlaps
+// them.
+func BenchmarkPrefetchHighLatency(b *testing.B) {
+	const delay = time.Millisecond
+	ciph := aead.NewAES128GCM(fragmentPSK)
+	payload := make([]byte, aead.MaxPayloadSize)
+	for _, records := range []int{0, 1, 4} {
+		b.Run(fmt.Sprintf("prefetch=%d", records), func(b *testing.B) {
+			a, z := tcpPair(b)
+			c := aead.NewConn(a, ciph)
+			s := aead.NewConn(NewLatencyConn(z, delay, 0, 1), ciph, aead.WithPrefetch(records))
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := c.Write(payload); err != nil {
+						return
+					}
+				}
+			}()
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			want := int64(b.N) * int64(len(payload))
+			if n, err := io.CopyN(slowWriter{delay}, s, want); err != nil {
+				b.Fatalf("received %d of %d bytes: %v", n, want, err)
+			}
+		})
+	}
+}
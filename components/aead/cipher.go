@@ -17,6 +17,12 @@ package aead
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
 
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -29,23 +35,106 @@ type Cipher interface {
 	Decrypter(salt []byte) (cipher.AEAD, error)
 }
 
+// KDF derives the keySize bytes key of a direction from its salt, holding
+// the PSK itself.
+type KDF func(salt []byte, keySize int) ([]byte, error)
+
+// SoftwareKDF is the Snell KDF over psk, the one every cipher uses unless
+// built by NewCipherWithKDF.
+func SoftwareKDF(psk []byte) KDF {
+	return func(salt []byte, keySize int) ([]byte, error) {
+		if err := checkKeySize(keySize); err != nil {
+			return nil, err
+		}
+		return snellKDF(psk, salt, keySize), nil
+	}
+}
+
 type snellCipher struct {
 	psk      []byte
+	kdf      KDF // replaces snellKDF over psk if set
 	keySize  int
 	makeAEAD func(key []byte) (cipher.AEAD, error)
+	method   string // empty for custom ciphers
+
+	fpOnce sync.Once
+	fp     string
 }
 
 func (sc *snellCipher) KeySize() int  { return sc.keySize }
 func (sc *snellCipher) SaltSize() int { return 16 }
 func (sc *snellCipher) Encrypter(salt []byte) (cipher.AEAD, error) {
-	return sc.makeAEAD(snellKDF(sc.psk, salt, sc.KeySize()))
+	return sc.derive(salt)
 }
 func (sc *snellCipher) Decrypter(salt []byte) (cipher.AEAD, error) {
-	return sc.makeAEAD(snellKDF(sc.psk, salt, sc.KeySize()))
+	return sc.derive(salt)
+}
+
+func (sc *snellCipher) derive(salt []byte) (cipher.AEAD, error) {
+	key, err := sc.key(salt)
+	if err != nil {
+		return nil, err
+	}
+	return sc.makeAEAD(key)
+}
+
+func (sc *snellCipher) key(salt []byte) ([]byte, error) {
+	if sc.kdf == nil {
+		return snellKDF(sc.psk, salt, sc.keySize), nil
+	}
+	return sc.kdf(salt, sc.keySize)
+}
+
+// fingerprintSalt derives the key fingerprints are taken of, it is never
+// the salt of a stream but by chance.
+var fingerprintSalt = []byte("open-snell:fprnt")
+
+// Fingerprint identifies the PSK and the method of the cipher without
+// revealing either: the first 8 bytes, in hex, of the SHA-256 of the
+// method and of the key derived from a fixed salt. It is stable across
+// processes, computed once, and empty if the KDF fails.
+func (sc *snellCipher) Fingerprint() string {
+	sc.fpOnce.Do(func() {
+		key, err := sc.key(fingerprintSalt)
+		if err != nil {
+			return
+		}
+		h := sha256.New()
+		h.Write([]byte(sc.method))
+		h.Write([]byte{0})
+		h.Write(key)
+		sc.fp = hex.EncodeToString(h.Sum(nil)[:8])
+	})
+	return sc.fp
 }
 
+// Fingerprint returns the fingerprint of ciph if it has one, as the
+// ciphers of this package do, or an empty string.
+func Fingerprint(ciph Cipher) string {
+	if fc, ok := ciph.(interface{ Fingerprint() string }); ok {
+		return fc.Fingerprint()
+	}
+	return ""
+}
+
+// kdfSize is the length of the Snell KDF output, keys are its prefix.
+const kdfSize = 32
+
+var ErrInvalidKeySize = errors.New("invalid cipher key size")
+
+func checkKeySize(keySize int) error {
+	if keySize <= 0 || keySize > kdfSize {
+		return fmt.Errorf("%w: %d, must be within 1 and %d", ErrInvalidKeySize, keySize, kdfSize)
+	}
+	return nil
+}
+
+// snellKDF derives the key of a direction from its salt. It is the costly
+// part of a handshake and runs once per direction of a stream, streams
+// never rekey. Connections repeating salts cache their derivations, see
+// keyCache, never across connections.
 func snellKDF(psk, salt []byte, keySize int) []byte {
-	return argon2.IDKey(psk, salt, 3, 8, 1, 32)[:keySize]
+	return argon2.IDKey(psk, salt, 3, 8, 1, kdfSize)[:keySize]
 }
 
 func aesGCM(key []byte) (cipher.AEAD, error) {
@@ -61,6 +150,18 @@ func NewAES128GCM(psk []byte) Cipher {
 		psk:      psk,
 		keySize:  16,
 		makeAEAD: aesGCM,
+		method:   "aes-128-gcm",
+	}
+}
+
+// NewAES256GCM is NewAES128GCM with a 256 bits key. This is an open-snell
+// extension, both ends have to be configured with it.
+func NewAES256GCM(psk []byte) Cipher {
+	return &snellCipher{
+		psk:      psk,
+		keySize:  32,
+		makeAEAD: aesGCM,
+		method:   "aes-256-gcm",
 	}
 }
 
@@ -69,5 +170,101 @@ func NewChacha20Poly1305(psk []byte) Cipher {
 		psk:      psk,
 		keySize:  32,
 		makeAEAD: chacha20poly1305.New,
+		method:   "chacha20-poly1305",
+	}
+}
+
+// NewXChaCha20Poly1305 returns a cipher using the 24 bytes nonce variant
+// of ChaCha20-Poly1305, whose nonce space cannot be exhausted in practice.
+// This is an open-snell extension: stock Snell peers do not speak it. A
+// server holding it as primary or fallback cipher (see NewConnWithFallback)
+// tells it apart from the other by the first record of each client, so it
+// can be offered next to a stock method.
+func NewXChaCha20Poly1305(psk []byte) Cipher {
+	return &snellCipher{
+		psk:      psk,
+		keySize:  32,
+		makeAEAD: chacha20poly1305.NewX,
+		method:   "xchacha20-poly1305",
+	}
+}
+
+// methods maps the method names used in configurations to their ciphers.
+var methods = map[string]func(psk []byte) Cipher{
+	"aes-128-gcm":       NewAES128GCM,
+	"chacha20-poly1305": NewChacha20Poly1305,
+
+	"aes-256-gcm":        NewAES256GCM,
+	"xchacha20-poly1305": NewXChaCha20Poly1305,
+}
+
+var ErrUnknownMethod = errors.New("unknown cipher method")
+
+// SupportedMethods lists the method names NewCipher accepts, sorted.
+func SupportedMethods() []string {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewCipher returns the cipher of the method named method, keyed with psk.
+func NewCipher(method string, psk []byte) (Cipher, error) {
+	newCipher, ok := methods[method]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMethod, method)
+	}
+	return newCipher(psk), nil
+}
+
+// NewCipherWithAEAD keeps the Snell KDF and framing but builds the AEAD with
+// factory, e.g. to plug in a faster implementation than the standard
+// library one. keySize is the key length factory expects, the Snell KDF
+// derives at most 32 bytes so ErrInvalidKeySize is returned beyond.
+func NewCipherWithAEAD(psk []byte, keySize int, factory func(key []byte) (cipher.AEAD, error)) (Cipher, error) {
+	if err := checkKeySize(keySize); err != nil {
+		return nil, err
+	}
+	return &snellCipher{
+		psk:      psk,
+		keySize:  keySize,
+		makeAEAD: factory,
+	}, nil
+}
+
+// NewCipherWithKDF builds a cipher whose keys come from kdf rather than
+// from a PSK held in memory, e.g. an HSM or KMS computing the Snell KDF so
+// that the PSK never leaves it; factory may likewise return a cipher.AEAD
+// backed by the device. kdf runs once per direction of every connection,
+// so a device round-trip there costs handshake latency only. An AEAD
+// offloaded to a device pays a round-trip per record instead, about two
+// per 16KiB of data, which only suits low-throughput control channels.
+func NewCipherWithKDF(kdf KDF, keySize int, factory func(key []byte) (cipher.AEAD, error)) Cipher {
+	return &snellCipher{
+		kdf:      kdf,
+		keySize:  keySize,
+		makeAEAD: factory,
+	}
+}
+
+// Warmup derives a key and seals and opens a record with ciph, so that
+// lazy initialization and the first page faults happen now rather than on
+// the first connection. It has no effect on correctness and is cheap to
+// call again.
+func Warmup(ciph Cipher) error {
+	salt := make([]byte, ciph.SaltSize())
+	enc, err := ciph.Encrypter(salt)
+	if err != nil {
+		return err
+	}
+	dec, err := ciph.Decrypter(salt)
+	if err != nil {
+		return err
 	}
+	nonce := make([]byte, enc.NonceSize())
+	sealed := enc.Seal(nil, nonce, make([]byte, 64), nil)
+	_, err = dec.Open(sealed[:0], nonce, sealed, nil)
+	return err
 }
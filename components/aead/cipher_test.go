@@ -0,0 +1,534 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// roundTrip sends payload from a client to a server stream keyed with
+// ciph and checks it arrives intact.
+func roundTrip(t *testing.T, ciph Cipher, payload []byte) {
+	t.Helper()
+	c, s := cipherPair(t, ciph, nil, nil)
+
+	werr := make(chan error, 1)
+	go func() {
+		_, err := c.Write(payload)
+		if err == nil {
+			err = c.CloseWrite()
+		}
+		werr <- err
+	}()
+
+	got, err := io.ReadAll(s)
+	if err != nil && !errors.Is(err, ErrZeroChunk) {
+		t.Fatalf("read: %v", err)
+	}
+	if err := <-werr; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %d bytes, want %d intact", len(got), len(payload))
+	}
+}
+
+// countingAEAD counts the records sealed and opened through an injected
+// AEAD.
+type countingAEAD struct {
+	cipher.AEAD
+	sealed, opened *int
+}
+
+func (a countingAEAD) Seal(dst, nonce, plaintext, data []byte) []byte {
+	*a.sealed++
+	return a.AEAD.Seal(dst, nonce, plaintext, data)
+}
+
+func (a countingAEAD) Open(dst, nonce, ciphertext, data []byte) ([]byte, error) {
+	*a.opened++
+	return a.AEAD.Open(dst, nonce, ciphertext, data)
+}
+
+func TestCipherWithAEADRoundTrip(t *testing.T) {
+	var sealed, opened int
+	ciph, err := NewCipherWithAEAD(testPSK, 16, func(key []byte) (cipher.AEAD, error) {
+		aead, err := aesGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		return countingAEAD{aead, &sealed, &opened}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, ciph, pattern(3*MaxPayloadSize+5, 1))
+	if sealed == 0 || opened == 0 {
+		t.Fatalf("injected AEAD unused: %d sealed, %d opened", sealed, opened)
+	}
+}
+
+func TestCipherWithAEADInteropsWithBuiltin(t *testing.T) {
+	// same KDF and AEAD, so an injected stdlib GCM talks to NewAES128GCM
+	injected, err := NewCipherWithAEAD(testPSK, 16, aesGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := tcpPair(t)
+	c := NewConn(a, injected)
+	s := NewConn(b, NewAES128GCM(testPSK))
+
+	msg := []byte("hello through an injected AEAD")
+	go c.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+}
+
+func TestCipherWithAEADKeySize(t *testing.T) {
+	for _, size := range []int{-1, 0, 33, 64} {
+		if _, err := NewCipherWithAEAD(testPSK, size, aesGCM); !errors.Is(err, ErrInvalidKeySize) {
+			t.Errorf("key size %d: got %v, want ErrInvalidKeySize", size, err)
+		}
+	}
+	for _, size := range []int{1, 16, 24, 32} {
+		if _, err := NewCipherWithAEAD(testPSK, size, aesGCM); err != nil {
+			t.Errorf("key size %d: %v", size, err)
+		}
+	}
+}
+
+func TestSoftwareKDFKeySize(t *testing.T) {
+	kdf := SoftwareKDF(testPSK)
+	salt := make([]byte, 16)
+	if _, err := kdf(salt, 33); !errors.Is(err, ErrInvalidKeySize) {
+		t.Fatalf("got %v, want ErrInvalidKeySize", err)
+	}
+	key, err := kdf(salt, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, snellKDF(testPSK, salt, 32)) {
+		t.Fatal("SoftwareKDF differs from the Snell KDF")
+	}
+}
+
+// BenchmarkInjectedAEAD compares streaming through the built-in ciphers
+// with the same stream over AEADs injected with NewCipherWithAEAD: the
+// standard library GCM through the hook, which should cost nothing, and
+// the x/crypto ChaCha20-Poly1305 standing for a third-party
+// implementation.
+func BenchmarkInjectedAEAD(b *testing.B) {
+	injected := func(keySize int, factory func(key []byte) (cipher.AEAD, error)) Cipher {
+		ciph, err := NewCipherWithAEAD(benchPSK, keySize, factory)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return ciph
+	}
+	cases := []struct {
+		name string
+		ciph Cipher
+	}{
+		{"stdlib-aes-128-gcm", NewAES128GCM(benchPSK)},
+		{"injected-aes-128-gcm", injected(16, aesGCM)},
+		{"injected-chacha20-poly1305", injected(chacha20poly1305.KeySize, chacha20poly1305.New)},
+	}
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			benchmarkStream(b, tc.ciph)
+		})
+	}
+}
+
+// benchmarkStream measures a client stream keyed with ciph writing full
+// records to a server stream draining them.
+func benchmarkStream(b *testing.B, ciph Cipher) {
+	c, s := cipherPair(b, ciph, nil, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, s)
+		done <- err
+	}()
+
+	buf := pattern(MaxPayloadSize, 0)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := c.CloseWrite(); err != nil {
+		b.Fatal(err)
+	}
+	if err := <-done; err != nil && !errors.Is(err, ErrZeroChunk) {
+		b.Fatal(err)
+	}
+}
+
+func TestXChaCha20Poly1305RoundTrip(t *testing.T) {
+	ciph := NewXChaCha20Poly1305(testPSK)
+	enc, err := ciph.Encrypter(make([]byte, ciph.SaltSize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc.NonceSize() != chacha20poly1305.NonceSizeX {
+		t.Fatalf("nonce size %d, want %d", enc.NonceSize(), chacha20poly1305.NonceSizeX)
+	}
+	roundTrip(t, ciph, pattern(3*MaxPayloadSize+5, 7))
+
+	// and it does not open what another method sealed
+	a, b := tcpPair(t)
+	c := NewConn(a, NewChacha20Poly1305(testPSK))
+	s := NewConn(b, ciph)
+	go c.Write([]byte("hello"))
+	if _, err := s.Read(make([]byte, 16)); err == nil {
+		t.Fatal("xchacha20-poly1305 opened a chacha20-poly1305 record")
+	}
+}
+
+func TestIncrementExtendedNonce(t *testing.T) {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	increment(nonce)
+	if nonce[0] != 1 {
+		t.Fatalf("got %x", nonce)
+	}
+
+	// carries run little-endian across all 24 bytes
+	for i := range nonce {
+		nonce[i] = 0xFF
+	}
+	nonce[23] = 0
+	increment(nonce)
+	want := make([]byte, 24)
+	want[23] = 1
+	if !bytes.Equal(nonce, want) {
+		t.Fatalf("carry into the last byte: got %x", nonce)
+	}
+
+	// the counter wraps around only past 2^192-1
+	for i := range nonce {
+		nonce[i] = 0xFF
+	}
+	increment(nonce)
+	if !bytes.Equal(nonce, make([]byte, 24)) {
+		t.Fatalf("wrap around: got %x", nonce)
+	}
+
+	// record after record, the nonce is the record count
+	w := newWriter(io.Discard, mustAEAD(t, NewXChaCha20Poly1305(testPSK)))
+	for i := 0; i < 300; i++ {
+		w.Write([]byte{1})
+	}
+	want = make([]byte, 24)
+	want[0], want[1] = 600%256, 600/256 // two seals per record
+	if !bytes.Equal(w.nonce, want) {
+		t.Fatalf("nonce after 300 records: %x", w.nonce)
+	}
+}
+
+func mustAEAD(t *testing.T, ciph Cipher) cipher.AEAD {
+	t.Helper()
+	aead, err := ciph.Encrypter(make([]byte, ciph.SaltSize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestFallbackWithOtherNonceSize(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		client, primary, fb Cipher
+	}{
+		{"xchacha primary", NewAES128GCM(testPSK), NewXChaCha20Poly1305(testPSK), NewAES128GCM(testPSK)},
+		{"xchacha fallback", NewXChaCha20Poly1305(testPSK), NewAES128GCM(testPSK), NewXChaCha20Poly1305(testPSK)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := tcpPair(t)
+			c := NewConn(a, tc.client)
+			s := NewConnWithFallback(b, tc.primary, tc.fb)
+			msg := pattern(2*MaxPayloadSize, 8)
+			go c.Write(msg)
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, msg) {
+				t.Fatalf("request: %v", err)
+			}
+			go s.Write([]byte("reply"))
+			if _, err := io.ReadFull(c, got[:5]); err != nil || string(got[:5]) != "reply" {
+				t.Fatalf("reply %q: %v", got[:5], err)
+			}
+		})
+	}
+}
+
+// countingCipher is AES-128-GCM over psk counting its key derivations.
+func countingCipher(psk []byte, runs *int32) Cipher {
+	kdf := SoftwareKDF(psk)
+	return NewCipherWithKDF(func(salt []byte, keySize int) ([]byte, error) {
+		atomic.AddInt32(runs, 1)
+		return kdf(salt, keySize)
+	}, 16, aesGCM)
+}
+
+// wireConn replays wire as what the peer sent, discarding writes.
+func wireConn(wire []byte) net.Conn {
+	return rwConn{struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(wire), io.Discard}}
+}
+
+func TestWrongPSKDerivations(t *testing.T) {
+	salt := pattern(16, 1)
+	wrong, err := GenerateVector(NewAES128GCM([]byte("wrong psk")), salt, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, err := GenerateVector(NewAES128GCM(testPSK), salt, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name              string
+		wire              []byte
+		withFallback      bool
+		opens             bool
+		primary, fallback int32
+	}{
+		{"wrong psk", wrong, false, false, 1, 0},
+		{"wrong psk with fallback", wrong, true, false, 1, 1},
+		{"right psk with fallback", right, true, true, 1, 0},
+	} {
+		var primary, fallback int32
+		var s net.Conn
+		if tc.withFallback {
+			s = NewConnWithFallback(wireConn(tc.wire), countingCipher(testPSK, &primary), countingCipher(testPSK, &fallback))
+		} else {
+			s = NewConn(wireConn(tc.wire), countingCipher(testPSK, &primary))
+		}
+		_, err := s.Read(make([]byte, 16))
+		if (err == nil) != tc.opens {
+			t.Errorf("%s: read returned %v", tc.name, err)
+		}
+		if primary != tc.primary || fallback != tc.fallback {
+			t.Errorf("%s: %d primary and %d fallback derivations, want %d and %d",
+				tc.name, primary, fallback, tc.primary, tc.fallback)
+		}
+	}
+}
+
+// BenchmarkWrongPSKHandshake measures what a connection keyed with the
+// wrong PSK costs the accepting side: reading the salt, one derivation per
+// cipher tried and one failed Open each, nothing more.
+func BenchmarkWrongPSKHandshake(b *testing.B) {
+	wire, err := GenerateVector(NewAES128GCM([]byte("wrong psk")), pattern(16, 1), []byte("probe"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	primary, fallback := NewAES128GCM(testPSK), NewChacha20Poly1305(testPSK)
+	for _, bc := range []struct {
+		name string
+		conn func(net.Conn) net.Conn
+	}{
+		{"primary", func(c net.Conn) net.Conn { return NewConn(c, primary) }},
+		{"with-fallback", func(c net.Conn) net.Conn { return NewConnWithFallback(c, primary, fallback) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			buf := make([]byte, 64)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bc.conn(wireConn(wire)).Read(buf); err == nil {
+					b.Fatal("wrong psk accepted")
+				}
+			}
+		})
+	}
+}
+
+func TestOnFallbackUsed(t *testing.T) {
+	oldPSK := []byte("open-snell old psk")
+	for _, tc := range []struct {
+		name   string
+		client Cipher
+		fired  bool
+	}{
+		{"primary", NewAES128GCM(testPSK), false},
+		{"fallback", NewAES128GCM(oldPSK), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := tcpPair(t)
+			var peers []net.Addr
+			c := NewConn(a, tc.client)
+			s := NewConnWithFallback(b, NewAES128GCM(testPSK), NewAES128GCM(oldPSK),
+				WithOnFallbackUsed(func(peer net.Addr) { peers = append(peers, peer) }))
+
+			go c.Write(pattern(2*MaxPayloadSize, 9))
+			if _, err := io.ReadFull(s, make([]byte, 2*MaxPayloadSize)); err != nil {
+				t.Fatal(err)
+			}
+			if !tc.fired {
+				if len(peers) != 0 {
+					t.Fatalf("hook fired for a primary client: %v", peers)
+				}
+				return
+			}
+			if len(peers) != 1 || peers[0].String() != a.LocalAddr().String() {
+				t.Fatalf("hook fired for %v, want once for %v", peers, a.LocalAddr())
+			}
+		})
+	}
+}
+func TestSupportedMethodsRoundTrip(t *testing.T) {
+	methods := SupportedMethods()
+	for _, want := range []string{"aes-128-gcm", "aes-256-gcm", "chacha20-poly1305"} {
+		found := false
+		for _, m := range methods {
+			found = found || m == want
+		}
+		if !found {
+			t.Errorf("%s not listed in %v", want, methods)
+		}
+	}
+	for _, method := range methods {
+		t.Run(method, func(t *testing.T) {
+			ciph, err := NewCipher(method, testPSK)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roundTrip(t, ciph, pattern(2*MaxPayloadSize+5, 14))
+		})
+	}
+	if _, err := NewCipher("rc4-md5", testPSK); !errors.Is(err, ErrUnknownMethod) {
+		t.Fatalf("got %v, want ErrUnknownMethod", err)
+	}
+}
+
+func TestKeyCache(t *testing.T) {
+	var runs int32
+	ciph := countingCipher(testPSK, &runs)
+	kc := newKeyCache(ciph, 2)
+	a, b, c := pattern(16, 1), pattern(16, 2), pattern(16, 3)
+
+	for _, step := range []struct {
+		salt    []byte
+		encrypt bool
+		runs    int32
+	}{
+		{a, false, 1},
+		{a, false, 1}, // repeated salt, cached
+		{a, true, 2},  // the other direction is cached apart
+		{b, false, 3}, // evicts a for decryption, the least recently used
+		{a, true, 3},
+		{a, false, 4},
+	} {
+		derive := kc.Decrypter
+		if step.encrypt {
+			derive = kc.Encrypter
+		}
+		if _, err := derive(step.salt); err != nil {
+			t.Fatal(err)
+		}
+		if runs != step.runs {
+			t.Fatalf("%d derivations, want %d", runs, step.runs)
+		}
+	}
+
+	// a cache is a connection's own: another one derives again
+	if _, err := newKeyCache(ciph, 2).Decrypter(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newKeyCache(ciph, 2).Decrypter(c); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 6 {
+		t.Fatalf("%d derivations, want one per connection", runs)
+	}
+}
+
+// BenchmarkKeyDerivation compares deriving the key of a repeating salt
+// each time, as a SeqConn would for every record, with the
+// cached derivation.
+func BenchmarkKeyDerivation(b *testing.B) {
+	salt := pattern(16, 1)
+	for _, bc := range []struct {
+		name string
+		ciph Cipher
+	}{
+		{"derive", NewAES128GCM(testPSK)},
+		{"cached", newKeyCache(NewAES128GCM(testPSK), seqKeyCacheSize)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bc.ciph.Decrypter(salt); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fp := Fingerprint(NewAES128GCM(testPSK))
+	if len(fp) != 16 {
+		t.Fatalf("fingerprint %q, want 16 hex digits", fp)
+	}
+	if bytes.Contains([]byte(fp), testPSK) {
+		t.Fatalf("fingerprint %q reveals the psk", fp)
+	}
+	// stable for a PSK and a method, not bound to the cipher value
+	if again := Fingerprint(NewAES128GCM(append([]byte(nil), testPSK...))); again != fp {
+		t.Fatalf("same psk fingerprinted %q then %q", fp, again)
+	}
+
+	seen := map[string]string{fp: "aes-128-gcm " + string(testPSK)}
+	for _, psk := range [][]byte{testPSK, []byte("another psk"), []byte("another psl")} {
+		for _, method := range SupportedMethods() {
+			if method == "aes-128-gcm" && bytes.Equal(psk, testPSK) {
+				continue
+			}
+			ciph, err := NewCipher(method, psk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := method + " " + string(psk)
+			fp := Fingerprint(ciph)
+			if other, ok := seen[fp]; ok {
+				t.Fatalf("%s and %s share the fingerprint %q", key, other, fp)
+			}
+			seen[fp] = key
+		}
+	}
+
+	// ciphers without one
+	if fp := Fingerprint(struct{ Cipher }{NewAES128GCM(testPSK)}); fp != "" {
+		t.Fatalf("got %q for a cipher without Fingerprint", fp)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"math/rand"
+	"time"
+)
+
+// CoverTraffic shapes the decoy records of WithCoverTraffic.
+type CoverTraffic struct {
+	Interval time.Duration // mean gap between records
+	Jitter   float64       // gaps spread uniformly over Interval*(1±Jitter), in [0, 1]
+	MinSize  int           // padding per record, uniform in [MinSize, MaxSize]
+	MaxSize  int
+}
+
+// WithCoverTraffic sends decoy records on idle streams, so that silence
+// does not tell when real data flows: at every gap drawn from ct with no
+// data record written meanwhile, a padding record goes out, which the peer
+// discards. Data and padding records never interleave within a record.
+// Padding needs FeaturePadding, see SetNegotiated; with FeatureKeepalive
+// alone, keepalive records are sent instead, and nothing without either.
+//
+// It is off by default as it costs bandwidth on every idle stream, up to
+// 2+MaxSize+2*Overhead bytes per gap, plus a timer. ct without a positive
+// Interval leaves it off.
+func WithCoverTraffic(ct CoverTraffic) ConnOption {
+	return func(c *streamConn) {
+		if ct.Interval <= 0 {
+			return
+		}
+		if ct.Jitter < 0 {
+			ct.Jitter = 0
+		} else if ct.Jitter > 1 {
+			ct.Jitter = 1
+		}
+		if ct.MaxSize > payloadSizeMask {
+			ct.MaxSize = payloadSizeMask
+		}
+		if ct.MinSize < 0 {
+			ct.MinSize = 0
+		}
+		if ct.MinSize > ct.MaxSize {
+			ct.MinSize = ct.MaxSize
+		}
+		c.cover = &ct
+	}
+}
+
+func (ct *CoverTraffic) gap() time.Duration {
+	f := 1 + ct.Jitter*(2*rand.Float64()-1)
+	if d := time.Duration(float64(ct.Interval) * f); d > 0 {
+		return d
+	}
+	return time.Millisecond
+}
+
+func (ct *CoverTraffic) size() int {
+	return ct.MinSize + rand.Intn(ct.MaxSize-ct.MinSize+1)
+}
+
+// startCover arms the cover timer, once the handshake completed.
+func (c *streamConn) startCover() {
+	if c.cover == nil {
+		return
+	}
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	if c.coverTimer == nil && !c.coverStopped {
+		c.coverTimer = c.clock.AfterFunc(c.cover.gap(), c.coverTick)
+	}
+}
+
+func (c *streamConn) stopCover() {
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	c.coverStopped = true
+	if c.coverTimer != nil {
+		c.coverTimer.Stop()
+	}
+}
+
+func (c *streamConn) coverTick() {
+	f := c.Features()
+	n := -1
+	if f.Has(FeaturePadding) {
+		n = c.cover.size()
+	} else if f.Has(FeatureKeepalive) {
+		n = 0
+	}
+	if w := c.currentWriter(); w != nil && n >= 0 {
+		if err := w.cover(n, &c.coverSeen); err != nil {
+			return // the stream is over
+		}
+	}
+
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	if !c.coverStopped {
+		c.coverTimer.Reset(c.cover.gap())
+	}
+}
+
+// cover sends a control record of n bytes of padding unless data records
+// went out since *seen was taken, which it then updates.
+func (w *writer) cover(n int, seen *uint64) error {
+	w.out.Lock()
+	defer w.out.Unlock()
+
+	if w.done {
+		return ErrWriteClosed
+	}
+	if w.records != *seen {
+		*seen = w.records
+		return nil
+	}
+	return w.control(n)
+}
@@ -0,0 +1,140 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrSlowRecord = errors.New("record not received within the record timeout")
+
+// WithRecordTimeout bounds how long a record may take to arrive once its
+// first byte did, defeating peers trickling records in a byte at a time.
+// Waiting for a record to start is not bounded. A record exceeding it
+// fails the read with ErrSlowRecord and closes the conn. Read deadlines set
+// on the stream still apply, the earliest one wins. Off by default, it
+// costs an extra read per record.
+func WithRecordTimeout(d time.Duration) ConnOption {
+	return func(c *streamConn) {
+		c.recordTimeout = d
+	}
+}
+
+// recordDeadline arms the record timeout on the underlying conn, on top
+// of the read deadline set by the user. Socket deadlines are wall clock
+// times, so the record one is taken from package time; an injected clock
+// drives a logical deadline on top, cutting the read short through the
+// socket once it expires.
+type recordDeadline struct {
+	conn    net.Conn
+	timeout time.Duration
+	clock   Clock
+
+	mux     sync.Mutex
+	user    time.Time // read deadline set by the user
+	record  time.Time // deadline of the record being read, zero if none
+	timer   Timer     // logical deadline on an injected clock
+	expired bool      // the logical deadline passed
+}
+
+func (d *recordDeadline) setUser(t time.Time) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.user = t
+	if d.expired {
+		return nil // the read is being cut short already
+	}
+	return d.conn.SetReadDeadline(d.effective())
+}
+
+// effective returns the earliest deadline in force.
+func (d *recordDeadline) effective() time.Time {
+	if d.record.IsZero() || (!d.user.IsZero() && d.user.Before(d.record)) {
+		return d.user
+	}
+	return d.record
+}
+
+// start arms the timeout as the first byte of a record arrived.
+func (d *recordDeadline) start() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.record = time.Now().Add(d.timeout)
+	d.conn.SetReadDeadline(d.effective())
+	if d.clock != RealClock {
+		d.timer = d.clock.AfterFunc(d.timeout, d.expire)
+	}
+}
+
+// expire cuts the read of the record short as the logical deadline passed.
+func (d *recordDeadline) expire() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.record.IsZero() {
+		return // the record completed meanwhile
+	}
+	d.expired = true
+	d.conn.SetReadDeadline(time.Now())
+}
+
+// end disarms it once the record is complete.
+func (d *recordDeadline) end() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.record = time.Time{}
+	d.expired = false
+	d.conn.SetReadDeadline(d.user)
+}
+
+// check turns a timeout caused by the record deadline into ErrSlowRecord,
+// closing the conn.
+func (d *recordDeadline) check(err error) error {
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		return err
+	}
+	d.mux.Lock()
+	slow := d.expired || (!d.record.IsZero() && d.effective().Equal(d.record))
+	d.mux.Unlock()
+	if !slow {
+		return err
+	}
+	d.conn.Close()
+	return ErrSlowRecord
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	if c.deadline != nil {
+		return c.deadline.setUser(t)
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if c.deadline == nil {
+		return c.Conn.SetDeadline(t)
+	}
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.deadline.setUser(t)
+}
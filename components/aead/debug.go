@@ -0,0 +1,82 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// wireDump writes hex dumps of the bytes a stream exchanges, see
+// WithDebugWire.
+type wireDump struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+func (d *wireDump) dump(format string, args ...interface{}) {
+	if d == nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	n := len(args)
+	if n > 0 {
+		if b, ok := args[n-1].([]byte); ok {
+			fmt.Fprintf(d.w, format+"\n", args[:n-1]...)
+			d.w.Write([]byte(hex.Dump(b)))
+			return
+		}
+	}
+	fmt.Fprintf(d.w, format+"\n", args...)
+}
+
+// WithDebugWire dumps, in hex, the salts and every sealed record the stream
+// sends or receives to w, along with the sizes of the decrypted payloads.
+// It is a heavyweight diagnostic for chasing framing mismatches with other
+// implementations and must never be left on: the dumps plus the PSK reveal
+// the whole plaintext, and record sizes alone already leak a lot.
+func WithDebugWire(w io.Writer) ConnOption {
+	return func(c *streamConn) {
+		c.dump = &wireDump{w: w}
+	}
+}
+
+// NonceCounters reports how many nonces each direction of c, a stream
+// returned by NewConn, used up: two per record, one per ZERO_CHUNK. A
+// direction not set up yet reports 0, ok is false if c is not a stream.
+// It is for tests checking the stream state after a failure, call it with
+// no read or write in progress.
+func NonceCounters(c net.Conn) (read, write uint64, ok bool) {
+	sc, ok := c.(*streamConn)
+	if !ok {
+		return 0, 0, false
+	}
+	if r := sc.r; r != nil {
+		r.mux.Lock()
+		read = binary.LittleEndian.Uint64(r.nonce)
+		r.mux.Unlock()
+	}
+	if w := sc.currentWriter(); w != nil {
+		w.out.Lock()
+		write = binary.LittleEndian.Uint64(w.nonce)
+		w.out.Unlock()
+	}
+	return read, write, true
+}
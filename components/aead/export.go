@@ -0,0 +1,77 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrHandshakeIncomplete = errors.New("both salts are needed, the handshake is not complete")
+	ErrNoExporter          = errors.New("cipher does not support keying material export")
+)
+
+// exporter is implemented by ciphers able to feed ExportKeyingMaterial.
+type exporter interface {
+	exportSecret() []byte
+}
+
+func (sc *snellCipher) exportSecret() []byte { return sc.psk }
+
+// ExportKeyingMaterial derives length bytes unique to the stream, in the
+// spirit of TLS exporters (RFC 5705): HKDF-SHA256 over the PSK, keyed with
+// both salts and label. Both ends derive the same bytes once each has sent
+// and received its salt, different labels give unrelated bytes.
+func (c *streamConn) ExportKeyingMaterial(label string, length int) ([]byte, error) {
+	c.rinit.Lock()
+	r := c.r
+	c.rinit.Unlock()
+	w := c.currentWriter()
+	if r == nil || w == nil || !c.isEstablished() {
+		return nil, ErrHandshakeIncomplete
+	}
+
+	wciph := c.Cipher
+	if c.wcipher != nil {
+		wciph = c.wcipher
+	}
+	re, ok1 := c.Cipher.(exporter)
+	we, ok2 := wciph.(exporter)
+	if !ok1 || !ok2 {
+		return nil, ErrNoExporter
+	}
+
+	// order by value, so that both ends agree without knowing their role
+	secrets := [][]byte{re.exportSecret(), we.exportSecret()}
+	salts := [][]byte{c.rsalt, c.wsalt}
+	if bytes.Compare(salts[0], salts[1]) > 0 {
+		secrets[0], secrets[1] = secrets[1], secrets[0]
+		salts[0], salts[1] = salts[1], salts[0]
+	}
+	ikm := append(append([]byte{}, secrets[0]...), secrets[1]...)
+	salt := append(append([]byte{}, salts[0]...), salts[1]...)
+	info := append([]byte("snell exporter "), label...)
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,73 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// established returns a stream pair both ends of which sent and received
+// their salt.
+func established(t *testing.T) (*streamConn, *streamConn) {
+	t.Helper()
+	c, s := streamPair(t, nil, nil)
+	buf := make([]byte, 4)
+	go c.Write([]byte("ping"))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	go s.Write([]byte("pong"))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+func TestExportKeyingMaterialMatches(t *testing.T) {
+	c, s := established(t)
+	for _, length := range []int{1, 32, 100} {
+		ck, err := c.ExportKeyingMaterial("channel binding", length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sk, err := s.ExportKeyingMaterial("channel binding", length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ck) != length || !bytes.Equal(ck, sk) {
+			t.Fatalf("client exported %x, server %x", ck, sk)
+		}
+	}
+
+	a, _ := c.ExportKeyingMaterial("label a", 32)
+	b, _ := c.ExportKeyingMaterial("label b", 32)
+	if bytes.Equal(a, b) {
+		t.Fatal("labels not domain separated")
+	}
+	other, _ := established(t)
+	if o, _ := other.ExportKeyingMaterial("label a", 32); bytes.Equal(a, o) {
+		t.Fatal("two streams exported the same material")
+	}
+}
+
+func TestExportKeyingMaterialBeforeHandshake(t *testing.T) {
+	c, _ := streamPair(t, nil, nil)
+	if _, err := c.ExportKeyingMaterial("early", 32); !errors.Is(err, ErrHandshakeIncomplete) {
+		t.Fatalf("got %v, want ErrHandshakeIncomplete", err)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"strings"
+)
+
+// Features is a set of open-snell extensions, as a bitfield. Bits unknown
+// to this version are carried along but never reported active.
+type Features uint32
+
+const (
+	// FeatureConnID: records are bound to the connection id, see
+	// WithConnID.
+	FeatureConnID Features = 1 << iota
+	// FeatureFallbackCipher: the peer authenticated with the fallback
+	// cipher.
+	FeatureFallbackCipher
+	// FeatureKeepalive: the peer reads keepalive records, see
+	// WriteKeepalive.
+	FeatureKeepalive
+	// FeatureSequenced: records carry their sequence number, see
+	// NewSeqConn.
+	FeatureSequenced
+	// FeaturePadding: the peer reads padding records, see
+	// WithCoverTraffic.
+	FeaturePadding
+
+	// KnownFeatures holds every bit this version understands.
+	KnownFeatures = FeatureConnID | FeatureFallbackCipher | FeatureKeepalive | FeatureSequenced | FeaturePadding
+)
+
+var featureNames = []string{"conn-id", "fallback-cipher", "keepalive", "sequenced", "padding"}
+
+// Has reports whether all of x are in f.
+func (f Features) Has(x Features) bool {
+	return f&x == x
+}
+
+// Negotiate returns the features active between two peers: those both
+// want and this version knows. Unsupported bits requested by the remote
+// side are dropped, not an error.
+func Negotiate(local, remote Features) Features {
+	return local & remote & KnownFeatures
+}
+
+func (f Features) String() string {
+	var names []string
+	for i, name := range featureNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Features reports the extensions active on the stream, none until the
+// handshake completed, along with those agreed through SetNegotiated.
+func (c *streamConn) Features() Features {
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	return c.features | c.negotiated
+}
+
+// SetNegotiated records the extensions the layer above agreed on with the
+// peer, for Features to report.
+func (c *streamConn) SetNegotiated(f Features) {
+	c.hookMux.Lock()
+	c.negotiated = f & KnownFeatures
+	c.hookMux.Unlock()
+}
@@ -0,0 +1,78 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var ErrNoDeadline = errors.New("transport does not support deadlines")
+
+// FramedReadWriter runs the salt handshake and record framing of a stream
+// over any io.ReadWriter, e.g. an in-process pipe or a message stream,
+// rather than a net.Conn. It accepts the options of NewConn. Features
+// relying on the transport being a net.Conn are unavailable: there are no
+// deadlines, so Relay cannot stop a direction early, and
+// WithOnFallbackUsed is given a nil address.
+type FramedReadWriter struct {
+	sc *streamConn
+}
+
+// NewFramedReadWriter wraps rw with cipher. Close closes rw if it is an
+// io.Closer.
+func NewFramedReadWriter(rw io.ReadWriter, ciph Cipher, opts ...ConnOption) *FramedReadWriter {
+	sc := NewConn(rwConn{rw}, ciph, opts...).(*streamConn)
+	return &FramedReadWriter{sc: sc}
+}
+
+func (f *FramedReadWriter) Read(b []byte) (int, error)          { return f.sc.Read(b) }
+func (f *FramedReadWriter) Write(b []byte) (int, error)         { return f.sc.Write(b) }
+func (f *FramedReadWriter) WriteTo(w io.Writer) (int64, error)  { return f.sc.WriteTo(w) }
+func (f *FramedReadWriter) ReadFrom(r io.Reader) (int64, error) { return f.sc.ReadFrom(r) }
+
+// Handshake is streamConn.Handshake.
+func (f *FramedReadWriter) Handshake() error { return f.sc.Handshake() }
+
+// Flush sends any write held back by coalescing.
+func (f *FramedReadWriter) Flush() error { return f.sc.Flush() }
+
+// CloseWrite sends a ZERO_CHUNK, the transport stays open.
+func (f *FramedReadWriter) CloseWrite() error { return f.sc.CloseWrite() }
+
+func (f *FramedReadWriter) Close() error { return f.sc.Close() }
+
+// Tags returns the labels attached to the stream.
+func (f *FramedReadWriter) Tags() *Tags { return f.sc.Tags() }
+
+// rwConn dresses an io.ReadWriter up as a net.Conn for streamConn.
+type rwConn struct {
+	io.ReadWriter
+}
+
+func (c rwConn) Close() error {
+	if cl, ok := c.ReadWriter.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+func (rwConn) LocalAddr() net.Addr                { return nil }
+func (rwConn) RemoteAddr() net.Addr               { return nil }
+func (rwConn) SetDeadline(t time.Time) error      { return ErrNoDeadline }
+func (rwConn) SetReadDeadline(t time.Time) error  { return ErrNoDeadline }
+func (rwConn) SetWriteDeadline(t time.Time) error { return ErrNoDeadline }
@@ -0,0 +1,160 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package grpccreds runs gRPC over Snell AEAD streams, the cipher being
+// the security layer in place of TLS. It is a package of its own so that
+// only its users depend on gRPC.
+package grpccreds
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// AuthType is reported by AuthInfo.AuthType.
+const AuthType = "snell"
+
+type snellCreds struct {
+	primary    aead.Cipher
+	fallback   aead.Cipher
+	opts       []aead.ConnOption
+	serverName string
+}
+
+// New returns transport credentials wrapping connections with ciph, and
+// the options in opts, e.g. aead.WithConnID on clients and
+// aead.WithOptionalConnID on servers. Roles are set by the handshake.
+func New(ciph aead.Cipher, opts ...aead.ConnOption) credentials.TransportCredentials {
+	return NewWithFallback(ciph, nil, opts...)
+}
+
+// NewWithFallback is New for servers also accepting clients using the
+// fallback cipher, see aead.NewConnWithFallback. Clients ignore fallback.
+func NewWithFallback(ciph, fallback aead.Cipher, opts ...aead.ConnOption) credentials.TransportCredentials {
+	return &snellCreds{primary: ciph, fallback: fallback, opts: opts}
+}
+
+// AuthInfo describes the Snell stream under a gRPC connection, as found in
+// the peer of a call. Its methods report the stream live, e.g. extensions
+// agreed later through SetNegotiated.
+type AuthInfo struct {
+	credentials.CommonAuthInfo
+	conn net.Conn
+}
+
+func (AuthInfo) AuthType() string { return AuthType }
+
+// Features reports the extensions active on the stream.
+func (a AuthInfo) Features() aead.Features {
+	return a.conn.(interface{ Features() aead.Features }).Features()
+}
+
+// Fallback reports whether the peer uses the fallback cipher.
+func (a AuthInfo) Fallback() bool {
+	return a.Features().Has(aead.FeatureFallbackCipher)
+}
+
+// ClientHandshake wraps rawConn and sends the salt, bounded by ctx.
+func (sc *snellCreds) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	opts := append([]aead.ConnOption{aead.WithRole(aead.RoleClient)}, sc.opts...)
+	c := aead.NewConn(rawConn, sc.primary, opts...)
+	if err := handshake(ctx, c); err != nil {
+		return nil, nil, err
+	}
+	return c, sc.authInfo(c), nil
+}
+
+// ServerHandshake wraps rawConn and reads up to the first record of the
+// client, bounded by the deadline gRPC sets on rawConn: gRPC servers write
+// first, which the stream refuses until the cipher is settled.
+func (sc *snellCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	opts := append([]aead.ConnOption{aead.WithRole(aead.RoleServer)}, sc.opts...)
+	c := aead.NewConnWithFallback(rawConn, sc.primary, sc.fallback, opts...)
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(c, first); err != nil {
+		return nil, nil, err
+	}
+	return &prefixConn{Conn: c, prefix: first}, sc.authInfo(c), nil
+}
+
+// prefixConn hands out prefix before reading from the conn.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (pc *prefixConn) Read(b []byte) (int, error) {
+	if len(pc.prefix) > 0 {
+		n := copy(b, pc.prefix)
+		pc.prefix = pc.prefix[n:]
+		return n, nil
+	}
+	return pc.Conn.Read(b)
+}
+
+// handshake runs the handshake of c until ctx is done.
+func handshake(ctx context.Context, c net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Now()) // unblock the handshake
+		case <-done:
+		}
+	}()
+	err := c.(interface{ Handshake() error }).Handshake()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (sc *snellCreds) authInfo(c net.Conn) AuthInfo {
+	return AuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+		conn:           c,
+	}
+}
+
+func (sc *snellCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{
+		SecurityProtocol: AuthType,
+		SecurityVersion:  "1",
+		ServerName:       sc.serverName,
+	}
+}
+
+func (sc *snellCreds) Clone() credentials.TransportCredentials {
+	clone := *sc
+	clone.opts = append([]aead.ConnOption(nil), sc.opts...)
+	return &clone
+}
+
+// OverrideServerName only records name for Info, there is no certificate
+// to check it against.
+func (sc *snellCreds) OverrideServerName(name string) error {
+	sc.serverName = name
+	return nil
+}
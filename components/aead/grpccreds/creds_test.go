@@ -0,0 +1,120 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package grpccreds
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// rawCodec passes messages as they are, sparing the test generated code.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) { return *v.(*[]byte), nil }
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "raw" }
+
+// echoService answers every Echo call with its request, reporting whether
+// the caller used the fallback cipher on fallback.
+func echoService(fallback chan<- bool) *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: "snell.test.Echo",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Echo",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var msg []byte
+				if err := dec(&msg); err != nil {
+					return nil, err
+				}
+				if p, ok := peer.FromContext(ctx); ok {
+					if info, ok := p.AuthInfo.(AuthInfo); ok {
+						fallback <- info.Fallback()
+					}
+				}
+				return &msg, nil
+			},
+		}},
+	}
+}
+
+func TestEchoInterop(t *testing.T) {
+	primary, fallback := aead.NewAES128GCM([]byte("primary psk")), aead.NewChacha20Poly1305([]byte("fallback psk"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usedFallback := make(chan bool, 16)
+	srv := grpc.NewServer(grpc.Creds(NewWithFallback(primary, fallback)), grpc.ForceServerCodec(rawCodec{}))
+	srv.RegisterService(echoService(usedFallback), struct{}{})
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	for _, tc := range []struct {
+		name     string
+		ciph     aead.Cipher
+		fallback bool
+	}{
+		{"primary", aead.NewAES128GCM([]byte("primary psk")), false},
+		{"fallback", aead.NewChacha20Poly1305([]byte("fallback psk")), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			cc, err := grpc.DialContext(ctx, l.Addr().String(), grpc.WithTransportCredentials(New(tc.ciph)), grpc.WithBlock())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cc.Close()
+
+			// spanning several records
+			for _, req := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("snell"), 3*aead.MaxPayloadSize/5)} {
+				var resp []byte
+				if err := cc.Invoke(ctx, "/snell.test.Echo/Echo", &req, &resp, grpc.ForceCodec(rawCodec{})); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(resp, req) {
+					t.Fatalf("echoed %d bytes, want %d", len(resp), len(req))
+				}
+				if got := <-usedFallback; got != tc.fallback {
+					t.Fatalf("server saw fallback %v, want %v", got, tc.fallback)
+				}
+			}
+		})
+	}
+
+	t.Run("wrong psk", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		cc, err := grpc.DialContext(ctx, l.Addr().String(), grpc.WithTransportCredentials(New(aead.NewAES128GCM([]byte("wrong psk")))), grpc.WithBlock())
+		if err == nil {
+			cc.Close()
+			t.Fatal("connected with the wrong PSK")
+		}
+	})
+}
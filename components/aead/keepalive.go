@@ -0,0 +1,92 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"errors"
+)
+
+var ErrKeepaliveNotNegotiated = errors.New("peer did not agree to keepalive records")
+
+// errKeepalive tells the reader consumed a keepalive record.
+var errKeepalive = errors.New("keepalive record")
+
+// keepaliveHeader is the size header of a keepalive record: an empty
+// payload with the top bit set. The size field is 14 bits wide, so stock
+// readers mask the bit away and see a ZERO_CHUNK, hence FeatureKeepalive.
+// With a size, the bit marks a padding record, whose payload readers
+// discard, hence FeaturePadding.
+const keepaliveHeader = 0x8000
+
+// keepalive sends a keepalive record. It takes out alone, so a ReadFrom
+// blocked on its source, as in a relay, does not hold it back; data still
+// pending under coalescing goes out after it.
+func (w *writer) keepalive() error {
+	w.out.Lock()
+	defer w.out.Unlock()
+
+	if w.done {
+		return ErrWriteClosed
+	}
+	return w.control(0)
+}
+
+// control seals and sends a record of n bytes of padding, a keepalive
+// record if n is 0. It must be called with out held.
+func (w *writer) control(n int) error {
+	size := 2 + w.Overhead()
+	if n > 0 {
+		size += n + w.Overhead()
+	}
+	if cap(w.kbuf) < size {
+		w.kbuf = make([]byte, size)
+	}
+	buf := w.kbuf[:size]
+	buf[0], buf[1] = byte((keepaliveHeader|n)>>8), byte(n)
+	w.Seal(buf[:0], w.nonce, buf[:2], w.ad)
+	increment(w.nonce)
+	if n > 0 {
+		payload := buf[2+w.Overhead() : 2+w.Overhead()+n]
+		for i := range payload {
+			payload[i] = 0
+		}
+		w.Seal(payload[:0], w.nonce, payload, w.ad)
+		increment(w.nonce)
+	}
+	return w.writeRecord(buf)
+}
+
+// WriteKeepalive sends a keepalive record, even while a write or ReadFrom
+// is in progress. The peer consumes it silently, Read never returns for
+// it, and it does not end the stream as a ZERO_CHUNK would.
+//
+// Unlike TCP keepalive, which probes a single TCP hop from the kernel, the
+// record travels end to end through whatever relays the stream, so it
+// keeps NAT mappings and idle timeouts of proxies on the path from
+// expiring and proves the peer itself still reads. It costs a nonce and
+// 2+Overhead bytes.
+//
+// It fails with ErrKeepaliveNotNegotiated unless FeatureKeepalive is
+// active, see SetNegotiated: a peer without it would take the record for
+// a ZERO_CHUNK.
+func (c *streamConn) WriteKeepalive() error {
+	if !c.Features().Has(FeatureKeepalive) {
+		return ErrKeepaliveNotNegotiated
+	}
+	if err := c.ensureWriter(); err != nil {
+		return err
+	}
+	return c.w.keepalive()
+}
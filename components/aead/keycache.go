@@ -0,0 +1,99 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"crypto/cipher"
+	"sync"
+)
+
+// keyCache memoizes the AEADs a cipher derives from salts, so that a salt
+// repeating within one connection, as the salt of every sequenced record
+// does, costs one run of the KDF rather than one per use.
+//
+// A cache belongs to a single connection and dies with it. Shared across
+// connections, it would hand a replayed salt its key for free: replay
+// protection rests on the salt pool, but the derivation cost is what makes
+// probing the server with replayed or forged salts expensive, and keys
+// would outlive the connections they were derived for.
+type keyCache struct {
+	Cipher
+	size int
+
+	mux     sync.Mutex
+	entries []keyEntry // least recently used first
+}
+
+type keyEntry struct {
+	salt    string
+	encrypt bool
+	aead    cipher.AEAD
+}
+
+// newKeyCache caches up to size derivations of ciph.
+func newKeyCache(ciph Cipher, size int) *keyCache {
+	return &keyCache{Cipher: ciph, size: size}
+}
+
+func (kc *keyCache) Encrypter(salt []byte) (cipher.AEAD, error) {
+	return kc.get(salt, true)
+}
+
+func (kc *keyCache) Decrypter(salt []byte) (cipher.AEAD, error) {
+	return kc.get(salt, false)
+}
+
+// cached reports whether the key of salt is cached, without deriving it.
+func (kc *keyCache) cached(salt []byte, encrypt bool) bool {
+	kc.mux.Lock()
+	defer kc.mux.Unlock()
+	return kc.find(salt, encrypt) >= 0
+}
+
+func (kc *keyCache) find(salt []byte, encrypt bool) int {
+	for i, e := range kc.entries {
+		if e.encrypt == encrypt && e.salt == string(salt) {
+			return i
+		}
+	}
+	return -1
+}
+
+// get derives under the lock, concurrent uses of a new salt wait for the
+// one derivation rather than running their own.
+func (kc *keyCache) get(salt []byte, encrypt bool) (cipher.AEAD, error) {
+	kc.mux.Lock()
+	defer kc.mux.Unlock()
+
+	if i := kc.find(salt, encrypt); i >= 0 {
+		e := kc.entries[i]
+		kc.entries = append(append(kc.entries[:i], kc.entries[i+1:]...), e)
+		return e.aead, nil
+	}
+
+	derive := kc.Cipher.Decrypter
+	if encrypt {
+		derive = kc.Cipher.Encrypter
+	}
+	aead, err := derive(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(kc.entries) >= kc.size {
+		kc.entries = append(kc.entries[:0], kc.entries[1:]...)
+	}
+	kc.entries = append(kc.entries, keyEntry{string(salt), encrypt, aead})
+	return aead, nil
+}
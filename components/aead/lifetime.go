@@ -0,0 +1,72 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var ErrMaxLifetime = errors.New("stream closed at its maximum lifetime")
+
+// lifetimeGrace bounds how long ending an expired stream may take.
+const lifetimeGrace = 5 * time.Second
+
+// WithMaxLifetime closes the stream d after its handshake completed,
+// however busy it is, bounding how long a key stays in use and forcing
+// clients to reconnect with fresh salts. The stream ends as with
+// CloseGracefully, writes held back by coalescing and a ZERO_CHUNK going
+// out first; operations pending or issued afterwards fail with
+// ErrMaxLifetime. It costs one timer per stream.
+func WithMaxLifetime(d time.Duration) ConnOption {
+	return func(c *streamConn) {
+		c.maxLifetime = d
+	}
+}
+
+// startLifetime arms the lifetime timer, once the handshake completed.
+func (c *streamConn) startLifetime() {
+	if c.maxLifetime <= 0 {
+		return
+	}
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	if c.lifeTimer == nil {
+		c.lifeTimer = c.clock.AfterFunc(c.maxLifetime, c.expireLifetime)
+	}
+}
+
+func (c *streamConn) stopLifetime() {
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	if c.lifeTimer != nil {
+		c.lifeTimer.Stop()
+	}
+}
+
+func (c *streamConn) expireLifetime() {
+	atomic.StoreInt32(&c.lifeOver, 1)
+	c.CloseGracefully(lifetimeGrace)
+}
+
+// lifetimeErr reports the failures caused by the lifetime running out as
+// ErrMaxLifetime.
+func (c *streamConn) lifetimeErr(err error) error {
+	if err != nil && atomic.LoadInt32(&c.lifeOver) != 0 {
+		return ErrMaxLifetime
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Messages are carried as a sequence of fragments, each prefixed with a
+// big-endian uint16 whose top bit marks the last fragment of a message and
+// whose low 15 bits hold the fragment length. Fragments are written one at
+// a time but framing does not depend on records: coalescing may put several
+// in one record and a capped first record may split one. This is an
+// open-snell extension, both peers must speak it.
+const (
+	messageEndFlag     = 0x8000
+	messageLengthMask  = 0x7FFF
+	maxMessageFragment = payloadSizeMask - 2
+
+	DefaultMaxMessageSize = 1 << 20
+)
+
+var ErrMessageTooLarge = errors.New("message exceeds the size limit")
+
+// MessageConn provides datagram-like semantics over a cipher stream.
+type MessageConn struct {
+	net.Conn
+	maxSize int
+	rmux    sync.Mutex
+	wmux    sync.Mutex
+}
+
+// NewMessageConn wraps a cipher stream (as returned by NewConn). Messages
+// larger than maxSize are refused on both ends; maxSize <= 0 selects
+// DefaultMaxMessageSize.
+func NewMessageConn(c net.Conn, maxSize int) *MessageConn {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	return &MessageConn{Conn: c, maxSize: maxSize}
+}
+
+// WriteMessage sends b as exactly one message.
+func (mc *MessageConn) WriteMessage(b []byte) error {
+	if len(b) > mc.maxSize {
+		return ErrMessageTooLarge
+	}
+
+	mc.wmux.Lock()
+	defer mc.wmux.Unlock()
+
+	size := len(b)
+	if size > maxMessageFragment {
+		size = maxMessageFragment
+	}
+	frag := make([]byte, 2+size)
+	for {
+		n := copy(frag[2:], b)
+		b = b[n:]
+		hdr := n
+		if len(b) == 0 {
+			hdr |= messageEndFlag
+		}
+		frag[0], frag[1] = byte(hdr>>8), byte(hdr)
+		if _, err := mc.Conn.Write(frag[:2+n]); err != nil {
+			return err
+		}
+		if len(b) == 0 {
+			return nil
+		}
+	}
+}
+
+// ReadMessage reads exactly one message, accumulating its fragments. A
+// message above the size limit is skipped and ErrMessageTooLarge returned,
+// the conn is still usable for the next one.
+func (mc *MessageConn) ReadMessage() ([]byte, error) {
+	mc.rmux.Lock()
+	defer mc.rmux.Unlock()
+
+	var hdr [2]byte
+	var msg []byte
+	for {
+		if _, err := io.ReadFull(mc.Conn, hdr[:]); err != nil {
+			return nil, err
+		}
+		h := int(hdr[0])<<8 | int(hdr[1])
+		n := h & messageLengthMask
+		if len(msg)+n > mc.maxSize {
+			if err := mc.discard(h); err != nil {
+				return nil, err
+			}
+			return nil, ErrMessageTooLarge
+		}
+		msg = append(msg, make([]byte, n)...)
+		if _, err := io.ReadFull(mc.Conn, msg[len(msg)-n:]); err != nil {
+			return nil, err
+		}
+		if h&messageEndFlag != 0 {
+			return msg, nil
+		}
+	}
+}
+
+// discard skips the rest of the message whose fragment header h was just
+// read, so that the next ReadMessage starts at a message boundary.
+func (mc *MessageConn) discard(h int) error {
+	var hdr [2]byte
+	for {
+		if _, err := io.CopyN(io.Discard, mc.Conn, int64(h&messageLengthMask)); err != nil {
+			return err
+		}
+		if h&messageEndFlag != 0 {
+			return nil
+		}
+		if _, err := io.ReadFull(mc.Conn, hdr[:]); err != nil {
+			return err
+		}
+		h = int(hdr[0])<<8 | int(hdr[1])
+	}
+}
+
+// Read reads one message into b. Like a datagram socket, a message longer
+// than b is truncated and io.ErrShortBuffer is returned.
+func (mc *MessageConn) Read(b []byte) (int, error) {
+	msg, err := mc.ReadMessage()
+	if err != nil {
+		return 0, err
+	}
+	n := copy(b, msg)
+	if n < len(msg) {
+		return n, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// Write sends b as one message.
+func (mc *MessageConn) Write(b []byte) (int, error) {
+	if err := mc.WriteMessage(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
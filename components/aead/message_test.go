@@ -0,0 +1,140 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func pattern(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = seed + byte(i*7)
+	}
+	return b
+}
+
+func TestMessageSpanningRecords(t *testing.T) {
+	c, s := streamPair(t, nil, nil)
+	mc, ms := NewMessageConn(c, 0), NewMessageConn(s, 0)
+
+	msgs := [][]byte{
+		pattern(3*MaxPayloadSize+7, 1),
+		{},
+		pattern(maxMessageFragment, 2),
+		pattern(maxMessageFragment+1, 3),
+	}
+	go func() {
+		for _, m := range msgs {
+			if err := mc.WriteMessage(m); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i, want := range msgs {
+		got, err := ms.ReadMessage()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("message %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+}
+
+func TestMessagesSharingRecord(t *testing.T) {
+	c, s := streamPair(t, []ConnOption{WithWriteCoalescing(time.Hour)}, nil)
+	mc, ms := NewMessageConn(c, 0), NewMessageConn(s, 0)
+
+	msgs := [][]byte{[]byte("one"), []byte("two"), pattern(100, 4)}
+	for _, m := range msgs {
+		if err := mc.WriteMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.currentWriter().records; n != 1 {
+		t.Fatalf("%d records sent, want all messages in 1", n)
+	}
+	for i, want := range msgs {
+		got, err := ms.ReadMessage()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("message %d: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestMessageFragmentSplitByFirstRecord(t *testing.T) {
+	c, s := streamPair(t, []ConnOption{WithFirstRecordMTU(200)}, nil)
+	mc, ms := NewMessageConn(c, 0), NewMessageConn(s, 0)
+
+	want := pattern(1000, 5)
+	go mc.WriteMessage(want)
+	got, err := ms.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	c, s := streamPair(t, nil, nil)
+	mc, ms := NewMessageConn(c, 0), NewMessageConn(s, 1000)
+
+	if err := NewMessageConn(c, 10).WriteMessage(make([]byte, 11)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("write: got %v, want ErrMessageTooLarge", err)
+	}
+
+	big := pattern(2*MaxPayloadSize, 6)
+	next := []byte("after the oversized one")
+	go func() {
+		mc.WriteMessage(big)
+		mc.WriteMessage(next)
+	}()
+	if _, err := ms.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("read: got %v, want ErrMessageTooLarge", err)
+	}
+	got, err := ms.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, next) {
+		t.Fatalf("got %q after the oversized message, want %q", got, next)
+	}
+}
+
+func TestMessageConnReadShortBuffer(t *testing.T) {
+	c, s := streamPair(t, nil, nil)
+	mc, ms := NewMessageConn(c, 0), NewMessageConn(s, 0)
+
+	go mc.Write([]byte("0123456789"))
+	b := make([]byte, 4)
+	n, err := ms.Read(b)
+	if !errors.Is(err, io.ErrShortBuffer) || string(b[:n]) != "0123" {
+		t.Fatalf("got %q, %v", b[:n], err)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// DecryptStream returns the plaintext of one direction of a captured
+// stream, salt then records, e.g. for analysing traffic. A ZERO_CHUNK
+// ends it like io.EOF, a record failing to authenticate is an error.
+func DecryptStream(r io.Reader, ciph Cipher) io.Reader {
+	return &decryptStream{src: r, ciph: ciph}
+}
+
+type decryptStream struct {
+	src  io.Reader
+	ciph Cipher
+	r    *reader
+	err  error
+}
+
+func (d *decryptStream) Read(b []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.r == nil {
+		salt := make([]byte, d.ciph.SaltSize())
+		if _, err := io.ReadFull(d.src, salt); err != nil {
+			d.err = err
+			return 0, err
+		}
+		aead, err := d.ciph.Decrypter(salt)
+		if err != nil {
+			d.err = err
+			return 0, err
+		}
+		d.r = newReader(d.src, aead, nil)
+	}
+	n, err := d.r.Read(b)
+	if errors.Is(err, ErrZeroChunk) {
+		err = io.EOF
+	}
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+// EncryptStream is the counterpart of DecryptStream: what is written to it
+// is sealed to w, after a random salt, one record per Write. Close sends a
+// ZERO_CHUNK, it does not close w.
+func EncryptStream(w io.Writer, ciph Cipher) (io.WriteCloser, error) {
+	salt := make([]byte, ciph.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := ciph.Encrypter(salt)
+	if err != nil {
+		return nil, err
+	}
+	sw := newWriter(w, aead)
+	sw.salt = salt
+	return encryptStream{sw}, nil
+}
+
+type encryptStream struct {
+	*writer
+}
+
+func (e encryptStream) Close() error {
+	return e.writer.CloseWrite()
+}
@@ -0,0 +1,130 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// WithPrefetch makes the read direction fetch up to records records of
+// ciphertext ahead in a goroutine of its own, so that the network wait for
+// the next record overlaps the decryption and delivery of the current
+// one. It helps bulk transfers over high latency links, at the cost of a
+// goroutine and records*MaxPayloadSize bytes per conn while reading, so it
+// is off by default. Errors of the underlying conn, deadlines included,
+// are delivered in order after the data fetched before them; reading
+// again after a timeout resumes fetching. A record timeout, see
+// WithRecordTimeout, only sees data once it was fetched.
+func WithPrefetch(records int) ConnOption {
+	return func(c *streamConn) {
+		if records > 0 {
+			c.prefetch = records
+			c.prefetchDone = make(chan struct{})
+			c.prefetchOnce = new(sync.Once)
+		}
+	}
+}
+
+type prefetchChunk struct {
+	data []byte
+	buf  []byte // backing buffer of data, returned to the free list
+	err  error
+}
+
+// prefetcher reads r ahead into a fixed set of buffers. Read must not be
+// called concurrently, the reader of a stream serializes it.
+type prefetcher struct {
+	r     io.Reader
+	ch    chan prefetchChunk
+	free  chan []byte
+	done  <-chan struct{}
+	alive bool // fetching goroutine running
+
+	cur []byte
+	buf []byte
+	err error // delivered once cur is drained
+}
+
+func newPrefetcher(r io.Reader, records int, done <-chan struct{}) *prefetcher {
+	p := &prefetcher{
+		r:    r,
+		ch:   make(chan prefetchChunk, records),
+		free: make(chan []byte, records+1),
+		done: done,
+	}
+	// one buffer more than the queue holds, for the one being consumed;
+	// each fits a record with 16 bytes tags
+	for i := 0; i <= records; i++ {
+		p.free <- make([]byte, 2+16+MaxPayloadSize+16)
+	}
+	return p
+}
+
+func (p *prefetcher) fetch() {
+	for {
+		var buf []byte
+		select {
+		case buf = <-p.free:
+		case <-p.done:
+			return
+		}
+		n, err := p.r.Read(buf)
+		select {
+		case p.ch <- prefetchChunk{data: buf[:n], buf: buf, err: err}:
+		case <-p.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *prefetcher) Read(b []byte) (int, error) {
+	if len(p.cur) == 0 && p.err == nil {
+		if p.buf != nil {
+			p.free <- p.buf
+			p.buf = nil
+		}
+		if !p.alive {
+			p.alive = true
+			go p.fetch()
+		}
+		select {
+		case chunk := <-p.ch:
+			p.cur, p.buf, p.err = chunk.data, chunk.buf, chunk.err
+			p.alive = chunk.err == nil
+		case <-p.done:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(b, p.cur)
+	p.cur = p.cur[n:]
+	if len(p.cur) == 0 && p.err != nil {
+		err := p.err
+		p.err = nil
+		return n, err
+	}
+	return n, nil
+}
+
+// stopPrefetch ends the fetching goroutine, if any, once the conn closes.
+func (c *streamConn) stopPrefetch() {
+	if c.prefetchDone != nil {
+		c.prefetchOnce.Do(func() { close(c.prefetchDone) })
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrRecordRateExceeded = errors.New("peer exceeds the record rate limit")
+
+// WithRecordRateLimit bounds the records read per second to rate, with
+// bursts of up to burst records, as a defense against crypto
+// amplification: a flood of tiny or empty records costs an Open and a
+// nonce per record for next to no data, which byte rate limits do not
+// catch. Over the limit, reading waits for the rate to allow the next
+// record if throttle is set, pushing back on the peer through the
+// transport, or fails with ErrRecordRateExceeded otherwise, after which
+// the stream should be closed. Keepalive records and ZERO_CHUNKs count
+// too. rate <= 0 disables it, burst below 1 is taken as 1.
+func WithRecordRateLimit(rate float64, burst int, throttle bool) ConnOption {
+	return func(c *streamConn) {
+		c.recordRate = rate
+		c.recordBurst = burst
+		c.rateThrottle = throttle
+	}
+}
+
+// recordRate is a token bucket of records, used by the reading goroutine
+// only.
+type recordRate struct {
+	rate     float64
+	burst    float64
+	throttle bool
+	clock    Clock
+	tokens   float64
+	last     time.Time
+}
+
+func newRecordRate(rate float64, burst int, throttle bool, clock Clock) *recordRate {
+	if burst < 1 {
+		burst = 1
+	}
+	return &recordRate{rate: rate, burst: float64(burst), throttle: throttle, clock: clock, tokens: float64(burst)}
+}
+
+// take charges a record, waiting or failing as configured when the
+// bucket is empty.
+func (rr *recordRate) take() error {
+	now := rr.clock.Now()
+	// A Clock without monotonic readings may step back, which must not
+	// take tokens away.
+	if elapsed := now.Sub(rr.last); !rr.last.IsZero() && elapsed > 0 {
+		rr.tokens += rr.rate * elapsed.Seconds()
+		if rr.tokens > rr.burst {
+			rr.tokens = rr.burst
+		}
+	}
+	rr.last = now
+	if rr.tokens < 1 {
+		if !rr.throttle {
+			return ErrRecordRateExceeded
+		}
+		wait := time.Duration((1 - rr.tokens) / rr.rate * float64(time.Second))
+		<-rr.clock.After(wait)
+		rr.tokens, rr.last = 1, rr.last.Add(wait)
+	}
+	rr.tokens--
+	return nil
+}
@@ -0,0 +1,141 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+// Relay copies between a and b in both directions until both are done and
+// returns the bytes copied each way along with the first error met. When a
+// side reaches EOF the other one is half-closed if it supports CloseWrite,
+// so the opposite direction keeps flowing; otherwise the opposite
+// direction is stopped as well. Neither conn is closed, except when a copy
+// fails: a destination with CloseWithError is then aborted so that its
+// peer sees an error instead of a clean end.
+//
+// Bytes already decrypted but not read yet, e.g. left behind by a sniffer
+// using Peek or a partial Read, are copied first.
+func Relay(a, b net.Conn) (ab, ba int64, err error) {
+	return RelayWithBuffers(a, b, defaultBuffers{})
+}
+
+// BufferPool supplies copy buffers. Get may block to bound the buffers in
+// use across its users, as pool.Fixed does. Such a pool should also
+// provide GetPair() ([]byte, []byte), taking two buffers at once, so that
+// relays sharing it never each hold one while waiting for another.
+type BufferPool interface {
+	Get() []byte
+	Put(buf []byte)
+}
+
+// getPair takes the two buffers of a relay from pool.
+func getPair(pool BufferPool) ([]byte, []byte) {
+	if pp, ok := pool.(interface{ GetPair() ([]byte, []byte) }); ok {
+		return pp.GetPair()
+	}
+	return pool.Get(), pool.Get()
+}
+
+type defaultBuffers struct{}
+
+func (defaultBuffers) Get() []byte    { return p.Get(p.RelayBufferSize) }
+func (defaultBuffers) Put(buf []byte) { p.Put(buf) }
+
+// RelayWithBuffers is Relay drawing its copy buffers from pool, two held
+// for the whole relay, so that relays sharing a bounded pool share a bound
+// on their copy memory: a relay waits for its buffers before copying
+// anything. A stream on either end copies through its record buffers and
+// draws none.
+func RelayWithBuffers(a, b net.Conn, pool BufferPool) (ab, ba int64, err error) {
+	var abuf, bbuf []byte
+	if !isStream(a) && !isStream(b) {
+		abuf, bbuf = getPair(pool)
+		defer pool.Put(abuf)
+		defer pool.Put(bbuf)
+	}
+
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	setErr := func(e error) {
+		mux.Lock()
+		if err == nil {
+			err = e
+		}
+		mux.Unlock()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var e error
+		ba, e = relayHalf(a, b, abuf)
+		setErr(e)
+	}()
+	ab, e := relayHalf(b, a, bbuf)
+	setErr(e)
+	wg.Wait()
+	return
+}
+
+// relayHalf copies src to dst, then shuts down the direction.
+func relayHalf(dst, src net.Conn, buf []byte) (int64, error) {
+	n, err := copyConn(dst, src, buf)
+	if errors.Is(err, ErrZeroChunk) { // end of the stream direction
+		err = nil
+	}
+	if err == nil {
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+			return n, nil
+		}
+	}
+	// nothing can be signalled through dst, or the copy failed: stop the
+	// opposite direction too
+	dst.SetReadDeadline(time.Now())
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		err = nil // most likely the deadline set by the opposite direction
+	}
+	if err != nil {
+		if ce, ok := dst.(interface{ CloseWithError(error) error }); ok {
+			ce.CloseWithError(err)
+		}
+	}
+	return n, err
+}
+
+// copyConn picks the copy path avoiding an intermediate buffer: the stream
+// decrypts straight into dst, or seals straight from src. Otherwise buf is
+// used.
+func copyConn(dst, src net.Conn, buf []byte) (int64, error) {
+	if sc, ok := src.(*streamConn); ok {
+		return sc.WriteTo(dst)
+	}
+	if sc, ok := dst.(*streamConn); ok {
+		return sc.ReadFrom(src)
+	}
+	return io.CopyBuffer(dst, src, buf)
+}
+
+func isStream(c net.Conn) bool {
+	_, ok := c.(*streamConn)
+	return ok
+}
@@ -0,0 +1,401 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/icpz/open-snell/components/utils/pool"
+)
+
+type relayResult struct {
+	ab, ba int64
+	err    error
+}
+
+func relay(a, b net.Conn) <-chan relayResult {
+	done := make(chan relayResult, 1)
+	go func() {
+		ab, ba, err := Relay(a, b)
+		done <- relayResult{ab, ba, err}
+	}()
+	return done
+}
+
+// tunnel builds app <-> [relay] client stream ~ server stream [relay] <->
+// upstream, returning the app and upstream ends and the two relays.
+func tunnel(t *testing.T) (app, upstream net.Conn, local, remote <-chan relayResult) {
+	t.Helper()
+	app, appSide := tcpPair(t)
+	c, s := streamPair(t, nil, nil)
+	upSide, upstream := tcpPair(t)
+	return app, upstream, relay(appSide, c), relay(s, upSide)
+}
+
+func readAll(t *testing.T, c net.Conn) []byte {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func waitRelay(t *testing.T, done <-chan relayResult) relayResult {
+	t.Helper()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not finish")
+	}
+	return relayResult{}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	app, upstream, local, remote := tunnel(t)
+	request := pattern(3*MaxPayloadSize+11, 1)
+	reply := pattern(2*MaxPayloadSize+3, 2)
+
+	// the app sends its request and shuts its write side down
+	if _, err := app.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	app.(*net.TCPConn).CloseWrite()
+
+	// upstream sees the request end, the reply direction still flows
+	if got := readAll(t, upstream); !bytes.Equal(got, request) {
+		t.Fatalf("upstream got %d bytes, want the %d bytes request", len(got), len(request))
+	}
+	if _, err := upstream.Write(reply); err != nil {
+		t.Fatal(err)
+	}
+	upstream.Close()
+
+	if got := readAll(t, app); !bytes.Equal(got, reply) {
+		t.Fatalf("app got %d bytes, want the %d bytes reply", len(got), len(reply))
+	}
+
+	l, r := waitRelay(t, local), waitRelay(t, remote)
+	if l.ab != int64(len(request)) || r.ab != int64(len(request)) {
+		t.Fatalf("request relayed %d and %d bytes, want %d", l.ab, r.ab, len(request))
+	}
+	if l.ba != int64(len(reply)) || r.ba != int64(len(reply)) {
+		t.Fatalf("reply relayed %d and %d bytes, want %d", l.ba, r.ba, len(reply))
+	}
+}
+
+func TestRelayUpstreamClosesFirst(t *testing.T) {
+	app, upstream, local, remote := tunnel(t)
+
+	// server speaks and hangs up without reading
+	if _, err := upstream.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	upstream.(*net.TCPConn).CloseWrite()
+
+	app.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(app, b); err != nil || string(b) != "bye" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	if _, err := app.Read(b); err != io.EOF {
+		t.Fatalf("got %v, want EOF after the reply", err)
+	}
+
+	// the request direction is still open
+	if _, err := app.Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	app.Close()
+	if got := readAll(t, upstream); string(got) != "late" {
+		t.Fatalf("upstream got %q", got)
+	}
+	waitRelay(t, local)
+	waitRelay(t, remote)
+}
+
+// TestRelayResetVsEOF checks the client of a server relaying to an
+// upstream tells an upstream reset from an upstream finishing.
+func TestRelayResetVsEOF(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		reset bool
+	}{
+		{"eof", false},
+		{"reset", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, s := streamPair(t, nil, nil)
+			upSide, upstream := tcpPair(t)
+			remote := relay(s, upSide)
+
+			if _, err := upstream.Write([]byte("partial")); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 7)
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(c, b); err != nil {
+				t.Fatal(err)
+			}
+			if tc.reset {
+				upstream.(*net.TCPConn).SetLinger(0)
+			}
+			upstream.Close()
+
+			_, err := c.Read(b)
+			if !tc.reset {
+				if !errors.Is(err, ErrZeroChunk) {
+					t.Fatalf("got %v, want the clean end of a ZERO_CHUNK", err)
+				}
+				c.CloseWrite()
+				waitRelay(t, remote)
+				return
+			}
+			if err == nil || errors.Is(err, ErrZeroChunk) || err == io.EOF {
+				t.Fatalf("got %v, want an error after an upstream reset", err)
+			}
+			select {
+			case res := <-remote:
+				if res.err == nil {
+					t.Fatal("relay hid the upstream reset")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("relay did not finish")
+			}
+		})
+	}
+}
+
+// headerFirst sends hdr along with the first write, in the same record, as
+// Snell clients do with the request header.
+type headerFirst struct {
+	net.Conn
+	hdr []byte
+}
+
+func (c *headerFirst) Write(b []byte) (int, error) {
+	if c.hdr != nil {
+		hdr := c.hdr
+		c.hdr = nil
+		if _, err := c.Conn.Write(append(hdr, b...)); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// TestRelayAfterPeekUpgrade proxies a WebSocket upgrade through a sniffing
+// server: it peeks at the HTTP request behind the header, then relays, and
+// the upstream must see the request whole.
+func TestRelayAfterPeekUpgrade(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			typ, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(typ, msg)
+		}
+	}))
+	defer upstream.Close()
+
+	c, s := streamPair(t, nil, nil)
+	sniffed := make(chan string, 1)
+	go func() {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(s, hdr); err != nil {
+			sniffed <- err.Error()
+			return
+		}
+		sniffed <- string(s.Peek(s.Buffered()))
+		up, err := net.Dial("tcp", upstream.Listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer up.Close()
+		Relay(s, up)
+	}()
+
+	dialer := websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		return &headerFirst{Conn: c, hdr: []byte("HDR:")}, nil
+	}}
+	ws, _, err := dialer.Dial("ws://"+upstream.Listener.Addr().String()+"/chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	req := <-sniffed
+	if !strings.HasPrefix(req, "GET /chat HTTP/1.1\r\n") || !strings.Contains(req, "Upgrade: websocket") {
+		t.Fatalf("sniffer peeked %q", req)
+	}
+
+	for _, msg := range [][]byte{[]byte("hello"), pattern(3*MaxPayloadSize, 13)} {
+		if err := ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, got, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("echoed %d bytes, want %d", len(got), len(msg))
+		}
+	}
+}
+
+// relayMany runs n relays at once, each copying size bytes from a client to
+// a sink over pipes, and waits for them all. Both ends keep the relay open
+// for hold after the data.
+func relayMany(t testing.TB, n, size int, hold time.Duration, buffers BufferPool) {
+	t.Helper()
+	msg := pattern(size, 5)
+	errs := make(chan error, 2*n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		client, a := net.Pipe()
+		b, sink := net.Pipe()
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_, _, err := RelayWithBuffers(a, b, buffers)
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			client.Write(msg)
+			time.Sleep(hold)
+			client.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			got := make([]byte, size)
+			_, err := io.ReadFull(sink, got)
+			if err == nil && !bytes.Equal(got, msg) {
+				err = errors.New("sink got corrupted data")
+			}
+			errs <- err
+			time.Sleep(hold)
+			sink.Close()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("relays did not finish")
+	}
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestRelayWithBuffersSharedPool runs many relays over pools too small for
+// all of them at once: they take turns and none deadlocks.
+func TestRelayWithBuffersSharedPool(t *testing.T) {
+	for _, n := range []int{2, 3, 4} {
+		relayMany(t, 50, 3*pool.RelayBufferSize+1, 0, pool.NewFixed(pool.RelayBufferSize, n))
+	}
+}
+
+// peakHeap samples the heap in use until stop is closed and returns the
+// highest value seen.
+func peakHeap(stop <-chan struct{}) <-chan uint64 {
+	peak := make(chan uint64, 1)
+	go func() {
+		var ms runtime.MemStats
+		var max uint64
+		tick := time.NewTicker(time.Millisecond)
+		defer tick.Stop()
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapInuse > max {
+				max = ms.HeapInuse
+			}
+			select {
+			case <-stop:
+				peak <- max
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return peak
+}
+
+// BenchmarkRelayMemory relays over 200 concurrent connections, each held
+// open a while, with the default buffers and with a Fixed pool of 16,
+// reporting the peak heap growth. The pool bounds the relay buffers to
+// 320 KB where the default ones take 40 KB per relay.
+func BenchmarkRelayMemory(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		buffers func() BufferPool
+	}{
+		{"default", func() BufferPool { return defaultBuffers{} }},
+		{"fixed16", func() BufferPool { return pool.NewFixed(pool.RelayBufferSize, 16) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				var ms runtime.MemStats
+				runtime.ReadMemStats(&ms)
+				stop := make(chan struct{})
+				sampled := peakHeap(stop)
+				relayMany(b, 200, 1024, 10*time.Millisecond, bc.buffers())
+				close(stop)
+				if p := <-sampled; p > ms.HeapInuse && p-ms.HeapInuse > peak {
+					peak = p - ms.HeapInuse
+				}
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+		})
+	}
+}
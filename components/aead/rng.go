@@ -0,0 +1,66 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RNGCheckTimeout bounds how long CheckRNG waits for random bytes.
+const RNGCheckTimeout = 5 * time.Second
+
+var ErrRNGNotReady = errors.New("random number generator not ready")
+
+// CheckRNG verifies crypto/rand, where salts come from, returns random
+// looking bytes in time. On Linux reads block until the kernel pool got
+// initialized, which may take a while right after boot on headless or
+// embedded systems: CheckRNG then fails with ErrRNGNotReady instead of
+// stalling the first handshakes. The sanity checks only catch a broken
+// source, they are no statistical test.
+func CheckRNG() error {
+	done := make(chan error, 1)
+	go func() {
+		var a, b [64]byte
+		if _, err := rand.Read(a[:]); err != nil {
+			done <- err
+			return
+		}
+		if _, err := rand.Read(b[:]); err != nil {
+			done <- err
+			return
+		}
+		if bytes.Equal(a[:], b[:]) || bytes.Count(a[:], a[:1]) == len(a) {
+			done <- errors.New("random number generator returns constant output")
+			return
+		}
+		done <- nil
+	}()
+
+	t := time.NewTimer(RNGCheckTimeout)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrRNGNotReady, err)
+		}
+		return nil
+	case <-t.C:
+		return fmt.Errorf("%w: no output after %v", ErrRNGNotReady, RNGCheckTimeout)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"crypto/rand"
+	"io"
+	"sync"
+)
+
+// SaltPool is an io.Reader for WithSaltReader serving salts generated
+// ahead of time by a background goroutine, taking the RNG off the
+// connection setup path. Each salt is handed out once; when the pool runs
+// dry reads go to crypto/rand directly.
+type SaltPool struct {
+	saltSize int
+	salts    chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewSaltPool starts filling a pool of size salts of saltSize bytes.
+func NewSaltPool(size, saltSize int) *SaltPool {
+	sp := &SaltPool{
+		saltSize: saltSize,
+		salts:    make(chan []byte, size),
+		done:     make(chan struct{}),
+	}
+	go sp.fill()
+	return sp
+}
+
+func (sp *SaltPool) fill() {
+	for {
+		salt := make([]byte, sp.saltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return // readers fall back to crypto/rand and see the error
+		}
+		select {
+		case sp.salts <- salt:
+		case <-sp.done:
+			return
+		}
+	}
+}
+
+// Read fills b with a pooled salt if it is exactly one salt long and one
+// is available, from crypto/rand otherwise.
+func (sp *SaltPool) Read(b []byte) (int, error) {
+	if len(b) == sp.saltSize {
+		select {
+		case salt := <-sp.salts:
+			return copy(b, salt), nil
+		default:
+		}
+	}
+	return rand.Read(b)
+}
+
+// Close stops the background goroutine.
+func (sp *SaltPool) Close() error {
+	sp.once.Do(func() { close(sp.done) })
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSaltPoolNeverReuses(t *testing.T) {
+	sp := NewSaltPool(8, 16)
+	defer sp.Close()
+	time.Sleep(10 * time.Millisecond) // let it fill up
+
+	seen := map[string]bool{}
+	salt := make([]byte, 16)
+	for i := 0; i < 1000; i++ { // well past the pool, served by crypto/rand
+		if _, err := io.ReadFull(sp, salt); err != nil {
+			t.Fatal(err)
+		}
+		if seen[string(salt)] {
+			t.Fatalf("salt %x handed out twice", salt)
+		}
+		seen[string(salt)] = true
+	}
+}
+
+func TestSaltPoolOtherSizes(t *testing.T) {
+	sp := NewSaltPool(8, 16)
+	defer sp.Close()
+	b := make([]byte, 32)
+	if n, err := sp.Read(b); n != 32 || err != nil {
+		t.Fatalf("read %d, %v", n, err)
+	}
+}
+
+// BenchmarkHandshakeSalt measures the client side of a handshake, salt,
+// key derivation and first record, under a connection storm, every P
+// opening connections in a loop, drawing salts from crypto/rand or from a
+// SaltPool.
+func BenchmarkHandshakeSalt(b *testing.B) {
+	ciph := NewAES128GCM(benchPSK)
+	for _, bc := range []struct {
+		name string
+		salt func() (io.Reader, func())
+	}{
+		{"crypto-rand", func() (io.Reader, func()) { return rand.Reader, func() {} }},
+		{"salt-pool", func() (io.Reader, func()) {
+			sp := NewSaltPool(4096, ciph.SaltSize())
+			time.Sleep(50 * time.Millisecond) // filled before the storm
+			return sp, func() { sp.Close() }
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			src, release := bc.salt()
+			defer release()
+			msg := []byte("GET / HTTP/1.1\r\n\r\n")
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c := NewConn(wireConn(nil), ciph, WithSaltReader(src))
+					if _, err := c.Write(msg); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// SelfTestResult reports a successful SelfTest.
+type SelfTestResult struct {
+	Method   string
+	Bytes    int64
+	Duration time.Duration
+}
+
+// Throughput returns the measured rate in bytes per second.
+func (r *SelfTestResult) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// MarshalJSON encodes the result with its throughput in MB/s, for tools.
+func (r *SelfTestResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Method     string  `json:"method"`
+		Bytes      int64   `json:"bytes"`
+		DurationNS int64   `json:"duration_ns"`
+		MBPerSec   float64 `json:"mb_per_sec"`
+	}{r.Method, r.Bytes, int64(r.Duration), r.Throughput() / 1e6})
+}
+
+// benchPSK keys BenchmarkCiphers, the PSK has no effect on throughput.
+var benchPSK = []byte("open-snell cipher benchmark")
+
+// BenchmarkCiphers runs SelfTest over size bytes for every supported
+// method in turn, in SupportedMethods order, so that operators can pick
+// the fastest one on their CPU, AES-GCM winning with AES-NI and
+// ChaCha20-Poly1305 without. Each method is warmed up first. Like
+// SelfTest it is a diagnostic, it keeps a core busy while it runs.
+func BenchmarkCiphers(size int) ([]*SelfTestResult, error) {
+	var results []*SelfTestResult
+	for _, method := range SupportedMethods() {
+		ciph, err := NewCipher(method, benchPSK)
+		if err != nil {
+			return nil, err
+		}
+		if err := Warmup(ciph); err != nil {
+			return nil, err
+		}
+		res, err := SelfTest(method, benchPSK, size)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// SelfTest streams size bytes of a known pattern through an in-memory
+// stream pair keyed with method and psk, and checks they come out intact.
+// It is a diagnostic for confirming the crypto and framing work on the
+// running platform, e.g. at startup, not something for the data path.
+func SelfTest(method string, psk []byte, size int) (*SelfTestResult, error) {
+	ciph, err := NewCipher(method, psk)
+	if err != nil {
+		return nil, err
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	src := NewConn(a, ciph, WithRole(RoleClient))
+	dst := NewConn(b, ciph, WithRole(RoleServer))
+
+	start := time.Now()
+	werr := make(chan error, 1)
+	go func() {
+		_, err := src.(io.ReaderFrom).ReadFrom(&patternReader{left: int64(size)})
+		if err == nil {
+			err = src.(interface{ CloseWrite() error }).CloseWrite()
+		}
+		werr <- err
+	}()
+
+	pw := &patternWriter{}
+	_, err = dst.(io.WriterTo).WriteTo(pw)
+	if !errors.Is(err, ErrZeroChunk) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("self test read failed after %d bytes: %w", pw.off, err)
+	}
+	if err := <-werr; err != nil {
+		return nil, fmt.Errorf("self test write failed: %w", err)
+	}
+	if pw.err != nil {
+		return nil, pw.err
+	}
+	if pw.off != int64(size) {
+		return nil, fmt.Errorf("self test got %d bytes, %d sent", pw.off, size)
+	}
+
+	return &SelfTestResult{
+		Method:   method,
+		Bytes:    pw.off,
+		Duration: time.Since(start),
+	}, nil
+}
+
+// patternReader produces left bytes of an incrementing byte pattern.
+type patternReader struct {
+	off  int64
+	left int64
+}
+
+func (r *patternReader) Read(b []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.left {
+		b = b[:r.left]
+	}
+	for i := range b {
+		b[i] = byte(r.off + int64(i))
+	}
+	r.off += int64(len(b))
+	r.left -= int64(len(b))
+	return len(b), nil
+}
+
+// patternWriter checks it is fed the pattern of patternReader.
+type patternWriter struct {
+	off int64
+	err error
+}
+
+func (w *patternWriter) Write(b []byte) (int, error) {
+	for i, c := range b {
+		if c != byte(w.off+int64(i)) {
+			w.err = fmt.Errorf("self test mismatch at byte %d", w.off+int64(i))
+			return i, w.err
+		}
+	}
+	w.off += int64(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,236 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Sequenced records are an open-snell extension for transports that may
+// lose, duplicate or reorder datagrams, where the implicit nonce counter
+// of a stream cannot work. Every datagram is a record on its own:
+//
+//	[salt][seq, big-endian uint64][payload sealed with nonce seq]
+//
+// The nonce is seq, little-endian like the stream counters, so seq is
+// authenticated without being additional data. The salt is repeated in
+// every datagram since any of them may be the first to arrive, its key is
+// derived once. There is no size header nor ZERO_CHUNK, the transport
+// delimits records and the layer above ends the session. Both peers must
+// agree on FeatureSequenced, it is of no use over TCP.
+
+// seqKeyCacheSize is how many derivations a SeqConn keeps, see keyCache:
+// its own salt and the peer's, plus a few salts not proven yet.
+const seqKeyCacheSize = 4
+
+// Until a salt is proven, every record bearing a salt not seen yet costs a
+// key derivation, which forged datagrams could repeat at line rate. Those
+// derivations are rate limited: past the burst, records with an unknown
+// salt are dropped without deriving, the peer's next records repeat its
+// salt and get through once the rate allows.
+const (
+	seqSaltRate  = 20 // derivations per second
+	seqSaltBurst = 4
+)
+
+// SeqReplayWindow is how far behind the newest sequence number a record
+// may arrive and still be accepted, once.
+const SeqReplayWindow = 64
+
+var ErrReplayed = errors.New("sequenced record replayed or out of the window")
+
+// replayWindow tracks the sequence numbers seen, a bit per number up to
+// SeqReplayWindow below the highest one.
+type replayWindow struct {
+	top  uint64
+	bits uint64 // bit i set: top-i seen
+	any  bool
+}
+
+// check reports whether seq is neither seen nor too old.
+func (w *replayWindow) check(seq uint64) bool {
+	if !w.any || seq > w.top {
+		return true
+	}
+	d := w.top - seq
+	return d < SeqReplayWindow && w.bits&(1<<d) == 0
+}
+
+// commit marks seq seen, it must have passed check and authenticated.
+func (w *replayWindow) commit(seq uint64) {
+	switch {
+	case !w.any:
+		w.top, w.bits, w.any = seq, 1, true
+	case seq > w.top:
+		if d := seq - w.top; d < SeqReplayWindow {
+			w.bits = w.bits<<d | 1
+		} else {
+			w.bits = 1
+		}
+		w.top = seq
+	default:
+		w.bits |= 1 << (w.top - seq)
+	}
+}
+
+// SeqConn carries sequenced records over a datagram conn, each Write
+// sending one and each Read returning the payload of one.
+type SeqConn struct {
+	net.Conn
+	ciph *keyCache
+
+	wmux sync.Mutex
+	salt []byte
+	enc  cipher.AEAD
+	seq  uint64
+	wbuf []byte
+
+	rmux    sync.Mutex
+	rsalt   []byte // latched once a record authenticated with it
+	salts   *recordRate
+	dec     cipher.AEAD
+	window  replayWindow
+	rbuf    []byte
+	dropped uint64
+}
+
+// NewSeqConn wraps c, whose Read and Write must deliver whole datagrams,
+// e.g. a connected *net.UDPConn or a reliable datagram layer.
+func NewSeqConn(c net.Conn, ciph Cipher) (*SeqConn, error) {
+	salt := make([]byte, ciph.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	cache := newKeyCache(ciph, seqKeyCacheSize)
+	enc, err := cache.Encrypter(salt)
+	if err != nil {
+		return nil, err
+	}
+	hdr := len(salt) + 8
+	return &SeqConn{
+		Conn:  c,
+		ciph:  cache,
+		salts: newRecordRate(seqSaltRate, seqSaltBurst, false, RealClock),
+		salt:  salt,
+		enc:   enc,
+		wbuf:  make([]byte, hdr+MaxPayloadSize+enc.Overhead()),
+		rbuf:  make([]byte, hdr+MaxPayloadSize+enc.Overhead()),
+	}, nil
+}
+
+// Write seals b as one record, ErrRecordTooLarge if it exceeds
+// MaxPayloadSize.
+func (sc *SeqConn) Write(b []byte) (int, error) {
+	if len(b) > MaxPayloadSize {
+		return 0, ErrRecordTooLarge
+	}
+	sc.wmux.Lock()
+	defer sc.wmux.Unlock()
+
+	hdr := len(sc.salt) + 8
+	copy(sc.wbuf, sc.salt)
+	binary.BigEndian.PutUint64(sc.wbuf[len(sc.salt):], sc.seq)
+	nonce := make([]byte, sc.enc.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, sc.seq)
+	out := sc.enc.Seal(sc.wbuf[:hdr], nonce, b, nil)
+	sc.seq++
+	if _, err := sc.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the payload of the next valid record, in arrival order.
+// Records failing to authenticate, replayed, too old, from another salt
+// than the first valid one or with a new salt past the derivation rate
+// are dropped, see Dropped. Like a datagram socket, a payload longer than
+// b is truncated and io.ErrShortBuffer is returned.
+func (sc *SeqConn) Read(b []byte) (int, error) {
+	sc.rmux.Lock()
+	defer sc.rmux.Unlock()
+
+	for {
+		n, err := sc.Conn.Read(sc.rbuf)
+		if err != nil {
+			return 0, err
+		}
+		payload, ok := sc.open(sc.rbuf[:n])
+		if !ok {
+			atomic.AddUint64(&sc.dropped, 1)
+			continue
+		}
+		m := copy(b, payload)
+		if m < len(payload) {
+			return m, io.ErrShortBuffer
+		}
+		return m, nil
+	}
+}
+
+func (sc *SeqConn) open(rec []byte) ([]byte, bool) {
+	ss := sc.ciph.SaltSize()
+	if len(rec) < ss+8 {
+		return nil, false
+	}
+	salt, seq := rec[:ss], binary.BigEndian.Uint64(rec[ss:])
+	if !sc.window.check(seq) {
+		return nil, false
+	}
+	dec := sc.dec
+	if sc.rsalt == nil {
+		// keys are only derived until a salt is proven, a forged one
+		// later costs nothing; records repeating a salt not proven yet,
+		// e.g. the first ones reordered, find its key cached
+		if !sc.ciph.cached(salt, false) && sc.salts.take() != nil {
+			return nil, false
+		}
+		var err error
+		if dec, err = sc.ciph.Decrypter(salt); err != nil {
+			return nil, false
+		}
+	} else if !bytes.Equal(salt, sc.rsalt) {
+		return nil, false
+	}
+	nonce := make([]byte, dec.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, seq)
+	payload, err := dec.Open(rec[ss+8:ss+8], nonce, rec[ss+8:], nil)
+	if err != nil {
+		return nil, false
+	}
+	if sc.rsalt == nil {
+		sc.rsalt = append([]byte(nil), salt...)
+		sc.dec = dec
+	}
+	sc.window.commit(seq)
+	return payload, true
+}
+
+// Dropped returns how many datagrams Read discarded.
+func (sc *SeqConn) Dropped() uint64 {
+	return atomic.LoadUint64(&sc.dropped)
+}
+
+// Features reports FeatureSequenced.
+func (sc *SeqConn) Features() Features {
+	return FeatureSequenced
+}
@@ -0,0 +1,146 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// datagrams keeps every write as a datagram and reads back those queued
+// with deliver, as a transport that may reorder or duplicate them.
+type datagrams struct {
+	sent  [][]byte
+	queue [][]byte
+}
+
+func (d *datagrams) Write(b []byte) (int, error) {
+	d.sent = append(d.sent, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (d *datagrams) Read(b []byte) (int, error) {
+	if len(d.queue) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, d.queue[0])
+	d.queue = d.queue[1:]
+	return n, nil
+}
+
+func (d *datagrams) deliver(dgs ...[]byte) {
+	d.queue = append(d.queue, dgs...)
+}
+
+// seqPair returns a sender and the receiver it reaches through link, the
+// test delivering what the sender sent.
+func seqPair(t *testing.T, recvCipher Cipher) (sender, receiver *SeqConn, out, link *datagrams) {
+	t.Helper()
+	out, link = &datagrams{}, &datagrams{}
+	sender, err := NewSeqConn(rwConn{out}, NewAES128GCM(testPSK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err = NewSeqConn(rwConn{link}, recvCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, receiver, out, link
+}
+
+func TestSeqConnReordered(t *testing.T) {
+	sender, receiver, out, link := seqPair(t, NewAES128GCM(testPSK))
+	for i := 0; i < 80; i++ {
+		if _, err := sender.Write([]byte(fmt.Sprintf("record %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reordered, with duplicates, and one too far behind the newest
+	order := []int{3, 0, 1, 1, 9, 2, 5, 4, 8, 7, 6, 3, 79, 10, 5}
+	for _, i := range order {
+		link.deliver(out.sent[i])
+	}
+	var got []string
+	buf := make([]byte, 64)
+	for {
+		n, err := receiver.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(buf[:n]))
+	}
+
+	want := []string{"record 3", "record 0", "record 1", "record 9", "record 2", "record 5",
+		"record 4", "record 8", "record 7", "record 6", "record 79"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	// the duplicates of 1, 3 and 5, and 10, 69 behind 79
+	if d := receiver.Dropped(); d != 4 {
+		t.Fatalf("%d datagrams dropped, want 4", d)
+	}
+}
+
+func TestSeqConnUnknownSaltsLimited(t *testing.T) {
+	var runs int32
+	sender, receiver, out, link := seqPair(t, countingCipher(testPSK, &runs))
+	runs = 0 // the receiver's own salt
+
+	// one forged salt repeated, as the first records of a peer would be,
+	// is derived once
+	repeated := make([]byte, 16+8+32)
+	copy(repeated, pattern(16, 100))
+	for i := 0; i < 10; i++ {
+		link.deliver(repeated)
+	}
+	if _, err := receiver.Read(make([]byte, 64)); err != io.EOF {
+		t.Fatalf("got %v, want every forged datagram dropped", err)
+	}
+	if runs != 1 {
+		t.Fatalf("%d derivations for a repeated salt, want 1", runs)
+	}
+
+	// forged datagrams each with a salt of their own run out the burst
+	for i := 0; i < 20; i++ {
+		forged := make([]byte, 16+8+32)
+		copy(forged, pattern(16, byte(i)))
+		link.deliver(forged)
+	}
+	if _, err := receiver.Read(make([]byte, 64)); err != io.EOF {
+		t.Fatalf("got %v, want every forged datagram dropped", err)
+	}
+	if runs > seqSaltBurst {
+		t.Fatalf("%d derivations for forged salts, want at most the burst of %d", runs, seqSaltBurst)
+	}
+	if d := receiver.Dropped(); d != 30 {
+		t.Fatalf("%d datagrams dropped, want 30", d)
+	}
+
+	// the peer gets through once the rate allows, its salt repeated in
+	// every record
+	sender.Write([]byte("genuine"))
+	time.Sleep(time.Second / seqSaltRate)
+	link.deliver(out.sent[0])
+	buf := make([]byte, 64)
+	if n, err := receiver.Read(buf); err != nil || string(buf[:n]) != "genuine" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var ErrNotSerializable = errors.New("stream state cannot be serialized now")
+
+// stateVersion is bumped whenever connState changes incompatibly.
+const stateVersion = 1
+
+// connState is what Serialize captures. Keys are not part of it, they are
+// derived again from the salts by the Cipher given to Deserialize.
+type connState struct {
+	Version    int      `json:"v"`
+	Role       Role     `json:"role"`
+	Fallback   bool     `json:"fallback,omitempty"` // the fallback cipher is in use
+	Features   Features `json:"features"`
+	Negotiated Features `json:"negotiated"`
+	BindID     int      `json:"bind_id"`
+	ConnID     []byte   `json:"conn_id,omitempty"`
+	Tags       []Tag    `json:"tags,omitempty"`
+
+	RSalt    []byte `json:"rsalt,omitempty"`
+	RNonce   []byte `json:"rnonce,omitempty"`
+	RAD      []byte `json:"rad,omitempty"`
+	Leftover []byte `json:"leftover,omitempty"`
+
+	WSalt     []byte `json:"wsalt,omitempty"`
+	WNonce    []byte `json:"wnonce,omitempty"`
+	WAD       []byte `json:"wad,omitempty"`
+	WSaltSent bool   `json:"wsalt_sent,omitempty"`
+	WClosed   bool   `json:"wclosed,omitempty"`
+}
+
+// Serialize snapshots the cryptographic state of the stream, for a new
+// process inheriting its fd to resume it with Deserialize, e.g. across a
+// zero-downtime restart. It captures the salts and nonce counters of both
+// directions, the decrypted bytes not read yet, the negotiated extensions
+// and the tags.
+//
+// No read or write may be in progress, and none may follow: once
+// serialized, the stream belongs to whoever restores it, two processes
+// writing on from the same state would reuse nonces, which breaks the
+// AEAD. Writes held back by coalescing must be flushed first. It fails
+// with ErrNotSerializable half way through the handshake, with read-ahead
+// by WithPrefetch or on a stream from NewConnBidir.
+//
+// The snapshot holds no keys, but anyone with it and the PSK can decrypt
+// the rest of the stream and forge records into it: hand it over the same
+// unix socket as the fd, never store it.
+func (c *streamConn) Serialize() ([]byte, error) {
+	c.rinit.Lock()
+	defer c.rinit.Unlock()
+	c.winit.Lock()
+	defer c.winit.Unlock()
+
+	if c.prefetch > 0 || c.wcipher != nil {
+		return nil, ErrNotSerializable
+	}
+	st := &connState{
+		Version: stateVersion,
+		Role:    c.role,
+		BindID:  c.bindID,
+		Tags:    c.tags.List(),
+	}
+	c.hookMux.Lock()
+	established := c.established
+	st.Features, st.Negotiated = c.features, c.negotiated
+	c.hookMux.Unlock()
+	st.Fallback = st.Features.Has(FeatureFallbackCipher)
+
+	if c.r != nil {
+		if !established {
+			return nil, fmt.Errorf("%w: first record not read", ErrNotSerializable)
+		}
+		c.r.mux.Lock()
+		st.RSalt = c.rsalt
+		st.RNonce = append([]byte(nil), c.r.nonce...)
+		st.RAD = c.r.ad
+		st.Leftover = append([]byte(nil), c.r.leftover...)
+		c.r.mux.Unlock()
+	}
+	if c.w != nil {
+		c.w.mux.Lock()
+		pending, werr := c.w.pending, c.w.err
+		c.w.out.Lock()
+		st.WSalt = c.wsalt
+		st.WNonce = append([]byte(nil), c.w.nonce...)
+		st.WAD = c.w.ad
+		st.WSaltSent = c.w.salt == nil
+		st.WClosed = c.w.closed || c.w.done
+		c.w.out.Unlock()
+		c.w.mux.Unlock()
+		if pending > 0 || werr != nil {
+			return nil, fmt.Errorf("%w: writes pending", ErrNotSerializable)
+		}
+	}
+	st.ConnID = c.connID
+	return json.Marshal(st)
+}
+
+// Deserialize resumes on c a stream snapshot by Serialize, with the
+// ciphers and options it was created with. Reading and writing go on
+// where they stopped, the lifetime set by WithMaxLifetime starts over.
+func Deserialize(c net.Conn, ciph, fallback Cipher, state []byte, opts ...ConnOption) (net.Conn, error) {
+	st := &connState{}
+	if err := json.Unmarshal(state, st); err != nil {
+		return nil, err
+	}
+	if st.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported stream state version %d", st.Version)
+	}
+	sc := NewConnWithFallback(c, ciph, fallback, opts...).(*streamConn)
+	if st.Fallback {
+		if fallback == nil {
+			return nil, errors.New("stream state needs the fallback cipher")
+		}
+		sc.Cipher = fallback
+	}
+	sc.fallback = nil
+	sc.role = st.Role
+	sc.bindID = st.BindID
+	sc.connID = st.ConnID
+	sc.negotiated = st.Negotiated
+	for _, t := range st.Tags {
+		sc.tags.Set(t.Key, t.Value)
+	}
+
+	if st.RSalt != nil {
+		aead, err := sc.Decrypter(st.RSalt)
+		if err != nil {
+			return nil, err
+		}
+		if len(st.RNonce) != aead.NonceSize() || len(st.Leftover) > payloadSizeMask {
+			return nil, errors.New("malformed stream state")
+		}
+		sc.rsalt = st.RSalt
+		sc.r = sc.newReader(c, aead, nil)
+		copy(sc.r.nonce, st.RNonce)
+		sc.r.ad = st.RAD
+		sc.r.leftover = sc.r.buf[:copy(sc.r.buf, st.Leftover)]
+		sc.established = true
+		sc.features = st.Features
+	}
+	if st.WSalt != nil {
+		aead, err := sc.Encrypter(st.WSalt)
+		if err != nil {
+			return nil, err
+		}
+		if len(st.WNonce) != aead.NonceSize() {
+			return nil, errors.New("malformed stream state")
+		}
+		sc.wsalt = st.WSalt
+		sc.w = sc.newWriter(aead)
+		copy(sc.w.nonce, st.WNonce)
+		sc.w.ad = st.WAD
+		if !st.WSaltSent {
+			sc.w.salt = st.WSalt
+		}
+		sc.w.closed, sc.w.done = st.WClosed, st.WClosed
+	}
+	if sc.established {
+		sc.startLifetime()
+		sc.startCover()
+	}
+	return sc, nil
+}
@@ -0,0 +1,104 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestSerializeRoundTrip hands a server stream over mid-record, with a
+// fallback cipher and conn ids, to a restored one on the same conn.
+func TestSerializeRoundTrip(t *testing.T) {
+	primary, fallback := NewAES128GCM([]byte("primary psk")), NewChacha20Poly1305(testPSK)
+	a, b := tcpPair(t)
+	c := NewConn(a, NewChacha20Poly1305(testPSK), WithConnID()).(*streamConn)
+	s := NewConnWithFallback(b, primary, fallback, WithOptionalConnID()).(*streamConn)
+
+	request := pattern(2*MaxPayloadSize+100, 1)
+	go c.Write(request)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, MaxPayloadSize+10) // part of the second record is left over
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	s.Tags().Set("user", "alice")
+
+	state, err := s.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := Deserialize(b, primary, fallback, state, WithOptionalConnID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rc.(*streamConn)
+	if !r.Features().Has(FeatureFallbackCipher) {
+		t.Fatalf("restored features %v, want the fallback cipher", r.Features())
+	}
+	if !bytes.Equal(r.ConnID(), c.ConnID()) {
+		t.Fatalf("restored conn id %x, want %x", r.ConnID(), c.ConnID())
+	}
+	if v, _ := r.Tags().Get("user"); v != "alice" {
+		t.Fatalf("restored tag user %q", v)
+	}
+
+	// reading goes on at the byte it stopped, writing at its nonce
+	rest := make([]byte, len(request)-len(got))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(got, rest...), request) {
+		t.Fatal("request differs across the handover")
+	}
+	go func() {
+		r.Write([]byte(" after"))
+		r.CloseWrite()
+	}()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(c)
+	if !errors.Is(err, ErrZeroChunk) || string(reply) != "before after" {
+		t.Fatalf("client got %q, %v", reply, err)
+	}
+
+	// and the client's later records open on the restored stream
+	go c.Write([]byte("more"))
+	more := make([]byte, 4)
+	if _, err := io.ReadFull(r, more); err != nil || string(more) != "more" {
+		t.Fatalf("got %q, %v", more, err)
+	}
+}
+
+func TestSerializeRefusesPendingWrites(t *testing.T) {
+	c, _ := streamPair(t, []ConnOption{WithWriteCoalescing(time.Hour)}, nil)
+	if _, err := c.Write([]byte("held back")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Serialize(); !errors.Is(err, ErrNotSerializable) {
+		t.Fatalf("got %v, want ErrNotSerializable with writes pending", err)
+	}
+	if err := c.currentWriter().Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Serialize(); err != nil {
+		t.Fatalf("flushed stream: %v", err)
+	}
+}
@@ -12,28 +12,84 @@
  * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
  */
 
+// Package aead implements the Snell AEAD stream framing.
+//
+// Streams never hold more than one record per direction in memory: the
+// writer seals into a fixed buffer of one record and the reader decrypts
+// into another, undelivered plaintext being a slice of it. A conn thus
+// costs about 2*(MaxPayloadSize+overhead) bytes plus the salts, however
+// much data goes through it. WithWriteToBatchSize is the exception, its
+// staging buffer comes on top while WriteTo runs.
 package aead
 
 import (
-	"bytes"
+	"context"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
+	"syscall"
+	"time"
+
+	p "github.com/icpz/open-snell/components/utils/pool"
 )
 
 const payloadSizeMask = 0x3FFF // 16*1024 - 1
 
+// MaxPayloadSize is the largest plaintext carried by a single record.
+const MaxPayloadSize = payloadSizeMask
+
 var ErrZeroChunk = errors.New("Snell ZERO_CHUNK occurred")
 
+var ErrWriteClosed = errors.New("write on a stream closed for writing")
+
+var ErrWouldBlock = errors.New("no decrypted data available without blocking")
+
+// errLeftoverPending reports a bug: a record read before the plaintext of
+// the previous one was delivered, see reader.read.
+var errLeftoverPending = errors.New("aead: record read with undelivered plaintext pending")
+
+// ErrDesynchronized is returned once records failed to authenticate too
+// many times in a row, see WithDesyncThreshold: the stream is beyond
+// recovery and must be torn down.
+var ErrDesynchronized = errors.New("stream desynchronized, records keep failing to authenticate")
+
+var (
+	ErrReadBeforeWrite = errors.New("client stream read before its first write, the server would never answer")
+	ErrWriteBeforeRead = errors.New("server stream written before the client's first record, the cipher is not settled")
+)
+
 type writer struct {
 	io.Writer
 	cipher.AEAD
 	nonce []byte
 	buf   []byte
-	mux   sync.Mutex
+	ad    []byte
+	fill  bool
+	mux   sync.Mutex // guards buf and the coalescing state
+	out   sync.Mutex // orders sealing and sending, taken under mux
+	rmux  sync.Mutex // serializes ReadFrom, held while reading its source
+	done  bool       // ZERO_CHUNK sent, guarded by out
+	kbuf  []byte     // keepalive or padding record, sealed under out alone
+
+	records uint64 // data records sealed, guarded by out
+
+	firstLimit int    // payload limit of the first record, 0 for none
+	salt       []byte // salt not sent yet, goes out with the first record
+	dump       *wireDump
+	ctx        context.Context
+
+	// write coalescing, see WithWriteCoalescing
+	linger  time.Duration
+	pending int
+	timer   Timer
+	err     error
+	clock   Clock
+	closed  bool
 }
 
 func NewWriter(w io.Writer, aead cipher.AEAD) io.Writer { return newWriter(w, aead) }
@@ -44,65 +100,273 @@ func newWriter(w io.Writer, aead cipher.AEAD) *writer {
 		AEAD:   aead,
 		buf:    make([]byte, 2+aead.Overhead()+payloadSizeMask+aead.Overhead()),
 		nonce:  make([]byte, aead.NonceSize()),
+		clock:  RealClock,
 	}
 }
 
 func (w *writer) Write(b []byte) (int, error) {
-	if len(b) == 0 { // zero chunk
-		w.mux.Lock()
-		defer w.mux.Unlock()
+	w.mux.Lock()
+	defer w.mux.Unlock()
 
-		buf := w.buf
-		buf = buf[:2+w.Overhead()]
+	if w.closed {
+		return 0, ErrWriteClosed
+	}
+	if w.linger > 0 && len(b) > 0 {
+		n, err := w.appendPending(b)
+		if err == nil && w.pending > 0 && w.timer == nil {
+			w.timer = w.clock.AfterFunc(w.linger, w.lingerExpired)
+		}
+		return n, err
+	}
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
 
-		buf[0], buf[1] = 0, 0
-		w.Seal(buf[:0], w.nonce, buf[:2], nil)
-		increment(w.nonce)
+	if len(b) == 0 {
+		return 0, w.zeroChunk()
+	}
 
-		_, err := w.Writer.Write(buf)
-		return 0, err
+	n := 0
+	for n < len(b) {
+		nr := copy(w.buf[2+w.Overhead():2+w.Overhead()+w.maxPayload()], b[n:])
+		if err := w.seal(nr); err != nil {
+			return n, err
+		}
+		n += nr
 	}
+	return n, nil
+}
 
-	n, err := w.ReadFrom(bytes.NewBuffer(b))
-	return int(n), err
+func (w *writer) zeroChunk() error {
+	w.out.Lock()
+	defer w.out.Unlock()
+	w.done = true
+	buf := w.buf
+	buf = buf[:2+w.Overhead()]
+
+	buf[0], buf[1] = 0, 0
+	w.Seal(buf[:0], w.nonce, buf[:2], w.ad)
+	increment(w.nonce)
+
+	return w.writeRecord(buf)
 }
 
-func (w *writer) ReadFrom(r io.Reader) (n int64, err error) {
+// writeRecord writes a sealed record out, in the same write as the salt if
+// that is still pending. The caller holds out.
+func (w *writer) writeRecord(buf []byte) error {
+	if w.salt != nil {
+		w.dump.dump("send salt", w.salt)
+	}
+	w.dump.dump("send record, %d bytes", len(buf), buf)
+	if w.salt != nil {
+		buf = append(w.salt[:len(w.salt):len(w.salt)], buf...)
+		w.salt = nil
+	}
+	_, err := writeFull(w.clock, w.Writer, buf)
+	return err
+}
+
+// sendSalt sends the salt now if it did not go out yet.
+func (w *writer) sendSalt() error {
+	w.out.Lock()
+	defer w.out.Unlock()
+	if w.salt == nil {
+		return nil
+	}
+	w.dump.dump("send salt", w.salt)
+	salt := w.salt
+	w.salt = nil
+	_, err := writeFull(w.clock, w.Writer, salt)
+	return err
+}
+
+// CloseWrite sends anything pending followed by a ZERO_CHUNK, later writes
+// fail with ErrWriteClosed.
+func (w *writer) CloseWrite() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.closed = true
+	return w.zeroChunk()
+}
+
+// seal the nr bytes of payload at the head of the payload buffer and write
+// the record out.
+func (w *writer) seal(nr int) error {
+	return w.sealRecord(w.buf, nr)
+}
+
+// sealRecord is seal for a record buffer other than buf, laid out alike.
+func (w *writer) sealRecord(buf []byte, nr int) error {
+	buf = buf[:2+w.Overhead()+nr+w.Overhead()]
+	payloadBuf := buf[2+w.Overhead() : 2+w.Overhead()+nr]
+	buf[0], buf[1] = byte(nr>>8), byte(nr) // big-endian payload size
+	w.out.Lock()
+	defer w.out.Unlock()
+	w.Seal(buf[:0], w.nonce, buf[:2], w.ad)
+	increment(w.nonce)
+
+	w.Seal(payloadBuf[:0], w.nonce, payloadBuf, w.ad)
+	increment(w.nonce)
+
+	w.firstLimit = 0
+	w.records++
+	return w.writeRecord(buf)
+}
+
+// maxPayload returns the payload size limit of the next record.
+func (w *writer) maxPayload() int {
+	if w.firstLimit > 0 {
+		return w.firstLimit
+	}
+	return payloadSizeMask
+}
+
+// appendPending adds b to the pending record, sealing it each time it is
+// full.
+func (w *writer) appendPending(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for n < len(b) {
+		m := copy(w.buf[2+w.Overhead()+w.pending:2+w.Overhead()+w.maxPayload()], b[n:])
+		w.pending += m
+		n += m
+		if w.pending == w.maxPayload() {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush seals the pending record, if any. A failure is sticky since the
+// bytes were already accepted by Write.
+func (w *writer) flush() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.pending == 0 {
+		return nil
+	}
+	nr := w.pending
+	w.pending = 0
+	w.err = w.seal(nr)
+	return w.err
+}
+
+func (w *writer) lingerExpired() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.timer = nil
+	w.flush()
+}
+
+// PushWrite writes b and flushes at once: the pending record including b
+// is sealed and sent, and the underlying writer is flushed if it buffers.
+func (w *writer) PushWrite(b []byte) (int, error) {
 	w.mux.Lock()
 	defer w.mux.Unlock()
 
+	if w.closed {
+		return 0, ErrWriteClosed
+	}
+	n, err := w.appendPending(b)
+	if err != nil {
+		return n, err
+	}
+	return n, w.flushAll()
+}
+
+// Flush sends the pending record, if any, and flushes the underlying writer.
+func (w *writer) Flush() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.flushAll()
+}
+
+func (w *writer) flushAll() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if f, ok := w.Writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// ReadFrom reads from r straight into the payload area of a record buffer
+// of its own and seals in place, there is no intermediate copy. The writer
+// is only held to seal and send each record, never while r is read, so
+// that Flush, Close or CloseWrite, e.g. from an expiring lifetime, get in
+// while r is idle or under continuous traffic; ReadFrom then returns
+// ErrWriteClosed at its next record.
+func (w *writer) ReadFrom(r io.Reader) (n int64, err error) {
+	w.rmux.Lock()
+	defer w.rmux.Unlock()
+	buf := p.Get(len(w.buf))
+	defer p.Put(buf)
+	off := 2 + w.Overhead()
+
 	for {
-		buf := w.buf
-		payloadBuf := buf[2+w.Overhead() : 2+w.Overhead()+payloadSizeMask]
+		if w.ctx != nil && w.ctx.Err() != nil {
+			return n, fmt.Errorf("aead: ReadFrom canceled: %w", w.ctx.Err())
+		}
+		w.mux.Lock()
+		closed, limit := w.closed, w.maxPayload()
+		w.mux.Unlock()
+		if closed {
+			return n, ErrWriteClosed
+		}
+
+		payloadBuf := buf[off : off+limit]
 		nr, er := r.Read(payloadBuf)
+		for w.fill && er == nil && nr < len(payloadBuf) {
+			var m int
+			m, er = r.Read(payloadBuf[nr:])
+			nr += m
+		}
 
 		if nr > 0 {
-			n += int64(nr)
-			buf = buf[:2+w.Overhead()+nr+w.Overhead()]
-			payloadBuf = payloadBuf[:nr]
-			buf[0], buf[1] = byte(nr>>8), byte(nr) // big-endian payload size
-			w.Seal(buf[:0], w.nonce, buf[:2], nil)
-			increment(w.nonce)
-
-			w.Seal(payloadBuf[:0], w.nonce, payloadBuf, nil)
-			increment(w.nonce)
-
-			_, ew := w.Writer.Write(buf)
-			if ew != nil {
-				err = ew
-				break
+			if ew := w.sealFrom(buf, nr); ew != nil {
+				return n, ew
 			}
+			n += int64(nr)
 		}
 
 		if er != nil {
 			if er != io.EOF { // ignore EOF as per io.ReaderFrom contract
 				err = er
 			}
-			break
+			return n, err
 		}
 	}
+}
 
-	return n, err
+// sealFrom seals and sends a record read by ReadFrom into buf, after the
+// bytes a Write in between may have left coalesced.
+func (w *writer) sealFrom(buf []byte, nr int) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return ErrWriteClosed
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.sealRecord(buf, nr)
 }
 
 type reader struct {
@@ -111,8 +375,19 @@ type reader struct {
 	nonce    []byte
 	buf      []byte
 	leftover []byte
-	fallback cipher.AEAD
+	fallback func() (cipher.AEAD, error) // derived only if needed
 	switched bool
+	ad       []byte
+	optional bool // first record tells whether ad is in use
+	onOpen   func()
+	clock    Clock
+	dump     *wireDump
+	batch    int // records staged per write by WriteTo
+	fails    int // consecutive authentication failures
+	maxFails int
+	maxSize  int // largest payload accepted, 0 for payloadSizeMask
+	rate     *recordRate
+	deadline *recordDeadline
 	mux      sync.Mutex
 }
 
@@ -120,70 +395,198 @@ type reader struct {
 func NewReader(r io.Reader, aead cipher.AEAD) io.Reader { return newReader(r, aead, nil) }
 
 func NewReaderWithFallback(r io.Reader, aead, fallback cipher.AEAD) io.Reader {
-	return newReader(r, aead, fallback)
+	return newReader(r, aead, func() (cipher.AEAD, error) { return fallback, nil })
 }
 
-func newReader(r io.Reader, aead cipher.AEAD, fallback cipher.AEAD) *reader {
+func newReader(r io.Reader, aead cipher.AEAD, fallback func() (cipher.AEAD, error)) *reader {
 	return &reader{
 		Reader:   r,
 		AEAD:     aead,
 		buf:      make([]byte, payloadSizeMask+aead.Overhead()),
 		nonce:    make([]byte, aead.NonceSize()),
 		fallback: fallback,
+		clock:    RealClock,
 	}
 }
 
 // read and decrypt a record into the internal buffer. Return decrypted payload length and any error encountered.
+//
+// leftover always aliases r.buf, so there is never more than one record of
+// undelivered plaintext. Every caller must drain leftover before reading the
+// next record, otherwise it would be overwritten: reading one anyway fails
+// with errLeftoverPending, leaving leftover intact.
 func (r *reader) read() (int, error) {
+	for {
+		n, err := r.readRecord()
+		if err != errKeepalive {
+			return n, err
+		}
+	}
+}
+
+// readRecord reads a single record, errKeepalive tells a keepalive or
+// padding record was consumed.
+func (r *reader) readRecord() (int, error) {
+	if len(r.leftover) > 0 {
+		return 0, errLeftoverPending
+	}
+	if r.maxFails > 0 && r.fails >= r.maxFails {
+		return 0, ErrDesynchronized
+	}
+	if r.rate != nil {
+		if err := r.rate.take(); err != nil {
+			return 0, err
+		}
+	}
+
 	// decrypt payload size
 	buf := r.buf[:2+r.Overhead()]
-	_, err := io.ReadFull(r.Reader, buf)
+	var err error
+	if r.deadline != nil {
+		// the record timeout runs from its first byte on
+		if _, err = readFull(r.clock, r.Reader, buf[:1]); err != nil {
+			return 0, err
+		}
+		r.deadline.start()
+		defer r.deadline.end()
+		_, err = readFull(r.clock, r.Reader, buf[1:])
+		err = r.deadline.check(err)
+	} else {
+		_, err = readFull(r.clock, r.Reader, buf)
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	if r.fallback != nil {
-		tbuf := make([]byte, len(buf))
-		copy(tbuf, buf)
-		_, err = r.Open(buf[:0], r.nonce, tbuf, nil)
-		if err != nil {
-			r.AEAD = r.fallback
-			r.switched = true
-			_, err = r.Open(buf[:0], r.nonce, tbuf, nil)
-		}
-		r.fallback = nil
+	r.dump.dump("recv size header", buf)
+
+	if r.fallback != nil || r.optional {
+		err = r.openFirst(buf)
 	} else {
-		_, err = r.Open(buf[:0], r.nonce, buf, nil)
+		_, err = r.Open(buf[:0], r.nonce, buf, r.ad)
 	}
 	increment(r.nonce)
 	if err != nil {
-		return 0, err
+		r.dump.dump("recv size header failed to open: %v", err)
+		return 0, r.authFailed(err)
 	}
 
-	size := (int(buf[0])<<8 + int(buf[1])) & payloadSizeMask
+	if r.onOpen != nil { // first record authenticated, cipher settled
+		onOpen := r.onOpen
+		r.onOpen = nil
+		onOpen()
+	}
+
+	hdr := int(buf[0])<<8 + int(buf[1])
+	if hdr == keepaliveHeader {
+		r.dump.dump("recv keepalive")
+		r.fails = 0
+		return 0, errKeepalive
+	}
+	padding := hdr&keepaliveHeader != 0
+	size := hdr & payloadSizeMask
+	r.dump.dump("recv size %d", size)
+	if r.maxSize > 0 && size > r.maxSize {
+		return 0, fmt.Errorf("%w: %d bytes, %d allowed", ErrRecordTooLarge, size, r.maxSize)
+	}
 
 	if size == 0 {
+		r.fails = 0
 		return 0, ErrZeroChunk
 	}
 
 	// decrypt payload
 	buf = r.buf[:size+r.Overhead()]
-	_, err = io.ReadFull(r.Reader, buf)
+	_, err = readFull(r.clock, r.Reader, buf)
+	if r.deadline != nil {
+		err = r.deadline.check(err)
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	_, err = r.Open(buf[:0], r.nonce, buf, nil)
+	r.dump.dump("recv payload", buf)
+	_, err = r.Open(buf[:0], r.nonce, buf, r.ad)
 	increment(r.nonce)
 	if err != nil {
-		return 0, err
+		r.dump.dump("recv payload failed to open: %v", err)
+		return 0, r.authFailed(err)
 	}
+	r.fails = 0
 
+	if padding {
+		r.dump.dump("recv padding")
+		return 0, errKeepalive
+	}
 	return size, nil
 }
 
+// authFailed counts a record failing to authenticate, turning err into
+// ErrDesynchronized once the threshold is reached.
+func (r *reader) authFailed(err error) error {
+	r.fails++
+	if r.maxFails > 0 && r.fails >= r.maxFails {
+		return ErrDesynchronized
+	}
+	return err
+}
+
+// openFirst opens the first size header, trying the fallback cipher and,
+// if optional, the absence of additional data. It settles both for the
+// rest of the stream.
+func (r *reader) openFirst(buf []byte) error {
+	tbuf := make([]byte, len(buf))
+	copy(tbuf, buf)
+
+	ads := [][]byte{r.ad}
+	if r.optional && r.ad != nil {
+		ads = append(ads, nil)
+	}
+
+	var err error
+	for i := 0; i < 2; i++ {
+		aead := r.AEAD
+		if i > 0 {
+			if r.fallback == nil {
+				break
+			}
+			// the fallback key is derived on the first miss only, sparing
+			// a KDF run to every connection using the primary cipher
+			var ferr error
+			if aead, ferr = r.fallback(); ferr != nil || aead == nil {
+				break
+			}
+		}
+		// the first record uses the zero nonce, sized for the AEAD tried as
+		// the fallback may take longer nonces than the primary or shorter;
+		// the tags of every method are 16 bytes, so is the header record
+		nonce := r.nonce
+		if len(nonce) != aead.NonceSize() {
+			nonce = make([]byte, aead.NonceSize())
+		}
+		for _, ad := range ads {
+			if _, err = aead.Open(buf[:0], nonce, tbuf, ad); err == nil {
+				r.AEAD = aead
+				r.nonce = nonce
+				r.switched = i > 0
+				r.ad = ad
+				r.fallback = nil
+				r.optional = false
+				return nil
+			}
+		}
+	}
+	r.fallback = nil
+	r.optional = false
+	return err
+}
+
 // Read reads from the embedded io.Reader, decrypts and writes to b.
 func (r *reader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
 	r.mux.Lock()
 	defer r.mux.Unlock()
 
@@ -202,6 +605,25 @@ func (r *reader) Read(b []byte) (int, error) {
 	return m, err
 }
 
+// Buffered returns the number of decrypted bytes waiting to be read, it is
+// never more than one record.
+func (r *reader) Buffered() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return len(r.leftover)
+}
+
+// Peek returns up to n decrypted bytes waiting to be read without
+// consuming them. It never reads from the underlying reader.
+func (r *reader) Peek(n int) []byte {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if n > len(r.leftover) {
+		n = len(r.leftover)
+	}
+	return r.leftover[:n]
+}
+
 // WriteTo reads from the embedded io.Reader, decrypts and writes to w until
 // there's no more data to write or when an error occurs. Return number of
 // bytes written to w and any error encountered.
@@ -219,6 +641,11 @@ func (r *reader) WriteTo(w io.Writer) (n int64, err error) {
 		}
 	}
 
+	if r.batch > 1 {
+		nw, err := r.writeToBatched(w)
+		return n + nw, err
+	}
+
 	for {
 		nr, er := r.read()
 		if nr > 0 {
@@ -242,6 +669,88 @@ func (r *reader) WriteTo(w io.Writer) (n int64, err error) {
 	return n, err
 }
 
+// writeToBatched is the WriteTo loop staging up to r.batch records before
+// each write to w. Whatever is staged is written before returning, errors
+// and ZERO_CHUNK included.
+func (r *reader) writeToBatched(w io.Writer) (n int64, err error) {
+	stage := make([]byte, 0, r.batch*payloadSizeMask)
+	for {
+		nr, er := r.read()
+		stage = append(stage, r.buf[:nr]...)
+		if len(stage) > 0 && (er != nil || cap(stage)-len(stage) < payloadSizeMask) {
+			nw, ew := w.Write(stage)
+			n += int64(nw)
+			stage = stage[:0]
+			if ew != nil {
+				return n, ew
+			}
+		}
+		if er != nil {
+			if er != io.EOF {
+				err = er
+			}
+			return n, err
+		}
+	}
+}
+
+// maxTemporaryRetries bounds how many temporary errors a single record
+// read or write survives.
+const maxTemporaryRetries = 3
+
+func isTemporary(err error) bool {
+	if errors.Is(err, syscall.EINTR) {
+		return true
+	}
+	// timeouts report temporary too, but they are deadlines set on purpose
+	if e, ok := err.(net.Error); ok && e.Temporary() && !e.Timeout() {
+		return true
+	}
+	return false
+}
+
+// readFull is io.ReadFull retrying temporary errors in place, so that a
+// transient failure in the middle of a record keeps the bytes already read
+// and the nonces in sync.
+func readFull(clk Clock, r io.Reader, buf []byte) (n int, err error) {
+	retries := 0
+	for n < len(buf) && err == nil {
+		var nr int
+		nr, err = r.Read(buf[n:])
+		n += nr
+		if err != nil && retries < maxTemporaryRetries && isTemporary(err) {
+			retries++
+			err = nil
+			<-clk.After(time.Duration(retries) * time.Millisecond)
+		}
+	}
+	if n == len(buf) {
+		err = nil
+	} else if n > 0 && err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// writeFull writes all of buf, retrying temporary errors with the remainder.
+func writeFull(clk Clock, w io.Writer, buf []byte) (n int, err error) {
+	retries := 0
+	for n < len(buf) {
+		var nw int
+		nw, err = w.Write(buf[n:])
+		n += nw
+		if err != nil {
+			if retries < maxTemporaryRetries && isTemporary(err) {
+				retries++
+				<-clk.After(time.Duration(retries) * time.Millisecond)
+				continue
+			}
+			return
+		}
+	}
+	return n, nil
+}
+
 // increment little-endian encoded unsigned integer b. Wrap around on overflow.
 func increment(b []byte) {
 	for i := range b {
@@ -258,99 +767,709 @@ type streamConn struct {
 	r        *reader
 	w        *writer
 	fallback Cipher
+	wcipher  Cipher // write direction cipher if not Cipher
+	rinit    sync.Mutex
+	winit    sync.Mutex
+	saltSrc  io.Reader
+	fill     bool
+	batch    int
+	desync   int
+	linger   time.Duration
+	firstMTU int
+	clock    Clock
+	role     Role
+	dump     *wireDump
+	ctx      context.Context
+
+	recordTimeout time.Duration
+	deadline      *recordDeadline
+
+	prefetch     int // records read ahead, see WithPrefetch
+	prefetchDone chan struct{}
+	prefetchOnce *sync.Once
+
+	maxRecord int // see SetMaxRecordSize
+
+	recordRate   float64 // see WithRecordRateLimit
+	recordBurst  int
+	rateThrottle bool
+
+	maxLifetime time.Duration
+	lifeTimer   Timer
+	lifeOver    int32 // set once the lifetime ran out
+
+	cover        *CoverTraffic // see WithCoverTraffic
+	coverTimer   Timer
+	coverSeen    uint64 // data records written as of the last tick
+	coverStopped bool
+
+	rsalt []byte // salts of both directions, for ExportKeyingMaterial
+	wsalt []byte
+
+	// connection id bound to every record as additional data
+	bindID int
+	connID []byte
+
+	hookMux       sync.Mutex
+	established   bool
+	features      Features
+	negotiated    Features
+	onEstablished func()
+
+	tags Tags
+
+	onFallback func(peer net.Addr)
+}
+
+// Tags returns the labels attached to the conn. Once the handshake
+// completed, "cipher" holds the index of the cipher in use: 0 for the
+// primary one, 1 for the fallback.
+func (c *streamConn) Tags() *Tags {
+	return &c.tags
+}
+
+// Role tells which side of the handshake a stream is on.
+type Role int
+
+const (
+	RoleUnspecified Role = iota
+	// RoleClient streams must write before they read: the server only
+	// sends anything after the request.
+	RoleClient
+	// RoleServer streams must read the first record of the client before
+	// they write, which settles the cipher when there is a fallback.
+	RoleServer
+)
+
+// ConnOption configures a stream created by NewConn or NewConnWithFallback.
+type ConnOption func(*streamConn)
+
+// WithOnEstablished is the option form of OnEstablished.
+func WithOnEstablished(fn func()) ConnOption {
+	return func(c *streamConn) {
+		c.onEstablished = fn
+	}
+}
+
+// WithOnFallbackUsed calls fn with the address of the peer when its first
+// record authenticated with the fallback cipher rather than the primary
+// one, e.g. to track clients still on the old key during a rotation.
+func WithOnFallbackUsed(fn func(peer net.Addr)) ConnOption {
+	return func(c *streamConn) {
+		c.onFallback = fn
+	}
+}
+
+// WithFillRecords makes ReadFrom fill a whole record from the source before
+// sealing it, rather than sealing whatever a single read returned. This cuts
+// the framing overhead for sources returning small chunks, but a record is
+// only sent once full or at the end of the source: only use it for bulk
+// transfers, never for interactive streams.
+func WithFillRecords() ConnOption {
+	return func(c *streamConn) {
+		c.fill = true
+	}
+}
+
+// DefaultDesyncThreshold is how many records in a row may fail to
+// authenticate before reads fail with ErrDesynchronized.
+const DefaultDesyncThreshold = 3
+
+// WithDesyncThreshold sets how many records in a row may fail to
+// authenticate before the stream gives up with ErrDesynchronized, for
+// good. Failures below it are returned as they are. n <= 0 never gives up.
+func WithDesyncThreshold(n int) ConnOption {
+	return func(c *streamConn) {
+		c.desync = n
+	}
+}
+
+// WithWriteToBatchSize makes WriteTo decrypt up to records records into a
+// staging buffer and hand them to the destination in one write, trading
+// that much memory for fewer writes. Like WithFillRecords, data is held
+// back until the batch is full or the stream ends or fails, so only use it
+// for bulk transfers.
+func WithWriteToBatchSize(records int) ConnOption {
+	return func(c *streamConn) {
+		c.batch = records
+	}
+}
+
+// ErrRecordTooLarge is returned when the peer sends a record larger than
+// the maximum set by WithMaxRecordSize, the stream cannot go on.
+var ErrRecordTooLarge = errors.New("record exceeds the negotiated maximum size")
+
+// WithMaxRecordSize makes the stream refuse records whose payload exceeds
+// n bytes, for extensions negotiating records smaller than
+// MaxPayloadSize. n <= 0 or above MaxPayloadSize leaves the default.
+func WithMaxRecordSize(n int) ConnOption {
+	return func(c *streamConn) {
+		c.maxRecord = n
+	}
+}
+
+// SetMaxRecordSize is WithMaxRecordSize for a maximum negotiated once the
+// stream is up, it applies from the next record read. Call it from the
+// reading goroutine.
+func (c *streamConn) SetMaxRecordSize(n int) {
+	c.maxRecord = n
+	if c.r != nil {
+		c.r.maxSize = n
+	}
+}
+
+var ErrInvalidBatchSize = errors.New("batch size below one record")
+
+// SetWriteToBatchSize is WithWriteToBatchSize on a live stream, taking
+// effect at the next WriteTo. records must be at least 1, the default
+// delivering record by record; the staging buffer costs records times
+// MaxPayloadSize bytes while WriteTo runs. Call it from the reading
+// goroutine or before reading starts.
+func (c *streamConn) SetWriteToBatchSize(records int) error {
+	if records < 1 {
+		return ErrInvalidBatchSize
+	}
+	c.batch = records
+	if c.r != nil {
+		c.r.batch = records
+	}
+	return nil
+}
+
+// WithWriteCoalescing lets Write batch small writes into one record, which
+// is sent once full or linger after the first byte entered it, whichever
+// comes first. PushWrite and Flush send it right away, so does any write of
+// a ZERO_CHUNK, ReadFrom and Close. Use PushWrite for data the peer waits
+// for, e.g. a prompt, and Write for the rest.
+func WithWriteCoalescing(linger time.Duration) ConnOption {
+	return func(c *streamConn) {
+		c.linger = linger
+	}
+}
+
+// DefaultFirstRecordMTU leaves room for IP and TCP headers, options
+// included, in a 1500 bytes MTU.
+const DefaultFirstRecordMTU = 1400
+
+// WithFirstRecordMTU caps the first record so that it fits in one segment
+// of mtu bytes together with the salt, mtu <= 0 selecting
+// DefaultFirstRecordMTU. Later records are not affected. This trades a
+// little framing overhead for a handshake that is not fragmented on small
+// MTU paths.
+func WithFirstRecordMTU(mtu int) ConnOption {
+	return func(c *streamConn) {
+		if mtu <= 0 {
+			mtu = DefaultFirstRecordMTU
+		}
+		c.firstMTU = mtu
+	}
+}
+
+// WithRole makes the stream enforce the ordering of its role: reading or
+// writing out of order fails with ErrReadBeforeWrite or ErrWriteBeforeRead
+// instead of deadlocking or picking the wrong cipher.
+func WithRole(role Role) ConnOption {
+	return func(c *streamConn) {
+		c.role = role
+	}
+}
+
+// WithContext makes ReadFrom give up between two records once ctx is done,
+// returning the bytes sent so far and an error wrapping ctx.Err(). A read
+// of the source or a write blocking meanwhile is not interrupted, use
+// deadlines for those.
+func WithContext(ctx context.Context) ConnOption {
+	return func(c *streamConn) {
+		c.ctx = ctx
+	}
+}
+
+// WithClock sets the clock of the stream, RealClock by default.
+func WithClock(clk Clock) ConnOption {
+	return func(c *streamConn) {
+		c.clock = clk
+	}
+}
+
+// WithSaltReader sets where the salt of the write direction is read from,
+// crypto/rand by default. Besides a SaltPool, only meant to produce
+// reproducible streams.
+func WithSaltReader(r io.Reader) ConnOption {
+	return func(c *streamConn) {
+		c.saltSrc = r
+	}
+}
+
+const (
+	bindNone = iota
+	bindInitiator
+	bindOptional
+)
+
+// ConnIDSize is the length of the id bound to records by WithConnID.
+const ConnIDSize = 4
+
+// connIDOf derives the connection id from the salt of the initiator.
+func connIDOf(salt []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("snell connection id"))
+	h.Write(salt)
+	return h.Sum(nil)[:ConnIDSize]
+}
+
+// WithConnID authenticates every record in both directions with an id
+// derived from the salt this side sends, so a record spliced in from
+// another connection under the same PSK fails to open. For the initiating
+// side. This is an open-snell extension: the peer must accept it
+// (WithOptionalConnID), stock Snell servers reject the stream.
+func WithConnID() ConnOption {
+	return func(c *streamConn) {
+		c.bindID = bindInitiator
+	}
+}
+
+// WithOptionalConnID is the accepting side of WithConnID: the id is derived
+// from the salt of the peer, and whether the peer binds it is told by its
+// first record. Replies are bound only if the peer's records were.
+func WithOptionalConnID() ConnOption {
+	return func(c *streamConn) {
+		c.bindID = bindOptional
+	}
+}
+
+// ConnID returns the id bound to the records, nil if there is none or it
+// is not known yet.
+func (c *streamConn) ConnID() []byte {
+	if c.bindID == bindOptional && (c.r == nil || c.r.optional) {
+		return nil
+	}
+	return c.connID
 }
 
 func (c *streamConn) initReader() error {
+	if c.role == RoleClient && c.currentWriter() == nil {
+		return ErrReadBeforeWrite
+	}
 	salt := make([]byte, c.SaltSize())
-	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+	if _, err := readFull(c.clock, c.Conn, salt); err != nil {
 		return err
 	}
+	c.dump.dump("recv salt", salt)
+	c.rsalt = salt
 	aead, err := c.Decrypter(salt)
 	if err != nil {
 		return err
 	}
 
-	var fallback cipher.AEAD = nil
+	var fallback func() (cipher.AEAD, error)
 	if c.fallback != nil {
-		fallback, _ = c.fallback.Decrypter(salt)
+		fb := c.fallback
+		fallback = func() (cipher.AEAD, error) { return fb.Decrypter(salt) }
 	}
 
-	c.r = newReader(c.Conn, aead, fallback)
+	var src io.Reader = c.Conn
+	if c.prefetch > 0 {
+		src = newPrefetcher(c.Conn, c.prefetch, c.prefetchDone)
+	}
+	c.r = c.newReader(src, aead, fallback)
+	c.r.onOpen = c.establish
+	switch c.bindID {
+	case bindInitiator:
+		c.r.ad = c.connID
+	case bindOptional:
+		c.connID = connIDOf(salt)
+		c.r.ad = c.connID
+		c.r.optional = true
+	}
 	return nil
 }
 
+// newReader returns a reader set up with the options of the stream.
+func (c *streamConn) newReader(src io.Reader, aead cipher.AEAD, fallback func() (cipher.AEAD, error)) *reader {
+	r := newReader(src, aead, fallback)
+	r.clock = c.clock
+	r.dump = c.dump
+	r.batch = c.batch
+	r.maxFails = c.desync
+	r.deadline = c.deadline
+	r.maxSize = c.maxRecord
+	if c.recordRate > 0 {
+		r.rate = newRecordRate(c.recordRate, c.recordBurst, c.rateThrottle, c.clock)
+	}
+	return r
+}
+
+// establish runs once the first record of the peer authenticated, before
+// any of its payload is handed out.
+func (c *streamConn) establish() {
+	var f Features
+	if c.r.switched { // cipher switched
+		f |= FeatureFallbackCipher
+		c.Cipher = c.fallback
+		c.fallback = nil
+		c.tags.Set("cipher", "1")
+		if c.onFallback != nil {
+			c.onFallback(c.RemoteAddr())
+		}
+	} else {
+		c.tags.Set("cipher", "0")
+	}
+	if c.r.ad == nil {
+		c.connID = nil
+	} else {
+		f |= FeatureConnID
+	}
+
+	c.hookMux.Lock()
+	c.established = true
+	c.features |= f
+	fn := c.onEstablished
+	c.onEstablished = nil
+	c.hookMux.Unlock()
+	c.startLifetime()
+	c.startCover()
+	if fn != nil {
+		fn()
+	}
+}
+
+func (c *streamConn) isEstablished() bool {
+	c.hookMux.Lock()
+	defer c.hookMux.Unlock()
+	return c.established
+}
+
+// OnEstablished registers fn to be called once the handshake completed,
+// that is the salt was read, the first record authenticated and the cipher
+// settled, right before application data is returned. fn is called at once
+// if that already happened.
+func (c *streamConn) OnEstablished(fn func()) {
+	c.hookMux.Lock()
+	if !c.established {
+		c.onEstablished = fn
+		fn = nil
+	}
+	c.hookMux.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// ensureReader sets the read direction up, once.
+func (c *streamConn) ensureReader() error {
+	c.rinit.Lock()
+	defer c.rinit.Unlock()
+	if c.r != nil {
+		return nil
+	}
+	return c.initReader()
+}
+
+// ensureWriter sets the write direction up, once.
+func (c *streamConn) ensureWriter() error {
+	c.winit.Lock()
+	defer c.winit.Unlock()
+	if c.w != nil {
+		return nil
+	}
+	return c.initWriter()
+}
+
+// Handshake runs the handshake of the stream eagerly rather than on first
+// use: a client sends its salt, a server reads the salt of the client. It
+// returns the first handshake error, and nil at once if the handshake is
+// already done. Streams without a role handshake as clients.
+func (c *streamConn) Handshake() error {
+	if c.role == RoleServer {
+		return c.ensureReader()
+	}
+	if err := c.ensureWriter(); err != nil {
+		return err
+	}
+	return c.w.sendSalt()
+}
+
 func (c *streamConn) Read(b []byte) (int, error) {
+	if err := c.ensureReader(); err != nil {
+		return 0, c.lifetimeErr(err)
+	}
+	n, err := c.r.Read(b)
+	return n, c.lifetimeErr(err)
+}
+
+// Buffered returns the number of decrypted bytes Read can return without
+// touching the underlying conn. Call it from the reading goroutine.
+func (c *streamConn) Buffered() int {
 	if c.r == nil {
-		if err := c.initReader(); err != nil {
-			return 0, err
-		}
-		n, err := c.r.Read(b)
-		if c.r.switched { // cipher switched
-			c.Cipher = c.fallback
-			c.fallback = nil
-		}
-		return n, err
+		return 0
 	}
-	return c.r.Read(b)
+	return c.r.Buffered()
 }
 
-func (c *streamConn) WriteTo(w io.Writer) (int64, error) {
+// Peek returns up to n bytes Read would return next, only looking at what
+// is already decrypted. Call it from the reading goroutine, the slice is
+// only valid until the next read. Peeked bytes are not consumed: Read,
+// TryRead, WriteTo and thus Relay deliver them first, so a sniffing proxy
+// can switch to plain copying without replaying anything.
+func (c *streamConn) Peek(n int) []byte {
 	if c.r == nil {
-		if err := c.initReader(); err != nil {
-			return 0, err
-		}
-		n, err := c.r.WriteTo(w)
-		if c.r.switched { // cipher switched
-			c.Cipher = c.fallback
-			c.fallback = nil
-		}
-		return n, err
+		return nil
 	}
-	return c.r.WriteTo(w)
+	return c.r.Peek(n)
+}
+
+// TryRead is Read limited to what is already decrypted, it never touches
+// the underlying conn and returns ErrWouldBlock when nothing is buffered.
+//
+// It is meant for event loops, with a constraint: records arrive in
+// pieces, so a readable conn does not mean a whole record is there, and
+// Read blocks until it is. Once the conn is readable, call Read from a
+// goroutine allowed to block for a record, then drain with TryRead.
+func (c *streamConn) TryRead(b []byte) (int, error) {
+	if c.r == nil || len(b) == 0 {
+		return 0, ErrWouldBlock
+	}
+	c.r.mux.Lock()
+	defer c.r.mux.Unlock()
+	if len(c.r.leftover) == 0 {
+		return 0, ErrWouldBlock
+	}
+	n := copy(b, c.r.leftover)
+	c.r.leftover = c.r.leftover[n:]
+	return n, nil
+}
+
+// Readable reports whether TryRead would return data.
+func (c *streamConn) Readable() bool {
+	return c.Buffered() > 0
+}
+
+func (c *streamConn) WriteTo(w io.Writer) (int64, error) {
+	if err := c.ensureReader(); err != nil {
+		return 0, c.lifetimeErr(err)
+	}
+	n, err := c.r.WriteTo(w)
+	return n, c.lifetimeErr(err)
 }
 
 func (c *streamConn) initWriter() error {
-	salt := make([]byte, c.SaltSize())
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		return err
+	if c.role == RoleServer && !c.isEstablished() {
+		return ErrWriteBeforeRead
 	}
-	aead, err := c.Encrypter(salt)
-	if err != nil {
+	var ciph Cipher = c.Cipher
+	if c.wcipher != nil {
+		ciph = c.wcipher
+	}
+	salt := make([]byte, ciph.SaltSize())
+	if _, err := io.ReadFull(c.saltSrc, salt); err != nil {
 		return err
 	}
-	_, err = c.Conn.Write(salt)
+	aead, err := ciph.Encrypter(salt)
 	if err != nil {
 		return err
 	}
-	c.w = newWriter(c.Conn, aead)
+	c.w = c.newWriter(aead)
+	c.w.salt = salt
+	c.wsalt = salt
+	if c.firstMTU > 0 {
+		c.w.firstLimit = c.firstMTU - len(salt) - 2 - 2*aead.Overhead()
+		if c.w.firstLimit < 1 {
+			c.w.firstLimit = 1
+		}
+	}
+	switch c.bindID {
+	case bindInitiator:
+		c.connID = connIDOf(salt)
+		c.w.ad = c.connID
+	case bindOptional:
+		c.w.ad = c.ConnID()
+	}
 	return nil
 }
 
+// newWriter returns a writer set up with the options of the stream.
+func (c *streamConn) newWriter(aead cipher.AEAD) *writer {
+	w := newWriter(c.Conn, aead)
+	w.dump = c.dump
+	w.ctx = c.ctx
+	w.fill = c.fill
+	w.linger = c.linger
+	w.clock = c.clock
+	return w
+}
+
 func (c *streamConn) Write(b []byte) (int, error) {
-	if c.w == nil {
-		if err := c.initWriter(); err != nil {
-			return 0, err
-		}
+	if err := c.ensureWriter(); err != nil {
+		return 0, c.lifetimeErr(err)
+	}
+	n, err := c.w.Write(b)
+	return n, c.lifetimeErr(err)
+}
+
+// PushWrite is Write bypassing coalescing: b and anything pending are sent
+// before it returns.
+func (c *streamConn) PushWrite(b []byte) (int, error) {
+	if err := c.ensureWriter(); err != nil {
+		return 0, err
+	}
+	return c.w.PushWrite(b)
+}
+
+// Flush sends any write held back by coalescing.
+func (c *streamConn) Flush() error {
+	w := c.currentWriter()
+	if w == nil {
+		return nil
+	}
+	return w.Flush()
+}
+
+// currentWriter returns the writer, nil if the write direction is not set
+// up yet. It never blocks on the network, unlike ensureReader.
+func (c *streamConn) currentWriter() *writer {
+	c.winit.Lock()
+	defer c.winit.Unlock()
+	return c.w
+}
+
+// CloseWrite half-closes the stream: a ZERO_CHUNK tells the peer no more
+// data follows while reading goes on. The underlying conn stays open, the
+// stream is fully closed only by Close once both directions are done.
+func (c *streamConn) CloseWrite() error {
+	if err := c.ensureWriter(); err != nil {
+		return err
+	}
+	return c.w.CloseWrite()
+}
+
+// Close flushes writes held back by coalescing, then closes the underlying
+// conn. The peer sees no ZERO_CHUNK, see CloseGracefully.
+func (c *streamConn) Close() error {
+	if w := c.currentWriter(); w != nil && c.linger > 0 {
+		w.Flush()
 	}
-	return c.w.Write(b)
+	c.stopPrefetch()
+	c.stopLifetime()
+	c.stopCover()
+	return c.Conn.Close()
 }
 
+// CloseWithError closes the stream abortively so the peer observes an
+// error rather than the clean end a ZERO_CHUNK or FIN would tell: pending
+// writes are dropped and the underlying conn, if it is a *net.TCPConn or
+// anything else with SetLinger, is reset. err is what made the stream
+// fail, it is not sent, Snell has no way to carry it.
+func (c *streamConn) CloseWithError(err error) error {
+	if l, ok := c.Conn.(interface{ SetLinger(sec int) error }); ok {
+		l.SetLinger(0)
+	}
+	c.stopPrefetch()
+	c.stopLifetime()
+	c.stopCover()
+	return c.Conn.Close()
+}
+
+// ErrCloseTimeout is returned by CloseGracefully when the stream could not
+// be ended cleanly in time and was reset instead.
+var ErrCloseTimeout = errors.New("graceful close timed out, the stream was reset")
+
+// CloseGracefully is Close telling the peer the stream ended cleanly:
+// writes held back by coalescing are sent, then a ZERO_CHUNK unless
+// CloseWrite already did, then the underlying conn is closed. A positive
+// timeout, measured on the Clock of the stream, bounds the whole call,
+// waiting for a concurrent Write to let go of the writer included: past it
+// the stream is closed as by CloseWithError and ErrCloseTimeout returned. Otherwise the conn is
+// closed once those are written and the first error is returned. A stream
+// that never wrote is closed right away, it has nothing to end.
+func (c *streamConn) CloseGracefully(timeout time.Duration) error {
+	w := c.currentWriter()
+	if w == nil {
+		c.stopPrefetch()
+		c.stopLifetime()
+		c.stopCover()
+		return c.Conn.Close()
+	}
+	if timeout <= 0 {
+		return c.finishClose(c.endWrite(w))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.endWrite(w)
+	}()
+	timer := c.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return c.finishClose(err)
+	case <-timer.Chan():
+		// closing the conn fails the write endWrite is blocked in, letting
+		// go of the writer
+		c.CloseWithError(ErrCloseTimeout)
+		return ErrCloseTimeout
+	}
+}
+
+// endWrite sends what coalescing holds back and the ZERO_CHUNK.
+func (c *streamConn) endWrite(w *writer) error {
+	err := w.CloseWrite()
+	if err == nil {
+		err = w.Flush()
+	}
+	return err
+}
+
+// finishClose closes the stream after endWrite, returning its error first.
+func (c *streamConn) finishClose(err error) error {
+	c.stopPrefetch()
+	c.stopLifetime()
+	c.stopCover()
+	if cerr := c.Conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ReadFrom is the plaintext to tunnel fast path, see writer.ReadFrom.
+// io.Copy and utils.Relay take it, from a net.Conn source too; Relay calls
+// it explicitly.
 func (c *streamConn) ReadFrom(r io.Reader) (int64, error) {
-	if c.w == nil {
-		if err := c.initWriter(); err != nil {
-			return 0, err
-		}
+	if err := c.ensureWriter(); err != nil {
+		return 0, c.lifetimeErr(err)
 	}
-	return c.w.ReadFrom(r)
+	n, err := c.w.ReadFrom(r)
+	return n, c.lifetimeErr(err)
 }
 
 // NewConn wraps a stream-oriented net.Conn with cipher.
-func NewConn(c net.Conn, ciph Cipher) net.Conn { return &streamConn{Conn: c, Cipher: ciph} }
+func NewConn(c net.Conn, ciph Cipher, opts ...ConnOption) net.Conn {
+	return NewConnWithFallback(c, ciph, nil, opts...)
+}
 
-func NewConnWithFallback(c net.Conn, ciph, fallback Cipher) net.Conn {
-	return &streamConn{
+func NewConnWithFallback(c net.Conn, ciph, fallback Cipher, opts ...ConnOption) net.Conn {
+	sc := &streamConn{
 		Conn:     c,
 		Cipher:   ciph,
 		fallback: fallback,
+		saltSrc:  rand.Reader,
+		clock:    RealClock,
+		desync:   DefaultDesyncThreshold,
+	}
+	for _, opt := range opts {
+		opt(sc)
+	}
+	if sc.recordTimeout > 0 {
+		sc.deadline = &recordDeadline{conn: c, timeout: sc.recordTimeout, clock: sc.clock}
 	}
+	return sc
+}
+
+// NewConnBidir wraps c with a different cipher per direction: what is read
+// is decrypted with readCipher, what is written sealed with writeCipher.
+// The peer must be set up the other way round, stock Snell peers use a
+// single cipher and only interoperate if both are the same.
+func NewConnBidir(c net.Conn, readCipher, writeCipher Cipher, opts ...ConnOption) net.Conn {
+	sc := NewConnWithFallback(c, readCipher, nil, opts...).(*streamConn)
+	sc.wcipher = writeCipher
+	return sc
 }
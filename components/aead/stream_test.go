@@ -0,0 +1,1033 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var testPSK = []byte("open-snell test psk")
+
+// tcpPair returns both ends of a loopback TCP connection, which unlike
+// net.Pipe buffers writes.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// streamPair returns a client and a server stream over a loopback
+// connection, both keyed with testPSK.
+func streamPair(t testing.TB, clientOpts, serverOpts []ConnOption) (*streamConn, *streamConn) {
+	t.Helper()
+	return cipherPair(t, NewAES128GCM(testPSK), clientOpts, serverOpts)
+}
+
+// cipherPair is streamPair with both ends keyed with ciph.
+func cipherPair(t testing.TB, ciph Cipher, clientOpts, serverOpts []ConnOption) (*streamConn, *streamConn) {
+	t.Helper()
+	a, b := tcpPair(t)
+	return NewConn(a, ciph, clientOpts...).(*streamConn), NewConn(b, ciph, serverOpts...).(*streamConn)
+}
+
+// temporaryErr is a net.Error reporting a transient failure.
+type temporaryErr struct{}
+
+func (temporaryErr) Error() string   { return "transient failure" }
+func (temporaryErr) Temporary() bool { return true }
+func (temporaryErr) Timeout() bool   { return false }
+
+// flakyConn cuts every call whose number, counted from 1, is in fail at
+// half its buffer and returns err with the bytes before the cut.
+type flakyConn struct {
+	net.Conn
+	err          error
+	reads        map[int]bool
+	writes       map[int]bool
+	nread, nwrit int
+}
+
+func (fc *flakyConn) Read(b []byte) (int, error) {
+	fc.nread++
+	if fc.reads[fc.nread] {
+		n, err := fc.Conn.Read(b[:len(b)/2])
+		if err == nil {
+			err = fc.err
+		}
+		return n, err
+	}
+	return fc.Conn.Read(b)
+}
+
+func (fc *flakyConn) Write(b []byte) (int, error) {
+	fc.nwrit++
+	if fc.writes[fc.nwrit] {
+		n, err := fc.Conn.Write(b[:len(b)/2])
+		if err == nil {
+			err = fc.err
+		}
+		return n, err
+	}
+	return fc.Conn.Write(b)
+}
+
+func calls(n ...int) map[int]bool {
+	m := make(map[int]bool, len(n))
+	for _, i := range n {
+		m[i] = true
+	}
+	return m
+}
+
+// flakyPair is streamPair with the client writing and the server reading
+// through flaky conns.
+func flakyPair(t *testing.T, err error, writes, reads map[int]bool) (*streamConn, *streamConn) {
+	t.Helper()
+	a, b := tcpPair(t)
+	ciph := NewAES128GCM(testPSK)
+	c := NewConn(&flakyConn{Conn: a, err: err, writes: writes}, ciph).(*streamConn)
+	s := NewConn(&flakyConn{Conn: b, err: err, reads: reads}, ciph).(*streamConn)
+	return c, s
+}
+
+func TestTemporaryErrorsRetriedInRecord(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"eintr", syscall.EINTR},
+		{"temporary", temporaryErr{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// every direction fails mid-record, more than once in a row
+			c, s := flakyPair(t, tc.err, calls(1, 2, 4), calls(2, 3, 5, 6, 7))
+			msg := pattern(3*MaxPayloadSize, 3)
+
+			werr := make(chan error, 1)
+			go func() {
+				_, err := c.Write(msg)
+				werr <- err
+			}()
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(s, got); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if err := <-werr; err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatal("payload corrupted, nonces out of step")
+			}
+		})
+	}
+}
+
+func TestTemporaryErrorsBounded(t *testing.T) {
+	fail := make([]int, 0, maxTemporaryRetries+1)
+	for i := 0; i <= maxTemporaryRetries; i++ {
+		fail = append(fail, 2+i)
+	}
+	c, s := flakyPair(t, syscall.EINTR, nil, calls(fail...))
+	go c.Write([]byte("hello"))
+
+	_, err := s.Read(make([]byte, 16))
+	if !errors.Is(err, syscall.EINTR) {
+		t.Fatalf("got %v, want EINTR once the retries are exhausted", err)
+	}
+}
+
+func TestTimeoutNotRetried(t *testing.T) {
+	c, s := streamPair(t, nil, nil)
+	go c.Write([]byte("hello"))
+	if _, err := s.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	start := time.Now()
+	_, err := s.Read(make([]byte, 16))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("timeout took %v, was it retried?", d)
+	}
+}
+
+func TestLeftoverNeverExceedsOneRecord(t *testing.T) {
+	c, s := streamPair(t, nil, nil)
+	msg := pattern(8*MaxPayloadSize, 5)
+	go c.Write(msg)
+
+	// tiny reads while the peer floods records
+	got := make([]byte, 0, len(msg))
+	b := make([]byte, 7)
+	for len(got) < len(msg) {
+		n, err := s.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b[:n]...)
+		if buffered := s.r.Buffered(); buffered > MaxPayloadSize {
+			t.Fatalf("%d bytes buffered, more than a record", buffered)
+		}
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload corrupted")
+	}
+}
+
+func TestRecordReadWithLeftoverFails(t *testing.T) {
+	c, s := streamPair(t, nil, nil)
+	go c.Write(pattern(100, 1))
+	go c.Write(pattern(100, 2))
+
+	if _, err := s.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	pending := append([]byte(nil), s.r.leftover...)
+
+	// a refactor reading a record before draining leftover must not
+	// overwrite it
+	s.r.mux.Lock()
+	_, err := s.r.read()
+	s.r.mux.Unlock()
+	if !errors.Is(err, errLeftoverPending) {
+		t.Fatalf("got %v, want errLeftoverPending", err)
+	}
+	if !bytes.Equal(s.r.leftover, pending) {
+		t.Fatal("leftover altered")
+	}
+}
+
+// recordingConn keeps a copy of everything written to it, and of every
+// Write call.
+type recordingConn struct {
+	net.Conn
+	mux     sync.Mutex
+	written []byte
+	writes  [][]byte
+}
+
+func (rc *recordingConn) Write(b []byte) (int, error) {
+	rc.mux.Lock()
+	rc.written = append(rc.written, b...)
+	rc.writes = append(rc.writes, append([]byte(nil), b...))
+	rc.mux.Unlock()
+	return rc.Conn.Write(b)
+}
+
+func (rc *recordingConn) wire() []byte {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	return append([]byte(nil), rc.written...)
+}
+
+// spliceReply captures the reply of a server on one connection and feeds
+// it to the client of another. Both servers send the same salt, so the
+// reply opens on the second connection unless records are bound to it.
+func spliceReply(t *testing.T, clientOpts, serverOpts []ConnOption) ([]byte, error) {
+	t.Helper()
+	ciph := NewAES128GCM(testPSK)
+	salt := pattern(16, 9)
+	serverOpts = append(serverOpts[:len(serverOpts):len(serverOpts)], WithSaltReader(bytes.NewReader(salt)))
+
+	a1, b1 := tcpPair(t)
+	rec := &recordingConn{Conn: b1}
+	c1, s1 := NewConn(a1, ciph, clientOpts...), NewConn(rec, ciph, serverOpts...)
+	go c1.Write([]byte("hello"))
+	if _, err := s1.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c1.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	a2, b2 := tcpPair(t)
+	c2 := NewConn(a2, ciph, clientOpts...)
+	go io.Copy(io.Discard, b2)
+	if _, err := c2.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b2.Write(rec.wire()); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	n, err := c2.Read(b)
+	return b[:n], err
+}
+
+func TestConnIDPreventsSplicing(t *testing.T) {
+	// without binding the spliced record opens: the test does splice
+	got, err := spliceReply(t, nil, nil)
+	if err != nil || string(got) != "reply" {
+		t.Fatalf("unbound splice got %q, %v", got, err)
+	}
+
+	_, err = spliceReply(t, []ConnOption{WithConnID()}, []ConnOption{WithOptionalConnID()})
+	if err == nil {
+		t.Fatal("record spliced from another connection opened")
+	}
+}
+
+func TestConnIDOptionalInterop(t *testing.T) {
+	// a server accepting ids still serves clients not binding one
+	for _, clientOpts := range [][]ConnOption{nil, {WithConnID()}} {
+		c, s := streamPair(t, clientOpts, []ConnOption{WithOptionalConnID()})
+		go c.Write([]byte("ping"))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(s, b); err != nil {
+			t.Fatal(err)
+		}
+		go s.Write([]byte("pong"))
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "pong" {
+			t.Fatalf("got %q, %v", b, err)
+		}
+		if !bytes.Equal(c.ConnID(), s.ConnID()) {
+			t.Fatalf("client id %x, server id %x", c.ConnID(), s.ConnID())
+		}
+	}
+}
+
+// TestProxyMemoryBounded drives a large upload through a server relaying
+// a stream to an upstream conn and checks the heap stays flat: memory is
+// bounded per connection, not proportional to the transfer.
+func TestProxyMemoryBounded(t *testing.T) {
+	size := int64(2 << 30)
+	if testing.Short() {
+		size = 64 << 20
+	}
+
+	c, s := streamPair(t, nil, nil)
+	up, upPeer := tcpPair(t)
+	go func() {
+		io.Copy(io.Discard, upPeer)
+		upPeer.Close() // ends the reply direction
+	}()
+	relayed := make(chan int64, 1)
+	go func() {
+		n, _, _ := Relay(s, up)
+		relayed <- n
+	}()
+
+	var base, peak uint64
+	sample := func() uint64 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return ms.HeapInuse
+	}
+	var sent int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		src := &patternReader{left: size}
+		for src.left > 0 {
+			n, err := c.ReadFrom(io.LimitReader(src, 16<<20))
+			atomic.AddInt64(&sent, n)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		c.CloseWrite()
+	}()
+
+	tick := time.NewTicker(20 * time.Millisecond)
+	defer tick.Stop()
+	for warm := false; ; {
+		select {
+		case <-done:
+			if n := <-relayed; n != size {
+				t.Fatalf("relayed %d bytes, want %d", n, size)
+			}
+			if peak > base+8<<20 {
+				t.Fatalf("heap grew from %d to %d bytes over %d bytes relayed", base, peak, size)
+			}
+			return
+		case <-tick.C:
+			if !warm {
+				if atomic.LoadInt64(&sent) < 16<<20 {
+					continue
+				}
+				runtime.GC()
+				base, warm = sample(), true
+			}
+			if h := sample(); h > peak {
+				peak = h
+			}
+		}
+	}
+}
+
+func TestCloseWriteAsymmetric(t *testing.T) {
+	c, s := streamPair(t, nil, nil)
+
+	if _, err := c.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatalf("second CloseWrite: %v", err)
+	}
+	if _, err := c.Write([]byte("more")); !errors.Is(err, ErrWriteClosed) {
+		t.Fatalf("write after CloseWrite: got %v, want ErrWriteClosed", err)
+	}
+
+	// the server reads the request up to the ZERO_CHUNK
+	got, err := io.ReadAll(s)
+	if !errors.Is(err, ErrZeroChunk) || string(got) != "request" {
+		t.Fatalf("server got %q, %v", got, err)
+	}
+
+	// and still answers through its own, open, direction
+	reply := pattern(2*MaxPayloadSize, 4)
+	go func() {
+		s.Write(reply)
+		s.CloseWrite()
+	}()
+	got, err = io.ReadAll(c)
+	if !errors.Is(err, ErrZeroChunk) || !bytes.Equal(got, reply) {
+		t.Fatalf("client got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestCloseWriteFlushesPending(t *testing.T) {
+	c, s := streamPair(t, []ConnOption{WithWriteCoalescing(time.Hour)}, nil)
+	if _, err := c.Write([]byte("coalesced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(s)
+	if !errors.Is(err, ErrZeroChunk) || string(got) != "coalesced" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestServerSaltSentWithFirstRecord(t *testing.T) {
+	a, b := tcpPair(t)
+	ciph := NewAES128GCM(testPSK)
+	rec := &recordingConn{Conn: b}
+	c := NewConn(a, ciph, WithRole(RoleClient))
+	s := NewConn(rec, ciph, WithRole(RoleServer))
+
+	go c.Write([]byte("request"))
+	if _, err := s.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mux.Lock()
+	writes := rec.writes
+	rec.mux.Unlock()
+	if len(writes) != 1 {
+		t.Fatalf("salt and first record took %d writes", len(writes))
+	}
+	overhead := 16 // GCM tag
+	if want := ciph.SaltSize() + 2 + overhead + len("response") + overhead; len(writes[0]) != want {
+		t.Fatalf("first write of %d bytes, want salt and record, %d bytes", len(writes[0]), want)
+	}
+
+	// and the combined write is still salt followed by the sealed record
+	b2 := make([]byte, len("response"))
+	if _, err := io.ReadFull(c, b2); err != nil || string(b2) != "response" {
+		t.Fatalf("client got %q, %v", b2, err)
+	}
+	got, err := io.ReadAll(io.LimitReader(DecryptStream(bytes.NewReader(writes[0]), ciph), 64))
+	if err != nil || string(got) != "response" {
+		t.Fatalf("decrypted %q, %v", got, err)
+	}
+}
+
+func TestCloseGracefullyDeliversQueued(t *testing.T) {
+	c, s := streamPair(t, []ConnOption{WithWriteCoalescing(time.Hour)}, nil)
+	for _, part := range []string{"queued ", "by ", "coalescing"} {
+		if _, err := c.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.CloseGracefully(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(s)
+	if !errors.Is(err, ErrZeroChunk) || string(got) != "queued by coalescing" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+// TestCloseWhileReadFromBlocked closes streams whose ReadFrom waits on a
+// silent source: neither Close, flushing what coalescing holds, nor
+// CloseGracefully waits for the source, and ReadFrom ends at its next
+// record.
+func TestCloseWhileReadFromBlocked(t *testing.T) {
+	for _, graceful := range []bool{false, true} {
+		c, s := streamPair(t, []ConnOption{WithWriteCoalescing(time.Hour)}, nil)
+		src, feed := io.Pipe()
+		defer feed.Close()
+		copied := make(chan error, 1)
+		go func() {
+			_, err := c.ReadFrom(src)
+			copied <- err
+		}()
+		feed.Write([]byte("first "))
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		first := make([]byte, 6)
+		if _, err := io.ReadFull(s, first); err != nil {
+			t.Fatal(err)
+		}
+		wrote := make(chan struct{})
+		go func() {
+			c.Write([]byte("coalesced"))
+			close(wrote)
+		}()
+		select {
+		case <-wrote:
+		case <-time.After(5 * time.Second):
+			t.Fatal("write blocked on the idle source")
+		}
+
+		closed := make(chan error, 1)
+		go func() {
+			if graceful {
+				closed <- c.CloseGracefully(0)
+			} else {
+				closed <- c.Close()
+			}
+		}()
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("close (graceful %v) blocked on the idle source", graceful)
+		}
+
+		got, err := io.ReadAll(s)
+		if string(got) != "coalesced" {
+			t.Fatalf("peer got %q, %v", got, err)
+		}
+		if graceful && !errors.Is(err, ErrZeroChunk) {
+			t.Fatalf("peer got %v, want the clean end", err)
+		}
+
+		feed.Write([]byte("late"))
+		select {
+		case err := <-copied:
+			if err == nil {
+				t.Fatal("ReadFrom went on after the close")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("ReadFrom did not end at its next record")
+		}
+	}
+}
+
+// stallConn stops writing once stalled, whatever the deadlines, until it
+// is closed.
+type stallConn struct {
+	net.Conn
+	stalled int32
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.stalled) != 0 {
+		<-c.closed
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *stallConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// TestCloseGracefullyBounded closes a stream whose transport stalled: the
+// close must not wait past its timeout, and the reset lets the writer go.
+func TestCloseGracefullyBounded(t *testing.T) {
+	a, b := tcpPair(t)
+	sc := &stallConn{Conn: a, closed: make(chan struct{})}
+	c := NewConn(sc, NewAES128GCM(testPSK)).(*streamConn)
+	s := NewConn(b, NewAES128GCM(testPSK))
+	c.Write([]byte("first"))
+	buf := make([]byte, 5)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&sc.stalled, 1)
+	go c.Write([]byte("stuck")) // holds the writer until the reset
+	start := time.Now()
+	if err := c.CloseGracefully(100 * time.Millisecond); !errors.Is(err, ErrCloseTimeout) {
+		t.Fatalf("got %v, want ErrCloseTimeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("returned after %v, past its 100ms timeout", d)
+	}
+	// the peer sees no clean end
+	if _, err := s.Read(buf); err == nil || errors.Is(err, ErrZeroChunk) {
+		t.Fatalf("peer got %v, want the stream reset", err)
+	}
+	// and the writer is free again
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("after"))
+		wrote <- err
+	}()
+	select {
+	case err := <-wrote:
+		if err == nil {
+			t.Fatal("write succeeded on a reset stream")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer still held after the reset")
+	}
+}
+
+// slowReader returns a chunk of data every interval, forever.
+type slowReader struct {
+	interval time.Duration
+	chunk    int
+}
+
+func (r slowReader) Read(b []byte) (int, error) {
+	time.Sleep(r.interval)
+	if len(b) > r.chunk {
+		b = b[:r.chunk]
+	}
+	return len(b), nil
+}
+
+func TestReadFromCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c, s := streamPair(t, []ConnOption{WithContext(ctx)}, nil)
+	go io.Copy(io.Discard, s)
+
+	type result struct {
+		n   int64
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := c.ReadFrom(slowReader{interval: 5 * time.Millisecond, chunk: 100})
+		done <- result{n, err}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	canceled := time.Now()
+	select {
+	case res := <-done:
+		if !errors.Is(res.err, context.Canceled) {
+			t.Fatalf("got %v, want an error wrapping context.Canceled", res.err)
+		}
+		if res.n == 0 || res.n%100 != 0 {
+			t.Fatalf("reported %d bytes sent, want the whole records sent", res.n)
+		}
+		// one source read at most, not the rest of the stream
+		if d := time.Since(canceled); d > 100*time.Millisecond {
+			t.Fatalf("returned %v after the cancellation", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadFrom kept going after the cancellation")
+	}
+
+	// records are whole, the stream stays usable
+	if _, err := c.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMaxLifetimeUnderTraffic checks a stream streaming without pause still
+// ends cleanly at its lifetime.
+func TestMaxLifetimeUnderTraffic(t *testing.T) {
+	const lifetime = 200 * time.Millisecond
+	c, s := streamPair(t, nil, []ConnOption{WithMaxLifetime(lifetime)})
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	established := time.Now()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.ReadFrom(slowReader{interval: time.Millisecond, chunk: 1000})
+		done <- err
+	}()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.Copy(io.Discard, c)
+	if !errors.Is(err, ErrZeroChunk) {
+		t.Fatalf("client got %v after %d bytes, want the clean end of a ZERO_CHUNK", err, n)
+	}
+	if n == 0 || n%1000 != 0 {
+		t.Fatalf("client got %d bytes, want whole records", n)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrMaxLifetime) {
+			t.Fatalf("ReadFrom returned %v, want ErrMaxLifetime", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadFrom kept going past the lifetime")
+	}
+	if d := time.Since(established); d < lifetime || d > lifetime+time.Second {
+		t.Fatalf("closed after %v, want about %v", d, lifetime)
+	}
+}
+
+// TestOversizedRecordAfterNegotiation has a peer agree on 1000 byte
+// records, then send a larger one.
+func TestOversizedRecordAfterNegotiation(t *testing.T) {
+	c, s := streamPair(t, nil, nil)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	s.SetMaxRecordSize(1000)
+
+	go func() {
+		c.Write(pattern(1000, 1))
+		c.Write(pattern(1001, 2))
+	}()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 1000)
+	if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, pattern(1000, 1)) {
+		t.Fatalf("record at the maximum: %v", err)
+	}
+	if n, err := s.Read(got); !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("oversized record: got %d bytes, %v, want ErrRecordTooLarge", n, err)
+	}
+}
+
+func TestKeepaliveDoesNotTerminate(t *testing.T) {
+	c, s := streamPair(t, nil, nil)
+	if err := c.WriteKeepalive(); !errors.Is(err, ErrKeepaliveNotNegotiated) {
+		t.Fatalf("got %v, want ErrKeepaliveNotNegotiated before negotiation", err)
+	}
+	c.SetNegotiated(FeatureKeepalive)
+	s.SetNegotiated(FeatureKeepalive)
+
+	go func() {
+		c.Write([]byte("before "))
+		for i := 0; i < 3; i++ {
+			c.WriteKeepalive()
+		}
+		c.Write([]byte("between "))
+		c.WriteKeepalive()
+		c.Write([]byte("after"))
+		c.CloseWrite()
+	}()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(s)
+	if !errors.Is(err, ErrZeroChunk) || string(got) != "before between after" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// nor does one on an idle stream, the server still answers after it
+	go func() {
+		s.WriteKeepalive()
+		s.Write([]byte("reply"))
+	}()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "reply" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+}
+
+func TestRecordRateLimit(t *testing.T) {
+	for _, throttle := range []bool{false, true} {
+		c, s := streamPair(t, nil, []ConnOption{WithRecordRateLimit(100, 10, throttle)})
+		c.SetNegotiated(FeatureKeepalive)
+		s.SetNegotiated(FeatureKeepalive)
+
+		// a flood of tiny records, keepalives in between cost an Open too
+		go func() {
+			for i := 0; i < 30; i++ {
+				c.Write([]byte{byte(i)})
+				if i%3 == 0 {
+					c.WriteKeepalive()
+				}
+			}
+		}()
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		b := make([]byte, 1)
+		got := 0
+		var err error
+		for got < 30 {
+			if _, err = s.Read(b); err != nil {
+				break
+			}
+			got++
+		}
+
+		if !throttle {
+			// the 10 of the burst, three of them keepalives
+			if !errors.Is(err, ErrRecordRateExceeded) || got != 7 {
+				t.Fatalf("reject: %d records read, %v, want ErrRecordRateExceeded after 7", got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("throttle: %v after %d records", err, got)
+		}
+		// 40 records, 30 over the burst at 100 a second
+		if d := time.Since(start); d < 250*time.Millisecond {
+			t.Fatalf("throttle: 40 records read in %v, want about 300ms", d)
+		}
+	}
+}
+
+// sealWire returns what a client writing payload, then the ZERO_CHUNK if
+// end is set, puts on the wire.
+func sealWire(payload []byte, end bool) []byte {
+	var wire bytes.Buffer
+	c := NewConn(rwConn{struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(nil), &wire}}, NewAES128GCM(testPSK))
+	c.Write(payload)
+	if end {
+		c.(*streamConn).CloseWrite()
+	}
+	return wire.Bytes()
+}
+
+// writeCounter collects what is written to it, counting the writes.
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (wc *writeCounter) Write(b []byte) (int, error) {
+	wc.writes++
+	return wc.Buffer.Write(b)
+}
+
+func TestWriteToBatchFlushesOnEnd(t *testing.T) {
+	msg := pattern(5*MaxPayloadSize+100, 10)
+	full := sealWire(msg, true)
+	for _, tc := range []struct {
+		name string
+		wire []byte
+		err  error
+	}{
+		{"zero chunk", full, ErrZeroChunk},
+		{"eof", sealWire(msg, false), nil},
+		{"truncated", full[:len(full)-100], io.ErrUnexpectedEOF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewConn(wireConn(tc.wire), NewAES128GCM(testPSK), WithWriteToBatchSize(4))
+			var sink writeCounter
+			n, err := s.(io.WriterTo).WriteTo(&sink)
+			if !errors.Is(err, tc.err) || (tc.err == nil) != (err == nil) {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+			want := msg
+			if tc.err == io.ErrUnexpectedEOF {
+				want = msg[:5*MaxPayloadSize] // the last record is cut
+			}
+			if n != int64(len(want)) || !bytes.Equal(sink.Bytes(), want) {
+				t.Fatalf("wrote %d bytes, want %d", n, len(want))
+			}
+			if sink.writes != 2 { // a full batch, then what was staged
+				t.Fatalf("%d writes, want 2", sink.writes)
+			}
+		})
+	}
+}
+
+// BenchmarkWriteToBatch decrypts a stream of full records to /dev/null,
+// one write per record against batches of several.
+func BenchmarkWriteToBatch(b *testing.B) {
+	wire := sealWire(pattern(64*MaxPayloadSize, 11), true)
+	sink, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	for _, batch := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("batch-%d", batch), func(b *testing.B) {
+			b.SetBytes(64 * MaxPayloadSize)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s := NewConn(wireConn(wire), NewAES128GCM(testPSK), WithWriteToBatchSize(batch))
+				if _, err := s.(io.WriterTo).WriteTo(sink); !errors.Is(err, ErrZeroChunk) {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDesyncThreshold(t *testing.T) {
+	// a valid salt followed by garbage: every record fails to authenticate
+	wire := sealWire([]byte("x"), false)[:16]
+	wire = append(wire, pattern(20*(2+16), 12)...)
+
+	for _, tc := range []struct {
+		threshold int
+		desyncAt  int // read giving ErrDesynchronized first, 0 for none
+	}{
+		{0, DefaultDesyncThreshold},
+		{1, 1},
+		{5, 5},
+		{-1, 0},
+	} {
+		opts := []ConnOption{}
+		if tc.threshold != 0 {
+			opts = append(opts, WithDesyncThreshold(tc.threshold))
+		}
+		s := NewConn(wireConn(wire), NewAES128GCM(testPSK), opts...)
+		want := tc.desyncAt
+		b := make([]byte, 64)
+		for i := 1; i <= 10; i++ {
+			_, err := s.Read(b)
+			if err == nil {
+				t.Fatalf("threshold %d: read %d of garbage succeeded", tc.threshold, i)
+			}
+			desync := errors.Is(err, ErrDesynchronized)
+			if want > 0 && i >= want {
+				if !desync {
+					t.Fatalf("threshold %d: read %d got %v, want ErrDesynchronized", tc.threshold, i, err)
+				}
+			} else if desync {
+				t.Fatalf("threshold %d: ErrDesynchronized at read %d, want it at %d", tc.threshold, i, want)
+			}
+		}
+	}
+}
+
+// BenchmarkSealFromSource feeds a stream from a plaintext source through
+// its ReadFrom, as io.Copy and Relay do, against io.CopyBuffer with a 16KB
+// buffer going through Write.
+func BenchmarkSealFromSource(b *testing.B) {
+	const size = 64 * MaxPayloadSize
+	for _, bc := range []struct {
+		name string
+		copy func(c net.Conn, src io.Reader) error
+	}{
+		{"read-from", func(c net.Conn, src io.Reader) error {
+			_, err := io.Copy(c, src)
+			return err
+		}},
+		{"write-16KB", func(c net.Conn, src io.Reader) error {
+			_, err := io.CopyBuffer(struct{ io.Writer }{c}, src, make([]byte, 16*1024))
+			return err
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c := NewConn(wireConn(nil), NewAES128GCM(testPSK))
+				if err := bc.copy(c, &patternReader{left: size}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordTimeout(t *testing.T) {
+	wire := sealWire([]byte("slow"), false)
+	for _, tc := range []struct {
+		name string
+		user time.Duration // read deadline set on the stream, 0 for none
+		want error
+	}{
+		{"record", 0, ErrSlowRecord},
+		{"user first", 10 * time.Millisecond, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := tcpPair(t)
+			s := NewConn(b, NewAES128GCM(testPSK), WithRecordTimeout(100*time.Millisecond))
+			if tc.user > 0 {
+				s.SetReadDeadline(time.Now().Add(tc.user))
+			}
+			a.Write(wire[:len(wire)-1]) // the last byte never comes
+
+			start := time.Now()
+			_, err := s.Read(make([]byte, 4))
+			if tc.want != nil {
+				if !errors.Is(err, tc.want) {
+					t.Fatalf("got %v, want %v", err, tc.want)
+				}
+			} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() || errors.Is(err, ErrSlowRecord) {
+				t.Fatalf("got %v, want the timeout of the user deadline", err)
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Fatalf("read took %v", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var ErrSwapPending = errors.New("stream has undelivered data, cannot swap its conn")
+
+// SwapConn replaces the underlying conn of the stream, e.g. with one over
+// a backup transport once the current one died, and resets both
+// directions: the next Write sends a fresh salt and the next Read expects
+// one, as on a new stream keyed with the cipher the first handshake
+// settled on. The old conn is left to the caller.
+//
+// It is a failover primitive, not migration: the peer sees a new stream
+// and has to be told by the application it continues the old one, there
+// is no resumption token. Anything in flight on the old conn is lost:
+// records the peer sent that were not read, and writes held back by
+// coalescing, which are dropped. The application has to detect and
+// retransmit what was lost. It fails with ErrSwapPending while decrypted
+// data is still unread, so the swap happens at a record boundary. No read
+// or write may be in progress.
+func (c *streamConn) SwapConn(nc net.Conn) error {
+	c.rinit.Lock()
+	defer c.rinit.Unlock()
+	c.winit.Lock()
+	defer c.winit.Unlock()
+
+	if c.r != nil && c.r.Buffered() > 0 {
+		return ErrSwapPending
+	}
+	if c.w != nil {
+		c.w.mux.Lock()
+		if c.w.timer != nil {
+			c.w.timer.Stop()
+		}
+		c.w.mux.Unlock()
+	}
+	if c.prefetchDone != nil {
+		c.stopPrefetch()
+		c.prefetchDone = make(chan struct{})
+		c.prefetchOnce = new(sync.Once)
+	}
+
+	c.Conn = nc
+	c.r, c.w = nil, nil
+	c.rsalt, c.wsalt = nil, nil
+	if c.deadline != nil {
+		c.deadline = &recordDeadline{conn: nc, timeout: c.recordTimeout, clock: c.clock}
+	}
+	c.hookMux.Lock()
+	c.established = false
+	c.hookMux.Unlock()
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"strings"
+	"sync"
+)
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Tags is a small set of labels attached to a conn, e.g. the client id or
+// source address, for logs and metrics. It is safe for concurrent use and
+// does not allocate for the first few tags.
+type Tags struct {
+	mux    sync.Mutex
+	list   []Tag
+	inline [4]Tag
+}
+
+// Set adds or replaces the tag key.
+func (t *Tags) Set(key, value string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for i := range t.list {
+		if t.list[i].Key == key {
+			t.list[i].Value = value
+			return
+		}
+	}
+	if t.list == nil {
+		t.list = t.inline[:0]
+	}
+	t.list = append(t.list, Tag{key, value})
+}
+
+// Get returns the value of the tag key, if present.
+func (t *Tags) Get(key string) (string, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, tag := range t.list {
+		if tag.Key == key {
+			return tag.Value, true
+		}
+	}
+	return "", false
+}
+
+// List returns a copy of the tags in insertion order.
+func (t *Tags) List() []Tag {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return append([]Tag(nil), t.list...)
+}
+
+// String formats the tags as space separated key=value pairs.
+func (t *Tags) String() string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	var sb strings.Builder
+	for i, tag := range t.list {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(tag.Key)
+		sb.WriteByte('=')
+		sb.WriteString(tag.Value)
+	}
+	return sb.String()
+}
@@ -0,0 +1,45 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"errors"
+)
+
+// GenerateVector returns the exact bytes a stream puts on the wire when
+// keyed with salt and fed chunks, one Write per chunk (an empty chunk is a
+// ZERO_CHUNK). It is meant for comparing against captures of the reference
+// implementation; testdata/vectors.json holds its output for aes-128-gcm
+// and chacha20-poly1305, regenerated with go test -update-vectors.
+func GenerateVector(ciph Cipher, salt []byte, chunks ...[]byte) ([]byte, error) {
+	if len(salt) != ciph.SaltSize() {
+		return nil, errors.New("invalid salt size")
+	}
+	aead, err := ciph.Encrypter(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &bytes.Buffer{}
+	out.Write(salt)
+	w := newWriter(out, aead)
+	for _, chunk := range chunks {
+		if _, err := w.Write(chunk); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
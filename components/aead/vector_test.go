@@ -0,0 +1,279 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package aead
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var updateVectors = flag.Bool("update-vectors", false, "rewrite testdata/vectors.json")
+
+const vectorsFile = "testdata/vectors.json"
+
+// wireVector is the on-wire encoding of a payload by a client stream: the
+// salt, the payload in full records and a ZERO_CHUNK. The payload is
+// vectorPayload(Size), kept out of the file.
+type wireVector struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	PSK    string `json:"psk"`
+	Salt   string `json:"salt"`
+	Size   int    `json:"size"`
+	Wire   string `json:"wire"`
+}
+
+func vectorPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// vectorChunks splits the payload of a vector in writes, the ZERO_CHUNK
+// last.
+func vectorChunks(size int) [][]byte {
+	if size == 0 {
+		return [][]byte{{}}
+	}
+	return [][]byte{vectorPayload(size), {}}
+}
+
+// vectorCases are the vectors checked in, per method: no payload, a
+// single record and three records.
+func vectorCases() []wireVector {
+	var cases []wireVector
+	for i, method := range []string{"aes-128-gcm", "chacha20-poly1305"} {
+		for _, c := range []struct {
+			name string
+			size int
+		}{
+			{"empty", 0},
+			{"single-record", 1000},
+			{"multi-record", 2*MaxPayloadSize + 100},
+		} {
+			salt := make([]byte, 16)
+			for j := range salt {
+				salt[j] = byte(0x10*i + j)
+			}
+			cases = append(cases, wireVector{
+				Name:   method + "/" + c.name,
+				Method: method,
+				PSK:    "open-snell vectors",
+				Salt:   hex.EncodeToString(salt),
+				Size:   c.size,
+			})
+		}
+	}
+	return cases
+}
+
+func (v *wireVector) generate() ([]byte, error) {
+	ciph, err := NewCipher(v.Method, []byte(v.PSK))
+	if err != nil {
+		return nil, err
+	}
+	salt, err := hex.DecodeString(v.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return GenerateVector(ciph, salt, vectorChunks(v.Size)...)
+}
+
+func loadVectors(t *testing.T) []wireVector {
+	t.Helper()
+	if *updateVectors {
+		cases := vectorCases()
+		for i := range cases {
+			wire, err := cases[i].generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cases[i].Wire = hex.EncodeToString(wire)
+		}
+		out, err := json.MarshalIndent(cases, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(vectorsFile, append(out, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(vectorsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []wireVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) != len(vectorCases()) {
+		t.Fatalf("%d vectors in %s, want %d", len(vectors), vectorsFile, len(vectorCases()))
+	}
+	return vectors
+}
+
+// TestWireVectors checks GenerateVector still produces the checked in
+// bytes, that a stream reads them back, and that they decode with
+// openReference, written from the protocol rather than from this package.
+func TestWireVectors(t *testing.T) {
+	for _, v := range loadVectors(t) {
+		v := v
+		t.Run(v.Name, func(t *testing.T) {
+			want, err := hex.DecodeString(v.Wire)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := v.generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("wire encoding diverged from %s", vectorsFile)
+			}
+
+			payload, err := openReference(v.Method, []byte(v.PSK), want)
+			if err != nil {
+				t.Fatalf("reference decoding: %v", err)
+			}
+			if !bytes.Equal(payload, vectorPayload(v.Size)) {
+				t.Fatal("reference decoding returned another payload")
+			}
+
+			ciph, _ := NewCipher(v.Method, []byte(v.PSK))
+			read, err := io.ReadAll(DecryptStream(bytes.NewReader(want), ciph))
+			if err != nil && !errors.Is(err, ErrZeroChunk) {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(read, vectorPayload(v.Size)) {
+				t.Fatal("stream decoding returned another payload")
+			}
+		})
+	}
+}
+
+// TestStreamMatchesVector checks a stream keyed through WithSaltReader
+// puts the same bytes on the wire as GenerateVector.
+func TestStreamMatchesVector(t *testing.T) {
+	v := vectorCases()[1]
+	want, err := v.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	salt, _ := hex.DecodeString(v.Salt)
+	ciph, _ := NewCipher(v.Method, []byte(v.PSK))
+	out := &bytes.Buffer{}
+	c := NewFramedReadWriter(struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(nil), out}, ciph, WithSaltReader(bytes.NewReader(salt)))
+	if _, err := c.Write(vectorPayload(v.Size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatal("stream output differs from GenerateVector")
+	}
+}
+
+// openReference decodes wire following the Snell framing: a salt, the key
+// argon2id(psk, salt, t=3, m=8KiB, p=1) truncated to the key size, then
+// records of a sealed 2 bytes big-endian length followed by the sealed
+// payload, the nonce a little-endian counter incremented per seal and a
+// zero length ending the stream.
+func openReference(method string, psk, wire []byte) ([]byte, error) {
+	var keySize int
+	var newAEAD func([]byte) (cipher.AEAD, error)
+	switch method {
+	case "aes-128-gcm":
+		keySize = 16
+		newAEAD = func(key []byte) (cipher.AEAD, error) {
+			blk, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(blk)
+		}
+	case "chacha20-poly1305":
+		keySize, newAEAD = 32, chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("no reference for %s", method)
+	}
+
+	if len(wire) < 16 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	key := argon2.IDKey(psk, wire[:16], 3, 8, 1, 32)[:keySize]
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	wire = wire[16:]
+
+	var counter uint64
+	open := func(n int) ([]byte, error) {
+		if len(wire) < n+aead.Overhead() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		nonce := make([]byte, aead.NonceSize())
+		binary.LittleEndian.PutUint64(nonce, counter)
+		counter++
+		rec := wire[:n+aead.Overhead()]
+		wire = wire[n+aead.Overhead():]
+		return aead.Open(nil, nonce, rec, nil)
+	}
+
+	var payload []byte
+	for {
+		hdr, err := open(2)
+		if err != nil {
+			return nil, err
+		}
+		size := int(binary.BigEndian.Uint16(hdr))
+		if size == 0 {
+			break
+		}
+		if size > 0x3FFF {
+			return nil, fmt.Errorf("record of %d bytes", size)
+		}
+		b, err := open(size)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, b...)
+	}
+	if len(wire) != 0 {
+		return nil, fmt.Errorf("%d bytes after the ZERO_CHUNK", len(wire))
+	}
+	return payload, nil
+}
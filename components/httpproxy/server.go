@@ -0,0 +1,196 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// ProxyCallback tunnels conn to target ("host:port"), it owns conn. For a
+// CONNECT request conn is an Establisher: the callback must report whether
+// the tunnel is up before relaying anything, the client being answered
+// only then.
+type ProxyCallback func(conn net.Conn, target string)
+
+// Establisher is implemented by the conns of CONNECT requests.
+// Established(nil) answers a CONNECT with 200 Connection Established, an
+// error with 504 Gateway Timeout if it is a timeout and 502 Bad Gateway
+// otherwise, after which conn must be closed. It returns the error of
+// writing the response.
+type Establisher interface {
+	Established(err error) error
+}
+
+type HTTPListener struct {
+	net.Listener
+	address  string
+	closed   bool
+	callback ProxyCallback
+}
+
+// NewHTTPProxy serves an HTTP proxy at addr, tunneling CONNECT requests and
+// plain requests in absolute-form through cb. A plain request is sent to
+// the origin in origin-form with Connection: close, and the connection
+// ends with its response: keep-alive is not supported since later requests
+// may be for other origins, so clients open a connection per request. It
+// goes out with the tunnel request to spare a round-trip, so a failed
+// tunnel closes the connection without a response.
+func NewHTTPProxy(addr string, cb ProxyCallback) (*HTTPListener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	hl := &HTTPListener{l, addr, false, cb}
+	go func() {
+		log.Infof("HTTP proxy listening at: %s\n", addr)
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if hl.closed {
+					break
+				}
+				continue
+			}
+			go handleHTTP(c, hl.callback)
+		}
+	}()
+
+	return hl, nil
+}
+
+func (l *HTTPListener) Close() {
+	l.closed = true
+	l.Listener.Close()
+}
+
+func (l *HTTPListener) Address() string {
+	return l.address
+}
+
+func handleHTTP(conn net.Conn, cb ProxyCallback) {
+	bio := bufio.NewReader(conn)
+	req, err := http.ReadRequest(bio)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+
+	if req.Method == http.MethodConnect {
+		target := withPort(req.URL.Host, "443")
+		cb(&tunnelConn{bufferedConn{Conn: conn, r: bio}}, target)
+		return
+	}
+
+	if req.URL.Host == "" {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	target := withPort(req.URL.Host, "80")
+	head := rewriteRequest(req)
+	cb(&bufferedConn{Conn: conn, r: bio, head: head}, target)
+}
+
+// tunnelConn is the conn of a CONNECT request, answering it once the
+// tunnel is established.
+type tunnelConn struct {
+	bufferedConn
+}
+
+func (c *tunnelConn) Established(err error) error {
+	if err == nil {
+		_, err = c.Conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		return err
+	}
+
+	status := "502 Bad Gateway"
+	var te interface{ Timeout() bool }
+	if errors.As(err, &te) && te.Timeout() {
+		status = "504 Gateway Timeout"
+	}
+	_, err = fmt.Fprintf(c.Conn, "HTTP/1.1 %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status)
+	return err
+}
+
+// rewriteRequest serializes the head of a proxy request in origin-form,
+// the body is left in the connection buffer and relayed untouched. Only the
+// first request is rewritten, so the origin is asked to close afterwards,
+// see NewHTTPProxy.
+func rewriteRequest(req *http.Request) []byte {
+	for _, h := range []string{"Proxy-Connection", "Proxy-Authorization", "Connection", "Keep-Alive", "Content-Length", "Transfer-Encoding"} {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Connection", "close")
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	} else if req.ContentLength > 0 {
+		req.Header.Set("Content-Length", fmt.Sprint(req.ContentLength))
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s %s HTTP/%d.%d\r\n", req.Method, req.URL.RequestURI(), req.ProtoMajor, req.ProtoMinor)
+	fmt.Fprintf(buf, "Host: %s\r\n", host)
+	req.Header.Write(buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// bufferedConn replays head and whatever the request parser buffered before
+// reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r    *bufio.Reader
+	head []byte
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if len(c.head) > 0 {
+		n := copy(b, c.head)
+		c.head = c.head[n:]
+		return n, nil
+	}
+	if c.r != nil {
+		if c.r.Buffered() > 0 {
+			return c.r.Read(b)
+		}
+		c.r = nil // drained, read the conn directly from now on
+	}
+	return c.Conn.Read(b)
+}
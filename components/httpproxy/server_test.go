@@ -0,0 +1,144 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package httpproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "dial timeout" }
+func (timeoutError) Timeout() bool { return true }
+
+// proxy serves cb and returns a connection to it.
+func proxy(t *testing.T, cb ProxyCallback) net.Conn {
+	t.Helper()
+	hl, err := NewHTTPProxy("127.0.0.1:0", cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(hl.Close)
+	c, err := net.Dial("tcp", hl.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestConnectEstablished(t *testing.T) {
+	targets := make(chan string, 1)
+	c := proxy(t, func(conn net.Conn, target string) {
+		defer conn.Close()
+		targets <- target
+		if err := conn.(Establisher).Established(nil); err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(conn, conn)
+	})
+
+	// data sent right behind the request must not be lost
+	io.WriteString(c, "CONNECT example.com:8443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\nearly")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	if got := <-targets; got != "example.com:8443" {
+		t.Fatalf("target %q", got)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "early" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+}
+
+func TestConnectFailed(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+	}{
+		{errors.New("connection refused"), http.StatusBadGateway},
+		{timeoutError{}, http.StatusGatewayTimeout},
+	} {
+		c := proxy(t, func(conn net.Conn, target string) {
+			conn.(Establisher).Established(tc.err)
+			conn.Close()
+		})
+		io.WriteString(c, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%v: status %d, want %d", tc.err, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestPlainRequestRewritten(t *testing.T) {
+	type forwarded struct {
+		target string
+		head   string
+	}
+	got := make(chan forwarded, 1)
+	c := proxy(t, func(conn net.Conn, target string) {
+		defer conn.Close()
+		if _, ok := conn.(Establisher); ok {
+			t.Error("plain request conn is an Establisher")
+		}
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		got <- forwarded{target, req.Method + " " + req.RequestURI + " " + req.Host + " " + req.Header.Get("Connection") + " " + req.Header.Get("Proxy-Connection") + " " + string(body)}
+	})
+
+	io.WriteString(c, "POST http://example.com/path?q=1 HTTP/1.1\r\nHost: example.com\r\nProxy-Connection: keep-alive\r\nContent-Length: 4\r\n\r\nbody")
+	f := <-got
+	if f.target != "example.com:80" {
+		t.Fatalf("target %q", f.target)
+	}
+	if want := "POST /path?q=1 example.com close  body"; f.head != want {
+		t.Fatalf("origin got %q, want %q", f.head, want)
+	}
+}
+
+func TestPlainRequestWithoutHost(t *testing.T) {
+	c := proxy(t, func(conn net.Conn, target string) {
+		t.Error("tunnel opened for a request without host")
+		conn.Close()
+	})
+	io.WriteString(c, "GET /relative HTTP/1.1\r\nHost: \r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package redir
+
+import (
+	"net"
+)
+
+func listenTCP(addr string, tproxy bool) (net.Listener, error) {
+	return nil, ErrNotSupported
+}
+
+func listenTProxyUDP(addr string) (*net.UDPConn, error) {
+	return nil, ErrNotSupported
+}
+
+func originalDst(c *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrNotSupported
+}
+
+func originalDstUDP(oob []byte) (*net.UDPAddr, error) {
+	return nil, ErrNotSupported
+}
+
+func listenSpoofUDP(from *net.UDPAddr) (net.PacketConn, error) {
+	return nil, ErrNotSupported
+}
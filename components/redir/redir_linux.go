@@ -0,0 +1,175 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package redir
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst       = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	ipv6Transparent     = 75 // IPV6_TRANSPARENT
+	ipv6RecvOrigDstAddr = 74 // IPV6_RECVORIGDSTADDR
+)
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); serr != nil {
+			return
+		}
+		if network == "udp6" || network == "tcp6" {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func listenTCP(addr string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = transparentControl
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func listenTProxyUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := transparentControl(network, address, c); err != nil {
+				return err
+			}
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); serr != nil {
+					return
+				}
+				if network == "udp6" {
+					serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// originalDst reads the pre-NAT destination of a REDIRECT-ed connection.
+func originalDst(c *net.TCPConn) (*net.TCPAddr, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		var raw [syscall.SizeofSockaddrInet6]byte
+		size := uint32(len(raw))
+		level := syscall.SOL_IP
+		if la, ok := c.LocalAddr().(*net.TCPAddr); ok && la.IP.To4() == nil {
+			level = syscall.SOL_IPV6
+		}
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), soOriginalDst,
+			uintptr(unsafe.Pointer(&raw[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			serr = errno
+			return
+		}
+		addr, serr = parseSockaddr(raw[:size])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, serr
+}
+
+func parseSockaddr(raw []byte) (*net.TCPAddr, error) {
+	if len(raw) < 2 {
+		return nil, errors.New("short sockaddr")
+	}
+	family := *(*uint16)(unsafe.Pointer(&raw[0]))
+	switch {
+	case family == syscall.AF_INET && len(raw) >= syscall.SizeofSockaddrInet4:
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, raw[4:8])
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(raw[2:4]))}, nil
+	case family == syscall.AF_INET6 && len(raw) >= syscall.SizeofSockaddrInet6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, raw[8:24])
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(raw[2:4]))}, nil
+	}
+	return nil, errors.New("unknown sockaddr family")
+}
+
+// originalDstUDP extracts the pre-TPROXY destination from the control
+// messages received along with a datagram.
+func originalDstUDP(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		if (msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_RECVORIGDSTADDR) ||
+			(msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr) {
+			addr, err := parseSockaddr(msg.Data)
+			if err != nil {
+				return nil, err
+			}
+			return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+		}
+	}
+	return nil, errors.New("original destination not found")
+}
+
+// listenSpoofUDP opens a transparent socket bound to from, a foreign
+// address, to send replies to TPROXY-ed clients from it.
+func listenSpoofUDP(from *net.UDPAddr) (net.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := transparentControl(network, address, c); err != nil {
+				return err
+			}
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	network := "udp4"
+	if from.IP.To4() == nil {
+		network = "udp6"
+	}
+	return lc.ListenPacket(context.Background(), network, from.String())
+}
@@ -0,0 +1,166 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package redir
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func sockaddr4(ip net.IP, port int) []byte {
+	raw := make([]byte, syscall.SizeofSockaddrInet4)
+	*(*uint16)(unsafe.Pointer(&raw[0])) = syscall.AF_INET
+	binary.BigEndian.PutUint16(raw[2:4], uint16(port))
+	copy(raw[4:8], ip.To4())
+	return raw
+}
+
+func sockaddr6(ip net.IP, port int) []byte {
+	raw := make([]byte, syscall.SizeofSockaddrInet6)
+	*(*uint16)(unsafe.Pointer(&raw[0])) = syscall.AF_INET6
+	binary.BigEndian.PutUint16(raw[2:4], uint16(port))
+	copy(raw[8:24], ip.To16())
+	return raw
+}
+
+func TestParseSockaddr(t *testing.T) {
+	addr, err := parseSockaddr(sockaddr4(net.IPv4(192, 0, 2, 1), 443))
+	if err != nil || addr.String() != "192.0.2.1:443" {
+		t.Fatalf("IPv4: got %v, %v", addr, err)
+	}
+	addr, err = parseSockaddr(sockaddr6(net.ParseIP("2001:db8::1"), 8443))
+	if err != nil || addr.String() != "[2001:db8::1]:8443" {
+		t.Fatalf("IPv6: got %v, %v", addr, err)
+	}
+	if _, err := parseSockaddr(sockaddr4(net.IPv4(192, 0, 2, 1), 443)[:6]); err == nil {
+		t.Fatal("truncated sockaddr accepted")
+	}
+}
+
+func TestOriginalDstUDP(t *testing.T) {
+	data := sockaddr4(net.IPv4(198, 51, 100, 7), 53)
+	oob := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.SOL_IP
+	h.Type = syscall.IP_RECVORIGDSTADDR
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(oob[syscall.CmsgLen(0):], data)
+
+	addr, err := originalDstUDP(oob)
+	if err != nil || addr.String() != "198.51.100.7:53" {
+		t.Fatalf("got %v, %v", addr, err)
+	}
+	if _, err := originalDstUDP(nil); err == nil {
+		t.Fatal("missing original destination not reported")
+	}
+}
+
+func TestRedirectWithoutNAT(t *testing.T) {
+	called := make(chan struct{}, 1)
+	rl, err := NewRedirProxy("127.0.0.1:0", false, func(conn net.Conn, target string) {
+		called <- struct{}{}
+		conn.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	c, err := net.Dial("tcp", rl.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// not redirected, there is no original destination to recover
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection without original destination not closed")
+	}
+	select {
+	case <-called:
+		t.Fatal("callback run without original destination")
+	default:
+	}
+}
+
+func skipWithoutTransparent(t *testing.T, err error) {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, os.ErrPermission) {
+		t.Skip("needs CAP_NET_ADMIN:", err)
+	}
+}
+
+func TestTProxyTarget(t *testing.T) {
+	targets := make(chan string, 1)
+	rl, err := NewRedirProxy("127.0.0.1:0", true, func(conn net.Conn, target string) {
+		targets <- target
+		conn.Close()
+	})
+	skipWithoutTransparent(t, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	c, err := net.Dial("tcp", rl.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// without a TPROXY rule the destination is the listener itself
+	if got := <-targets; got != rl.Listener.Addr().String() {
+		t.Fatalf("target %s, want %s", got, rl.Listener.Addr())
+	}
+}
+
+func TestUDPReplierReusesSockets(t *testing.T) {
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	r := NewUDPReplier(client.LocalAddr().(*net.UDPAddr))
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 5353}
+	buf := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		err := r.WriteBack([]byte("reply"), from)
+		skipWithoutTransparent(t, err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, src, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "reply" || src.String() != from.String() {
+			t.Fatalf("got %q from %s, want it from %s", buf[:n], src, from)
+		}
+	}
+	if n := len(r.conns); n != 1 {
+		t.Fatalf("%d sockets for one source address, want 1", n)
+	}
+
+	r.Close()
+	if err := r.WriteBack([]byte("late"), from); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write back after Close: got %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package redir
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	log "github.com/golang/glog"
+
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+var ErrNotSupported = errors.New("transparent proxy is not supported on this platform")
+
+// RedirCallback tunnels conn to its original destination, it owns conn.
+type RedirCallback func(conn net.Conn, target string)
+
+// RedirUDPCallback handles one intercepted datagram, the payload is only
+// valid during the call. Replies must be sent through a UDPReplier.
+type RedirUDPCallback func(payload []byte, target, src *net.UDPAddr)
+
+type RedirListener struct {
+	net.Listener
+	address  string
+	closed   bool
+	tproxy   bool
+	callback RedirCallback
+}
+
+// NewRedirProxy accepts connections diverted by iptables, either with the
+// REDIRECT target (tproxy false) or the TPROXY target (tproxy true).
+func NewRedirProxy(addr string, tproxy bool, cb RedirCallback) (*RedirListener, error) {
+	l, err := listenTCP(addr, tproxy)
+	if err != nil {
+		return nil, err
+	}
+
+	rl := &RedirListener{l, addr, false, tproxy, cb}
+	go func() {
+		log.Infof("Transparent proxy listening at: %s\n", addr)
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if rl.closed {
+					break
+				}
+				continue
+			}
+			go rl.handleRedir(c)
+		}
+	}()
+
+	return rl, nil
+}
+
+func (l *RedirListener) handleRedir(conn net.Conn) {
+	var target string
+	if l.tproxy {
+		target = conn.LocalAddr().String()
+	} else {
+		tc, ok := conn.(*net.TCPConn)
+		if !ok {
+			conn.Close()
+			return
+		}
+		addr, err := originalDst(tc)
+		if err != nil {
+			log.Warningf("Failed to get original destination of %s: %v\n", conn.RemoteAddr().String(), err)
+			conn.Close()
+			return
+		}
+		target = addr.String()
+	}
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.SetKeepAlive(true)
+	}
+	l.callback(conn, target)
+}
+
+func (l *RedirListener) Close() {
+	l.closed = true
+	l.Listener.Close()
+}
+
+func (l *RedirListener) Address() string {
+	return l.address
+}
+
+type RedirUDPListener struct {
+	*net.UDPConn
+	address  string
+	closed   bool
+	callback RedirUDPCallback
+}
+
+// NewTProxyUDP receives datagrams diverted by the iptables TPROXY target.
+func NewTProxyUDP(addr string, cb RedirUDPCallback) (*RedirUDPListener, error) {
+	uc, err := listenTProxyUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ul := &RedirUDPListener{uc, addr, false, cb}
+	go func() {
+		log.Infof("Transparent UDP proxy listening at: %s\n", addr)
+		buf := p.Get(p.RelayBufferSize)
+		defer p.Put(buf)
+		oob := make([]byte, 64)
+		for {
+			n, oobn, _, src, err := uc.ReadMsgUDP(buf, oob)
+			if err != nil {
+				if ul.closed {
+					break
+				}
+				continue
+			}
+			target, err := originalDstUDP(oob[:oobn])
+			if err != nil {
+				log.V(1).Infof("Transparent UDP drop packet from %s: %v\n", src.String(), err)
+				continue
+			}
+			ul.callback(buf[:n], target, src)
+		}
+	}()
+
+	return ul, nil
+}
+
+func (l *RedirUDPListener) Close() {
+	l.closed = true
+	l.UDPConn.Close()
+}
+
+func (l *RedirUDPListener) Address() string {
+	return l.address
+}
+
+// UDPReplier sends the replies of a TPROXY-ed flow back to its client,
+// each from the address the client sent to. It keeps a transparent socket
+// per such address, to be released with Close once the flow ends.
+type UDPReplier struct {
+	src   *net.UDPAddr
+	mux   sync.Mutex
+	conns map[string]net.PacketConn
+}
+
+// NewUDPReplier returns a replier to the client src.
+func NewUDPReplier(src *net.UDPAddr) *UDPReplier {
+	return &UDPReplier{src: src, conns: map[string]net.PacketConn{}}
+}
+
+// WriteBack sends b to the client with from as its source address.
+func (r *UDPReplier) WriteBack(b []byte, from *net.UDPAddr) error {
+	key := from.String()
+	r.mux.Lock()
+	pc, ok := r.conns[key]
+	if !ok {
+		if r.conns == nil {
+			r.mux.Unlock()
+			return net.ErrClosed
+		}
+		var err error
+		if pc, err = listenSpoofUDP(from); err != nil {
+			r.mux.Unlock()
+			return err
+		}
+		r.conns[key] = pc
+	}
+	r.mux.Unlock()
+
+	_, err := pc.WriteTo(b, r.src)
+	return err
+}
+
+// Close releases the sockets of the replier.
+func (r *UDPReplier) Close() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, pc := range r.conns {
+		pc.Close()
+	}
+	r.conns = nil
+	return nil
+}
@@ -0,0 +1,222 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// AccessLogEntry describes a client connection once it is done.
+type AccessLogEntry struct {
+	Time      time.Time // accepted at
+	Client    string    // remote address
+	User      string    // client id, see WithClientID
+	Command   string    // tcp, udp or ping, of the last request
+	Targets   []string  // in request order, a v2 conn may carry several
+	BytesUp   uint64    // payload, client to target
+	BytesDown uint64
+	Duration  time.Duration
+	Cipher    string // method the client authenticated with
+	KeyID     string // fingerprint of its PSK, see aead.Fingerprint
+	Features  aead.Features
+	Reason    string // why it ended
+	Err       error  // what failed, if anything
+}
+
+// AccessLogger receives an entry per client connection when it ends,
+// whatever the way. It is called from the goroutine serving the
+// connection, so it must not block for long.
+type AccessLogger interface {
+	LogAccess(e *AccessLogEntry)
+}
+
+// WithAccessLogger hands an entry for every client connection to l when
+// it ends.
+func WithAccessLogger(l AccessLogger) ServerOption {
+	return func(s *SnellServer) {
+		s.accessLog = l
+	}
+}
+
+type jsonAccessLogger struct {
+	mux sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONAccessLogger returns an AccessLogger writing an entry per line to
+// w as a JSON object, for log pipelines.
+func NewJSONAccessLogger(w io.Writer) AccessLogger {
+	return &jsonAccessLogger{enc: json.NewEncoder(w)}
+}
+
+type jsonAccessEntry struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	User       string    `json:"user,omitempty"`
+	Command    string    `json:"command,omitempty"`
+	Targets    []string  `json:"targets,omitempty"`
+	BytesUp    uint64    `json:"bytes_up"`
+	BytesDown  uint64    `json:"bytes_down"`
+	DurationMS float64   `json:"duration_ms"`
+	Cipher     string    `json:"cipher,omitempty"`
+	KeyID      string    `json:"key_id,omitempty"`
+	Features   string    `json:"features"`
+	Reason     string    `json:"reason"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (l *jsonAccessLogger) LogAccess(e *AccessLogEntry) {
+	je := jsonAccessEntry{
+		Time:       e.Time,
+		Client:     e.Client,
+		User:       e.User,
+		Command:    e.Command,
+		Targets:    e.Targets,
+		BytesUp:    e.BytesUp,
+		BytesDown:  e.BytesDown,
+		DurationMS: float64(e.Duration) / float64(time.Millisecond),
+		Cipher:     e.Cipher,
+		KeyID:      e.KeyID,
+		Features:   e.Features.String(),
+		Reason:     e.Reason,
+	}
+	if e.Err != nil {
+		je.Error = e.Err.Error()
+	}
+	l.mux.Lock()
+	l.enc.Encode(&je)
+	l.mux.Unlock()
+}
+
+// connAccess collects the access log entry of a conn, it is also what the
+// connection registry holds. A nil *connAccess collects nothing, so the
+// server calls it unconditionally.
+type connAccess struct {
+	mux   sync.Mutex // guards entry against registry snapshots
+	entry AccessLogEntry
+	cs    *cipherSnapshot
+	up    uint64
+	down  uint64
+	id    uint64
+	conn  net.Conn
+}
+
+func (s *SnellServer) newAccess(c net.Conn, cs *cipherSnapshot) *connAccess {
+	if s.accessLog == nil && s.registry == nil {
+		return nil
+	}
+	a := &connAccess{
+		entry: AccessLogEntry{
+			Time:   time.Now(),
+			Client: c.RemoteAddr().String(),
+			Reason: "closed",
+		},
+		cs:   cs,
+		conn: c,
+	}
+	if s.registry != nil {
+		s.registry.add(a)
+	}
+	return a
+}
+
+func (a *connAccess) request(command, target string) {
+	if a == nil {
+		return
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.entry.Command = command
+	if target != "" {
+		a.entry.Targets = append(a.entry.Targets, target)
+	}
+}
+
+// end records why the conn ended, the last call wins.
+func (a *connAccess) end(reason string, err error) {
+	if a == nil {
+		return
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.entry.Reason = reason
+	a.entry.Err = err
+}
+
+func (a *connAccess) add(up, down int) {
+	if a == nil {
+		return
+	}
+	atomic.AddUint64(&a.up, uint64(up))
+	atomic.AddUint64(&a.down, uint64(down))
+}
+
+// countConn counts the target side traffic of a tunnel in too.
+func (a *connAccess) countConn(c net.Conn) net.Conn {
+	if a == nil {
+		return c
+	}
+	return &countingConn{c, &a.down, &a.up}
+}
+
+// finish completes the entry and logs it, it runs once as handleSnell
+// returns.
+func (s *SnellServer) finishAccess(a *connAccess, conn net.Conn) {
+	if a == nil {
+		return
+	}
+	if s.registry != nil {
+		s.registry.remove(a.id)
+	}
+	if s.accessLog == nil {
+		return
+	}
+	e := &a.entry
+	e.Duration = time.Since(e.Time)
+	e.BytesUp = atomic.LoadUint64(&a.up)
+	e.BytesDown = atomic.LoadUint64(&a.down)
+	e.User, e.Cipher, e.KeyID = a.identity(conn)
+	if fc, ok := conn.(interface{ Features() aead.Features }); ok {
+		e.Features = fc.Features()
+	}
+	s.accessLog.LogAccess(e)
+}
+
+// identity returns the client id, and the cipher method conn
+// authenticated with along with the fingerprint of its key, as far as
+// known yet.
+func (a *connAccess) identity(conn net.Conn) (user, cipher, keyID string) {
+	tags := connTags(conn)
+	if tags == nil {
+		return "", "", ""
+	}
+	user, _ = tags.Get("client")
+	if idx, ok := tags.Get("cipher"); ok {
+		if i, _ := strconv.Atoi(idx); i == 1 {
+			cipher, keyID = a.cs.config.FallbackMethod, aead.Fingerprint(a.cs.fallback)
+		} else {
+			cipher, keyID = a.cs.config.Method, aead.Fingerprint(a.cs.primary)
+		}
+	}
+	return user, cipher, keyID
+}
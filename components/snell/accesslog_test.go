@@ -0,0 +1,78 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// accessRecorder keeps the entries logged.
+type accessRecorder struct {
+	mux     sync.Mutex
+	entries []AccessLogEntry
+}
+
+func (r *accessRecorder) LogAccess(e *AccessLogEntry) {
+	r.mux.Lock()
+	r.entries = append(r.entries, *e)
+	r.mux.Unlock()
+}
+
+func (r *accessRecorder) logged() []AccessLogEntry {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return append([]AccessLogEntry(nil), r.entries...)
+}
+
+func TestAccessLogOncePerConn(t *testing.T) {
+	rec := &accessRecorder{}
+	_, server := startServer(t, WithAccessLogger(rec))
+
+	if _, err := Probe(context.Background(), nil, server, aead.NewAES128GCM([]byte(testPSK))); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "ping not logged", func() bool { return len(rec.logged()) == 1 })
+	if e := rec.logged()[0]; e.Command != "ping" || len(e.Targets) != 0 {
+		t.Fatalf("ping logged as %q to %v", e.Command, e.Targets)
+	}
+	if e, want := rec.logged()[0], aead.Fingerprint(aead.NewAES128GCM([]byte(testPSK))); e.KeyID != want {
+		t.Fatalf("ping logged with key %q, want %q", e.KeyID, want)
+	}
+
+	// closed once below, ending its pooled session
+	sc, err := NewSnellClient("127.0.0.1:0", server, "", "", testPSK, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := tcpEcho(t)
+	c := dialSocks(t, sc, echo)
+	if !echoes(c, []byte("logged")) {
+		t.Fatal("tunnel not echoed")
+	}
+	c.Close()
+	sc.Close()
+	eventually(t, "tunnel not logged", func() bool { return len(rec.logged()) == 2 })
+	e := rec.logged()[1]
+	if e.Command != "tcp" || len(e.Targets) != 1 || e.Targets[0] != echo {
+		t.Fatalf("tunnel logged as %q to %v", e.Command, e.Targets)
+	}
+	if e.BytesUp != 6 || e.BytesDown != 6 {
+		t.Fatalf("tunnel logged %d bytes up and %d down, want 6 each", e.BytesUp, e.BytesDown)
+	}
+}
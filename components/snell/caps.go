@@ -0,0 +1,113 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// Capabilities let two open-snell peers agree on extensions. The client
+// proposes them right after the header of the first request of a session,
+// in the same record, and the server confirms the agreed set right after
+// ResponseTunnel:
+//
+//	magic (8) | length (2, BE) | TLV...
+//	TLV: type (1) | length (1) | value
+//
+// TLVs of unknown types are skipped. capFeatures carries an aead.Features
+// bitfield (4, BE), the agreed set is the intersection, see
+// aead.Negotiate. Stock Snell servers would forward the block to the
+// target as data, clients must only propose to known open-snell servers.
+const (
+	capsMagic   = "\x00OSCAPS\x00"
+	capsHdrSize = len(capsMagic) + 2
+	capsMaxSize = 1024
+
+	capFeatures byte = 1
+)
+
+var ErrMalformedCapabilities = errors.New("malformed capabilities block")
+
+// encodeCapabilities appends the capabilities block offering f to buf.
+func encodeCapabilities(buf *bytes.Buffer, f aead.Features) {
+	buf.WriteString(capsMagic)
+	binary.Write(buf, binary.BigEndian, uint16(2+4))
+	buf.WriteByte(capFeatures)
+	buf.WriteByte(4)
+	binary.Write(buf, binary.BigEndian, uint32(f))
+}
+
+// parseCapabilities returns the features offered by a TLV list, unknown
+// TLVs and feature bits left for the caller to ignore.
+func parseCapabilities(b []byte) (f aead.Features, err error) {
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return 0, ErrMalformedCapabilities
+		}
+		typ, val := b[0], b[2:2+int(b[1])]
+		b = b[2+len(val):]
+		if typ == capFeatures {
+			if len(val) != 4 {
+				return 0, ErrMalformedCapabilities
+			}
+			f = aead.Features(binary.BigEndian.Uint32(val))
+		}
+	}
+	return f, nil
+}
+
+// readCapabilities reads a whole capabilities block from r.
+func readCapabilities(r io.Reader) (aead.Features, error) {
+	hdr := make([]byte, capsHdrSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, err
+	}
+	if string(hdr[:len(capsMagic)]) != capsMagic {
+		return 0, ErrMalformedCapabilities
+	}
+	size := int(binary.BigEndian.Uint16(hdr[len(capsMagic):]))
+	if size > capsMaxSize {
+		return 0, fmt.Errorf("%w: %d bytes", ErrMalformedCapabilities, size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	return parseCapabilities(body)
+}
+
+// hasCapabilities reports whether what follows the header on c, within the
+// same record, is a capabilities block.
+func hasCapabilities(c net.Conn) bool {
+	pc, ok := c.(interface{ Peek(n int) []byte })
+	if !ok {
+		return false
+	}
+	return string(pc.Peek(len(capsMagic))) == capsMagic
+}
+
+// setNegotiated records the agreed features on the stream under c.
+func setNegotiated(c net.Conn, f aead.Features) {
+	if nc, ok := c.(interface{ SetNegotiated(aead.Features) }); ok {
+		nc.SetNegotiated(f)
+	}
+}
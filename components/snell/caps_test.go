@@ -0,0 +1,92 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+func TestCapabilitiesRoundTrip(t *testing.T) {
+	for _, f := range []aead.Features{0, aead.FeatureKeepalive, aead.KnownFeatures, 1 << 31} {
+		var buf bytes.Buffer
+		encodeCapabilities(&buf, f)
+		got, err := readCapabilities(&buf)
+		if err != nil || got != f {
+			t.Fatalf("%v: read back %v, %v", f, got, err)
+		}
+	}
+}
+
+func TestCapabilitiesUnknownTLVSkipped(t *testing.T) {
+	body := []byte{
+		42, 3, 'x', 'y', 'z', // a TLV from a later version
+		capFeatures, 4, 0, 0, 0, byte(aead.FeaturePadding),
+		0xff, 0,
+	}
+	if f, err := parseCapabilities(body); err != nil || f != aead.FeaturePadding {
+		t.Fatalf("got %v, %v", f, err)
+	}
+	for _, bad := range [][]byte{{capFeatures}, {capFeatures, 4, 0}, {capFeatures, 2, 0, 0}} {
+		if _, err := parseCapabilities(bad); !errors.Is(err, ErrMalformedCapabilities) {
+			t.Fatalf("%x: got %v, want ErrMalformedCapabilities", bad, err)
+		}
+	}
+}
+
+// negotiated returns the features agreed on a session opened by sc.
+func negotiated(t *testing.T, sc *SnellClient, target string) aead.Features {
+	t.Helper()
+	c, err := sc.GetSession(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.DropSession(c)
+	pc := c.(*snellPoolConn)
+	if err := pc.WaitConnected(); err != nil {
+		t.Fatal(err)
+	}
+	return pc.Conn.(*clientSession).Features()
+}
+
+func TestFeatureNegotiation(t *testing.T) {
+	echo := tcpEcho(t)
+	_, server := startServer(t, WithAcceptCapabilities(aead.FeatureKeepalive|aead.FeaturePadding))
+
+	for _, tc := range []struct {
+		name    string
+		propose aead.Features
+		want    aead.Features
+	}{
+		{"agreed", aead.FeatureKeepalive | aead.FeaturePadding, aead.FeatureKeepalive | aead.FeaturePadding},
+		{"intersection", aead.FeatureKeepalive | aead.FeatureConnID, aead.FeatureKeepalive},
+		{"disjoint", aead.FeatureSequenced, 0},
+		// bits of a later version are dropped, not fatal
+		{"unknown bits", aead.FeaturePadding | 1<<30, aead.FeaturePadding},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sc := startClient(t, server, WithCapabilities(tc.propose))
+			if got := negotiated(t, sc, echo); got != tc.want {
+				t.Fatalf("negotiated %v, want %v", got, tc.want)
+			}
+			if !echoes(dialSocks(t, sc, echo), []byte("still tunnels")) {
+				t.Fatal("tunnel broken after negotiation")
+			}
+		})
+	}
+}
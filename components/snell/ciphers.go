@@ -0,0 +1,129 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// CipherConfig selects the ciphers new connections are accepted with: the
+// primary one, and the fallback tried when the first record of a client
+// does not open with it. An empty FallbackMethod disables the fallback.
+type CipherConfig struct {
+	Method         string
+	PSK            []byte
+	FallbackMethod string
+	FallbackPSK    []byte
+}
+
+// defaultCipherConfig is what stock Snell servers accept: v2 clients with
+// AES-128-GCM, v1 clients with ChaCha20-Poly1305.
+func defaultCipherConfig(psk []byte) CipherConfig {
+	return CipherConfig{
+		Method:         "aes-128-gcm",
+		PSK:            psk,
+		FallbackMethod: "chacha20-poly1305",
+		FallbackPSK:    psk,
+	}
+}
+
+// WithCipherMethod makes the client seal its sessions with method, one of
+// aead.SupportedMethods, rather than the cipher of its protocol version.
+// Methods beyond aes-128-gcm and chacha20-poly1305 are open-snell
+// extensions, only servers accepting them (WithAcceptCipherMethod) can be
+// reached with them.
+func WithCipherMethod(method string) ClientOption {
+	return func(s *SnellClient) {
+		s.method = method
+	}
+}
+
+// WithAcceptCipherMethod makes the server accept method as its primary
+// cipher, AES-128-GCM of stock v2 clients staying accepted as the fallback.
+// Which of the two a client uses is told by its first record, so stock
+// clients and clients of method share the server. v1 clients are no longer
+// accepted unless method is chacha20-poly1305.
+func WithAcceptCipherMethod(method string) ServerOption {
+	return func(s *SnellServer) {
+		s.method = method
+	}
+}
+
+// initialCipherConfig is the configuration the server starts with.
+func (s *SnellServer) initialCipherConfig() CipherConfig {
+	cfg := defaultCipherConfig(s.psk)
+	if s.method != "" && s.method != cfg.Method {
+		cfg.Method = s.method
+		cfg.FallbackMethod = "aes-128-gcm"
+	}
+	return cfg
+}
+
+// cipherSnapshot is a CipherConfig with its ciphers built, swapped as a
+// whole so that a connection never mixes two configurations.
+type cipherSnapshot struct {
+	config   CipherConfig
+	primary  aead.Cipher
+	fallback aead.Cipher
+}
+
+func newCipherSnapshot(cfg CipherConfig) (*cipherSnapshot, error) {
+	cs := &cipherSnapshot{config: cfg}
+	var err error
+	if cs.primary, err = aead.NewCipher(cfg.Method, cfg.PSK); err != nil {
+		return nil, err
+	}
+	if cfg.FallbackMethod != "" {
+		if cs.fallback, err = aead.NewCipher(cfg.FallbackMethod, cfg.FallbackPSK); err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+func (s *SnellServer) currentCiphers() *cipherSnapshot {
+	return s.ciphers.Load().(*cipherSnapshot)
+}
+
+// SetCipherConfig makes connections accepted from now on use cfg, live
+// ones keep the ciphers they started with. The fingerprints of the keys
+// are logged, see aead.Fingerprint. An unknown method is refused
+// with aead.ErrUnknownMethod and leaves the configuration alone.
+func (s *SnellServer) SetCipherConfig(cfg CipherConfig) error {
+	cs, err := newCipherSnapshot(cfg)
+	if err != nil {
+		return err
+	}
+	if s.warmup {
+		aead.Warmup(cs.primary)
+		if cs.fallback != nil {
+			aead.Warmup(cs.fallback)
+		}
+	}
+	s.ciphers.Store(cs)
+	log.Infof("Accepting %s with key %s\n", cfg.Method, aead.Fingerprint(cs.primary))
+	if cs.fallback != nil {
+		log.Infof("Accepting %s with key %s as fallback\n", cfg.FallbackMethod, aead.Fingerprint(cs.fallback))
+	}
+	return nil
+}
+
+// CipherConfig returns the configuration new connections are accepted
+// with.
+func (s *SnellServer) CipherConfig() CipherConfig {
+	return s.currentCiphers().config
+}
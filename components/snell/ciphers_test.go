@@ -0,0 +1,55 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+func TestXChaChaSelectedByFirstRecord(t *testing.T) {
+	_, server := startServer(t, WithAcceptCipherMethod("xchacha20-poly1305"))
+	echo := tcpEcho(t)
+
+	xc := startClient(t, server, WithCipherMethod("xchacha20-poly1305"))
+	if !echoes(dialSocks(t, xc, echo), []byte("over xchacha20")) {
+		t.Fatal("xchacha20-poly1305 client not served")
+	}
+
+	// stock v2 clients share the server through the fallback
+	stock := startClient(t, server)
+	if !echoes(dialSocks(t, stock, echo), []byte("over aes-128-gcm")) {
+		t.Fatal("stock client not served")
+	}
+}
+
+func TestXChaChaRefusedByStockServer(t *testing.T) {
+	_, server := startServer(t)
+	xc := startClient(t, server, WithCipherMethod("xchacha20-poly1305"))
+	if echoes(dialSocks(t, xc, tcpEcho(t)), []byte("hello")) {
+		t.Fatal("stock server accepted xchacha20-poly1305")
+	}
+}
+
+func TestUnknownCipherMethod(t *testing.T) {
+	if _, err := NewSnellClient("127.0.0.1:0", "127.0.0.1:1", "", "", testPSK, true, WithCipherMethod("rot13")); !errors.Is(err, aead.ErrUnknownMethod) {
+		t.Fatalf("client: got %v, want ErrUnknownMethod", err)
+	}
+	if _, err := NewSnellServer("127.0.0.1:0", testPSK, "", WithAcceptCipherMethod("rot13")); !errors.Is(err, aead.ErrUnknownMethod) {
+		t.Fatalf("server: got %v, want ErrUnknownMethod", err)
+	}
+}
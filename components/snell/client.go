@@ -28,6 +28,8 @@ import (
 	log "github.com/golang/glog"
 
 	"github.com/icpz/open-snell/components/aead"
+	"github.com/icpz/open-snell/components/httpproxy"
+	"github.com/icpz/open-snell/components/redir"
 	obfs "github.com/icpz/open-snell/components/simple-obfs"
 	"github.com/icpz/open-snell/components/socks5"
 	"github.com/icpz/open-snell/components/utils"
@@ -37,56 +39,404 @@ import (
 const (
 	MaxPoolCap    = 10
 	PoolTimeoutMS = 150000
+
+	// DefaultPoolPing bounds the ping checking an idle session before reuse.
+	DefaultPoolPing = 2 * time.Second
+
+	// HeaderCoalesceDelay is how long a read waits for the first write
+	// before sending the request header on its own, so that protocols where
+	// the server speaks first still work.
+	HeaderCoalesceDelay = 10 * time.Millisecond
 )
 
+type ClientOption func(*SnellClient)
+
+// WithPoolSize sets the maximum number of idle sessions kept for reuse and
+// the maximum number of sessions alive at once (0 for no limit).
+func WithPoolSize(maxIdle, maxTotal int) ClientOption {
+	return func(s *SnellClient) {
+		s.poolIdle = maxIdle
+		s.poolTotal = maxTotal
+	}
+}
+
+// WithHTTPProxy additionally serves an HTTP proxy (CONNECT and plain
+// requests) at listen.
+func WithHTTPProxy(listen string) ClientOption {
+	return func(s *SnellClient) {
+		s.httpListen = listen
+	}
+}
+
+// WithRedirProxy additionally serves a transparent proxy at listen for
+// traffic diverted by iptables REDIRECT, or TPROXY if tproxy is set in which
+// case UDP is relayed as well. Linux only.
+func WithRedirProxy(listen string, tproxy bool) ClientOption {
+	return func(s *SnellClient) {
+		s.redirListen = listen
+		s.redirTProxy = tproxy
+	}
+}
+
+// WithPoolTimeout sets how long an idle session may stay in the pool.
+func WithPoolTimeout(idle time.Duration) ClientOption {
+	return func(s *SnellClient) {
+		s.poolTimeout = idle
+	}
+}
+
+// WithPoolPing sets how long the ping checking an idle session before reuse
+// may take, DefaultPoolPing by default, 0 leaves only the passive check.
+// Servers closing the session after any ping, as older ones do, fail every
+// check so that no session is reused: disable the ping for them.
+func WithPoolPing(timeout time.Duration) ClientOption {
+	return func(s *SnellClient) {
+		s.poolPing = timeout
+	}
+}
+
+// WithSessionLimits retires pooled sessions older than maxAge or handed out
+// more than maxReuse times, zero disables the respective limit.
+func WithSessionLimits(maxAge time.Duration, maxReuse int) ClientOption {
+	return func(s *SnellClient) {
+		s.sessionAge = maxAge
+		s.sessionReuse = maxReuse
+	}
+}
+
+// WithKeepAlive sets the TCP keepalive of the sessions to the server,
+// DefaultKeepAlive by default.
+func WithKeepAlive(ka KeepAlive) ClientOption {
+	return func(s *SnellClient) {
+		s.keepAlive = ka
+	}
+}
+
+// WithConnIDBinding binds every record to a per-connection id so records
+// cannot be spliced across connections. The server must enable it as well,
+// stock Snell servers refuse such sessions.
+func WithConnIDBinding() ClientOption {
+	return func(s *SnellClient) {
+		s.bindConnID = true
+	}
+}
+
+// WithCapabilities proposes the extensions in f on every new session, the
+// server confirming those it agrees to. Only for open-snell servers
+// enabling WithAcceptCapabilities: a stock server would forward the
+// proposal to the target as data.
+func WithCapabilities(f aead.Features) ClientOption {
+	return func(s *SnellClient) {
+		s.caps = f
+	}
+}
+
+// WithSocketBuffers sets the socket receive and send buffer sizes of the
+// connections to the server, for long fat networks. 0 keeps the system
+// default.
+func WithSocketBuffers(rsize, wsize int) ClientOption {
+	return func(s *SnellClient) {
+		s.rcvBuf = rsize
+		s.sndBuf = wsize
+	}
+}
+
+// WithEagerHeader sends the request header as soon as a session is set
+// up rather than with the first write, sparing protocols where the server
+// speaks first, e.g. SMTP or FTP, the HeaderCoalesceDelay wait. It costs a
+// record of its own for the header.
+func WithEagerHeader() ClientOption {
+	return func(s *SnellClient) {
+		s.eagerHeader = true
+	}
+}
+
+// WithCoverTraffic sends decoy records on idle connections to the server,
+// see aead.WithCoverTraffic. The server has to agree on aead.FeaturePadding,
+// or aead.FeatureKeepalive, proposed through WithCapabilities.
+func WithCoverTraffic(ct aead.CoverTraffic) ClientOption {
+	return func(s *SnellClient) {
+		s.cover = &ct
+	}
+}
+
+// WithMaxConnLifetime ends every connection to the server d after its
+// handshake, however busy, see aead.WithMaxLifetime. Pooled sessions are
+// retired before, WithSessionLimits defaulting to 90% of d.
+func WithMaxConnLifetime(d time.Duration) ClientOption {
+	return func(s *SnellClient) {
+		s.lifetime = d
+	}
+}
+
+// WithReadBatch makes connections to the server hand up to records
+// decrypted records at once to the client side, see
+// aead.WithWriteToBatchSize. It costs records*aead.MaxPayloadSize bytes
+// per busy connection, 0 keeps one record. Data is held back until the
+// batch fills or the stream ends, which stalls request-response traffic:
+// only for deployments carrying bulk transfers.
+func WithReadBatch(records int) ClientOption {
+	return func(s *SnellClient) {
+		s.readBatch = records
+	}
+}
+
+// MaxClientIDSize is the longest client id the header can carry.
+const MaxClientIDSize = 255
+
+var ErrClientIDTooLong = errors.New("snell client id too long")
+
+// WithClientID sends id in the client id field of every request header, for
+// the server to route on, see ClientIDFromContext. It must not exceed
+// MaxClientIDSize bytes.
+func WithClientID(id []byte) ClientOption {
+	return func(s *SnellClient) {
+		s.clientID = id
+	}
+}
+
 var (
 	bufferPool = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
 )
 
 type clientSession struct {
 	net.Conn
+	raw    net.Conn
 	buffer [1]byte
-	reply  bool
+
+	rmux     sync.Mutex
+	reply    bool
+	replyErr error
+
+	proposed  bool // capabilities sent
+	awaitCaps bool // their confirmation is still to be read
+
+	hmux    sync.Mutex
+	header  []byte
+	flushed chan struct{}
+}
+
+// aliveProbe bounds the wait of alive. A deadline already past would fail
+// the read before it looks at the socket.
+const aliveProbe = time.Millisecond
+
+// alive probes the raw transport of an idle session without consuming
+// tunnel data: a healthy one has nothing to read and times out, one the
+// server closed reads EOF or a reset.
+func (s *clientSession) alive() bool {
+	var b [1]byte
+	s.raw.SetReadDeadline(time.Now().Add(aliveProbe))
+	n, err := s.raw.Read(b[:])
+	s.raw.SetReadDeadline(time.Time{})
+	if n > 0 { // unsolicited data, the session is out of sync
+		return false
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// ping checks an idle session end to end with a ping request, ended by a
+// ZERO_CHUNK exchange like any request of a v2 session so that it can be
+// reused afterwards.
+func (s *clientSession) ping(timeout time.Duration) bool {
+	s.Conn.SetDeadline(time.Now().Add(timeout))
+	defer s.Conn.SetDeadline(time.Time{})
+
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{Version, CommandPing, 0})
+	buf.WriteByte(byte(len(probeTarget)))
+	buf.WriteString(probeTarget)
+	buf.Write([]byte{0, 80})
+	if _, err := s.Conn.Write(buf.Bytes()); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(s.Conn, s.buffer[:]); err != nil || s.buffer[0] != ResponsePong {
+		return false
+	}
+	if _, err := s.Conn.Read(s.buffer[:]); !errors.Is(err, aead.ErrZeroChunk) {
+		return false
+	}
+	_, err := s.Conn.Write([]byte{}) // write zero chunk back
+	return err == nil
+}
+
+// setHeader defers the request header so that it is sealed in the same
+// record as the first payload.
+func (s *clientSession) setHeader(header []byte) {
+	s.hmux.Lock()
+	s.header = header
+	s.flushed = make(chan struct{})
+	s.hmux.Unlock()
+}
+
+func (s *clientSession) Write(b []byte) (int, error) {
+	s.hmux.Lock()
+	if s.header == nil {
+		s.hmux.Unlock()
+		return s.Conn.Write(b)
+	}
+	defer s.hmux.Unlock()
+
+	header := s.header
+	s.header = nil
+	close(s.flushed)
+
+	if len(b) == 0 { // zero chunk must stay a record of its own
+		if _, err := s.Conn.Write(header); err != nil {
+			return 0, err
+		}
+		return s.Conn.Write(b)
+	}
+
+	n := aead.MaxPayloadSize - len(header)
+	if n > len(b) {
+		n = len(b)
+	}
+	if _, err := s.Conn.Write(append(header, b[:n]...)); err != nil {
+		return 0, err
+	}
+	if n == len(b) {
+		return n, nil
+	}
+	m, err := s.Conn.Write(b[n:])
+	return n + m, err
+}
+
+// sendHeader sends the deferred header alone right away.
+func (s *clientSession) sendHeader() error {
+	s.hmux.Lock()
+	defer s.hmux.Unlock()
+	if s.header == nil {
+		return nil
+	}
+	header := s.header
+	s.header = nil
+	close(s.flushed)
+	_, err := s.Conn.Write(header)
+	return err
+}
+
+// flushHeader waits briefly for the first write to carry the header, then
+// sends it alone.
+func (s *clientSession) flushHeader() error {
+	s.hmux.Lock()
+	flushed := s.flushed
+	pending := s.header != nil
+	s.hmux.Unlock()
+	if !pending {
+		return nil
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-time.After(HeaderCoalesceDelay):
+	}
+	return s.sendHeader()
 }
 
 func (s *clientSession) Read(b []byte) (int, error) {
+	if err := s.awaitReply(false); err != nil {
+		return 0, err
+	}
+	return s.Conn.Read(b)
+}
+
+// WaitConnected sends the request header right away if it was deferred and
+// blocks until the server confirmed the tunnel, which it does as soon as
+// it dialed the target, before any data. A failed dial is returned as an
+// *AppError. Stock Snell servers confirm the same way.
+func (s *clientSession) WaitConnected() error {
+	return s.awaitReply(true)
+}
+
+// awaitReply reads the reply once, the first caller reading it while the
+// others wait. flush sends a deferred header without waiting for data to
+// carry it.
+func (s *clientSession) awaitReply(flush bool) error {
+	s.rmux.Lock()
+	defer s.rmux.Unlock()
 	if s.reply {
-		return s.Conn.Read(b)
+		return s.replyErr
+	}
+	if flush {
+		if err := s.sendHeader(); err != nil {
+			return err
+		}
+	}
+	s.replyErr = s.readReply()
+	return s.replyErr
+}
+
+// readReply consumes the response to the request, an error response being
+// returned as an *AppError.
+func (s *clientSession) readReply() error {
+	if err := s.flushHeader(); err != nil {
+		return err
 	}
 
 	s.reply = true
 	if _, err := io.ReadFull(s.Conn, s.buffer[:]); err != nil {
-		return 0, err
+		return err
 	}
 
 	if s.buffer[0] == ResponseTunnel {
-		return s.Conn.Read(b)
+		if s.awaitCaps {
+			s.awaitCaps = false
+			f, err := readCapabilities(s.Conn)
+			if err != nil {
+				return err
+			}
+			setNegotiated(s.Conn, f)
+		}
+		return nil
 	} else if s.buffer[0] != ResponseError {
-		return 0, errors.New("Command not support")
+		return errors.New("Command not support")
 	}
 
-	// ResponseError
+	// ResponseError, nothing confirmed
+	s.awaitCaps = false
 	if _, err := io.ReadFull(s.Conn, s.buffer[:]); err != nil {
-		return 0, err
+		return err
 	}
+	code := s.buffer[0]
 	if _, err := io.ReadFull(s.Conn, s.buffer[:]); err != nil {
-		return 0, err
+		return err
 	}
 
 	length := int(s.buffer[0])
 	msg := make([]byte, length)
 
 	if _, err := io.ReadFull(s.Conn, msg); err != nil {
-		return 0, err
+		return err
 	}
 
-	return 0, NewAppError(0, string(msg))
+	return NewAppError(code, string(msg))
+}
+
+// Features reports the extensions active on the session, see
+// aead.Features.
+func (s *clientSession) Features() aead.Features {
+	if fc, ok := s.Conn.(interface{ Features() aead.Features }); ok {
+		return fc.Features()
+	}
+	return 0
 }
 
 func WriteHeader(conn net.Conn, host string, port uint, v2 bool) error {
 	buf := bufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufferPool.Put(buf)
+	encodeHeader(buf, nil, host, port, v2)
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func encodeHeader(buf *bytes.Buffer, clientID []byte, host string, port uint, v2 bool) {
 	buf.WriteByte(Version)
 	if v2 {
 		buf.WriteByte(CommandConnectV2)
@@ -95,18 +445,13 @@ func WriteHeader(conn net.Conn, host string, port uint, v2 bool) error {
 	}
 
 	// clientID length & id
-	buf.WriteByte(0)
+	buf.WriteByte(uint8(len(clientID)))
+	buf.Write(clientID)
 
 	// host & port
 	buf.WriteByte(uint8(len(host)))
 	buf.WriteString(host)
 	binary.Write(buf, binary.BigEndian, uint16(port))
-
-	if _, err := conn.Write(buf.Bytes()); err != nil {
-		return err
-	}
-
-	return nil
 }
 
 type SnellClient struct {
@@ -114,33 +459,96 @@ type SnellClient struct {
 	obfs     string
 	obfsHost string
 	cipher   aead.Cipher
+	method   string
 	socks5   *socks5.SockListener
+	udp      *socks5.SockUDPListener
+	http     *httpproxy.HTTPListener
+	redir    *redir.RedirListener
+	redirUDP *redir.RedirUDPListener
+	nat      udpNAT
 	isV2     bool
 	pool     *snellPool
+
+	httpListen   string
+	redirListen  string
+	redirTProxy  bool
+	poolIdle     int
+	poolTotal    int
+	poolTimeout  time.Duration
+	poolPing     time.Duration
+	sessionAge   time.Duration
+	sessionReuse int
+	bindConnID   bool
+	keepAlive    KeepAlive
+	caps         aead.Features
+	clientID     []byte
+	rcvBuf       int
+	sndBuf       int
+	eagerHeader  bool
+	lifetime     time.Duration
+	cover        *aead.CoverTraffic
+	readBatch    int
+	retry        DialRetry
 }
 
 func (s *SnellClient) StreamConn(c net.Conn, target string) (net.Conn, error) {
 	host, port, _ := net.SplitHostPort(target)
 	iport, _ := strconv.Atoi(port)
+	if pc, ok := c.(*snellPoolConn); ok {
+		if cs, ok := pc.Conn.(*clientSession); ok {
+			buf := &bytes.Buffer{}
+			encodeHeader(buf, s.clientID, host, uint(iport), s.isV2)
+			if s.caps != 0 && !cs.proposed {
+				encodeCapabilities(buf, s.caps)
+				cs.proposed = true
+				cs.awaitCaps = true
+			}
+			cs.setHeader(buf.Bytes())
+			if s.eagerHeader {
+				return c, cs.sendHeader()
+			}
+			return c, nil
+		}
+	}
 	err := WriteHeader(c, host, uint(iport), s.isV2)
 	return c, err
 }
 
 func (s *SnellClient) newSession() (net.Conn, error) {
-	c, err := net.Dial("tcp", s.server)
+	c, err := s.dialServer()
 	if err != nil {
 		return nil, err
 	}
 
-	if tc, ok := c.(*net.TCPConn); ok {
-		tc.SetKeepAlive(true)
+	if err := setKeepAlive(c, s.keepAlive); err != nil {
+		log.Warningf("Failed to set keepalive: %v\n", err)
+	}
+	if s.rcvBuf > 0 || s.sndBuf > 0 {
+		if err := setSocketBuffers(c, s.rcvBuf, s.sndBuf); err != nil {
+			log.Warningf("Failed to set socket buffers: %v\n", err)
+		}
 	}
 
+	raw := c
 	_, port, _ := net.SplitHostPort(s.server)
 	c, _ = obfs.NewObfsClient(c, s.obfsHost, port, s.obfs)
 
+	copts := []aead.ConnOption{aead.WithRole(aead.RoleClient)}
+	if s.bindConnID {
+		copts = append(copts, aead.WithConnID())
+	}
+	if s.lifetime > 0 {
+		copts = append(copts, aead.WithMaxLifetime(s.lifetime))
+	}
+	if s.readBatch > 1 {
+		copts = append(copts, aead.WithWriteToBatchSize(s.readBatch))
+	}
+	if s.cover != nil {
+		copts = append(copts, aead.WithCoverTraffic(*s.cover))
+	}
 	c = &clientSession{
-		Conn: aead.NewConn(c, s.cipher),
+		Conn: aead.NewConn(c, s.cipher, copts...),
+		raw:  raw,
 	}
 
 	return c, nil
@@ -162,7 +570,8 @@ func (s *SnellClient) GetSession(target string) (net.Conn, error) {
 
 func (s *SnellClient) PutSession(c net.Conn) {
 	if pc, ok := c.(*snellPoolConn); ok {
-		pc.Conn.(*clientSession).reply = false
+		cs := pc.Conn.(*clientSession)
+		cs.reply, cs.replyErr = false, nil
 	} else {
 		log.Fatalf("Invalid session type!")
 	}
@@ -186,10 +595,22 @@ func (s *SnellClient) DropSession(c net.Conn) {
 
 func (s *SnellClient) Close() {
 	s.socks5.Close()
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.http != nil {
+		s.http.Close()
+	}
+	if s.redir != nil {
+		s.redir.Close()
+	}
+	if s.redirUDP != nil {
+		s.redirUDP.Close()
+	}
 	s.pool.Close()
 }
 
-func NewSnellClient(listen, server, obfs, obfsHost, psk string, isV2 bool) (*SnellClient, error) {
+func NewSnellClient(listen, server, obfs, obfsHost, psk string, isV2 bool, opts ...ClientOption) (*SnellClient, error) {
 	if obfs != "tls" && obfs != "http" && obfs != "" {
 		return nil, fmt.Errorf("invalid snell obfs type %s", obfs)
 	}
@@ -210,9 +631,41 @@ func NewSnellClient(listen, server, obfs, obfsHost, psk string, isV2 bool) (*Sne
 		obfsHost: obfsHost,
 		cipher:   cipher,
 		isV2:     isV2,
+
+		nat: udpNAT{flows: map[string]*udpFlow{}},
+
+		keepAlive:   DefaultKeepAlive,
+		poolIdle:    MaxPoolCap,
+		poolTimeout: PoolTimeoutMS * time.Millisecond,
+		poolPing:    DefaultPoolPing,
+	}
+	for _, opt := range opts {
+		opt(sc)
+	}
+	if sc.method != "" {
+		c, err := aead.NewCipher(sc.method, []byte(psk))
+		if err != nil {
+			return nil, err
+		}
+		sc.cipher = c
+	}
+	if sc.rcvBuf < 0 || sc.sndBuf < 0 {
+		return nil, fmt.Errorf("invalid socket buffer sizes %d/%d", sc.rcvBuf, sc.sndBuf)
+	}
+	if sc.lifetime > 0 && (sc.sessionAge <= 0 || sc.sessionAge > sc.lifetime) {
+		sc.sessionAge = sc.lifetime * 9 / 10
+	}
+	if sc.readBatch < 0 {
+		return nil, fmt.Errorf("%w: %d", aead.ErrInvalidBatchSize, sc.readBatch)
+	}
+	if err := sc.retry.validate(); err != nil {
+		return nil, err
+	}
+	if len(sc.clientID) > MaxClientIDSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrClientIDTooLong, len(sc.clientID))
 	}
 
-	p, err := newSnellPool(MaxPoolCap, PoolTimeoutMS, sc.newSession)
+	p, err := newSnellPool(sc.poolIdle, sc.poolTotal, sc.poolTimeout, sc.sessionAge, sc.sessionReuse, sc.poolPing, sc.newSession)
 	if err != nil {
 		return nil, err
 	}
@@ -224,18 +677,76 @@ func NewSnellClient(listen, server, obfs, obfsHost, psk string, isV2 bool) (*Sne
 	}
 	sc.socks5 = sl
 
+	if isV2 {
+		ul, err := socks5.NewSocksUDPProxy(listen, sc.handleSnellUDP)
+		if err != nil {
+			log.Warningf("SOCKS UDP relay disabled: %v\n", err)
+		} else {
+			sc.udp = ul
+			sl.SetUDPRelay(ul)
+		}
+	}
+
+	if sc.httpListen != "" {
+		hl, err := httpproxy.NewHTTPProxy(sc.httpListen, sc.handleTunnel)
+		if err != nil {
+			sc.Close()
+			return nil, err
+		}
+		sc.http = hl
+	}
+
+	if sc.redirListen != "" {
+		rl, err := redir.NewRedirProxy(sc.redirListen, sc.redirTProxy, sc.handleTunnel)
+		if err != nil {
+			sc.Close()
+			return nil, err
+		}
+		sc.redir = rl
+
+		if sc.redirTProxy && isV2 {
+			ul, err := redir.NewTProxyUDP(sc.redirListen, sc.handleRedirUDP)
+			if err != nil {
+				log.Warningf("Transparent UDP relay disabled: %v\n", err)
+			} else {
+				sc.redirUDP = ul
+			}
+		}
+	}
+
 	return sc, nil
 }
 
 func (s *SnellClient) handleSnell(client net.Conn, addr socks5.Addr) {
-	target, err := s.GetSession(addr.String())
-	log.V(1).Infof("New target from %s to %s\n", client.RemoteAddr().String(), addr.String())
+	s.handleTunnel(client, addr.String())
+}
+
+func (s *SnellClient) handleTunnel(client net.Conn, addr string) {
+	target, err := s.GetSession(addr)
+	log.V(1).Infof("New target from %s to %s\n", client.RemoteAddr().String(), addr)
 	if err != nil {
-		log.Warningf("Failed to connect to target %s, error %v\n", addr.String(), err)
+		log.Warningf("Failed to connect to target %s, error %v\n", addr, err)
+		if est, ok := client.(httpproxy.Establisher); ok {
+			est.Established(err)
+		}
 		client.Close()
 		return
 	}
 
+	if est, ok := client.(httpproxy.Establisher); ok {
+		// answer the proxy client only once the server dialed the target
+		err := target.(*snellPoolConn).WaitConnected()
+		if ew := est.Established(err); err == nil {
+			err = ew
+		}
+		if err != nil {
+			log.Warningf("Failed to connect to target %s, error %v\n", addr, err)
+			s.DropSession(target)
+			client.Close()
+			return
+		}
+	}
+
 	_, er := utils.Relay(client, target)
 
 	client.Close()
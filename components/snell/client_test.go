@@ -0,0 +1,599 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+	"github.com/icpz/open-snell/components/socks5"
+)
+
+func TestSocksConnect(t *testing.T) {
+	_, server := startServer(t)
+	sc := startClient(t, server)
+	echo := tcpEcho(t)
+
+	c, err := net.Dial("tcp", sc.socks5.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := socks5.ClientHandshake(c, socks5.ParseAddr(echo), socks5.CmdConnect); err != nil {
+		t.Fatal(err)
+	}
+
+	want := bytes.Repeat([]byte("snell"), 20000)
+	go c.Write(want)
+	got := make([]byte, len(want))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("echoed data differs")
+	}
+}
+
+func TestSocksUDPAssociate(t *testing.T) {
+	_, server := startServer(t)
+	sc := startClient(t, server)
+	echo := udpEcho(t)
+
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	tcp, err := net.Dial("tcp", sc.socks5.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	if _, err := socks5.ClientHandshake(tcp, socks5.ParseAddrToSocksAddr(uc.LocalAddr()), socks5.CmdUDPAssociate); err != nil {
+		t.Fatal(err)
+	}
+
+	packet, _ := socks5.EncodeUDPPacket(socks5.ParseAddrToSocksAddr(echo), []byte("ping over snell"))
+	buf := make([]byte, 65536)
+	// the association is registered asynchronously, resend until it is
+	for i := 0; ; i++ {
+		if i == 50 {
+			t.Fatal("no reply through the UDP relay")
+		}
+		uc.WriteTo(packet, sc.udp.LocalAddr())
+		uc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := uc.ReadFrom(buf)
+		if err != nil {
+			continue
+		}
+		from, payload, err := socks5.DecodeUDPPacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from.String() != echo.String() || string(payload) != "ping over snell" {
+			t.Fatalf("got %q from %s", payload, from)
+		}
+		return
+	}
+}
+
+func TestRelayUDPDoesNotBlockOnDial(t *testing.T) {
+	// nothing listens there: every dial is refused and retried
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	sc := startClient(t, dead, WithDialRetry(DialRetry{Attempts: 5, BaseDelay: 200 * time.Millisecond}))
+	open := func() (udpReplyFunc, func()) {
+		return func([]byte, *net.UDPAddr) error { return nil }, nil
+	}
+
+	start := time.Now()
+	for i := 0; i < 3*udpFlowQueue; i++ {
+		sc.relayUDP("127.0.0.1:1000", []byte("x"), "192.0.2.1:53", open)
+		sc.relayUDP("127.0.0.1:1001", []byte("y"), "192.0.2.1:53", open)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("relaying took %v while sessions were being dialed", d)
+	}
+
+	sc.nat.mux.Lock()
+	flows := len(sc.nat.flows)
+	sc.nat.mux.Unlock()
+	if flows != 2 {
+		t.Fatalf("%d flows, want one per local client", flows)
+	}
+}
+
+func httpConnect(t *testing.T, proxy, target string) (*http.Response, *bufio.Reader, net.Conn) {
+	t.Helper()
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	io.WriteString(c, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, br, c
+}
+
+func TestHTTPConnect(t *testing.T) {
+	_, server := startServer(t)
+	sc := startClient(t, server, WithHTTPProxy("127.0.0.1:0"))
+	echo := tcpEcho(t)
+
+	resp, br, c := httpConnect(t, sc.http.Listener.Addr().String(), echo)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	io.WriteString(c, "through the tunnel")
+	b := make([]byte, len("through the tunnel"))
+	if _, err := io.ReadFull(br, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPConnectTargetRefused(t *testing.T) {
+	_, server := startServer(t)
+	sc := startClient(t, server, WithHTTPProxy("127.0.0.1:0"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	resp, _, _ := httpConnect(t, sc.http.Listener.Addr().String(), closed)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status %d for a refused target, want 502", resp.StatusCode)
+	}
+}
+
+func TestHTTPConnectTargetTimeout(t *testing.T) {
+	_, server := startServer(t, WithDialTimeout(time.Nanosecond))
+	sc := startClient(t, server, WithHTTPProxy("127.0.0.1:0"))
+
+	resp, _, _ := httpConnect(t, sc.http.Listener.Addr().String(), tcpEcho(t))
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status %d for a dial timeout, want 504", resp.StatusCode)
+	}
+}
+
+// writeCounter counts the writes to a conn.
+type writeCounter struct {
+	net.Conn
+	writes int32
+}
+
+func (c *writeCounter) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+// sessionPair returns a client session over a loopback connection and the
+// server end of it, both keyed with testPSK.
+func sessionPair(t *testing.T) (*clientSession, *writeCounter, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		raw.Close()
+		srv.Close()
+	})
+	ciph := aead.NewAES128GCM([]byte(testPSK))
+	wc := &writeCounter{Conn: raw}
+	cs := &clientSession{Conn: aead.NewConn(wc, ciph, aead.WithRole(aead.RoleClient)), raw: raw}
+	return cs, wc, aead.NewConn(srv, ciph, aead.WithRole(aead.RoleServer))
+}
+
+func TestHeaderSealedWithFirstPayload(t *testing.T) {
+	for _, size := range []int{1, 1000, aead.MaxPayloadSize - 32, aead.MaxPayloadSize, 3 * aead.MaxPayloadSize} {
+		cs, wc, server := sessionPair(t)
+		buf := &bytes.Buffer{}
+		encodeHeader(buf, []byte("id"), "example.com", 443, true)
+		header := buf.Len()
+		cs.setHeader(buf.Bytes())
+
+		payload := bytes.Repeat([]byte{0xA5}, size)
+		if n, err := cs.Write(payload); err != nil || n != size {
+			t.Fatalf("size %d: wrote %d, %v", size, n, err)
+		}
+		records := (header + size + aead.MaxPayloadSize - 1) / aead.MaxPayloadSize
+		if n := int(atomic.LoadInt32(&wc.writes)); n != records {
+			t.Fatalf("size %d: %d records for header and payload, want %d", size, n, records)
+		}
+
+		target, cmd, err := (&SnellServer{}).ServerHandshake(server)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if target != "example.com:443" || cmd != CommandConnectV2 {
+			t.Fatalf("size %d: parsed %s, command %d", size, target, cmd)
+		}
+		got := make([]byte, size)
+		if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, payload) {
+			t.Fatalf("size %d: payload after the header differs, %v", size, err)
+		}
+	}
+}
+
+func TestHeaderAloneForZeroChunk(t *testing.T) {
+	cs, wc, server := sessionPair(t)
+	buf := &bytes.Buffer{}
+	encodeHeader(buf, nil, "example.com", 80, true)
+	cs.setHeader(buf.Bytes())
+
+	if _, err := cs.Write(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&wc.writes); n != 2 {
+		t.Fatalf("%d records, want the header and the ZERO_CHUNK apart", n)
+	}
+	if _, _, err := (&SnellServer{}).ServerHandshake(server); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, aead.ErrZeroChunk) {
+		t.Fatalf("got %v after the header, want ErrZeroChunk", err)
+	}
+}
+
+func TestSessionAlive(t *testing.T) {
+	cs, _, server := sessionPair(t)
+	if !cs.alive() {
+		t.Fatal("idle session reported dead")
+	}
+	server.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for cs.alive() {
+		if time.Now().After(deadline) {
+			t.Fatal("session closed by the server reported alive")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolDropsSessionClosedByServer(t *testing.T) {
+	var servers []net.Conn
+	sp, _ := newSnellPool(2, 0, time.Minute, 0, 0, 0, func() (net.Conn, error) {
+		cs, _, server := sessionPair(t)
+		servers = append(servers, server)
+		return cs, nil
+	})
+	defer sp.Close()
+
+	c, err := sp.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := c.(*snellPoolConn).Conn
+	c.Close()
+	servers[0].Close()
+	time.Sleep(10 * time.Millisecond)
+
+	c, err = sp.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.(*snellPoolConn).Conn == first {
+		t.Fatal("session closed by the server handed out again")
+	}
+}
+
+func TestPoolPingKeepsSession(t *testing.T) {
+	_, addr := startServer(t)
+	echo := tcpEcho(t)
+	// count the sessions dialed through a forwarder in front of the server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var dialed int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dialed, 1)
+			go func() {
+				defer c.Close()
+				s, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer s.Close()
+				go io.Copy(s, c)
+				io.Copy(c, s)
+			}()
+		}
+	}()
+	sc := startClient(t, ln.Addr().String(), WithPoolPing(time.Second))
+
+	c := dialSocks(t, sc, echo)
+	if !echoes(c, []byte("first")) {
+		t.Fatal("first request not relayed")
+	}
+	c.Close()
+	eventually(t, "session not pooled", func() bool { return sc.pool.pool.Len() == 1 })
+
+	for i := 0; i < 3; i++ {
+		c = dialSocks(t, sc, echo)
+		if !echoes(c, []byte("again")) {
+			t.Fatalf("request %d on a pinged session not relayed", i)
+		}
+		c.Close()
+		eventually(t, "session not pooled", func() bool { return sc.pool.pool.Len() == 1 })
+	}
+	if n := atomic.LoadInt32(&dialed); n != 1 {
+		t.Fatalf("%d sessions dialed, the pinged one not reused", n)
+	}
+}
+
+// bufferConn collects what is written to it.
+type bufferConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func TestWriteErrorRoundTrip(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	for _, tc := range []struct {
+		msg, want string
+	}{
+		{"", ""},
+		{"dial tcp: lookup example.invalid: no such host", "dial tcp: lookup example.invalid: no such host"},
+		{long, long[:250]},
+	} {
+		cs, _, server := sessionPair(t)
+		hdr := requestHeader(CommandConnectV2, "", "example.invalid", 80)
+		cs.setHeader(hdr)
+		go func() {
+			if _, err := io.ReadFull(server, make([]byte, len(hdr))); err == nil {
+				WriteError(server, tc.msg)
+			}
+		}()
+
+		err := cs.WaitConnected()
+		var ae *AppError
+		if !errors.As(err, &ae) {
+			t.Fatalf("got %v, want an *AppError", err)
+		}
+		if ae.Error() != tc.want || ae.Code() != 0 {
+			t.Fatalf("got %q code %d, want %q code 0", ae.Error(), ae.Code(), tc.want)
+		}
+		if _, err := cs.Read(make([]byte, 1)); err != ae {
+			t.Fatalf("read after the error response: %v", err)
+		}
+	}
+}
+
+func TestWriteErrorEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteError(&bufferConn{w: &buf}, "refused"); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{ResponseError, 0, 7}, "refused"...)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("encoded %x, want %x", buf.Bytes(), want)
+	}
+}
+
+// idDialer records the client id of every dial.
+type idDialer struct {
+	mux sync.Mutex
+	ids []string
+}
+
+func (d *idDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mux.Lock()
+	d.ids = append(d.ids, ClientIDFromContext(ctx))
+	d.mux.Unlock()
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+func TestClientIDRoundTrip(t *testing.T) {
+	d := &idDialer{}
+	_, server := startServer(t, WithUpstreamDialer(d))
+	echo := tcpEcho(t)
+
+	for _, id := range []string{"egress-a", "", string(bytes.Repeat([]byte("i"), MaxClientIDSize))} {
+		sc := startClient(t, server, WithClientID([]byte(id)))
+		if !echoes(dialSocks(t, sc, echo), []byte("routed")) {
+			t.Fatalf("client id %q: not served", id)
+		}
+		d.mux.Lock()
+		got := d.ids[len(d.ids)-1]
+		d.mux.Unlock()
+		if got != id {
+			t.Fatalf("server parsed client id %q, want %q", got, id)
+		}
+	}
+
+	tooLong := bytes.Repeat([]byte("i"), MaxClientIDSize+1)
+	if _, err := NewSnellClient("127.0.0.1:0", server, "", "", testPSK, true, WithClientID(tooLong)); !errors.Is(err, ErrClientIDTooLong) {
+		t.Fatalf("got %v, want ErrClientIDTooLong", err)
+	}
+}
+
+// smtpServer greets every connection with a banner before reading
+// anything, answers one EHLO and signals each accept on accepted.
+func smtpServer(t *testing.T) (addr string, accepted <-chan struct{}) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ch := make(chan struct{}, 8)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ch <- struct{}{}
+			go func() {
+				defer c.Close()
+				c.Write([]byte("220 mail.test ESMTP\r\n"))
+				line, err := bufio.NewReader(c).ReadString('\n')
+				if err == nil && line == "EHLO client.test\r\n" {
+					c.Write([]byte("250 mail.test\r\n"))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+func TestServerSpeaksFirst(t *testing.T) {
+	_, server := startServer(t)
+	for _, tc := range []struct {
+		name string
+		opts []ClientOption
+	}{
+		{"deferred", nil},
+		{"eager", []ClientOption{WithEagerHeader()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			smtp, accepted := smtpServer(t)
+			sc := startClient(t, server, tc.opts...)
+			c := dialSocks(t, sc, smtp)
+
+			if tc.opts != nil {
+				// the header went out at setup: the server dials the
+				// target though the app neither wrote nor read yet
+				select {
+				case <-accepted:
+				case <-time.After(2 * time.Second):
+					t.Fatal("target not dialed before the app's first read")
+				}
+			}
+
+			// the app waits for the banner without writing first
+			r := bufio.NewReader(c)
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if banner, err := r.ReadString('\n'); err != nil || banner != "220 mail.test ESMTP\r\n" {
+				t.Fatalf("banner %q, %v", banner, err)
+			}
+			if _, err := c.Write([]byte("EHLO client.test\r\n")); err != nil {
+				t.Fatal(err)
+			}
+			if reply, err := r.ReadString('\n'); err != nil || reply != "250 mail.test\r\n" {
+				t.Fatalf("reply %q, %v", reply, err)
+			}
+		})
+	}
+}
+
+// waitConnected calls WaitConnected on a session from GetSession, failing
+// if it blocks.
+func waitConnected(t *testing.T, c net.Conn) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- c.(interface{ WaitConnected() error }).WaitConnected() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitConnected blocked")
+	}
+	return nil
+}
+
+// TestWaitConnected waits for the server's confirmation before any data
+// flows, on a fresh then on a pooled session, and for its refusal when the
+// target cannot be dialed.
+func TestWaitConnected(t *testing.T) {
+	_, server := startServer(t)
+	echo := tcpEcho(t)
+	sc := startClient(t, server)
+
+	var first net.Addr
+	for _, name := range []string{"fresh", "pooled"} {
+		c, err := sc.GetSession(echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = c.LocalAddr()
+		} else if c.LocalAddr().String() != first.String() {
+			t.Fatal("the session was not reused")
+		}
+		// the echo target is silent until it reads: the confirmation
+		// comes from the server alone
+		if err := waitConnected(t, c); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := waitConnected(t, c); err != nil {
+			t.Fatalf("%s: second wait: %v", name, err)
+		}
+		if !echoes(c, []byte("after the confirmation")) {
+			t.Fatalf("%s: no echo after the confirmation", name)
+		}
+		c.Write(nil) // zero chunk, ending the request
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); !errors.Is(err, aead.ErrZeroChunk) {
+			t.Fatalf("%s: got %v, want the end of the tunnel", name, err)
+		}
+		c.SetReadDeadline(time.Time{})
+		sc.PutSession(c)
+	}
+
+	c, err := sc.GetSession(freeAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.DropSession(c)
+	var ae *AppError
+	if err := waitConnected(t, c); !errors.As(err, &ae) {
+		t.Fatalf("got %v, want an *AppError for a refused target", err)
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.As(err, &ae) {
+		t.Fatalf("read got %v, want the same *AppError", err)
+	}
+}
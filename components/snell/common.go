@@ -14,6 +14,12 @@
 
 package snell
 
+import (
+	"strings"
+	"syscall"
+	"time"
+)
+
 const (
 	CommandPing      byte = 0
 	CommandConnect   byte = 1
@@ -39,9 +45,40 @@ func (e *AppError) Error() string {
 	return e.msg
 }
 
+// Code returns the error code of the response, the errno of the failed
+// dial on the server or 0.
+func (e *AppError) Code() byte {
+	return e.code
+}
+
+// Timeout reports whether the server gave up on a timeout, e.g. dialing
+// the target.
+func (e *AppError) Timeout() bool {
+	return syscall.Errno(e.code) == syscall.ETIMEDOUT ||
+		strings.Contains(e.msg, "timeout") || strings.Contains(e.msg, "deadline exceeded")
+}
+
 func NewAppError(code byte, msg string) error {
 	return &AppError{
 		code: code,
 		msg:  msg,
 	}
 }
+
+// KeepAlive configures TCP keepalive on the conns to and from the server.
+// Zero durations and count keep the system defaults.
+type KeepAlive struct {
+	Enable   bool
+	Idle     time.Duration
+	Interval time.Duration
+	Count    int
+}
+
+// DefaultKeepAlive probes after 30s of silence, keeping NAT mappings of idle
+// sessions alive.
+var DefaultKeepAlive = KeepAlive{
+	Enable:   true,
+	Idle:     30 * time.Second,
+	Interval: 10 * time.Second,
+	Count:    3,
+}
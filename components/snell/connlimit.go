@@ -0,0 +1,107 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"sync"
+)
+
+// ConnLimitMode selects what a server does with connections over its
+// limit, see WithConnLimit.
+type ConnLimitMode int
+
+const (
+	// ConnLimitPause stops accepting, connections wait in the kernel
+	// backlog until the server is back under the low-water mark.
+	ConnLimitPause ConnLimitMode = iota
+	// ConnLimitReject accepts and closes them at once, logging each.
+	ConnLimitReject
+)
+
+// connLimiter counts the connections being served. Reaching limit
+// saturates it until the count drops to low again.
+type connLimiter struct {
+	limit int
+	low   int
+	mode  ConnLimitMode
+
+	mux       sync.Mutex
+	cond      *sync.Cond
+	open      int
+	saturated bool
+	closed    bool
+	refused   uint64
+}
+
+func newConnLimiter(limit, low int, mode ConnLimitMode) *connLimiter {
+	if low <= 0 || low >= limit {
+		low = limit * 9 / 10
+	}
+	l := &connLimiter{limit: limit, low: low, mode: mode}
+	l.cond = sync.NewCond(&l.mux)
+	return l
+}
+
+// wait blocks while accepting is paused, it reports false once the limiter
+// is closed.
+func (l *connLimiter) wait() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for l.mode == ConnLimitPause && l.saturated && !l.closed {
+		l.cond.Wait()
+	}
+	return !l.closed
+}
+
+// admit counts a newly accepted connection in, it reports false if the
+// connection must be refused. Admitted ones are balanced by release.
+func (l *connLimiter) admit() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	// several accept loops may pass wait at once, the limit stays hard
+	if l.saturated && (l.mode == ConnLimitReject || l.open >= l.limit) {
+		l.refused++
+		return false
+	}
+	l.open++
+	if l.open >= l.limit {
+		l.saturated = true
+	}
+	return true
+}
+
+func (l *connLimiter) release() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.open--
+	if l.saturated && l.open <= l.low {
+		l.saturated = false
+		l.cond.Broadcast()
+	}
+}
+
+// close wakes the accept loops waiting in wait for good.
+func (l *connLimiter) close() {
+	l.mux.Lock()
+	l.closed = true
+	l.cond.Broadcast()
+	l.mux.Unlock()
+}
+
+func (l *connLimiter) stats() (open int, refused uint64, saturated bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.open, l.refused, l.saturated
+}
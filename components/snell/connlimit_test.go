@@ -0,0 +1,174 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// rawConn opens a TCP connection to the server that never handshakes, it
+// stays served until closed.
+func rawConn(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// closedByServer reports whether the server closed c without a word.
+func closedByServer(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	return err != nil && !isTimeout(err)
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestConnLimitReject(t *testing.T) {
+	s, addr := startServer(t, WithConnLimit(2, 1, ConnLimitReject))
+	a, _ := rawConn(t, addr), rawConn(t, addr)
+	eventually(t, "two connections not served", func() bool { return s.Stats().Conns == 2 })
+
+	if over := rawConn(t, addr); !closedByServer(over) {
+		t.Fatal("connection over the limit not closed")
+	}
+	st := s.Stats()
+	if st.ConnsRefused != 1 || !st.ConnsSaturated || st.ConnLimit != 2 {
+		t.Fatalf("stats %+v, want one refusal while saturated", st)
+	}
+
+	// dropping to the low-water mark accepts again
+	a.Close()
+	eventually(t, "count not released", func() bool { return !s.Stats().ConnsSaturated })
+	if again := rawConn(t, addr); closedByServer(again) {
+		t.Fatal("connection refused under the low-water mark")
+	}
+	eventually(t, "connection not served", func() bool { return s.Stats().Conns == 2 })
+}
+
+func TestConnLimitPause(t *testing.T) {
+	s, addr := startServer(t, WithConnLimit(2, 1, ConnLimitPause))
+	a, b := rawConn(t, addr), rawConn(t, addr)
+	eventually(t, "two connections not served", func() bool { return s.Stats().Conns == 2 })
+
+	// the next one waits in the backlog, neither served nor refused
+	waiting := rawConn(t, addr)
+	if closedByServer(waiting) {
+		t.Fatal("connection over the limit closed in pause mode")
+	}
+	if st := s.Stats(); st.Conns != 2 || st.ConnsRefused != 0 {
+		t.Fatalf("stats %+v, want the waiting connection not accepted", st)
+	}
+
+	// once the first two are gone it is the one left served
+	a.Close()
+	b.Close()
+	eventually(t, "waiting connection not accepted", func() bool { return s.Stats().Conns == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if n := s.Stats().Conns; n != 1 {
+		t.Fatalf("%d connections served, want the waiting one", n)
+	}
+	if closedByServer(waiting) {
+		t.Fatal("waiting connection closed once accepted")
+	}
+}
+
+// flood opens n connections to addr at once, none of them handshaking.
+func flood(t *testing.T, addr string, n int) []net.Conn {
+	t.Helper()
+	conns := make([]net.Conn, n)
+	done := make(chan struct{})
+	for i := range conns {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			if c, err := net.Dial("tcp", addr); err == nil {
+				conns[i] = c
+			}
+		}(i)
+	}
+	for range conns {
+		<-done
+	}
+	t.Cleanup(func() {
+		for _, c := range conns {
+			if c != nil {
+				c.Close()
+			}
+		}
+	})
+	return conns
+}
+
+func TestBufferBudgetUnderFlood(t *testing.T) {
+	const served = 3
+	for _, mode := range []ConnLimitMode{ConnLimitReject, ConnLimitPause} {
+		s, addr := startServer(t, WithBufferBudget(served*connBufferCost, mode))
+
+		// sample the charge while the flood comes in
+		stop, peak := make(chan struct{}), make(chan int64, 1)
+		go func() {
+			var max int64
+			for {
+				if used := s.Stats().BufferUsed; used > max {
+					max = used
+				}
+				select {
+				case <-stop:
+					peak <- max
+					return
+				default:
+				}
+			}
+		}()
+		conns := flood(t, addr, 20)
+		switch mode {
+		case ConnLimitReject:
+			eventually(t, "flood not refused", func() bool { return s.Stats().BufferRefusals == 20-served })
+		case ConnLimitPause:
+			eventually(t, "budget not filled", func() bool { return s.Stats().BufferUsed == served*connBufferCost })
+			time.Sleep(50 * time.Millisecond)
+		}
+		close(stop)
+		if max := <-peak; max > served*connBufferCost {
+			t.Fatalf("mode %d: %d bytes charged, over the %d bytes budget", mode, max, served*connBufferCost)
+		}
+		st := s.Stats()
+		if st.BufferUsed != served*connBufferCost || st.BufferBudget != served*connBufferCost {
+			t.Fatalf("mode %d: stats %+v, want the budget used up", mode, st)
+		}
+
+		if mode == ConnLimitPause {
+			// connections held back are served as others end
+			if st.BufferRefusals != 0 {
+				t.Fatalf("%d refusals in pause mode", st.BufferRefusals)
+			}
+			for _, c := range conns {
+				if c != nil {
+					c.Close()
+				}
+			}
+			// down to the share reserved for the next one
+			eventually(t, "budget not released", func() bool { return s.Stats().BufferUsed == connBufferCost })
+		}
+	}
+}
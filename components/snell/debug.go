@@ -0,0 +1,205 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+var errClosedByOperator = errors.New("closed by operator")
+
+// connRegistry holds the connections being served, by id.
+type connRegistry struct {
+	mux   sync.Mutex
+	next  uint64
+	conns map[uint64]*connAccess
+}
+
+// WithConnRegistry keeps track of every connection being served, for
+// DebugHandler. It costs a map entry and the access log bookkeeping per
+// connection.
+func WithConnRegistry() ServerOption {
+	return func(s *SnellServer) {
+		s.registry = &connRegistry{conns: make(map[uint64]*connAccess)}
+	}
+}
+
+func (r *connRegistry) add(a *connAccess) {
+	r.mux.Lock()
+	r.next++
+	a.id = r.next
+	r.conns[a.id] = a
+	r.mux.Unlock()
+}
+
+func (r *connRegistry) remove(id uint64) {
+	r.mux.Lock()
+	delete(r.conns, id)
+	r.mux.Unlock()
+}
+
+func (r *connRegistry) get(id uint64) *connAccess {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.conns[id]
+}
+
+func (r *connRegistry) list() []*connAccess {
+	r.mux.Lock()
+	as := make([]*connAccess, 0, len(r.conns))
+	for _, a := range r.conns {
+		as = append(as, a)
+	}
+	r.mux.Unlock()
+	sort.Slice(as, func(i, j int) bool { return as[i].id < as[j].id })
+	return as
+}
+
+// debugConn is the JSON form of a registered connection. Keys and salts
+// are left out.
+type debugConn struct {
+	ID        uint64            `json:"id"`
+	Client    string            `json:"client"`
+	User      string            `json:"user,omitempty"`
+	AgeMS     float64           `json:"age_ms"`
+	State     string            `json:"state"`
+	Command   string            `json:"command,omitempty"`
+	Targets   []string          `json:"targets,omitempty"`
+	BytesUp   uint64            `json:"bytes_up"`
+	BytesDown uint64            `json:"bytes_down"`
+	Cipher    string            `json:"cipher,omitempty"`
+	KeyID     string            `json:"key_id,omitempty"`
+	Features  string            `json:"features"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+func (a *connAccess) snapshot() *debugConn {
+	a.mux.Lock()
+	d := &debugConn{
+		ID:      a.id,
+		Client:  a.entry.Client,
+		AgeMS:   float64(time.Since(a.entry.Time)) / float64(time.Millisecond),
+		State:   "handshake",
+		Command: a.entry.Command,
+		Targets: append([]string(nil), a.entry.Targets...),
+	}
+	a.mux.Unlock()
+	if d.Command != "" {
+		d.State = "active"
+	}
+	d.BytesUp = atomic.LoadUint64(&a.up)
+	d.BytesDown = atomic.LoadUint64(&a.down)
+	d.User, d.Cipher, d.KeyID = a.identity(a.conn)
+	var f aead.Features
+	if fc, ok := a.conn.(interface{ Features() aead.Features }); ok {
+		f = fc.Features()
+	}
+	d.Features = f.String()
+	if tags := connTags(a.conn); tags != nil {
+		for _, t := range tags.List() {
+			if d.Tags == nil {
+				d.Tags = make(map[string]string)
+			}
+			d.Tags[t.Key] = t.Value
+		}
+	}
+	return d
+}
+
+// DebugHandler serves the connections being served as a JSON array on
+// GET, for operators investigating stuck or abusive clients. A POST with
+// the form values id and action acts on one of them: close resets it,
+// drain stops reading from it so that the request ends with a ZERO_CHUNK,
+// ping sends a keepalive record, which needs aead.FeatureKeepalive.
+//
+// Every request must carry "Authorization: Bearer <token>", an empty
+// token refuses them all. It needs WithConnRegistry.
+func (s *SnellServer) DebugHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if s.registry == nil {
+			http.Error(w, "connection registry disabled", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			conns := []*debugConn{}
+			for _, a := range s.registry.list() {
+				conns = append(conns, a.snapshot())
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(conns)
+		case http.MethodPost:
+			s.debugAction(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (s *SnellServer) debugAction(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	a := s.registry.get(id)
+	if a == nil {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	switch r.FormValue("action") {
+	case "close":
+		a.end("closed by operator", nil)
+		if cc, ok := a.conn.(interface{ CloseWithError(error) error }); ok {
+			err = cc.CloseWithError(errClosedByOperator)
+		} else {
+			err = a.conn.Close()
+		}
+	case "drain":
+		// the relay winds down as if the client went idle, then the
+		// request ends the way it normally does, with a ZERO_CHUNK
+		a.end("drained by operator", nil)
+		err = a.conn.SetReadDeadline(time.Now())
+	case "ping":
+		if kc, ok := a.conn.(interface{ WriteKeepalive() error }); ok {
+			err = kc.WriteKeepalive()
+		} else {
+			err = aead.ErrKeepaliveNotNegotiated
+		}
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
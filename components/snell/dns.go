@@ -0,0 +1,298 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// WithDNSTimeout makes the server resolve domain targets itself, bounding
+// each lookup by d apart from the connect timeout of WithDialTimeout. A
+// failed lookup is answered with an error response naming the host. The
+// UpstreamDialer is then handed addresses rather than names, except that
+// a destination policy such as acl.NewDialer still decides on the name.
+func WithDNSTimeout(d time.Duration) ServerOption {
+	return func(s *SnellServer) {
+		s.dnsTimeout = d
+	}
+}
+
+// WithDNSCache makes the server resolve domain targets itself, as
+// WithDNSTimeout does, and cache the answers for up to size names for
+// their TTL, maxTTL at most; maxTTL 0 sets no cap. Answers whose TTL is
+// unknown, e.g. from /etc/hosts, are kept maxTTL, or DefaultDNSCacheTTL
+// without a cap. Failures are not cached.
+func WithDNSCache(size int, maxTTL time.Duration) ServerOption {
+	return func(s *SnellServer) {
+		s.dnsCacheSize = size
+		s.dnsMaxTTL = maxTTL
+	}
+}
+
+// cachingResolver resolves names through dial, caching the answers for
+// their TTL as learned from the DNS messages read by the resolver. It
+// serves both the domain targets of the server and the tunnel Resolver.
+type cachingResolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+	cache    *lru.Cache // nil without cache
+	maxTTL   time.Duration
+
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// newCachingResolver returns a resolver querying through dial, each lookup
+// bounded by timeout if positive. Up to size names are cached for their
+// TTL, maxTTL at most if positive; size 0 disables the cache.
+func newCachingResolver(dial dialFunc, timeout time.Duration, size int, maxTTL time.Duration) (*cachingResolver, error) {
+	r := &cachingResolver{timeout: timeout, maxTTL: maxTTL}
+	if size > 0 {
+		cache, err := lru.New(size)
+		if err != nil {
+			return nil, err
+		}
+		r.cache = cache
+	}
+	r.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			ttl, _ := ctx.Value(dnsTTLKey{}).(*dnsTTL)
+			if ttl == nil {
+				return c, nil
+			}
+			if pc, ok := c.(net.PacketConn); ok {
+				return &ttlPacketConn{ttlConn{Conn: c, ttl: ttl}, pc}, nil
+			}
+			return &ttlConn{Conn: c, ttl: ttl, stream: true}, nil
+		},
+	}
+	return r, nil
+}
+
+// lookup returns the addresses of host, from the cache if possible.
+func (r *cachingResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	if r.cache != nil {
+		if v, ok := r.cache.Get(host); ok {
+			e := v.(*cacheEntry)
+			if time.Now().Before(e.expires) {
+				atomic.AddUint64(&r.hits, 1)
+				return e.addrs, nil
+			}
+			r.cache.Remove(host)
+		}
+		atomic.AddUint64(&r.misses, 1)
+	}
+
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	ttl := &dnsTTL{}
+	addrs, err := r.resolver.LookupHost(context.WithValue(ctx, dnsTTLKey{}, ttl), host)
+	if err != nil {
+		return nil, err
+	}
+	if r.cache != nil {
+		keep := r.maxTTL
+		if d, ok := ttl.get(); ok && (d < keep || keep <= 0) {
+			keep = d
+		} else if !ok && keep <= 0 {
+			keep = DefaultDNSCacheTTL
+		}
+		if keep > 0 {
+			r.cache.Add(host, &cacheEntry{addrs: addrs, expires: time.Now().Add(keep)})
+		}
+	}
+	return addrs, nil
+}
+
+// resolveError words a failed lookup of a target for the client.
+func resolveError(host string, err error) error {
+	var de *net.DNSError
+	if errors.As(err, &de) && de.IsTimeout {
+		return fmt.Errorf("resolve %s: timed out", host)
+	}
+	if errors.As(err, &de) && de.IsNotFound {
+		return fmt.Errorf("resolve %s: no such host", host)
+	}
+	return fmt.Errorf("resolve %s: %w", host, err)
+}
+
+func (r *cachingResolver) stats() (hits, misses uint64, names int) {
+	if r.cache != nil {
+		names = r.cache.Len()
+	}
+	return atomic.LoadUint64(&r.hits), atomic.LoadUint64(&r.misses), names
+}
+
+// policyDialer is an UpstreamDialer enforcing a destination policy, as
+// acl.NewDialer returns. Handed addresses alone it would only see them, so
+// it is asked about the name before the lookup and about each address
+// along with the name.
+type policyDialer interface {
+	Check(addr string) error
+	DialResolved(ctx context.Context, network, addr string, ip net.IP) (net.Conn, error)
+}
+
+// dialResolved dials the addresses of host in turn until one answers, the
+// dial timeout bounding them all.
+func (s *SnellServer) dialResolved(ctx context.Context, host, port string) (net.Conn, error) {
+	target := net.JoinHostPort(host, port)
+	pd, _ := s.dialer.(policyDialer)
+	if pd != nil {
+		if err := pd.Check(target); err != nil {
+			return nil, err
+		}
+	}
+	addrs, err := s.dns.lookup(ctx, host)
+	if err != nil {
+		return nil, resolveError(host, err)
+	}
+	if s.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.dialTimeout)
+		defer cancel()
+	}
+	for _, a := range addrs {
+		var c net.Conn
+		if pd != nil {
+			c, err = pd.DialResolved(ctx, "tcp", target, net.ParseIP(a))
+		} else {
+			c, err = s.dialer.DialContext(ctx, "tcp", net.JoinHostPort(a, port))
+		}
+		if err == nil || ctx.Err() != nil {
+			return c, err
+		}
+	}
+	return nil, err
+}
+
+type dnsTTLKey struct{}
+
+// dnsTTL is the lowest TTL of the answers read during a lookup.
+type dnsTTL struct {
+	mux  sync.Mutex
+	min  uint32
+	seen bool
+}
+
+func (t *dnsTTL) get() (time.Duration, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return time.Duration(t.min) * time.Second, t.seen
+}
+
+// observe records the TTLs of the address and alias records in msg.
+func (t *dnsTTL) observe(msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		switch h.Type {
+		case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeCNAME:
+			if !t.seen || h.TTL < t.min {
+				t.min, t.seen = h.TTL, true
+			}
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+// ttlConn is a conn to a DNS server passing the answers read to ttl, in
+// TCP framing if stream is set.
+type ttlConn struct {
+	net.Conn
+	ttl    *dnsTTL
+	stream bool
+	buf    []byte // partial message, in TCP framing
+}
+
+func (c *ttlConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.read(b[:n])
+	}
+	return n, err
+}
+
+func (c *ttlConn) read(b []byte) {
+	if !c.stream {
+		c.ttl.observe(b)
+		return
+	}
+	c.buf = append(c.buf, b...)
+	for len(c.buf) >= 2 {
+		size := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+size {
+			break
+		}
+		c.ttl.observe(c.buf[2 : 2+size])
+		c.buf = c.buf[2+size:]
+	}
+}
+
+// ttlPacketConn remains a net.PacketConn, so that the resolver keeps the
+// datagram framing.
+type ttlPacketConn struct {
+	ttlConn
+	pc net.PacketConn
+}
+
+func (c *ttlPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.pc.ReadFrom(b)
+	if n > 0 {
+		c.read(b[:n])
+	}
+	return n, addr, err
+}
+
+func (c *ttlPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
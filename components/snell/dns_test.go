@@ -0,0 +1,236 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/acl"
+)
+
+// fakeDNSResolver returns a resolver querying dns whatever the servers of
+// the system.
+func fakeDNSResolver(t *testing.T, dns *fakeDNS, timeout time.Duration, size int, maxTTL time.Duration) *cachingResolver {
+	t.Helper()
+	var d net.Dialer
+	r, err := newCachingResolver(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, network, dns.addr)
+	}, timeout, size, maxTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func resolve(t *testing.T, r *cachingResolver, host string) []string {
+	t.Helper()
+	addrs, err := r.lookup(context.Background(), host)
+	if err != nil {
+		t.Fatalf("lookup %s: %v", host, err)
+	}
+	return addrs
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	dns := startFakeDNS(t)
+	dns.set("short.example.", fakeRecord{ip: net.IPv4(192, 0, 2, 1), ttl: 1})
+	dns.set("long.example.", fakeRecord{ip: net.IPv4(192, 0, 2, 2), ttl: 300})
+	dns.set("tcp.example.", fakeRecord{ip: net.IPv4(192, 0, 2, 3), ttl: 1, truncate: true})
+	r := fakeDNSResolver(t, dns, 0, 16, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		for host, want := range map[string]string{
+			"short.example": "192.0.2.1",
+			"long.example":  "192.0.2.2",
+			"tcp.example":   "192.0.2.3",
+		} {
+			if addrs := resolve(t, r, host); len(addrs) != 1 || addrs[0] != want {
+				t.Fatalf("%s resolved to %v", host, addrs)
+			}
+		}
+	}
+	for _, name := range []string{"short.example.", "long.example.", "tcp.example."} {
+		if n := dns.count(name); n != 1 {
+			t.Fatalf("%d queries for %s, want 1 while cached", n, name)
+		}
+	}
+	if hits, misses, names := r.stats(); hits != 6 || misses != 3 || names != 3 {
+		t.Fatalf("stats %d hits, %d misses, %d names, want 6, 3, 3", hits, misses, names)
+	}
+
+	// the 1s TTLs, read over UDP and over TCP, run out
+	time.Sleep(1100 * time.Millisecond)
+	for _, host := range []string{"short.example", "long.example", "tcp.example"} {
+		resolve(t, r, host)
+	}
+	if n := dns.count("short.example."); n != 2 {
+		t.Fatalf("%d queries for short.example, want a second one past its TTL", n)
+	}
+	if n := dns.count("tcp.example."); n != 2 {
+		t.Fatalf("%d queries for tcp.example, want a second one past its TTL", n)
+	}
+	if n := dns.count("long.example."); n != 1 {
+		t.Fatalf("%d queries for long.example, want it still cached", n)
+	}
+}
+
+func TestDNSCacheBounds(t *testing.T) {
+	dns := startFakeDNS(t)
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		dns.set(name, fakeRecord{ip: net.IPv4(192, 0, 2, 1), ttl: 300})
+	}
+
+	// maxTTL caps the TTL of the answer
+	r := fakeDNSResolver(t, dns, 0, 2, 50*time.Millisecond)
+	resolve(t, r, "a.example")
+	time.Sleep(100 * time.Millisecond)
+	resolve(t, r, "a.example")
+	if n := dns.count("a.example."); n != 2 {
+		t.Fatalf("%d queries for a.example, want 2 past maxTTL", n)
+	}
+
+	// maxTTL 0 caches for the TTL of the answer, uncapped
+	dns.set("d.example.", fakeRecord{ip: net.IPv4(192, 0, 2, 4), ttl: 300})
+	r = fakeDNSResolver(t, dns, 0, 2, 0)
+	resolve(t, r, "d.example")
+	resolve(t, r, "d.example")
+	if n := dns.count("d.example."); n != 1 {
+		t.Fatalf("%d queries for d.example without a cap, want 1", n)
+	}
+
+	// the least recently used name is evicted past size
+	r = fakeDNSResolver(t, dns, 0, 2, time.Hour)
+	for _, host := range []string{"a.example", "b.example", "a.example", "c.example", "a.example", "b.example"} {
+		resolve(t, r, host)
+	}
+	if na, nb, nc := dns.count("a.example."), dns.count("b.example."), dns.count("c.example."); na != 3 || nb != 2 || nc != 1 {
+		t.Fatalf("queries a %d, b %d, c %d, want 3, 2, 1", na, nb, nc)
+	}
+	if _, _, names := r.stats(); names != 2 {
+		t.Fatalf("%d names cached, want 2", names)
+	}
+
+	// failures are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := r.lookup(context.Background(), "missing.example"); err == nil {
+			t.Fatal("missing.example resolved")
+		}
+	}
+	if n := dns.count("missing.example."); n != 2 {
+		t.Fatalf("%d queries for a missing name, want 2", n)
+	}
+}
+
+func TestDNSTimeout(t *testing.T) {
+	dns := startFakeDNS(t)
+	dns.set("slow.example.", fakeRecord{ip: net.IPv4(192, 0, 2, 1), ttl: 300, delay: time.Second})
+	r := fakeDNSResolver(t, dns, 100*time.Millisecond, 16, time.Hour)
+
+	start := time.Now()
+	_, err := r.lookup(context.Background(), "slow.example")
+	if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+		t.Fatalf("lookup took %v despite a 100ms timeout", elapsed)
+	}
+	if err == nil {
+		t.Fatal("slow lookup succeeded")
+	}
+	if msg := resolveError("slow.example", err).Error(); msg != "resolve slow.example: timed out" {
+		t.Fatalf("got %q", msg)
+	}
+}
+
+// TestDNSTimeoutAnswered checks a client is answered an error naming the
+// host when the server fails to resolve its target in time.
+func TestDNSTimeoutAnswered(t *testing.T) {
+	dns := startFakeDNS(t)
+	dns.set("slow.example.", fakeRecord{ip: net.IPv4(127, 0, 0, 1), ttl: 300, delay: time.Second})
+	dns.set("echo.example.", fakeRecord{ip: net.IPv4(127, 0, 0, 1), ttl: 300})
+	s, server := startServer(t, WithDNSTimeout(100*time.Millisecond), WithDNSCache(16, time.Hour))
+	s.dns = fakeDNSResolver(t, dns, 100*time.Millisecond, 16, time.Hour)
+	sc := startClient(t, server)
+
+	c, err := sc.GetSession("slow.example:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ae *AppError
+	if err := waitConnected(t, c); !errors.As(err, &ae) || !strings.Contains(ae.Error(), "resolve slow.example: timed out") {
+		t.Fatalf("got %v, want an *AppError for the timeout", err)
+	}
+	sc.DropSession(c)
+
+	_, port, _ := net.SplitHostPort(tcpEcho(t))
+	for i := 0; i < 2; i++ {
+		c, err := sc.GetSession(net.JoinHostPort("echo.example", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !echoes(c, []byte("resolved")) {
+			t.Fatal("no echo through a resolved target")
+		}
+		sc.DropSession(c)
+	}
+	if st := s.Stats(); st.DNSCacheHits != 1 || st.DNSCacheMisses != 2 || st.DNSCacheNames != 1 {
+		t.Fatalf("stats %d hits, %d misses, %d names, want 1, 2, 1", st.DNSCacheHits, st.DNSCacheMisses, st.DNSCacheNames)
+	}
+}
+
+// TestDNSCacheKeepsPolicy resolves targets through the DNS cache of a
+// server whose upstream dialer enforces an ACL: domain rules still refuse
+// names, CIDR rules still refuse the addresses they resolve to.
+func TestDNSCacheKeepsPolicy(t *testing.T) {
+	dns := startFakeDNS(t)
+	dns.set("blocked.example.", fakeRecord{ip: net.IPv4(127, 0, 0, 1), ttl: 300})
+	dns.set("internal.example.", fakeRecord{ip: net.IPv4(127, 0, 0, 2), ttl: 300})
+	dns.set("echo.example.", fakeRecord{ip: net.IPv4(127, 0, 0, 1), ttl: 300})
+	rules := acl.New()
+	if err := rules.Load(strings.NewReader("deny domain blocked.example\ndeny cidr 127.0.0.2/32\n")); err != nil {
+		t.Fatal(err)
+	}
+	s, server := startServer(t, WithDNSCache(16, time.Hour),
+		WithUpstreamDialer(acl.NewDialer(rules, &net.Dialer{}, "denied by test policy")))
+	s.dns = fakeDNSResolver(t, dns, 0, 16, time.Hour)
+	sc := startClient(t, server)
+	_, port, _ := net.SplitHostPort(tcpEcho(t))
+
+	for _, host := range []string{"blocked.example", "internal.example"} {
+		c, err := sc.GetSession(net.JoinHostPort(host, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ae *AppError
+		if err := waitConnected(t, c); !errors.As(err, &ae) || ae.Error() != "denied by test policy" {
+			t.Fatalf("%s: got %v, want the policy error", host, err)
+		}
+		sc.DropSession(c)
+	}
+	if n := dns.count("blocked.example."); n != 0 {
+		t.Fatalf("%d lookups of a denied name", n)
+	}
+
+	c, err := sc.GetSession(net.JoinHostPort("echo.example", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.DropSession(c)
+	if !echoes(c, []byte("allowed")) {
+		t.Fatal("no echo through an allowed name")
+	}
+}
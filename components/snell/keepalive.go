@@ -0,0 +1,37 @@
+//go:build !linux
+
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"net"
+)
+
+// setKeepAlive only applies the idle time here, the probe interval and
+// count keep the system defaults.
+func setKeepAlive(c net.Conn, ka KeepAlive) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tc.SetKeepAlive(ka.Enable); err != nil || !ka.Enable {
+		return err
+	}
+	if ka.Idle > 0 {
+		return tc.SetKeepAlivePeriod(ka.Idle)
+	}
+	return nil
+}
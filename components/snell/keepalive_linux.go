@@ -0,0 +1,54 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func setKeepAlive(c net.Conn, ka KeepAlive) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if !ka.Enable {
+		return tc.SetKeepAlive(false)
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	set := func(fd uintptr, opt, val int) {
+		if serr == nil && val > 0 {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, opt, val)
+		}
+	}
+	err = rc.Control(func(fd uintptr) {
+		set(fd, unix.TCP_KEEPIDLE, int(ka.Idle.Seconds()))
+		set(fd, unix.TCP_KEEPINTVL, int(ka.Interval.Seconds()))
+		set(fd, unix.TCP_KEEPCNT, ka.Count)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,113 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// serveShards accepts on every listener until it is closed, closing the
+// accepted conns right away.
+func serveShards(ls []net.Listener) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for _, l := range ls {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}(l)
+	}
+	return &wg
+}
+
+func TestListenShardsSharePort(t *testing.T) {
+	ls, err := listenShards("127.0.0.1:0", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := serveShards(ls)
+	defer wg.Wait()
+	defer func() {
+		for _, l := range ls {
+			l.Close()
+		}
+	}()
+
+	if runtime.GOOS == "linux" && len(ls) != 4 {
+		t.Fatalf("got %d listeners, want 4", len(ls))
+	}
+	for _, l := range ls[1:] {
+		if l.Addr().String() != ls[0].Addr().String() {
+			t.Fatalf("shard on %s, first one on %s", l.Addr(), ls[0].Addr())
+		}
+	}
+	for i := 0; i < 16; i++ {
+		c, err := net.Dial("tcp", ls[0].Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+}
+
+// BenchmarkAccept measures accepts per second under a connection storm,
+// every P dialing in a loop, against a single listener and against
+// SO_REUSEPORT shards. Dialed conns are reset so that a long run does not
+// exhaust the ephemeral ports.
+func BenchmarkAccept(b *testing.B) {
+	for _, bc := range []struct {
+		name   string
+		shards int
+	}{
+		{"single", 1},
+		{"sharded", runtime.GOMAXPROCS(0)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ls, err := listenShards("127.0.0.1:0", bc.shards)
+			if err != nil {
+				b.Fatal(err)
+			}
+			wg := serveShards(ls)
+			addr := ls[0].Addr().String()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					c.(*net.TCPConn).SetLinger(0) // no TIME_WAIT piling up
+					c.Close()
+				}
+			})
+			b.StopTimer()
+			for _, l := range ls {
+				l.Close()
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"sync"
+	"time"
+)
+
+// acceptPacer spaces out accepts to at most rate per second. During the
+// first slowStart after creation the rate ramps up linearly from a tenth of
+// it, so that a burst right after start does not hit cold caches at full
+// speed.
+type acceptPacer struct {
+	rate      float64
+	slowStart time.Duration
+	start     time.Time
+
+	mux  sync.Mutex
+	next time.Time
+}
+
+func newAcceptPacer(rate float64, slowStart time.Duration) *acceptPacer {
+	return &acceptPacer{
+		rate:      rate,
+		slowStart: slowStart,
+		start:     time.Now(),
+	}
+}
+
+func (p *acceptPacer) currentRate(now time.Time) float64 {
+	if elapsed := now.Sub(p.start); elapsed < p.slowStart {
+		return p.rate * (0.1 + 0.9*float64(elapsed)/float64(p.slowStart))
+	}
+	return p.rate
+}
+
+// wait blocks until the next accept is due, it reports how long it stalled.
+func (p *acceptPacer) wait() time.Duration {
+	p.mux.Lock()
+	now := time.Now()
+	due := p.next
+	if due.Before(now) {
+		due = now
+	}
+	p.next = due.Add(time.Duration(float64(time.Second) / p.currentRate(due)))
+	p.mux.Unlock()
+
+	stall := due.Sub(now)
+	if stall > 0 {
+		time.Sleep(stall)
+	}
+	return stall
+}
@@ -18,67 +18,209 @@ import (
 	"context"
 	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	log "github.com/golang/glog"
 	"github.com/icpz/pool"
 )
 
+var ErrPoolExhausted = errors.New("snell session pool exhausted")
+
 type snellFactory = func() (net.Conn, error)
 
+// healthChecker is implemented by sessions able to tell whether an idle
+// transport is still usable without consuming tunnel data.
+type healthChecker interface {
+	alive() bool
+}
+
+// pinger is implemented by sessions able to check the server end to end
+// with a ping request.
+type pinger interface {
+	ping(timeout time.Duration) bool
+}
+
+// pooledSession is a session of the pool, or a slot reserved for one still
+// to be dialed while Conn is nil.
+type pooledSession struct {
+	net.Conn
+	created time.Time
+	uses    int
+}
+
 type snellPool struct {
-	pool *pool.Pool
+	pool     *pool.Pool
+	maxTotal int32
+	maxAge   time.Duration
+	maxReuse int
+	ping     time.Duration
+	total    int32
+	factory  snellFactory
+
+	mux    sync.RWMutex // take and put against Close, which closes the idle list
+	closed bool
 }
 
 func (p *snellPool) Get() (net.Conn, error) {
-	i := p.pool.Get()
-	switch e := i.(type) {
-	case error:
-		return nil, e
-	case net.Conn:
+	for {
+		ps, err := p.take()
+		if err != nil {
+			return nil, err
+		}
+		if ps.Conn == nil {
+			// dialed without the lock, so that Close does not wait for it
+			c, err := p.factory()
+			if err != nil {
+				atomic.AddInt32(&p.total, -1)
+				return nil, err
+			}
+			ps.Conn, ps.created = c, time.Now()
+			if p.isClosed() {
+				p.destroy(ps)
+				return nil, net.ErrClosed
+			}
+		} else if !p.usable(ps) {
+			p.destroy(ps)
+			continue
+		}
+		ps.uses++
 		return &snellPoolConn{
-			Conn: e,
+			Conn: ps.Conn,
+			item: ps,
 			pool: p,
 		}, nil
 	}
-	return nil, errors.New("Invalid Type")
+}
+
+// take pops an idle session, or reserves a slot for a new one.
+func (p *snellPool) take() (*pooledSession, error) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	if p.closed {
+		return nil, net.ErrClosed
+	}
+	switch e := p.pool.Get().(type) {
+	case error:
+		return nil, e
+	case *pooledSession:
+		return e, nil
+	default:
+		return nil, errors.New("Invalid Type")
+	}
+}
+
+func (p *snellPool) isClosed() bool {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.closed
+}
+
+func (p *snellPool) usable(ps *pooledSession) bool {
+	if p.maxAge > 0 && time.Since(ps.created) > p.maxAge {
+		log.V(1).Infof("Drop conn %s, max age reached\n", ps.LocalAddr().String())
+		return false
+	}
+	if p.maxReuse > 0 && ps.uses >= p.maxReuse {
+		log.V(1).Infof("Drop conn %s, max reuse reached\n", ps.LocalAddr().String())
+		return false
+	}
+	if hc, ok := ps.Conn.(healthChecker); ok && !hc.alive() {
+		log.V(1).Infof("Drop conn %s, health check failed\n", ps.LocalAddr().String())
+		return false
+	}
+	if pg, ok := ps.Conn.(pinger); ok && p.ping > 0 && !pg.ping(p.ping) {
+		log.V(1).Infof("Drop conn %s, ping failed\n", ps.LocalAddr().String())
+		return false
+	}
+	return true
+}
+
+func (p *snellPool) destroy(ps *pooledSession) {
+	atomic.AddInt32(&p.total, -1)
+	ps.Conn.Close()
+}
+
+// put returns ps to the idle list, or destroys it once the pool is closed.
+func (p *snellPool) put(ps *pooledSession) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	if p.closed {
+		p.destroy(ps)
+		return
+	}
+	p.pool.Put(ps)
 }
 
 func (p *snellPool) Close() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
 	p.pool.ReleaseAll()
 }
 
 type snellPoolConn struct {
 	net.Conn
-	pool *snellPool
+	item     *pooledSession
+	pool     *snellPool
+	unusable bool
 }
 
 func (pc *snellPoolConn) Close() error {
-	if pc.pool == nil {
-		return pc.Conn.Close()
+	if pc.unusable {
+		pc.pool.destroy(pc.item)
+		return nil
+	}
+	pc.pool.put(pc.item)
+	return nil
+}
+
+// WaitConnected blocks until the server confirmed the tunnel, see
+// clientSession.WaitConnected.
+func (pc *snellPoolConn) WaitConnected() error {
+	if cs, ok := pc.Conn.(*clientSession); ok {
+		return cs.WaitConnected()
 	}
-	pc.pool.pool.Put(pc.Conn)
 	return nil
 }
 
 func (pc *snellPoolConn) MarkUnusable() {
-	pc.pool = nil
+	pc.unusable = true
 }
 
-func newSnellPool(maxSize, leaseMS int, factory snellFactory) (*snellPool, error) {
-	p := pool.New(
+// newSnellPool creates a session pool keeping at most maxIdle idle sessions
+// for idle time each. maxTotal bounds idle plus in-use sessions, 0 means no
+// limit.
+//
+// Idle sessions are health checked before being handed out: passively,
+// then with a ping request bounded by ping unless it is 0.
+func newSnellPool(maxIdle, maxTotal int, idle, maxAge time.Duration, maxReuse int, ping time.Duration, factory snellFactory) (*snellPool, error) {
+	sp := &snellPool{
+		maxTotal: int32(maxTotal),
+		maxAge:   maxAge,
+		maxReuse: maxReuse,
+		ping:     ping,
+		factory:  factory,
+	}
+	sp.pool = pool.New(
 		func(ctx context.Context) interface{} {
-			c, e := factory()
-			if e != nil {
-				return e
+			if n := atomic.AddInt32(&sp.total, 1); sp.maxTotal > 0 && n > sp.maxTotal {
+				atomic.AddInt32(&sp.total, -1)
+				return ErrPoolExhausted
 			}
-			return c
+			return &pooledSession{}
 		},
-		pool.OptCapacity(maxSize),
-		pool.OptLeaseMS(int64(leaseMS)),
+		pool.OptCapacity(maxIdle),
+		pool.OptLeaseMS(idle.Milliseconds()),
 		pool.OptDeleter(func(i interface{}) {
-			if c, ok := i.(net.Conn); ok {
-				c.Close()
+			if ps, ok := i.(*pooledSession); ok {
+				sp.destroy(ps)
 			}
 		}),
 	)
-	return &snellPool{p}, nil
+	return sp, nil
 }
@@ -0,0 +1,283 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSession is a pooled session whose health is set by the test.
+type fakeSession struct {
+	net.Conn
+	id     int
+	dead   int32
+	mute   int32 // fails pings only
+	pings  int32
+	closed int32
+}
+
+func (f *fakeSession) alive() bool { return atomic.LoadInt32(&f.dead) == 0 }
+func (f *fakeSession) ping(time.Duration) bool {
+	atomic.AddInt32(&f.pings, 1)
+	return atomic.LoadInt32(&f.mute) == 0
+}
+func (f *fakeSession) Close() error        { atomic.StoreInt32(&f.closed, 1); return nil }
+func (f *fakeSession) LocalAddr() net.Addr { return &net.TCPAddr{Port: f.id} }
+
+type fakeFactory struct {
+	mux      sync.Mutex
+	sessions []*fakeSession
+}
+
+func (ff *fakeFactory) dial() (net.Conn, error) {
+	ff.mux.Lock()
+	defer ff.mux.Unlock()
+	s := &fakeSession{id: len(ff.sessions) + 1}
+	ff.sessions = append(ff.sessions, s)
+	return s, nil
+}
+
+func (ff *fakeFactory) dialed() int {
+	ff.mux.Lock()
+	defer ff.mux.Unlock()
+	return len(ff.sessions)
+}
+
+func sessionOf(t *testing.T, c net.Conn) *fakeSession {
+	t.Helper()
+	return c.(*snellPoolConn).Conn.(*fakeSession)
+}
+
+func TestPoolReusesIdleSession(t *testing.T) {
+	ff := &fakeFactory{}
+	sp, _ := newSnellPool(2, 0, time.Minute, 0, 0, 0, ff.dial)
+	defer sp.Close()
+
+	c, err := sp.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := sessionOf(t, c)
+	c.Close()
+	c, err = sp.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionOf(t, c) != first || ff.dialed() != 1 {
+		t.Fatalf("idle session not reused, %d dialed", ff.dialed())
+	}
+}
+
+func TestPoolDropsUnhealthySession(t *testing.T) {
+	ff := &fakeFactory{}
+	sp, _ := newSnellPool(2, 0, time.Minute, 0, 0, 0, ff.dial)
+	defer sp.Close()
+
+	c, _ := sp.Get()
+	broken := sessionOf(t, c)
+	c.Close()
+	atomic.StoreInt32(&broken.dead, 1)
+
+	c, err := sp.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionOf(t, c) == broken {
+		t.Fatal("a session failing its health check was handed out")
+	}
+	if atomic.LoadInt32(&broken.closed) == 0 {
+		t.Fatal("unhealthy session not closed")
+	}
+}
+
+func TestPoolUnusableSessionNotReturned(t *testing.T) {
+	ff := &fakeFactory{}
+	sp, _ := newSnellPool(2, 0, time.Minute, 0, 0, 0, ff.dial)
+	defer sp.Close()
+
+	c, _ := sp.Get()
+	broken := sessionOf(t, c)
+	c.(*snellPoolConn).MarkUnusable()
+	c.Close()
+
+	c, _ = sp.Get()
+	if sessionOf(t, c) == broken {
+		t.Fatal("a session marked unusable was handed out again")
+	}
+}
+
+func TestPoolSessionLimits(t *testing.T) {
+	ff := &fakeFactory{}
+	sp, _ := newSnellPool(2, 0, time.Minute, time.Hour, 2, 0, ff.dial)
+	defer sp.Close()
+
+	c, _ := sp.Get()
+	first := sessionOf(t, c)
+	c.Close()
+	c, _ = sp.Get()
+	if sessionOf(t, c) != first {
+		t.Fatal("session retired before its reuse limit")
+	}
+	c.Close()
+	c, _ = sp.Get()
+	if sessionOf(t, c) == first {
+		t.Fatal("session handed out beyond its reuse limit")
+	}
+	second := sessionOf(t, c)
+	c.(*snellPoolConn).item.created = time.Now().Add(-2 * time.Hour)
+	c.Close()
+	c, _ = sp.Get()
+	if sessionOf(t, c) == second {
+		t.Fatal("session handed out beyond its maximum age")
+	}
+}
+
+func TestPoolMaxTotal(t *testing.T) {
+	ff := &fakeFactory{}
+	sp, _ := newSnellPool(2, 2, time.Minute, 0, 0, 0, ff.dial)
+	defer sp.Close()
+
+	a, _ := sp.Get()
+	b, _ := sp.Get()
+	if _, err := sp.Get(); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("got %v beyond the total limit, want ErrPoolExhausted", err)
+	}
+	a.(*snellPoolConn).MarkUnusable()
+	a.Close()
+	if _, err := sp.Get(); err != nil {
+		t.Fatalf("destroyed session not released from the total: %v", err)
+	}
+	b.Close()
+}
+
+func TestPoolConcurrentNeverSharesSession(t *testing.T) {
+	ff := &fakeFactory{}
+	sp, _ := newSnellPool(4, 0, time.Minute, 0, 0, 0, ff.dial)
+	defer sp.Close()
+
+	var inUse sync.Map
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				c, err := sp.Get()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				fs := c.(*snellPoolConn).Conn.(*fakeSession)
+				if _, dup := inUse.LoadOrStore(fs, true); dup {
+					t.Error("session handed out twice at once")
+				}
+				if j%7 == 0 {
+					atomic.StoreInt32(&fs.dead, 1)
+				}
+				inUse.Delete(fs)
+				c.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPoolPutAfterClose(t *testing.T) {
+	ff := &fakeFactory{}
+	sp, _ := newSnellPool(2, 0, time.Minute, 0, 0, 0, ff.dial)
+
+	c, _ := sp.Get()
+	sp.Close()
+	c.Close()
+	if atomic.LoadInt32(&sessionOf(t, c).closed) == 0 {
+		t.Fatal("session returned to a closed pool not closed")
+	}
+}
+
+func TestPoolGetAfterClose(t *testing.T) {
+	ff := &fakeFactory{}
+	sp, _ := newSnellPool(2, 0, time.Minute, 0, 0, 0, ff.dial)
+	sp.Close()
+	if _, err := sp.Get(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v from a closed pool, want net.ErrClosed", err)
+	}
+}
+
+func TestPoolPingsIdleSession(t *testing.T) {
+	ff := &fakeFactory{}
+	sp, _ := newSnellPool(2, 0, time.Minute, 0, 0, time.Second, ff.dial)
+	defer sp.Close()
+
+	c, _ := sp.Get()
+	first := sessionOf(t, c)
+	if atomic.LoadInt32(&first.pings) != 0 {
+		t.Fatal("freshly dialed session pinged")
+	}
+	c.Close()
+	c, _ = sp.Get()
+	if sessionOf(t, c) != first || atomic.LoadInt32(&first.pings) != 1 {
+		t.Fatalf("idle session not pinged before reuse, %d pings", first.pings)
+	}
+	c.Close()
+
+	atomic.StoreInt32(&first.mute, 1)
+	c, _ = sp.Get()
+	if sessionOf(t, c) == first {
+		t.Fatal("a session failing its ping was handed out")
+	}
+	if atomic.LoadInt32(&first.closed) == 0 {
+		t.Fatal("session failing its ping not closed")
+	}
+}
+
+func TestPoolCloseDuringDial(t *testing.T) {
+	fs := &fakeSession{id: 1}
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	sp, _ := newSnellPool(2, 0, time.Minute, 0, 0, 0, func() (net.Conn, error) {
+		close(dialing)
+		<-release
+		return fs, nil
+	})
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := sp.Get()
+		got <- err
+	}()
+	<-dialing
+	closed := make(chan struct{})
+	go func() {
+		sp.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for a dial in flight")
+	}
+	close(release)
+	if err := <-got; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v for a dial finished after Close, want net.ErrClosed", err)
+	}
+	if atomic.LoadInt32(&fs.closed) == 0 {
+		t.Fatal("session dialed after Close not closed")
+	}
+}
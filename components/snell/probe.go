@@ -0,0 +1,80 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// probeTarget fills the target of a ping request, it is never dialed.
+const probeTarget = "localhost"
+
+// ProbeResult reports the latencies of a successful Probe.
+type ProbeResult struct {
+	Connect   time.Duration // TCP connect
+	FirstByte time.Duration // request sent to first byte of the answer
+	Total     time.Duration
+}
+
+// Probe checks a Snell server end to end, e.g. for load balancer health
+// checks: it connects with dialer (a net.Dialer if nil), sends a ping
+// request sealed with ciph and waits for the pong, so the PSK and the
+// crypto path are exercised without any target being dialed. ctx bounds
+// the whole probe. No obfuscation is applied.
+func Probe(ctx context.Context, dialer UpstreamDialer, server string, ciph aead.Cipher) (*ProbeResult, error) {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	res := &ProbeResult{}
+	start := time.Now()
+	c, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	res.Connect = time.Since(start)
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	conn := aead.NewConn(c, ciph, aead.WithRole(aead.RoleClient))
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{Version, CommandPing, 0})
+	buf.WriteByte(byte(len(probeTarget)))
+	buf.WriteString(probeTarget)
+	buf.Write([]byte{0, 80})
+
+	sent := time.Now()
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 1)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	res.FirstByte = time.Since(sent)
+	if resp[0] != ResponsePong {
+		return nil, fmt.Errorf("unexpected response 0x%x to ping", resp[0])
+	}
+	res.Total = time.Since(start)
+	return res, nil
+}
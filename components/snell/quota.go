@@ -0,0 +1,274 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultQuotaInterval = 10 * time.Second
+
+var ErrQuotaExceeded = errors.New("traffic quota exhausted")
+
+// QuotaReporter connects the byte counters of the server to an external
+// quota or billing service. Users are the client ids of WithClientID,
+// empty for clients sending none. It must be safe for concurrent use.
+type QuotaReporter interface {
+	// ReportUsage adds the bytes relayed for user, both ways, since the
+	// last report.
+	ReportUsage(user string, bytes uint64)
+	// CheckQuota returns how many more bytes user may relay, ok false
+	// refusing any.
+	CheckQuota(user string) (remaining uint64, ok bool)
+}
+
+// WithQuota meters the TCP tunnels and UDP relays of every user against q,
+// UDP by payload. Each request checks the quota first and is refused with
+// ErrQuotaExceeded once it is exhausted. Usage is reported in batches,
+// once per user every interval (DefaultQuotaInterval if not positive), and
+// the quota checked again then: requests are admitted from the quota of
+// the last check, q being asked only for users not known yet. In between,
+// the bytes relayed are taken off the remaining quota locally, so that a
+// quota running out mid-transfer ends the tunnels of the user at once
+// instead of at the next report. Snell can only carry an error in place
+// of ResponseTunnel, so those tunnels are aborted and their clients see a
+// reset.
+func WithQuota(q QuotaReporter, interval time.Duration) ServerOption {
+	return func(s *SnellServer) {
+		if interval <= 0 {
+			interval = DefaultQuotaInterval
+		}
+		s.quota = &quotaTracker{
+			q:        q,
+			interval: interval,
+			users:    make(map[string]*quotaUser),
+			done:     make(chan struct{}),
+		}
+	}
+}
+
+// quotaTracker batches the usage of the users with requests in flight.
+type quotaTracker struct {
+	q        QuotaReporter
+	interval time.Duration
+
+	mux   sync.Mutex
+	users map[string]*quotaUser
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type quotaUser struct {
+	name      string
+	pending   uint64 // bytes not reported yet
+	remaining int64  // as of the last check, less the bytes since
+
+	checkOnce sync.Once // the first check, before the first admission
+
+	refs  int // requests admitted and not released, guarded by the tracker
+	conns map[*quotaConn]struct{}
+}
+
+func (t *quotaTracker) run() {
+	tk := time.NewTicker(t.interval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			t.flush()
+		case <-t.done:
+			t.flush()
+			return
+		}
+	}
+}
+
+// close reports what is pending one last time and stops reporting.
+func (t *quotaTracker) close() {
+	if t == nil {
+		return
+	}
+	t.closeOnce.Do(func() { close(t.done) })
+}
+
+// flush reports the usage of every user and refreshes the quota of those
+// kept, ending their tunnels if it ran out. Users neither active nor with
+// usage pending are forgotten.
+func (t *quotaTracker) flush() {
+	t.mux.Lock()
+	users := make([]*quotaUser, 0, len(t.users))
+	for _, u := range t.users {
+		users = append(users, u)
+	}
+	t.mux.Unlock()
+
+	for _, u := range users {
+		if n := atomic.SwapUint64(&u.pending, 0); n > 0 {
+			t.q.ReportUsage(u.name, n)
+		}
+		t.mux.Lock()
+		active := u.refs > 0
+		kept := active || atomic.LoadUint64(&u.pending) > 0
+		if !kept {
+			delete(t.users, u.name)
+		}
+		t.mux.Unlock()
+		if kept && !t.check(u) && active {
+			t.exhaust(u)
+		}
+	}
+}
+
+// check refreshes the remaining quota of u from the service, reporting
+// whether some is left once the bytes not reported yet are taken off. A
+// refusal leaves none.
+func (t *quotaTracker) check(u *quotaUser) bool {
+	rem, ok := t.q.CheckQuota(u.name)
+	left := int64(math.MaxInt64)
+	if rem < math.MaxInt64 {
+		left = int64(rem)
+	}
+	if !ok {
+		left = 0
+	}
+	left -= int64(atomic.LoadUint64(&u.pending))
+	atomic.StoreInt64(&u.remaining, left)
+	return left > 0
+}
+
+// admit checks the quota of user for a request, which must be released
+// once done if admitted. The quota is the one cached as of the last flush,
+// less the bytes since, so requests cost the service nothing; only the
+// first request of a user not cached yet waits for a check.
+func (t *quotaTracker) admit(user string) (*quotaUser, bool) {
+	t.mux.Lock()
+	u := t.users[user]
+	if u == nil {
+		u = &quotaUser{name: user, conns: make(map[*quotaConn]struct{})}
+		t.users[user] = u
+	}
+	u.refs++
+	t.mux.Unlock()
+
+	u.checkOnce.Do(func() { t.check(u) })
+	if atomic.LoadInt64(&u.remaining) <= 0 {
+		t.release(u, nil)
+		return nil, false
+	}
+	return u, true
+}
+
+// release ends a request admitted for u, qc being its tunnel if any.
+func (t *quotaTracker) release(u *quotaUser, qc *quotaConn) {
+	if t == nil || u == nil {
+		return
+	}
+	t.mux.Lock()
+	u.refs--
+	if qc != nil {
+		delete(u.conns, qc)
+	}
+	t.mux.Unlock()
+}
+
+// wrap meters the target side c of a tunnel for u, peer being the client
+// side aborted along with it. For a UDP relay c is the socket, metered
+// through ReadFrom and WriteTo.
+func (t *quotaTracker) wrap(u *quotaUser, c, peer net.Conn) *quotaConn {
+	qc := &quotaConn{Conn: c, peer: peer, user: u, t: t}
+	t.mux.Lock()
+	u.conns[qc] = struct{}{}
+	t.mux.Unlock()
+	return qc
+}
+
+// exhaust aborts the tunnels of u.
+func (t *quotaTracker) exhaust(u *quotaUser) {
+	t.mux.Lock()
+	conns := make([]*quotaConn, 0, len(u.conns))
+	for qc := range u.conns {
+		conns = append(conns, qc)
+	}
+	t.mux.Unlock()
+	for _, qc := range conns {
+		qc.abort()
+	}
+}
+
+// quotaConn counts the bytes of a tunnel against the quota of its user.
+type quotaConn struct {
+	net.Conn
+	peer net.Conn
+	user *quotaUser
+	t    *quotaTracker
+	over int32 // set once aborted
+}
+
+func (c *quotaConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count(n)
+	return n, err
+}
+
+func (c *quotaConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.count(n)
+	return n, err
+}
+
+func (c *quotaConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.Conn.(net.PacketConn).ReadFrom(b)
+	c.count(n)
+	return n, addr, err
+}
+
+func (c *quotaConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.Conn.(net.PacketConn).WriteTo(b, addr)
+	c.count(n)
+	return n, err
+}
+
+func (c *quotaConn) count(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddUint64(&c.user.pending, uint64(n))
+	if atomic.AddInt64(&c.user.remaining, -int64(n)) <= 0 {
+		c.t.exhaust(c.user)
+	}
+}
+
+func (c *quotaConn) abort() {
+	if !atomic.CompareAndSwapInt32(&c.over, 0, 1) {
+		return
+	}
+	c.Conn.Close()
+	if ce, ok := c.peer.(interface{ CloseWithError(error) error }); ok {
+		ce.CloseWithError(ErrQuotaExceeded)
+	} else {
+		c.peer.Close()
+	}
+}
+
+// exhausted reports whether the tunnel was aborted for its quota.
+func (c *quotaConn) exhausted() bool {
+	return c != nil && atomic.LoadInt32(&c.over) != 0
+}
@@ -0,0 +1,215 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockQuota is a quota service with a fixed quota per user, keeping what
+// was reported and how often each user was checked.
+type mockQuota struct {
+	mux      sync.Mutex
+	quota    map[string]uint64
+	denied   map[string]bool
+	used     map[string]uint64
+	checks   map[string]int
+	reported map[string]uint64
+}
+
+func newMockQuota() *mockQuota {
+	return &mockQuota{
+		quota:    map[string]uint64{},
+		denied:   map[string]bool{},
+		used:     map[string]uint64{},
+		checks:   map[string]int{},
+		reported: map[string]uint64{},
+	}
+}
+
+func (m *mockQuota) ReportUsage(user string, bytes uint64) {
+	m.mux.Lock()
+	m.used[user] += bytes
+	m.reported[user] += bytes
+	m.mux.Unlock()
+}
+
+func (m *mockQuota) CheckQuota(user string) (uint64, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.checks[user]++
+	if m.denied[user] || m.used[user] >= m.quota[user] {
+		return 0, false
+	}
+	return m.quota[user] - m.used[user], true
+}
+
+func (m *mockQuota) set(user string, quota uint64, denied bool) {
+	m.mux.Lock()
+	m.quota[user], m.denied[user] = quota, denied
+	m.mux.Unlock()
+}
+
+func (m *mockQuota) stats(user string) (checks int, reported uint64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.checks[user], m.reported[user]
+}
+
+// quotaClient runs a client of server sending user as its client id.
+func quotaClient(t *testing.T, server, user string) *SnellClient {
+	return startClient(t, server, WithClientID([]byte(user)))
+}
+
+// tunnelClosed reports whether the server ended the tunnel of c, an echo
+// tunnel, within five seconds.
+func tunnelClosed(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.Copy(io.Discard, c)
+	return !isTimeout(err)
+}
+
+func TestQuotaDeniedAtConnect(t *testing.T) {
+	mq := newMockQuota()
+	mq.set("alice", 1<<30, false)
+	mq.set("bob", 1<<30, true)
+	_, server := startServer(t, WithQuota(mq, time.Hour))
+	echo := tcpEcho(t)
+
+	bob := quotaClient(t, server, "bob")
+	c, err := bob.GetSession(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ae *AppError
+	if err := waitConnected(t, c); !errors.As(err, &ae) || ae.Error() != ErrQuotaExceeded.Error() {
+		t.Fatalf("got %v, want the quota error", err)
+	}
+	bob.DropSession(c)
+
+	// admissions are served from the quota cached at the first check
+	alice := quotaClient(t, server, "alice")
+	for i := 0; i < 5; i++ {
+		c := dialSocks(t, alice, echo)
+		if !echoes(c, []byte("within quota")) {
+			t.Fatal("no echo within the quota")
+		}
+		c.Close()
+	}
+	if checks, _ := mq.stats("alice"); checks != 1 {
+		t.Fatalf("quota of alice checked %d times for 5 requests, want once", checks)
+	}
+}
+
+// TestQuotaDeniedMidStream denies a user with a tunnel open: the next
+// flush ends the tunnel, and further requests are refused.
+func TestQuotaDeniedMidStream(t *testing.T) {
+	mq := newMockQuota()
+	mq.set("carol", 1<<30, false)
+	_, server := startServer(t, WithQuota(mq, 20*time.Millisecond))
+	echo := tcpEcho(t)
+	carol := quotaClient(t, server, "carol")
+
+	c := dialSocks(t, carol, echo)
+	if !echoes(c, []byte("before")) {
+		t.Fatal("no echo before the denial")
+	}
+	mq.set("carol", 1<<30, true)
+	if !tunnelClosed(c) {
+		t.Fatal("tunnel kept open past the denial")
+	}
+
+	eventually(t, "usage not reported", func() bool {
+		_, reported := mq.stats("carol")
+		return reported == 12
+	})
+	sess, err := carol.GetSession(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.DropSession(sess)
+	var ae *AppError
+	if err := waitConnected(t, sess); !errors.As(err, &ae) {
+		t.Fatalf("got %v, want the quota error once denied", err)
+	}
+}
+
+// TestQuotaExhaustedMidStream runs a user out of quota while it pushes
+// data: the tunnel ends without waiting for a flush, about a copy buffer
+// past the quota.
+func TestQuotaExhaustedMidStream(t *testing.T) {
+	mq := newMockQuota()
+	mq.set("dave", 100<<10, false)
+	_, server := startServer(t, WithQuota(mq, time.Hour))
+	echo := tcpEcho(t)
+	dave := quotaClient(t, server, "dave")
+
+	c := dialSocks(t, dave, echo)
+	go func() {
+		buf := make([]byte, 1<<20)
+		c.Write(buf)
+	}()
+	if !tunnelClosed(c) {
+		t.Fatal("tunnel kept open past the quota")
+	}
+	if checks, _ := mq.stats("dave"); checks != 1 {
+		t.Fatalf("quota of dave checked %d times, want once at connect", checks)
+	}
+}
+
+// TestQuotaMetersUDP runs a user out of quota over a UDP session: the
+// datagrams relayed both ways are metered, and the session ends once the
+// quota is exhausted.
+func TestQuotaMetersUDP(t *testing.T) {
+	mq := newMockQuota()
+	mq.set("erin", 1000, false)
+	_, server := startServer(t, WithQuota(mq, 20*time.Millisecond))
+	echo := udpEcho(t)
+	erin := quotaClient(t, server, "erin")
+
+	pc, err := erin.DialUDP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	payload := make([]byte, 300)
+	buf := make([]byte, 512)
+	for i := 0; ; i++ {
+		if i == 10 {
+			t.Fatal("UDP session kept open past the quota")
+		}
+		if _, err := pc.WriteTo(payload, echo); err != nil {
+			break
+		}
+		pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, _, err := pc.ReadFrom(buf); err != nil {
+			if isTimeout(err) {
+				t.Fatal("UDP session neither relayed nor ended")
+			}
+			break
+		}
+	}
+	eventually(t, "UDP usage not reported", func() bool {
+		_, reported := mq.stats("erin")
+		return reported >= 1000
+	})
+}
@@ -0,0 +1,155 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultDNSUpstream = "8.8.8.8:53"
+	// DefaultDNSCacheTTL caps how long an answer is cached, answers
+	// whose records have a shorter TTL expiring with them.
+	DefaultDNSCacheTTL = 60 * time.Second
+
+	resolverCacheSize = 1024
+)
+
+// Resolver resolves names through the tunnel: UDP queries go over a Snell
+// UDP session, TCP queries over a regular tunnel. Note that targets handed
+// to the client as host names are always resolved by the server, this is
+// for applications needing the addresses themselves.
+type Resolver struct {
+	client   *SnellClient
+	upstream string
+	bypass   []string
+	dns      *cachingResolver
+}
+
+// NewResolver creates a resolver querying upstream through client, names
+// matching one of the bypass suffixes are resolved locally. Answers are
+// cached for their TTL, DefaultDNSCacheTTL at most.
+func NewResolver(client *SnellClient, upstream string, bypass []string) *Resolver {
+	if upstream == "" {
+		upstream = DefaultDNSUpstream
+	}
+	r := &Resolver{
+		client:   client,
+		upstream: upstream,
+		bypass:   bypass,
+	}
+	r.SetCacheTTL(DefaultDNSCacheTTL)
+	return r
+}
+
+// SetCacheTTL sets the longest an answer is cached, 0 disabling the cache.
+// It must be called before the resolver is used.
+func (r *Resolver) SetCacheTTL(ttl time.Duration) {
+	size := resolverCacheSize
+	if ttl <= 0 {
+		size = 0
+	}
+	// cannot fail, size is never negative
+	r.dns, _ = newCachingResolver(r.Dial, 0, size, ttl)
+}
+
+// Dial is a net.Resolver Dial hook ignoring address in favor of the
+// configured upstream.
+func (r *Resolver) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if strings.HasPrefix(network, "udp") {
+		sess, err := r.client.newUDPSession()
+		if err != nil {
+			return nil, err
+		}
+		return &udpConn{snellPacketConn: sess, target: udpTarget(r.upstream)}, nil
+	}
+
+	c, err := r.client.GetSession(r.upstream)
+	if err != nil {
+		return nil, err
+	}
+	return &droppedSession{Conn: c, client: r.client}, nil
+}
+
+func (r *Resolver) bypassed(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	for _, suffix := range r.bypass {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupHost resolves host through the tunnel, or locally if bypassed.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+	if r.bypassed(host) {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	}
+	return r.dns.lookup(ctx, host)
+}
+
+// LookupIPAddr is LookupHost returning the addresses parsed.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IPAddr, 0, len(addrs))
+	for _, a := range addrs {
+		ip, zone := a, ""
+		if i := strings.LastIndexByte(a, '%'); i >= 0 {
+			ip, zone = a[:i], a[i+1:]
+		}
+		if parsed := net.ParseIP(ip); parsed != nil {
+			ips = append(ips, net.IPAddr{IP: parsed, Zone: zone})
+		}
+	}
+	return ips, nil
+}
+
+// udpConn is a connected view of a UDP session, it remains a
+// net.PacketConn so the resolver uses datagram framing.
+type udpConn struct {
+	*snellPacketConn
+	target net.Addr
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.target)
+}
+
+// droppedSession tears a pooled session down on Close instead of returning
+// it to the pool, for users not following the ZERO_CHUNK teardown.
+type droppedSession struct {
+	net.Conn
+	client *SnellClient
+}
+
+func (c *droppedSession) Close() error {
+	c.client.DropSession(c.Conn)
+	return nil
+}
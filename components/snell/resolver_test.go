@@ -0,0 +1,114 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func tunnelResolver(t *testing.T, bypass ...string) (*Resolver, *fakeDNS) {
+	t.Helper()
+	_, server := startServer(t)
+	dns := startFakeDNS(t)
+	return NewResolver(startClient(t, server), dns.addr, bypass), dns
+}
+
+func lookup(t *testing.T, r *Resolver, host string) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		t.Fatalf("lookup %s: %v", host, err)
+	}
+	return addrs
+}
+
+func TestResolverThroughTunnel(t *testing.T) {
+	r, dns := tunnelResolver(t)
+	dns.set("udp.example.", fakeRecord{ip: net.IPv4(192, 0, 2, 1), ttl: 300})
+
+	if addrs := lookup(t, r, "udp.example"); len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatalf("got %v", addrs)
+	}
+	ips, err := r.LookupIPAddr(context.Background(), "udp.example")
+	if err != nil || len(ips) != 1 || !ips[0].IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("LookupIPAddr got %v, %v", ips, err)
+	}
+	if n := dns.count("udp.example."); n != 1 {
+		t.Fatalf("%d queries for a cached name, want 1", n)
+	}
+}
+
+func TestResolverTCPFallback(t *testing.T) {
+	r, dns := tunnelResolver(t)
+	dns.set("tcp.example.", fakeRecord{ip: net.IPv4(192, 0, 2, 2), ttl: 300, truncate: true})
+
+	if addrs := lookup(t, r, "tcp.example"); len(addrs) != 1 || addrs[0] != "192.0.2.2" {
+		t.Fatalf("got %v", addrs)
+	}
+	if n := dns.count("tcp.example."); n != 1 {
+		t.Fatalf("%d queries answered over TCP, want 1", n)
+	}
+}
+
+func TestResolverCacheFollowsTTL(t *testing.T) {
+	r, dns := tunnelResolver(t)
+	dns.set("zero.example.", fakeRecord{ip: net.IPv4(192, 0, 2, 3), ttl: 0})
+	dns.set("long.example.", fakeRecord{ip: net.IPv4(192, 0, 2, 4), ttl: 3600})
+	r.SetCacheTTL(100 * time.Millisecond)
+
+	lookup(t, r, "zero.example")
+	lookup(t, r, "zero.example")
+	if n := dns.count("zero.example."); n != 2 {
+		t.Fatalf("%d queries for a name with a zero TTL, want 2", n)
+	}
+
+	lookup(t, r, "long.example")
+	lookup(t, r, "long.example")
+	if n := dns.count("long.example."); n != 1 {
+		t.Fatalf("%d queries within the cache TTL, want 1", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	lookup(t, r, "long.example")
+	if n := dns.count("long.example."); n != 2 {
+		t.Fatalf("%d queries past the cache TTL cap, want 2", n)
+	}
+}
+
+func TestResolverBypass(t *testing.T) {
+	r, dns := tunnelResolver(t, "localhost")
+	addrs := lookup(t, r, "localhost")
+	if len(addrs) == 0 {
+		t.Fatal("no address for localhost")
+	}
+	if n := dns.count("localhost."); n != 0 {
+		t.Fatalf("bypassed name queried %d times through the tunnel", n)
+	}
+	if addrs := lookup(t, r, "192.0.2.9"); len(addrs) != 1 || addrs[0] != "192.0.2.9" {
+		t.Fatalf("literal address got %v", addrs)
+	}
+}
+
+func TestResolverNotFound(t *testing.T) {
+	r, _ := tunnelResolver(t)
+	_, err := r.LookupHost(context.Background(), "missing.example")
+	if de, ok := err.(*net.DNSError); !ok || !de.IsNotFound {
+		t.Fatalf("got %v, want a not found DNSError", err)
+	}
+}
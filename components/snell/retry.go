@@ -0,0 +1,125 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// DialRetry is how the client retries connecting to the server. Only the
+// TCP connect is retried: a request goes out with the first record, so
+// nothing is ever sent twice. A wrong PSK is thus not seen at this stage,
+// the server drops the session once data flows and no retry happens.
+type DialRetry struct {
+	Attempts   int           // including the first, 1 or less disables retries
+	BaseDelay  time.Duration // before the second attempt
+	Multiplier float64       // growth of the delay per attempt, 1 if less
+	Jitter     float64       // random extra delay, as a fraction of it
+}
+
+// WithDialRetry retries connecting to the server on transient failures,
+// refused connections, timeouts or temporary DNS errors, as set by r.
+// Attempts go through the resolved addresses of the server in turn.
+func WithDialRetry(r DialRetry) ClientOption {
+	return func(s *SnellClient) {
+		s.retry = r
+	}
+}
+
+func (r DialRetry) validate() error {
+	if r.Attempts > 1 && (r.BaseDelay < 0 || r.Jitter < 0) {
+		return fmt.Errorf("invalid dial retry delay %v, jitter %v", r.BaseDelay, r.Jitter)
+	}
+	return nil
+}
+
+// delay returns the wait before attempt n, counted from 1 for the first
+// retry.
+func (r DialRetry) delay(n int) time.Duration {
+	m := r.Multiplier
+	if m < 1 {
+		m = 1
+	}
+	d := float64(r.BaseDelay) * math.Pow(m, float64(n-1))
+	if r.Jitter > 0 {
+		d += d * r.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// retryableDialError tells transient connect failures from lasting ones.
+func retryableDialError(err error) bool {
+	var de *net.DNSError
+	if errors.As(err, &de) {
+		return de.IsTemporary || de.IsTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+// dialServer connects to the server, retrying according to s.retry.
+func (s *SnellClient) dialServer() (net.Conn, error) {
+	if s.retry.Attempts <= 1 {
+		return net.Dial("tcp", s.server)
+	}
+	host, port, err := net.SplitHostPort(s.server)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{s.server}
+	for n := 0; ; n++ {
+		if n > 0 {
+			time.Sleep(s.retry.delay(n))
+		}
+		if net.ParseIP(host) == nil {
+			// resolved again each time, a DNS hiccup may be what failed
+			if ips, er := net.DefaultResolver.LookupHost(context.Background(), host); er == nil && len(ips) > 0 {
+				addrs = addrs[:0]
+				for _, ip := range ips {
+					addrs = append(addrs, net.JoinHostPort(ip, port))
+				}
+			} else if er != nil {
+				err = er
+				if !retryableDialError(er) || n+1 >= s.retry.Attempts {
+					return nil, err
+				}
+				log.V(1).Infof("Resolving %s failed, retry: %v\n", host, er)
+				continue
+			}
+		}
+		addr := addrs[n%len(addrs)]
+		var c net.Conn
+		if c, err = net.Dial("tcp", addr); err == nil {
+			return c, nil
+		}
+		if !retryableDialError(err) || n+1 >= s.retry.Attempts {
+			return nil, err
+		}
+		log.V(1).Infof("Connecting to %s failed, retry: %v\n", addr, err)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+func TestRetryableDialError(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{"reset", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNRESET)}, true},
+		{"unreachable", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, true},
+		{"timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, true},
+		{"dns temporary", &net.DNSError{Err: "server misbehaving", IsTemporary: true}, true},
+		{"dns timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, true},
+		{"no such host", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{"bad address", &net.AddrError{Err: "invalid port", Addr: "99999"}, false},
+		{"wrong psk", aead.ErrDesynchronized, false},
+	} {
+		if got := retryableDialError(tc.err); got != tc.retryable {
+			t.Errorf("%s: retryable %v, want %v", tc.name, got, tc.retryable)
+		}
+	}
+}
+
+func TestDialRetryDelay(t *testing.T) {
+	r := DialRetry{Attempts: 4, BaseDelay: 10 * time.Millisecond, Multiplier: 2}
+	for n, want := range []time.Duration{10, 20, 40} {
+		if got := r.delay(n + 1); got != want*time.Millisecond {
+			t.Errorf("retry %d: delay %v, want %v", n+1, got, want*time.Millisecond)
+		}
+	}
+	r.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := r.delay(2); d < 20*time.Millisecond || d > 30*time.Millisecond {
+			t.Fatalf("delay %v outside [20ms, 30ms] with a 0.5 jitter", d)
+		}
+	}
+}
+
+// freeAddr returns a loopback address nothing listens on, for now.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestDialRetryUntilListening(t *testing.T) {
+	addr := freeAddr(t)
+	s := &SnellClient{server: addr, retry: DialRetry{Attempts: 10, BaseDelay: 20 * time.Millisecond}}
+
+	listening := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			listening <- nil
+			return
+		}
+		listening <- l
+	}()
+	c, err := s.dialServer()
+	l := <-listening
+	if l == nil {
+		t.Skip("address taken meanwhile")
+	}
+	defer l.Close()
+	if err != nil {
+		t.Fatalf("refused server not retried until up: %v", err)
+	}
+	c.Close()
+}
+
+func TestDialRetryGivesUp(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		server   string
+		attempts int
+	}{
+		{"refused", freeAddr(t), 3},
+		{"not retryable", "127.0.0.1:99999", 1},
+	} {
+		var delays time.Duration
+		r := DialRetry{Attempts: 3, BaseDelay: 50 * time.Millisecond}
+		for n := 1; n < tc.attempts; n++ {
+			delays += r.delay(n)
+		}
+		s := &SnellClient{server: tc.server, retry: r}
+		start := time.Now()
+		_, err := s.dialServer()
+		took := time.Since(start)
+		if err == nil {
+			t.Fatalf("%s: dial succeeded", tc.name)
+		}
+		// attempts are told apart by the waits between them
+		if took < delays || took >= delays+50*time.Millisecond {
+			t.Errorf("%s: gave up after %v, want %d attempts and %v of waits", tc.name, took, tc.attempts, delays)
+		}
+		if tc.attempts > 1 && !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("%s: got %v, want the last refusal", tc.name, err)
+		}
+	}
+}
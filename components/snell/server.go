@@ -16,11 +16,15 @@ package snell
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -34,30 +38,657 @@ import (
 )
 
 type SnellServer struct {
-	listener net.Listener
-	psk      []byte
-	closed   bool
+	listeners []net.Listener
+	psk       []byte
+	obfsType  string
+	closed    bool
+	shards    int
+
+	handshakes    chan struct{}
+	handshakeWait time.Duration
+	handshakeQMax int64
+	pacer         *acceptPacer
+
+	stats serverCounters
+
+	bindConnID bool
+	dialer     UpstreamDialer
+	keepAlive  KeepAlive
+	maxHeader  int
+	checkRNG   bool
+	rewrite    TargetRewriter
+	onFallback func(peer net.Addr)
+	minVersion int
+	maxVersion int
+	caps       aead.Features
+	udpLimit   *udpLimiter
+	recordTO   time.Duration
+	warmup     bool
+	method     string
+
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+	firstByteTimeout time.Duration
+
+	dns          *cachingResolver // nil unless resolving targets itself
+	dnsTimeout   time.Duration
+	dnsCacheSize int
+	dnsMaxTTL    time.Duration
+
+	dials    chan struct{}
+	dialWait time.Duration
+
+	ciphers atomic.Value // *cipherSnapshot
+
+	rcvBuf int
+	sndBuf int
+
+	connLimit *connLimiter
+	budget    *p.Budget
+	budgetRej bool
+	accessLog AccessLogger
+	registry  *connRegistry
+	rateLimit float64
+	rateBurst int
+	throttle  bool
+	lifetime  time.Duration
+	cover     *aead.CoverTraffic
+	quota     *quotaTracker
+	readBatch int
+}
+
+// TargetRewriter maps the target requested by a client to the one dialed
+// instead, returning it unchanged to leave it alone. ErrDropTarget, or any
+// other error, refuses the request with an error response.
+type TargetRewriter func(target string) (string, error)
+
+var ErrDropTarget = errors.New("destination dropped by policy")
+
+// UpstreamDialer dials the targets requested by clients. Implementations
+// may route, filter or chain connections, an error is reported back to the
+// client as a Snell error response.
+type UpstreamDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type ServerOption func(*SnellServer)
+
+// WithMaxConcurrentHandshakes bounds how many connections may be in the
+// handshake (salt, key derivation, request header) at once. Excess
+// connections wait up to wait for a slot and are dropped afterwards.
+func WithMaxConcurrentHandshakes(n int, wait time.Duration) ServerOption {
+	return func(s *SnellServer) {
+		if n > 0 {
+			s.handshakes = make(chan struct{}, n)
+			s.handshakeWait = wait
+		}
+	}
+}
+
+// WithHandshakeQueue bounds how many connections may wait for a handshake
+// slot (see WithMaxConcurrentHandshakes), further ones are dropped at once.
+func WithHandshakeQueue(n int) ServerOption {
+	return func(s *SnellServer) {
+		s.handshakeQMax = int64(n)
+	}
+}
+
+// WithAcceptPacing caps accepts to rate per second across all listeners,
+// ramping up from a tenth of it during slowStart after the server started.
+// Pending connections wait in the kernel backlog meanwhile.
+func WithAcceptPacing(rate float64, slowStart time.Duration) ServerOption {
+	return func(s *SnellServer) {
+		if rate > 0 {
+			s.pacer = newAcceptPacer(rate, slowStart)
+		}
+	}
+}
+
+// WithReusePort opens shards SO_REUSEPORT listeners on the same address,
+// each with its own accept loop, letting the kernel spread connections.
+// shards <= 0 selects GOMAXPROCS. Only effective on Linux.
+func WithReusePort(shards int) ServerOption {
+	return func(s *SnellServer) {
+		if shards <= 0 {
+			shards = runtime.GOMAXPROCS(0)
+		}
+		s.shards = shards
+	}
+}
+
+// WithAcceptConnIDBinding accepts clients binding their records to a
+// connection id (see WithConnIDBinding) next to stock clients.
+func WithAcceptConnIDBinding() ServerOption {
+	return func(s *SnellServer) {
+		s.bindConnID = true
+	}
+}
+
+// WithListenerKeepAlive sets the TCP keepalive of accepted conns,
+// DefaultKeepAlive by default.
+func WithListenerKeepAlive(ka KeepAlive) ServerOption {
+	return func(s *SnellServer) {
+		s.keepAlive = ka
+	}
+}
+
+// WithRNGCheck makes NewSnellServer fail if the random number generator
+// is not ready, see aead.CheckRNG.
+func WithRNGCheck() ServerOption {
+	return func(s *SnellServer) {
+		s.checkRNG = true
+	}
+}
+
+// WithMaxHeaderSize bounds the request header a client may declare,
+// MaxHeaderSize by default.
+func WithMaxHeaderSize(n int) ServerOption {
+	return func(s *SnellServer) {
+		s.maxHeader = n
+	}
+}
+
+// WithOnFallbackUsed calls fn for every client authenticating with the
+// fallback cipher, see aead.WithOnFallbackUsed.
+func WithOnFallbackUsed(fn func(peer net.Addr)) ServerOption {
+	return func(s *SnellServer) {
+		s.onFallback = fn
+	}
+}
+
+// WithTargetRewriter consults rw for every target before dialing it.
+func WithTargetRewriter(rw TargetRewriter) ServerOption {
+	return func(s *SnellServer) {
+		s.rewrite = rw
+	}
+}
+
+// WithUpstreamDialer replaces the default net.Dialer used to reach targets.
+func WithUpstreamDialer(d UpstreamDialer) ServerOption {
+	return func(s *SnellServer) {
+		s.dialer = d
+	}
+}
+
+// WithMinVersion refuses clients speaking a protocol version below v with
+// ErrVersionTooOld, see CommandVersion.
+func WithMinVersion(v int) ServerOption {
+	return func(s *SnellServer) {
+		s.minVersion = v
+	}
+}
+
+// WithMaxVersion refuses clients speaking a protocol version above v with
+// ErrVersionTooNew, see CommandVersion.
+func WithMaxVersion(v int) ServerOption {
+	return func(s *SnellServer) {
+		s.maxVersion = v
+	}
+}
+
+// WithAcceptCapabilities makes the server answer the capabilities proposed
+// by open-snell clients, agreeing on what both sides offer out of f.
+func WithAcceptCapabilities(f aead.Features) ServerOption {
+	return func(s *SnellServer) {
+		s.caps = f
+	}
+}
+
+// WithUDPLimits bounds the UDP relay use of each client, see UDPLimits.
+func WithUDPLimits(l UDPLimits) ServerOption {
+	return func(s *SnellServer) {
+		s.udpLimit = newUDPLimiter(l)
+	}
+}
+
+// WithRecordTimeout drops clients taking longer than d to send a record
+// once it started, see aead.WithRecordTimeout.
+func WithRecordTimeout(d time.Duration) ServerOption {
+	return func(s *SnellServer) {
+		s.recordTO = d
+	}
+}
+
+// WithCipherWarmup runs aead.Warmup on the server ciphers before
+// listening, for a fast first connection.
+func WithCipherWarmup() ServerOption {
+	return func(s *SnellServer) {
+		s.warmup = true
+	}
+}
+
+// WithDialTimeout bounds how long connecting to a target may take.
+func WithDialTimeout(d time.Duration) ServerOption {
+	return func(s *SnellServer) {
+		s.dialTimeout = d
+	}
+}
+
+// WithHandshakeTimeout bounds how long a client may take to send its first
+// request once connected.
+func WithHandshakeTimeout(d time.Duration) ServerOption {
+	return func(s *SnellServer) {
+		s.handshakeTimeout = d
+	}
+}
+
+// WithFirstByteTimeout tears the session down, the client seeing an error,
+// when a target connected but sent nothing within d. Only for deployments
+// where targets speak first or answer quickly, a target waiting for the
+// client to speak first would be cut off.
+func WithFirstByteTimeout(d time.Duration) ServerOption {
+	return func(s *SnellServer) {
+		s.firstByteTimeout = d
+	}
+}
+
+// WithMaxUpstreamDials bounds how many target dials may be in flight at
+// once. Excess requests wait up to wait for a slot and are answered with
+// ErrTooManyDials afterwards.
+func WithMaxUpstreamDials(n int, wait time.Duration) ServerOption {
+	return func(s *SnellServer) {
+		if n > 0 {
+			s.dials = make(chan struct{}, n)
+			s.dialWait = wait
+		}
+	}
+}
+
+var ErrTooManyDials = errors.New("too many upstream dials in flight")
+
+// WithListenerSocketBuffers sets the socket receive and send buffer sizes
+// of accepted connections, for long fat networks. 0 keeps the system
+// default.
+func WithListenerSocketBuffers(rsize, wsize int) ServerOption {
+	return func(s *SnellServer) {
+		s.rcvBuf = rsize
+		s.sndBuf = wsize
+	}
+}
+
+// WithConnLimit bounds the connections served at once to limit, to stay
+// clear of the file descriptor limit. Once it is reached new connections
+// are held in the kernel backlog or refused, according to mode, until the
+// count drops to lowWater; lowWater outside (0, limit) selects 90% of
+// limit.
+func WithConnLimit(limit, lowWater int, mode ConnLimitMode) ServerOption {
+	return func(s *SnellServer) {
+		if limit > 0 {
+			s.connLimit = newConnLimiter(limit, lowWater, mode)
+		}
+	}
+}
+
+// connBufferCost is what a connection is charged against the buffer
+// budget: the record buffers of both directions and two relay buffers.
+const connBufferCost = 2*(2+16+aead.MaxPayloadSize+16) + 2*p.RelayBufferSize
+
+// WithBufferBudget caps the buffer memory of the connections served at
+// once to bytes, each being charged connBufferCost, about 70KiB, up
+// front. Over budget, new connections are held in the kernel backlog or
+// refused according to mode, like under WithConnLimit, instead of
+// growing the heap. It complements WithConnLimit, which guards file
+// descriptors rather than memory. In ConnLimitPause mode the share of the
+// next connection is reserved before accepting it. Staging buffers of
+// WithListenerReadBatch and UDP sessions are not charged.
+func WithBufferBudget(bytes int64, mode ConnLimitMode) ServerOption {
+	return func(s *SnellServer) {
+		if bytes > 0 {
+			s.budget = p.NewBudget(bytes)
+			s.budgetRej = mode == ConnLimitReject
+		}
+	}
+}
+
+// WithListenerMaxLifetime ends every accepted connection d after its
+// handshake, however busy, see aead.WithMaxLifetime.
+func WithListenerMaxLifetime(d time.Duration) ServerOption {
+	return func(s *SnellServer) {
+		s.lifetime = d
+	}
+}
+
+// WithListenerCoverTraffic sends decoy records on idle accepted
+// connections, see aead.WithCoverTraffic. Clients have to agree on
+// aead.FeaturePadding, or aead.FeatureKeepalive, through
+// WithAcceptCapabilities.
+func WithListenerCoverTraffic(ct aead.CoverTraffic) ServerOption {
+	return func(s *SnellServer) {
+		s.cover = &ct
+	}
+}
+
+// WithListenerReadBatch makes accepted connections hand up to records
+// decrypted records at once to the targets, see
+// aead.WithWriteToBatchSize. It costs records*aead.MaxPayloadSize bytes
+// per busy connection, 0 keeps one record. Data is held back until the
+// batch fills or the stream ends, which stalls request-response traffic:
+// only for deployments carrying bulk transfers.
+func WithListenerReadBatch(records int) ServerOption {
+	return func(s *SnellServer) {
+		s.readBatch = records
+	}
+}
+
+// WithListenerRecordRateLimit bounds the records each accepted connection
+// may send per second, see aead.WithRecordRateLimit. In reject mode the
+// connection is dropped once over the limit.
+func WithListenerRecordRateLimit(rate float64, burst int, throttle bool) ServerOption {
+	return func(s *SnellServer) {
+		s.rateLimit = rate
+		s.rateBurst = burst
+		s.throttle = throttle
+	}
+}
+
+// ServerStats is a snapshot of the server counters.
+type ServerStats struct {
+	HandshakesQueued   int64
+	HandshakesRejected uint64
+	AcceptStalls       uint64
+	AcceptStallTime    time.Duration
+
+	DialsInFlight int64
+	DialsQueued   int64
+	DialsRejected uint64
+
+	// UDP relay, only counted under WithUDPLimits
+	UDPFlows   int
+	UDPDropped uint64
+
+	// payload bytes relayed, up being client to target
+	TCPBytesUp   uint64
+	TCPBytesDown uint64
+	UDPBytesUp   uint64
+	UDPBytesDown uint64
+
+	// connections served, only counted under WithConnLimit
+	Conns          int
+	ConnLimit      int
+	ConnsRefused   uint64
+	ConnsSaturated bool
+
+	// buffer memory charged, only counted under WithBufferBudget
+	BufferUsed     int64
+	BufferBudget   int64
+	BufferRefusals uint64
+
+	// target lookups, only counted under WithDNSCache
+	DNSCacheHits   uint64
+	DNSCacheMisses uint64
+	DNSCacheNames  int
+}
+
+type serverCounters struct {
+	handshakesQueued   int64
+	handshakesRejected uint64
+	acceptStalls       uint64
+	acceptStallTime    int64
+	dialsInFlight      int64
+	dialsQueued        int64
+	dialsRejected      uint64
+	tcpBytesUp         uint64
+	tcpBytesDown       uint64
+	udpBytesUp         uint64
+	udpBytesDown       uint64
+}
+
+func (s *SnellServer) Stats() ServerStats {
+	st := ServerStats{
+		HandshakesQueued:   atomic.LoadInt64(&s.stats.handshakesQueued),
+		HandshakesRejected: atomic.LoadUint64(&s.stats.handshakesRejected),
+		AcceptStalls:       atomic.LoadUint64(&s.stats.acceptStalls),
+		AcceptStallTime:    time.Duration(atomic.LoadInt64(&s.stats.acceptStallTime)),
+		DialsInFlight:      atomic.LoadInt64(&s.stats.dialsInFlight),
+		DialsQueued:        atomic.LoadInt64(&s.stats.dialsQueued),
+		DialsRejected:      atomic.LoadUint64(&s.stats.dialsRejected),
+		TCPBytesUp:         atomic.LoadUint64(&s.stats.tcpBytesUp),
+		TCPBytesDown:       atomic.LoadUint64(&s.stats.tcpBytesDown),
+		UDPBytesUp:         atomic.LoadUint64(&s.stats.udpBytesUp),
+		UDPBytesDown:       atomic.LoadUint64(&s.stats.udpBytesDown),
+	}
+	if s.udpLimit != nil {
+		st.UDPFlows, st.UDPDropped = s.udpLimit.stats()
+	}
+	if s.connLimit != nil {
+		st.Conns, st.ConnsRefused, st.ConnsSaturated = s.connLimit.stats()
+		st.ConnLimit = s.connLimit.limit
+	}
+	if s.budget != nil {
+		st.BufferUsed, st.BufferBudget, st.BufferRefusals = s.budget.Stats()
+	}
+	if s.dns != nil {
+		st.DNSCacheHits, st.DNSCacheMisses, st.DNSCacheNames = s.dns.stats()
+	}
+	return st
+}
+
+// UDPClientStats returns the UDP relay counters of the clients with a UDP
+// session open, by source address. It is nil without WithUDPLimits.
+func (s *SnellServer) UDPClientStats() map[string]UDPClientStats {
+	if s.udpLimit == nil {
+		return nil
+	}
+	return s.udpLimit.clientStats()
+}
+
+// acquireHandshake waits for a handshake slot, it reports false if none
+// became available in time.
+func (s *SnellServer) acquireHandshake() bool {
+	if s.handshakes == nil {
+		return true
+	}
+	select {
+	case s.handshakes <- struct{}{}:
+		return true
+	default:
+	}
+
+	queued := atomic.AddInt64(&s.stats.handshakesQueued, 1)
+	defer atomic.AddInt64(&s.stats.handshakesQueued, -1)
+	if s.handshakeQMax > 0 && queued > s.handshakeQMax {
+		atomic.AddUint64(&s.stats.handshakesRejected, 1)
+		return false
+	}
+	t := time.NewTimer(s.handshakeWait)
+	defer t.Stop()
+	select {
+	case s.handshakes <- struct{}{}:
+		return true
+	case <-t.C:
+		atomic.AddUint64(&s.stats.handshakesRejected, 1)
+		return false
+	}
+}
+
+func (s *SnellServer) releaseHandshake() {
+	if s.handshakes != nil {
+		<-s.handshakes
+	}
+}
+
+// acquireDial waits for an upstream dial slot, it reports false if none
+// became available in time.
+func (s *SnellServer) acquireDial() bool {
+	if s.dials == nil {
+		return true
+	}
+	select {
+	case s.dials <- struct{}{}:
+		atomic.AddInt64(&s.stats.dialsInFlight, 1)
+		return true
+	default:
+	}
+
+	atomic.AddInt64(&s.stats.dialsQueued, 1)
+	defer atomic.AddInt64(&s.stats.dialsQueued, -1)
+	t := time.NewTimer(s.dialWait)
+	defer t.Stop()
+	select {
+	case s.dials <- struct{}{}:
+		atomic.AddInt64(&s.stats.dialsInFlight, 1)
+		return true
+	case <-t.C:
+		atomic.AddUint64(&s.stats.dialsRejected, 1)
+		return false
+	}
+}
+
+func (s *SnellServer) releaseDial() {
+	if s.dials != nil {
+		atomic.AddInt64(&s.stats.dialsInFlight, -1)
+		<-s.dials
+	}
+}
+
+type tagsKey struct{}
+
+// TagsFromContext returns the tags of the client conn a dial was requested
+// on, for use in an UpstreamDialer. It returns nil if there are none.
+func TagsFromContext(ctx context.Context) *aead.Tags {
+	t, _ := ctx.Value(tagsKey{}).(*aead.Tags)
+	return t
+}
+
+// ClientIDFromContext returns the client id sent in the request header,
+// for an UpstreamDialer to route on, empty if the client sent none.
+func ClientIDFromContext(ctx context.Context) string {
+	if t := TagsFromContext(ctx); t != nil {
+		id, _ := t.Get("client")
+		return id
+	}
+	return ""
+}
+
+func connTags(c net.Conn) *aead.Tags {
+	if tc, ok := c.(interface{ Tags() *aead.Tags }); ok {
+		return tc.Tags()
+	}
+	return nil
+}
+
+var (
+	ErrMalformedHeader = errors.New("malformed snell request header")
+	ErrHeaderTooLarge  = errors.New("snell request header too large")
+)
+
+var (
+	ErrVersionTooOld = errors.New("snell protocol version too old")
+	ErrVersionTooNew = errors.New("snell protocol version too new")
+)
+
+// CommandVersion returns the protocol version a request command belongs
+// to: 1 for CommandConnect, 2 for CommandConnectV2 and 3 for CommandUDP.
+// The header version byte stays 1 across all of them. Ping and unknown
+// commands report 0.
+func CommandVersion(cmd byte) int {
+	switch cmd {
+	case CommandConnect:
+		return 1
+	case CommandConnectV2:
+		return 2
+	case CommandUDP:
+		return 3
+	}
+	return 0
+}
+
+// checkVersion applies WithMinVersion and WithMaxVersion to a request.
+func (s *SnellServer) checkVersion(cmd byte) error {
+	v := CommandVersion(cmd)
+	if v == 0 {
+		return nil
+	}
+	if s.minVersion > 0 && v < s.minVersion {
+		return fmt.Errorf("%w: v%d < v%d", ErrVersionTooOld, v, s.minVersion)
+	}
+	if s.maxVersion > 0 && v > s.maxVersion {
+		return fmt.Errorf("%w: v%d > v%d", ErrVersionTooNew, v, s.maxVersion)
+	}
+	return nil
+}
+
+// MaxHeaderSize is the default bound of a request header, well above the
+// largest valid one (516 bytes).
+const MaxHeaderSize = 1024
+
+// checkHeaderSize reports ErrHeaderTooLarge once a header declares more
+// than the configured size.
+func (s *SnellServer) checkHeaderSize(size int) error {
+	max := s.maxHeader
+	if max <= 0 {
+		max = MaxHeaderSize
+	}
+	if size > max {
+		return fmt.Errorf("%w: %d > %d", ErrHeaderTooLarge, size, max)
+	}
+	return nil
+}
+
+// parseTarget validates the host and port of a request header and returns
+// them as a normalized "host:port", IPv6 addresses bracketed.
+func parseTarget(host []byte, port uint16) (string, error) {
+	if len(host) == 0 || port == 0 {
+		return "", ErrMalformedHeader
+	}
+	h := string(host)
+	if len(h) > 2 && h[0] == '[' && h[len(h)-1] == ']' {
+		h = h[1 : len(h)-1]
+	}
+	if ip := net.ParseIP(h); ip != nil {
+		h = ip.String()
+	} else {
+		for i := 0; i < len(h); i++ {
+			if c := h[i]; c <= ' ' || c == ':' || c == '/' || c >= 0x7F {
+				return "", ErrMalformedHeader
+			}
+		}
+	}
+	return net.JoinHostPort(h, strconv.Itoa(int(port))), nil
+}
+
+// readHeader is io.ReadFull where running out of data in the middle of the
+// header, including between two of its fields, is reported as
+// ErrMalformedHeader.
+func readHeader(c net.Conn, buf []byte) error {
+	_, err := io.ReadFull(c, buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = fmt.Errorf("%w: truncated", ErrMalformedHeader)
+	}
+	return err
 }
 
 func (s *SnellServer) ServerHandshake(c net.Conn) (target string, cmd byte, err error) {
-	buf := make([]byte, 255)
-	if _, err = io.ReadFull(c, buf[:3]); err != nil {
+	buf := make([]byte, 255+2)
+	// a conn closed before sending anything ends with a plain io.EOF
+	if _, err = io.ReadFull(c, buf[:1]); err != nil {
+		return
+	}
+	if err = readHeader(c, buf[1:3]); err != nil {
 		return
 	}
 
 	if buf[0] != Version {
 		log.Warningf("invalid snell version %x\n", buf[0])
+		err = fmt.Errorf("%w: version 0x%x", ErrMalformedHeader, buf[0])
 		return
 	}
 
 	cmd = buf[1]
 	clen := buf[2]
+	size := 3 + int(clen)
+	if err = s.checkHeaderSize(size); err != nil {
+		return
+	}
 	if clen > 0 {
-		if _, err = io.ReadFull(c, buf[:clen]); err != nil {
+		if err = readHeader(c, buf[:clen]); err != nil {
 			return
 		}
 
 		log.V(1).Infof("client id %s\n", string(buf[:clen]))
+		if t := connTags(c); t != nil {
+			t.Set("client", string(buf[:clen]))
+		}
 	}
 
 	if cmd == CommandUDP {
@@ -65,75 +696,260 @@ func (s *SnellServer) ServerHandshake(c net.Conn) (target string, cmd byte, err
 		return
 	}
 
-	if _, err = io.ReadFull(c, buf[:1]); err != nil {
+	if err = readHeader(c, buf[:1]); err != nil {
 		return
 	}
-	hlen := buf[0]
-	if _, err = io.ReadFull(c, buf[:hlen+2]); err != nil {
+	hlen := int(buf[0])
+	size += 1 + hlen + 2
+	if err = s.checkHeaderSize(size); err != nil {
 		return
 	}
-	host := string(buf[:hlen])
-	port := strconv.Itoa((int(buf[hlen]) << 8) | int(buf[hlen+1]))
-	target = net.JoinHostPort(host, port)
+	if err = readHeader(c, buf[:hlen+2]); err != nil {
+		return
+	}
+	target, err = parseTarget(buf[:hlen], uint16(buf[hlen])<<8|uint16(buf[hlen+1]))
 	return
 }
 
 func (s *SnellServer) Close() {
 	s.closed = true
-	s.listener.Close()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	if s.connLimit != nil {
+		s.connLimit.close()
+	}
+	if s.budget != nil {
+		s.budget.Close()
+	}
+	s.quota.close()
 }
 
-func NewSnellServer(listen, psk, obfsType string) (*SnellServer, error) {
+func NewSnellServer(listen, psk, obfsType string, opts ...ServerOption) (*SnellServer, error) {
 	if obfsType != "tls" && obfsType != "http" && obfsType != "" {
 		return nil, fmt.Errorf("invalid snell obfs type %s", obfsType)
 	}
 
-	l, err := net.Listen("tcp", listen)
+	bpsk := []byte(psk)
+	ss := &SnellServer{
+		psk:       bpsk,
+		obfsType:  obfsType,
+		shards:    1,
+		dialer:    &net.Dialer{},
+		keepAlive: DefaultKeepAlive,
+	}
+	for _, opt := range opts {
+		opt(ss)
+	}
+	if ss.readBatch < 0 {
+		return nil, fmt.Errorf("%w: %d", aead.ErrInvalidBatchSize, ss.readBatch)
+	}
+	if ss.rcvBuf < 0 || ss.sndBuf < 0 {
+		return nil, fmt.Errorf("invalid socket buffer sizes %d/%d", ss.rcvBuf, ss.sndBuf)
+	}
+	if ss.checkRNG {
+		if err := aead.CheckRNG(); err != nil {
+			return nil, err
+		}
+	}
+	if ss.dnsTimeout > 0 || ss.dnsCacheSize > 0 {
+		dns, err := newCachingResolver((&net.Dialer{}).DialContext, ss.dnsTimeout, ss.dnsCacheSize, ss.dnsMaxTTL)
+		if err != nil {
+			return nil, err
+		}
+		ss.dns = dns
+	}
+
+	ls, err := listenShards(listen, ss.shards)
 	if err != nil {
 		return nil, err
 	}
-	setTcpFastOpen(l, 1)
+	ss.listeners = ls
 
-	bpsk := []byte(psk)
-	ss := &SnellServer{l, bpsk, false}
-	ciph := aead.NewAES128GCM(bpsk)
-	fb := aead.NewChacha20Poly1305(bpsk)
-	go func() {
-		log.Infof("snell server listening at: %s\n", listen)
-		for {
-			c, err := l.Accept()
-			if err != nil {
-				if ss.closed {
-					break
-				}
-				continue
-			}
-			c, _ = obfs.NewObfsServer(c, obfsType)
-			c = aead.NewConnWithFallback(c, ciph, fb)
-			go ss.handleSnell(c)
-		}
-	}()
+	if err := ss.SetCipherConfig(ss.initialCipherConfig()); err != nil {
+		return nil, err
+	}
+	if ss.quota != nil {
+		go ss.quota.run()
+	}
+	log.Infof("snell server listening at: %s\n", listen)
+	for _, l := range ls {
+		setTcpFastOpen(l, 1)
+		go ss.serve(l)
+	}
 
 	return ss, nil
 }
 
-func (s *SnellServer) handleSnell(conn net.Conn) {
+func (s *SnellServer) serve(l net.Listener) {
+	reserved := false // budget held for the next connection
+	defer func() {
+		if reserved {
+			s.budget.Release(connBufferCost)
+		}
+	}()
+	for {
+		if s.pacer != nil {
+			if stall := s.pacer.wait(); stall > 0 {
+				atomic.AddUint64(&s.stats.acceptStalls, 1)
+				atomic.AddInt64(&s.stats.acceptStallTime, int64(stall))
+			}
+		}
+		if s.connLimit != nil && !s.connLimit.wait() {
+			break
+		}
+		if s.budget != nil && !s.budgetRej && !reserved {
+			if !s.budget.Acquire(connBufferCost) {
+				break
+			}
+			reserved = true
+		}
+		c, err := l.Accept()
+		if err != nil {
+			if s.closed {
+				break
+			}
+			continue
+		}
+		if s.connLimit != nil && !s.connLimit.admit() {
+			log.Warningf("Connection limit reached, refuse %s\n", c.RemoteAddr().String())
+			c.Close()
+			continue
+		}
+		if s.budget != nil && !reserved && !s.budget.TryAcquire(connBufferCost) {
+			log.Warningf("Buffer budget exhausted, refuse %s\n", c.RemoteAddr().String())
+			if s.connLimit != nil {
+				s.connLimit.release()
+			}
+			c.Close()
+			continue
+		}
+		charged := s.budget != nil
+		reserved = false
+		if err := setKeepAlive(c, s.keepAlive); err != nil {
+			log.Warningf("Failed to set keepalive: %v\n", err)
+		}
+		if s.rcvBuf > 0 || s.sndBuf > 0 {
+			if err := setSocketBuffers(c, s.rcvBuf, s.sndBuf); err != nil {
+				log.Warningf("Failed to set socket buffers: %v\n", err)
+			}
+		}
+		c, _ = obfs.NewObfsServer(c, s.obfsType)
+		copts := []aead.ConnOption{aead.WithRole(aead.RoleServer)}
+		if s.bindConnID {
+			copts = append(copts, aead.WithOptionalConnID())
+		}
+		if s.onFallback != nil {
+			copts = append(copts, aead.WithOnFallbackUsed(s.onFallback))
+		}
+		if s.recordTO > 0 {
+			copts = append(copts, aead.WithRecordTimeout(s.recordTO))
+		}
+		if s.lifetime > 0 {
+			copts = append(copts, aead.WithMaxLifetime(s.lifetime))
+		}
+		if s.readBatch > 1 {
+			copts = append(copts, aead.WithWriteToBatchSize(s.readBatch))
+		}
+		if s.rateLimit > 0 {
+			copts = append(copts, aead.WithRecordRateLimit(s.rateLimit, s.rateBurst, s.throttle))
+		}
+		if s.cover != nil {
+			copts = append(copts, aead.WithCoverTraffic(*s.cover))
+		}
+		cs := s.currentCiphers()
+		c = aead.NewConnWithFallback(c, cs.primary, cs.fallback, copts...)
+		if host, _, err := net.SplitHostPort(c.RemoteAddr().String()); err == nil {
+			connTags(c).Set("src", host)
+		}
+		acc := s.newAccess(c, cs)
+		if s.connLimit != nil || charged {
+			go func() {
+				if s.connLimit != nil {
+					defer s.connLimit.release()
+				}
+				if charged {
+					defer s.budget.Release(connBufferCost)
+				}
+				s.handleSnell(c, acc)
+			}()
+		} else {
+			go s.handleSnell(c, acc)
+		}
+	}
+}
+
+func (s *SnellServer) handleSnell(conn net.Conn, acc *connAccess) {
 	defer conn.Close()
+	defer s.finishAccess(acc, conn)
+
+	if !s.acquireHandshake() {
+		log.Warningf("Too many concurrent handshakes, drop %s\n", conn.RemoteAddr().String())
+		acc.end("handshake slots exhausted", nil)
+		return
+	}
+	handshaking := true
+	defer func() {
+		if handshaking {
+			s.releaseHandshake()
+		}
+	}()
 
 	isV2 := true
+	first := true
+	tags := connTags(conn)
+
+	if s.handshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
+	}
 
 muxLoop:
 	for isV2 {
 		target, command, err := s.ServerHandshake(conn)
+		if handshaking {
+			handshaking = false
+			s.releaseHandshake()
+		}
 		if err != nil {
 			if err != io.EOF {
 				log.Warningf("Failed to handshake from %s: %v\n", conn.RemoteAddr().String(), err)
+				acc.end("handshake failed", err)
 			}
 			break
 		}
 
+		if first && s.handshakeTimeout > 0 {
+			conn.SetReadDeadline(time.Time{})
+		}
+
+		if err := s.checkVersion(command); err != nil {
+			log.Warningf("Refused request from %s: %v [%s]\n", conn.RemoteAddr().String(), err, tags)
+			s.writeError(conn, err)
+			acc.end("version refused", err)
+			break
+		}
+
+		opening := first
+		var confirm []byte
+		if first {
+			first = false
+			if s.caps != 0 && hasCapabilities(conn) {
+				remote, err := readCapabilities(conn)
+				if err != nil {
+					log.Warningf("Invalid capabilities from %s: %v [%s]\n", conn.RemoteAddr().String(), err, tags)
+					acc.end("handshake failed", err)
+					break
+				}
+				agreed := aead.Negotiate(s.caps, remote)
+				setNegotiated(conn, agreed)
+				buf := bytes.NewBuffer([]byte{ResponseTunnel})
+				encodeCapabilities(buf, agreed)
+				confirm = buf.Bytes()
+			}
+		}
+
 		if command != CommandUDP {
-			log.V(1).Infof("New target from %s to %s\n", conn.RemoteAddr().String(), target)
+			log.V(1).Infof("New target from %s to %s [%s]\n", conn.RemoteAddr().String(), target, tags)
 		}
 
 		if c, ok := conn.(*net.TCPConn); ok {
@@ -141,89 +957,289 @@ muxLoop:
 		}
 
 		if command == CommandPing {
+			acc.request("ping", "")
 			buf := []byte{ResponsePong}
-			conn.Write(buf)
-			break
+			_, el := conn.Write(buf)
+			// a ping opening the connection is a probe, closed once
+			// answered. Later ones check a reused session, which goes on
+			// as after any request.
+			if opening || !s.endRequest(conn, el, acc) {
+				break
+			}
+			continue
+		}
+
+		switch command {
+		case CommandUDP:
+			tags.Set("cmd", "udp")
+			acc.request("udp", "")
+		default:
+			tags.Set("cmd", "tcp")
+			acc.request("tcp", target)
+		}
+
+		var quser *quotaUser
+		if s.quota != nil {
+			user, _ := tags.Get("client")
+			var ok bool
+			if quser, ok = s.quota.admit(user); !ok {
+				log.V(1).Infof("Quota of user %q exhausted, refuse %s [%s]\n", user, conn.RemoteAddr().String(), tags)
+				s.writeError(conn, ErrQuotaExceeded)
+				acc.end("quota exhausted", ErrQuotaExceeded)
+				break
+			}
 		}
 
 		switch command {
 		case CommandConnect:
 			isV2 = false
 		case CommandUDP:
-			s.handleUDPRequest(conn)
+			s.handleUDPRequest(conn, acc, quser)
 			break muxLoop
 		case CommandConnectV2:
 		default:
 			log.Errorf("Unknown command 0x%x\n", command)
+			s.quota.release(quser, nil)
+			acc.end("unknown command", nil)
 			break muxLoop
 		}
 
 		var el error = nil
-		tc, err := net.Dial("tcp", target)
+		ctx := context.WithValue(context.Background(), tagsKey{}, tags)
+		tc, err := s.dialTarget(ctx, target)
 		if err != nil {
+			s.quota.release(quser, nil)
+			acc.end("dial failed", err)
 			el = s.writeError(conn, err)
 		} else {
 			defer tc.Close()
-			_, el = conn.Write([]byte{ResponseTunnel})
+			if confirm == nil {
+				confirm = []byte{ResponseTunnel}
+			}
+			_, el = conn.Write(confirm)
 			if el != nil {
+				s.quota.release(quser, nil)
 				log.Errorf("Failed to write ResponseTunnel: %v\n", el)
 			} else {
-				el, _ = utils.Relay(conn, tc)
-			}
-		}
-
-		if isV2 {
-			conn.SetReadDeadline(time.Time{})
-			_, err := conn.Write([]byte{}) // write zero chunk back
-			if err != nil {
-				log.Errorf("Unexpected write error %v\n", err)
-				return
-			}
-			if e, ok := el.(*net.OpError); ok {
-				if e.Op == "write" {
-					el = nil
+				var fb *firstByteConn
+				var qc *quotaConn
+				var upstream net.Conn = &countingConn{acc.countConn(tc), &s.stats.tcpBytesDown, &s.stats.tcpBytesUp}
+				if quser != nil {
+					qc = s.quota.wrap(quser, upstream, conn)
+					upstream = qc
 				}
-			}
-			buf := p.Get(p.RelayBufferSize)
-			for el == nil {
-				_, err := conn.Read(buf)
-				el = err
-			}
-			p.Put(buf)
-			if !errors.Is(el, aead.ErrZeroChunk) {
-				if !errors.Is(el, io.EOF) {
-					log.Warningf("Unexpected error %v, ZERO CHUNK wanted\n", el)
+				if s.firstByteTimeout > 0 {
+					fb = newFirstByteConn(upstream, s.firstByteTimeout)
+					upstream = fb
+				}
+				var er error
+				el, er = utils.Relay(conn, upstream)
+				s.quota.release(quser, qc)
+				if qc.exhausted() {
+					log.V(1).Infof("Quota of user %q exhausted, end tunnel to %s [%s]\n", quser.name, target, tags)
+					acc.end("quota exhausted", ErrQuotaExceeded)
+					break
+				}
+				if fb != nil && fb.timedOut() {
+					er = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("no first byte from target in time")}
+				}
+				if e, ok := er.(*net.OpError); ok && e.Op == "read" {
+					// the target failed rather than finished, do not
+					// let a ZERO_CHUNK pass it off as a clean end
+					log.V(1).Infof("Target %s failed: %v [%s]\n", target, er, tags)
+					acc.end("target failed", er)
+					if ce, ok := conn.(interface{ CloseWithError(error) error }); ok {
+						ce.CloseWithError(er)
+					}
+					break
 				}
-				log.V(1).Infof("Close connection due to %v anyway\n", el)
-				break
 			}
 		}
+
+		if isV2 && !s.endRequest(conn, el, acc) {
+			break
+		}
+	}
+
+	log.V(1).Infof("Session from %s done [%s]", conn.RemoteAddr().String(), tags)
+}
+
+// endRequest ends a request of a v2 session: a ZERO_CHUNK is sent back,
+// then the client's is awaited, reporting whether the session goes on. el
+// is the error relaying to the client, if any.
+func (s *SnellServer) endRequest(conn net.Conn, el error, acc *connAccess) bool {
+	conn.SetReadDeadline(time.Time{})
+	_, err := conn.Write([]byte{}) // write zero chunk back
+	if err != nil {
+		log.Errorf("Unexpected write error %v\n", err)
+		return false
+	}
+	if e, ok := el.(*net.OpError); ok {
+		if e.Op == "write" {
+			el = nil
+		}
+	}
+	buf := p.Get(p.RelayBufferSize)
+	for el == nil {
+		_, err := conn.Read(buf)
+		el = err
+	}
+	p.Put(buf)
+	if !errors.Is(el, aead.ErrZeroChunk) {
+		if !errors.Is(el, io.EOF) {
+			log.Warningf("Unexpected error %v, ZERO CHUNK wanted\n", el)
+		}
+		log.V(1).Infof("Close connection due to %v anyway\n", el)
+		if !errors.Is(el, io.EOF) {
+			acc.end("unclean end", el)
+		}
+		return false
+	}
+	return true
+}
+
+// dialTarget dials target, or what the rewriter maps it to.
+func (s *SnellServer) dialTarget(ctx context.Context, target string) (net.Conn, error) {
+	if s.rewrite != nil {
+		rt, err := s.rewrite(target)
+		if err != nil {
+			log.V(1).Infof("Target %s refused by the rewriter: %v\n", target, err)
+			return nil, err
+		}
+		if rt != target {
+			log.V(1).Infof("Target %s rewritten to %s\n", target, rt)
+			target = rt
+		}
+	}
+	if !s.acquireDial() {
+		return nil, ErrTooManyDials
+	}
+	defer s.releaseDial()
+	if s.dns != nil {
+		host, port, err := net.SplitHostPort(target)
+		if err == nil && net.ParseIP(host) == nil {
+			return s.dialResolved(ctx, host, port)
+		}
 	}
+	if s.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.dialTimeout)
+		defer cancel()
+	}
+	return s.dialer.DialContext(ctx, "tcp", target)
+}
+
+// countingConn adds the bytes read and written to the counters rd and wr.
+type countingConn struct {
+	net.Conn
+	rd *uint64
+	wr *uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(c.rd, uint64(n))
+	return n, err
+}
 
-	log.V(1).Infof("Session from %s done", conn.RemoteAddr().String())
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(c.wr, uint64(n))
+	return n, err
+}
+
+// firstByteConn is a target conn that must send something within a
+// timeout, expired tells whether it failed to.
+type firstByteConn struct {
+	net.Conn
+	mux     sync.Mutex
+	waiting bool
+	expired bool
+}
+
+func newFirstByteConn(c net.Conn, timeout time.Duration) *firstByteConn {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	return &firstByteConn{Conn: c, waiting: true}
+}
+
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.waiting {
+		if n > 0 {
+			c.waiting = false
+			c.Conn.SetReadDeadline(time.Time{})
+		} else if e, ok := err.(net.Error); ok && e.Timeout() {
+			c.expired = true
+		}
+	}
+	return n, err
+}
+
+// SetReadDeadline keeps the timeout from being lifted before the first
+// byte, any other deadline, e.g. the relay stopping, ends the watch.
+func (c *firstByteConn) SetReadDeadline(t time.Time) error {
+	c.mux.Lock()
+	if c.waiting {
+		if t.IsZero() {
+			c.mux.Unlock()
+			return nil
+		}
+		c.waiting = false
+	}
+	c.mux.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *firstByteConn) timedOut() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.expired
 }
 
 func (s *SnellServer) writeError(conn net.Conn, err error) error {
-	buf := bytes.NewBuffer([]byte{})
-	buf.WriteByte(ResponseError)
-	if e, ok := err.(syscall.Errno); ok {
-		buf.WriteByte(byte(e))
-	} else {
-		buf.WriteByte(byte(0))
+	code := byte(0)
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		code = byte(errno)
 	}
-	es := err.Error()
-	if len(es) > 250 {
-		es = es[0:250]
+	return writeErrorCode(conn, code, err.Error())
+}
+
+// WriteError sends an error response carrying msg, truncated to 250 bytes,
+// in place of ResponseTunnel. Clients surface it as an *AppError.
+func WriteError(conn net.Conn, msg string) error {
+	return writeErrorCode(conn, 0, msg)
+}
+
+func writeErrorCode(conn net.Conn, code byte, msg string) error {
+	if len(msg) > 250 {
+		msg = msg[0:250]
 	}
-	buf.WriteByte(byte(len(es)))
-	buf.WriteString(es)
+	buf := bytes.NewBuffer(make([]byte, 0, 3+len(msg)))
+	buf.WriteByte(ResponseError)
+	buf.WriteByte(code)
+	buf.WriteByte(byte(len(msg)))
+	buf.WriteString(msg)
 	_, el := conn.Write(buf.Bytes())
 	return el
 }
 
-func (s *SnellServer) handleUDPRequest(conn net.Conn) {
+// handleUDPRequest relays a UDP session, metered against the quota of
+// quser if any, which is released once done.
+func (s *SnellServer) handleUDPRequest(conn net.Conn, acc *connAccess, quser *quotaUser) {
 	log.V(1).Infof("New UDP request from %s\n", conn.RemoteAddr().String())
 
+	var qc *quotaConn
+	defer func() {
+		s.quota.release(quser, qc)
+		if qc.exhausted() {
+			log.V(1).Infof("Quota of user %q exhausted, end UDP session from %s\n", quser.name, conn.RemoteAddr().String())
+			acc.end("quota exhausted", ErrQuotaExceeded)
+		}
+	}()
+
 	cache, err := lru.New(256)
 	if err != nil {
 		log.Errorf("UDP failed to create lru cache: %v\n", err)
@@ -245,14 +1261,30 @@ func (s *SnellServer) handleUDPRequest(conn net.Conn) {
 		}
 	}
 
-	go s.handleUDPIngress(conn, pc)
+	if quser != nil {
+		qc = s.quota.wrap(quser, pc.(net.Conn), conn)
+		pc = qc
+	}
 
-	buf := p.Get(p.RelayBufferSize)
-	defer p.Put(buf)
+	go s.handleUDPIngress(conn, pc, acc)
+
+	var limit *udpSessionLimiter
+	if s.udpLimit != nil {
+		client := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+		limit = s.udpLimit.open(client)
+		defer limit.close()
+	}
+
+	frames := newUDPFrameReader(conn)
+	defer frames.release()
 
 uotLoop:
 	for {
-		n, err := conn.Read(buf)
+		buf, err := frames.next()
+		n := len(buf)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				log.V(1).Infof("UDP over TCP read EOF, session ends\n")
@@ -322,6 +1354,10 @@ uotLoop:
 		}
 
 		payloadSize := n - head
+		if limit != nil && !limit.allow(target, payloadSize) {
+			log.V(1).Infof("UDP over TCP over limit, drop %d bytes to %s\n", payloadSize, target)
+			continue
+		}
 		if payloadSize > 0 {
 			log.V(1).Infof("UDP over TCP forward %d bytes to target %s\n", payloadSize, target)
 			_, err = pc.WriteTo(buf[head:n], uaddr)
@@ -329,12 +1365,14 @@ uotLoop:
 				log.Errorf("UDP over TCP  failed to write to %s: %v\n", target, err)
 				break
 			}
+			atomic.AddUint64(&s.stats.udpBytesUp, uint64(payloadSize))
+			acc.add(payloadSize, 0)
 		}
 	}
 }
 
-func (s *SnellServer) handleUDPIngress(conn net.Conn, pc net.PacketConn) {
-	buf := p.Get(p.RelayBufferSize)
+func (s *SnellServer) handleUDPIngress(conn net.Conn, pc net.PacketConn, acc *connAccess) {
+	buf := p.Get(maxUDPPayload)
 	defer p.Put(buf)
 
 	for {
@@ -363,10 +1401,12 @@ func (s *SnellServer) handleUDPIngress(conn net.Conn, pc net.PacketConn) {
 		buffer.Write([]byte{byte(uaddr.Port>>8), byte(uaddr.Port&0xff)})
 		buffer.Write(buf[:n])
 
-		_, err = conn.Write(buffer.Bytes())
+		err = writeUDPFrame(conn, buffer.Bytes())
 		if err != nil {
 			log.Errorf("UDP failed to write back: %v\n", err)
 			break
 		}
+		atomic.AddUint64(&s.stats.udpBytesDown, uint64(n))
+		acc.add(0, n)
 	}
 }
@@ -0,0 +1,457 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// headerConn serves a request header from memory.
+type headerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *headerConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// requestHeader encodes a request header for host and port.
+func requestHeader(cmd byte, clientID, host string, port uint16) []byte {
+	b := []byte{Version, cmd, byte(len(clientID))}
+	b = append(b, clientID...)
+	if cmd == CommandUDP {
+		return b
+	}
+	b = append(b, byte(len(host)))
+	b = append(b, host...)
+	return append(b, byte(port>>8), byte(port))
+}
+
+func handshake(s *SnellServer, hdr []byte) (string, byte, error) {
+	return s.ServerHandshake(&headerConn{r: bytes.NewReader(hdr)})
+}
+
+func TestServerHandshakeAddressTypes(t *testing.T) {
+	s := &SnellServer{}
+	for _, tc := range []struct {
+		host string
+		port uint16
+		want string
+	}{
+		{"1.2.3.4", 80, "1.2.3.4:80"},
+		{"::1", 443, "[::1]:443"},
+		{"[2001:db8::1]", 443, "[2001:db8::1]:443"},
+		{"2001:0db8:0000::0001", 53, "[2001:db8::1]:53"},
+		{"::ffff:10.0.0.1", 22, "10.0.0.1:22"},
+		{"example.com", 8080, "example.com:8080"},
+		{"xn--bcher-kva.example", 1, "xn--bcher-kva.example:1"},
+	} {
+		for _, cmd := range []byte{CommandConnect, CommandConnectV2} {
+			target, gotCmd, err := handshake(s, requestHeader(cmd, "client", tc.host, tc.port))
+			if err != nil {
+				t.Errorf("%s: %v", tc.host, err)
+				continue
+			}
+			if target != tc.want || gotCmd != cmd {
+				t.Errorf("%s: got %s cmd %d, want %s cmd %d", tc.host, target, gotCmd, tc.want, cmd)
+			}
+		}
+	}
+}
+
+func TestServerHandshakeUDP(t *testing.T) {
+	target, cmd, err := handshake(&SnellServer{}, requestHeader(CommandUDP, "", "", 0))
+	if err != nil || cmd != CommandUDP || target != "" {
+		t.Fatalf("got %q cmd %d, %v", target, cmd, err)
+	}
+}
+
+func TestServerHandshakeTruncated(t *testing.T) {
+	s := &SnellServer{}
+	for _, hdr := range [][]byte{
+		requestHeader(CommandConnectV2, "", "1.2.3.4", 80),
+		requestHeader(CommandConnectV2, "id", "::1", 80),
+		requestHeader(CommandConnect, "", "example.com", 80),
+	} {
+		if _, _, err := handshake(s, nil); err != io.EOF {
+			t.Fatalf("empty header: got %v, want io.EOF", err)
+		}
+		for cut := 1; cut < len(hdr); cut++ {
+			if _, _, err := handshake(s, hdr[:cut]); !errors.Is(err, ErrMalformedHeader) {
+				t.Errorf("header cut at %d of %d: got %v, want ErrMalformedHeader", cut, len(hdr), err)
+			}
+		}
+	}
+}
+
+func TestServerHandshakeMalformed(t *testing.T) {
+	s := &SnellServer{}
+	badVersion := requestHeader(CommandConnectV2, "", "1.2.3.4", 80)
+	badVersion[0] = 2
+	for name, hdr := range map[string][]byte{
+		"version":    badVersion,
+		"empty host": requestHeader(CommandConnectV2, "", "", 80),
+		"port 0":     requestHeader(CommandConnectV2, "", "1.2.3.4", 0),
+		"colon":      requestHeader(CommandConnectV2, "", "a:b", 80),
+		"space":      requestHeader(CommandConnectV2, "", "a b", 80),
+		"slash":      requestHeader(CommandConnectV2, "", "a/b", 80),
+		"control":    requestHeader(CommandConnectV2, "", "a\x00b", 80),
+		"non-ascii":  requestHeader(CommandConnectV2, "", "a\xffb", 80),
+	} {
+		if _, _, err := handshake(s, hdr); !errors.Is(err, ErrMalformedHeader) {
+			t.Errorf("%s: got %v, want ErrMalformedHeader", name, err)
+		}
+	}
+}
+
+func TestServerHandshakeOversizedDomain(t *testing.T) {
+	s := &SnellServer{}
+	WithMaxHeaderSize(64)(s)
+
+	// the declared domain length alone exceeds the bound: nothing more is
+	// read, the domain bytes need not even be there
+	hdr := []byte{Version, CommandConnectV2, 0, 200}
+	r := bytes.NewReader(append(hdr, bytes.Repeat([]byte("a"), 200)...))
+	_, _, err := s.ServerHandshake(&headerConn{r: r})
+	if !errors.Is(err, ErrHeaderTooLarge) {
+		t.Fatalf("got %v, want ErrHeaderTooLarge", err)
+	}
+	if read := int(r.Size()) - r.Len(); read != len(hdr) {
+		t.Fatalf("read %d bytes of the header, want %d", read, len(hdr))
+	}
+
+	// likewise for the client id
+	_, _, err = handshake(s, []byte{Version, CommandConnectV2, 100})
+	if !errors.Is(err, ErrHeaderTooLarge) {
+		t.Fatalf("client id: got %v, want ErrHeaderTooLarge", err)
+	}
+
+	// a header just within the bound is accepted
+	host := string(bytes.Repeat([]byte("a"), 64-3-1-2))
+	if _, _, err := handshake(s, requestHeader(CommandConnectV2, "", host, 80)); err != nil {
+		t.Fatalf("header of 64 bytes: %v", err)
+	}
+}
+
+func TestServerHandshakeDefaultHeaderSize(t *testing.T) {
+	// the largest valid header fits the default bound
+	id := string(bytes.Repeat([]byte("i"), 255))
+	host := string(bytes.Repeat([]byte("h"), 255))
+	if _, _, err := handshake(&SnellServer{}, requestHeader(CommandConnectV2, id, host, 80)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTargetRewriterDialsRewritten(t *testing.T) {
+	echo := tcpEcho(t)
+	var mux sync.Mutex
+	var seen []string
+	_, server := startServer(t, WithTargetRewriter(func(target string) (string, error) {
+		mux.Lock()
+		seen = append(seen, target)
+		mux.Unlock()
+		switch target {
+		case "ads.invalid:80":
+			return echo, nil
+		case "blocked.invalid:80":
+			return "", ErrDropTarget
+		}
+		return target, nil
+	}))
+	sc := startClient(t, server)
+
+	// resolving the original would fail, only the rewritten target answers
+	if !echoes(dialSocks(t, sc, "ads.invalid:80"), []byte("redirected")) {
+		t.Fatal("rewritten target not dialed")
+	}
+	if echoes(dialSocks(t, sc, "blocked.invalid:80"), []byte("dropped")) {
+		t.Fatal("dropped target served")
+	}
+	if !echoes(dialSocks(t, sc, echo), []byte("untouched")) {
+		t.Fatal("target left alone not dialed")
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if want := []string{"ads.invalid:80", "blocked.invalid:80", echo}; !reflect.DeepEqual(seen, want) {
+		t.Fatalf("rewriter consulted for %q, want %q", seen, want)
+	}
+}
+
+func TestCheckVersionBounds(t *testing.T) {
+	for _, tc := range []struct {
+		min, max int
+		cmd      byte
+		want     error
+	}{
+		{0, 0, CommandConnect, nil},
+		{2, 0, CommandConnect, ErrVersionTooOld},
+		{2, 0, CommandConnectV2, nil},
+		{2, 0, CommandUDP, nil},
+		{0, 2, CommandUDP, ErrVersionTooNew},
+		{0, 2, CommandConnectV2, nil},
+		{0, 2, CommandConnect, nil},
+		{2, 2, CommandConnect, ErrVersionTooOld},
+		{2, 2, CommandUDP, ErrVersionTooNew},
+		{3, 3, CommandPing, nil}, // ping carries no version
+	} {
+		s := &SnellServer{minVersion: tc.min, maxVersion: tc.max}
+		if err := s.checkVersion(tc.cmd); !errors.Is(err, tc.want) || (tc.want == nil) != (err == nil) {
+			t.Errorf("min %d max %d cmd %d: got %v, want %v", tc.min, tc.max, tc.cmd, err, tc.want)
+		}
+	}
+}
+
+func TestVersionBoundsRefuseClients(t *testing.T) {
+	echo := tcpEcho(t)
+	v1 := func(t *testing.T, server string) *SnellClient {
+		c, err := NewSnellClient("127.0.0.1:0", server, "", "", testPSK, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+
+	t.Run("min", func(t *testing.T) {
+		_, server := startServer(t, WithMinVersion(2))
+		if echoes(dialSocks(t, v1(t, server), echo), []byte("v1")) {
+			t.Fatal("v1 client served below the minimum version")
+		}
+		if !echoes(dialSocks(t, startClient(t, server), echo), []byte("v2")) {
+			t.Fatal("v2 client refused at the minimum version")
+		}
+	})
+	t.Run("max", func(t *testing.T) {
+		_, server := startServer(t, WithMaxVersion(1))
+		if echoes(dialSocks(t, startClient(t, server), echo), []byte("v2")) {
+			t.Fatal("v2 client served above the maximum version")
+		}
+		if !echoes(dialSocks(t, v1(t, server), echo), []byte("v1")) {
+			t.Fatal("v1 client refused at the maximum version")
+		}
+	})
+}
+
+// silentUpstream accepts connections and never sends anything.
+func silentUpstream(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		var held []net.Conn
+		defer func() {
+			for _, c := range held {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			held = append(held, c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	silent := silentUpstream(t)
+
+	_, server := startServer(t, WithFirstByteTimeout(100*time.Millisecond))
+	sc := startClient(t, server)
+	c := dialSocks(t, sc, silent)
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read data from a silent target")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("silent target never torn down")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("torn down after %v", d)
+	}
+
+	// targets answering in time are left alone
+	if !echoes(dialSocks(t, sc, tcpEcho(t)), []byte("in time")) {
+		t.Fatal("responsive target cut off")
+	}
+
+	// off by default
+	_, server = startServer(t)
+	c = dialSocks(t, startClient(t, server), silent)
+	c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read data from a silent target")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("silent target torn down without a first byte timeout: %v", err)
+	}
+}
+
+// stallDialer never connects, it waits for the dial to be canceled.
+type stallDialer struct{}
+
+func (stallDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDialTimeout(t *testing.T) {
+	s, _ := startServer(t, WithUpstreamDialer(stallDialer{}), WithDialTimeout(100*time.Millisecond))
+	start := time.Now()
+	if _, err := s.dialTarget(context.Background(), "192.0.2.1:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the dial timeout", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("dial gave up after %v", d)
+	}
+}
+
+// gateDialer holds every dial until release is closed, tracking how many
+// are in flight at most.
+type gateDialer struct {
+	release chan struct{}
+
+	mux           sync.Mutex
+	inFlight, max int
+}
+
+func (d *gateDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mux.Lock()
+	if d.inFlight++; d.inFlight > d.max {
+		d.max = d.inFlight
+	}
+	d.mux.Unlock()
+	defer func() {
+		d.mux.Lock()
+		d.inFlight--
+		d.mux.Unlock()
+	}()
+	select {
+	case <-d.release:
+		a, _ := net.Pipe()
+		return a, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestMaxUpstreamDialsBoundsConcurrency(t *testing.T) {
+	d := &gateDialer{release: make(chan struct{})}
+	s, _ := startServer(t, WithUpstreamDialer(d), WithMaxUpstreamDials(2, 5*time.Second))
+
+	const dials = 6
+	errc := make(chan error, dials)
+	for i := 0; i < dials; i++ {
+		go func() {
+			c, err := s.dialTarget(context.Background(), "192.0.2.1:80")
+			if err == nil {
+				c.Close()
+			}
+			errc <- err
+		}()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for st := s.Stats(); st.DialsInFlight != 2 || st.DialsQueued != dials-2; st = s.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dials in flight and %d queued, want 2 and %d", st.DialsInFlight, st.DialsQueued, dials-2)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(d.release)
+	for i := 0; i < dials; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.max != 2 {
+		t.Fatalf("%d dials ran at once, want 2", d.max)
+	}
+	if st := s.Stats(); st.DialsInFlight != 0 || st.DialsQueued != 0 || st.DialsRejected != 0 {
+		t.Fatalf("stats after the storm: %+v", st)
+	}
+}
+
+func TestMaxUpstreamDialsSaturated(t *testing.T) {
+	d := &gateDialer{release: make(chan struct{})}
+	defer close(d.release)
+	s, _ := startServer(t, WithUpstreamDialer(d), WithMaxUpstreamDials(1, 50*time.Millisecond))
+
+	go s.dialTarget(context.Background(), "192.0.2.1:80")
+	for s.Stats().DialsInFlight != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := s.dialTarget(context.Background(), "192.0.2.1:80"); !errors.Is(err, ErrTooManyDials) {
+		t.Fatalf("got %v, want ErrTooManyDials", err)
+	}
+	if st := s.Stats(); st.DialsRejected != 1 {
+		t.Fatalf("%d dials rejected, want 1", st.DialsRejected)
+	}
+}
+
+func TestTrafficMeteredByCommand(t *testing.T) {
+	s, server := startServer(t)
+	sc := startClient(t, server)
+
+	tcp := bytes.Repeat([]byte("t"), 1000)
+	if !echoes(dialSocks(t, sc, tcpEcho(t)), tcp) {
+		t.Fatal("TCP tunnel not echoed")
+	}
+	eventually(t, "TCP tunnel bytes not metered", func() bool {
+		st := s.Stats()
+		return st.TCPBytesUp == 1000 && st.TCPBytesDown == 1000
+	})
+	if st := s.Stats(); st.UDPBytesUp != 0 || st.UDPBytesDown != 0 {
+		t.Fatalf("TCP tunnel metered as UDP: %+v", st)
+	}
+
+	pc, err := sc.DialUDP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	echo := udpEcho(t)
+	if _, err := pc.WriteTo(bytes.Repeat([]byte("u"), 300), echo); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, _, err := pc.ReadFrom(make([]byte, 512)); err != nil || n != 300 {
+		t.Fatalf("UDP echo got %d bytes, %v", n, err)
+	}
+	eventually(t, "UDP session bytes not metered", func() bool {
+		st := s.Stats()
+		return st.UDPBytesUp == 300 && st.UDPBytesDown == 300
+	})
+	if st := s.Stats(); st.TCPBytesUp != 1000 || st.TCPBytesDown != 1000 {
+		t.Fatalf("UDP session metered as TCP: %+v", st)
+	}
+}
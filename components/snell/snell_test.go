@@ -0,0 +1,279 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/icpz/open-snell/components/socks5"
+)
+
+const testPSK = "open-snell test psk"
+
+// startServer runs a server on a loopback port and returns its address.
+func startServer(t testing.TB, opts ...ServerOption) (*SnellServer, string) {
+	t.Helper()
+	s, err := NewSnellServer("127.0.0.1:0", testPSK, "", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s, s.listeners[0].Addr().String()
+}
+
+// startClient runs a v2 client of server, its SOCKS proxy on a loopback
+// port.
+func startClient(t testing.TB, server string, opts ...ClientOption) *SnellClient {
+	t.Helper()
+	c, err := NewSnellClient("127.0.0.1:0", server, "", "", testPSK, true, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// tcpEcho runs a TCP echo server and returns its address.
+func tcpEcho(t testing.TB) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// udpEcho runs a UDP echo server and returns its address.
+func udpEcho(t testing.TB) *net.UDPAddr {
+	t.Helper()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+// fakeDNS answers A queries for the names it knows, over UDP and TCP on
+// the same port, and counts the queries.
+type fakeDNS struct {
+	addr string
+	udp  net.PacketConn
+	tcp  net.Listener
+
+	mux     sync.Mutex
+	records map[string]fakeRecord
+	queries map[string]int
+}
+
+type fakeRecord struct {
+	ip       net.IP
+	ttl      uint32
+	truncate bool          // over UDP, forcing a retry over TCP
+	delay    time.Duration // before answering
+}
+
+func startFakeDNS(t testing.TB) *fakeDNS {
+	t.Helper()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		t.Skip("cannot bind UDP next to TCP:", err)
+	}
+	d := &fakeDNS{
+		addr:    tcp.Addr().String(),
+		udp:     udp,
+		tcp:     tcp,
+		records: map[string]fakeRecord{},
+		queries: map[string]int{},
+	}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := append([]byte(nil), buf[:n]...)
+			go func() {
+				if resp := d.answer(q, true); resp != nil {
+					udp.WriteTo(resp, from)
+				}
+			}()
+		}
+	}()
+	go func() {
+		for {
+			c, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var size [2]byte
+				for {
+					if _, err := io.ReadFull(c, size[:]); err != nil {
+						return
+					}
+					q := make([]byte, binary.BigEndian.Uint16(size[:]))
+					if _, err := io.ReadFull(c, q); err != nil {
+						return
+					}
+					resp := d.answer(q, false)
+					binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+					c.Write(append(size[:], resp...))
+				}
+			}()
+		}
+	}()
+	return d
+}
+
+func (d *fakeDNS) set(name string, r fakeRecord) {
+	d.mux.Lock()
+	d.records[name] = r
+	d.mux.Unlock()
+}
+
+// count returns how many A queries for name were answered.
+func (d *fakeDNS) count(name string) int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.queries[name]
+}
+
+func (d *fakeDNS) answer(query []byte, udp bool) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	name := q.Name.String()
+
+	d.mux.Lock()
+	r, ok := d.records[name]
+	if q.Type == dnsmessage.TypeA && !(udp && r.truncate) {
+		d.queries[name]++
+	}
+	d.mux.Unlock()
+	time.Sleep(r.delay)
+
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	switch {
+	case !ok:
+		resp.RCode = dnsmessage.RCodeNameError
+	case udp && r.truncate:
+		resp.Truncated = true
+	case q.Type == dnsmessage.TypeA:
+		var a [4]byte
+		copy(a[:], r.ip.To4())
+		resp.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: r.ttl},
+			Body:   &dnsmessage.AResource{A: a},
+		}}
+	}
+	b, _ := resp.Pack()
+	return b
+}
+
+// dialSocks opens a SOCKS CONNECT to target through sc.
+func dialSocks(t testing.TB, sc *SnellClient, target string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", sc.socks5.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := socks5.ClientHandshake(c, socks5.ParseAddr(target), socks5.CmdConnect); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// echoes reports whether msg comes back through c, an echo tunnel.
+func echoes(c net.Conn, msg []byte) bool {
+	if _, err := c.Write(msg); err != nil {
+		return false
+	}
+	got := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := io.ReadFull(c, got)
+	return err == nil && bytes.Equal(got, msg)
+}
+
+// eventually polls cond for up to five seconds, failing with what if it
+// never holds.
+func eventually(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
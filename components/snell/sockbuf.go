@@ -0,0 +1,39 @@
+//go:build !linux
+
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"net"
+)
+
+// setSocketBuffers sets SO_RCVBUF and SO_SNDBUF, sizes of 0 keeping the
+// system default. Clamping by the system goes unnoticed here.
+func setSocketBuffers(c net.Conn, rsize, wsize int) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if rsize > 0 {
+		if err := tc.SetReadBuffer(rsize); err != nil {
+			return err
+		}
+	}
+	if wsize > 0 {
+		return tc.SetWriteBuffer(wsize)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"net"
+
+	log "github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// setSocketBuffers sets SO_RCVBUF and SO_SNDBUF, sizes of 0 keeping the
+// system default, and logs when the kernel clamps them (it reports twice
+// the size granted, the other half being bookkeeping).
+func setSocketBuffers(c net.Conn, rsize, wsize int) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if rsize > 0 {
+		if err := tc.SetReadBuffer(rsize); err != nil {
+			return err
+		}
+	}
+	if wsize > 0 {
+		if err := tc.SetWriteBuffer(wsize); err != nil {
+			return err
+		}
+	}
+
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	check := func(fd uintptr, opt, want int, name string) {
+		if want <= 0 {
+			return
+		}
+		got, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, opt)
+		if err == nil && got/2 < want {
+			log.Warningf("%s clamped to %d bytes, %d requested\n", name, got/2, want)
+		}
+	}
+	return rc.Control(func(fd uintptr) {
+		check(fd, unix.SO_RCVBUF, rsize, "SO_RCVBUF")
+		check(fd, unix.SO_SNDBUF, wsize, "SO_SNDBUF")
+	})
+}
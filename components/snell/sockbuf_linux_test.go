@@ -0,0 +1,168 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// netemDelay is the one way delay of the link the benchmarks run on, for
+// a round trip of twice that.
+const netemDelay = "25ms"
+
+func sockopt(t testing.TB, c net.Conn, opt int) int {
+	t.Helper()
+	rc, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	rc.Control(func(fd uintptr) {
+		got, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, opt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestSocketBuffersApplied(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := setSocketBuffers(c, 64<<10, 32<<10); err != nil {
+		t.Fatal(err)
+	}
+	// the kernel doubles what is asked for its bookkeeping
+	if got := sockopt(t, c, unix.SO_RCVBUF); got < 64<<10 {
+		t.Fatalf("SO_RCVBUF is %d, want at least %d", got, 64<<10)
+	}
+	if got := sockopt(t, c, unix.SO_SNDBUF); got < 32<<10 {
+		t.Fatalf("SO_SNDBUF is %d, want at least %d", got, 32<<10)
+	}
+}
+
+// netemPair connects two TCP conns across a loopback delayed by netem, in
+// a network namespace of their own so nothing else sees the delay. It
+// needs CAP_SYS_ADMIN and CAP_NET_ADMIN, skipping without them.
+func netemPair(b *testing.B) (client, server net.Conn) {
+	b.Helper()
+	type pair struct {
+		c, s net.Conn
+		err  error
+	}
+	done := make(chan pair, 1)
+	go func() {
+		// sockets belong to the namespace of the thread creating them;
+		// the thread is never unlocked, so it exits with the goroutine
+		// and takes the namespace along once the sockets close
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			done <- pair{err: err}
+			return
+		}
+		for _, args := range [][]string{
+			{"ip", "link", "set", "lo", "up"},
+			{"tc", "qdisc", "add", "dev", "lo", "root", "netem", "delay", netemDelay},
+		} {
+			if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+				done <- pair{err: fmt.Errorf("%v: %v: %s", args, err, out)}
+				return
+			}
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			done <- pair{err: err}
+			return
+		}
+		defer l.Close()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			done <- pair{err: err}
+			return
+		}
+		s, err := l.Accept()
+		if err != nil {
+			c.Close()
+			done <- pair{err: err}
+			return
+		}
+		done <- pair{c: c, s: s}
+	}()
+	p := <-done
+	if p.err != nil {
+		b.Skip("no netem link:", p.err)
+	}
+	b.Cleanup(func() {
+		p.c.Close()
+		p.s.Close()
+	})
+	return p.c, p.s
+}
+
+// BenchmarkSocketBuffersHighLatency streams through a tunnel over a link
+// with a 50ms round trip. The window a socket buffer allows caps what is
+// in flight per round trip, so small buffers starve the link; zero leaves
+// the kernel autotuning.
+func BenchmarkSocketBuffersHighLatency(b *testing.B) {
+	const chunk = 256 << 10
+	ciph := aead.NewAES128GCM([]byte(testPSK))
+	for _, size := range []int{0, 16 << 10, 256 << 10, 4 << 20} {
+		b.Run(fmt.Sprintf("buffers=%dKB", size>>10), func(b *testing.B) {
+			rc, rs := netemPair(b)
+			for _, c := range []net.Conn{rc, rs} {
+				if err := setSocketBuffers(c, size, size); err != nil {
+					b.Fatal(err)
+				}
+			}
+			c := aead.NewConn(rc, ciph, aead.WithRole(aead.RoleClient))
+			s := aead.NewConn(rs, ciph, aead.WithRole(aead.RoleServer))
+
+			received := make(chan int64, 1)
+			go func() {
+				n, _ := io.CopyN(io.Discard, s, int64(b.N)*chunk)
+				received <- n
+			}()
+			payload := make([]byte, chunk)
+			b.SetBytes(chunk)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if n := <-received; n != int64(b.N)*chunk {
+				b.Fatalf("received %d bytes, want %d", n, int64(b.N)*chunk)
+			}
+		})
+	}
+}
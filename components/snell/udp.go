@@ -0,0 +1,445 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/icpz/open-snell/components/aead"
+	"github.com/icpz/open-snell/components/redir"
+	"github.com/icpz/open-snell/components/socks5"
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+const UDPSessionTimeout = 60 * time.Second
+
+var (
+	ErrDatagramTooLarge  = errors.New("datagram exceeds the UDP maximum size")
+	ErrMalformedUDPFrame = errors.New("malformed fragmented UDP frame")
+)
+
+// A Snell UDP frame, a target address and a datagram, travels in one
+// record, record boundaries being the only frame boundaries of the
+// protocol. Frames exceeding aead.MaxPayloadSize, about 16KB where UDP
+// allows 65507 bytes, are fragmented across records as an open-snell
+// extension:
+//
+//	first: udpFragmentFirst | frame length (4, BE) | frame bytes...
+//	next:  udpFragmentNext | frame bytes...
+//
+// Neither marker is a valid command or address type, so stock clients
+// drop every fragment while a stock server ends the session. Frames
+// fitting one record are sent as they are.
+const (
+	udpFragmentFirst byte = 0xFF
+	udpFragmentNext  byte = 0xFE
+
+	udpFragmentFirstHdr = 5
+
+	// maxUDPFrame is the largest datagram behind the longest target
+	// header.
+	maxUDPFrame = 1 + 1 + 255 + 2 + maxUDPPayload
+)
+
+// writeUDPFrame writes frame to w in a record of its own, or fragmented if
+// it does not fit.
+func writeUDPFrame(w io.Writer, frame []byte) error {
+	if len(frame) <= aead.MaxPayloadSize {
+		_, err := w.Write(frame)
+		return err
+	}
+	if len(frame) > maxUDPFrame {
+		return ErrDatagramTooLarge
+	}
+
+	buf := p.Get(aead.MaxPayloadSize)
+	defer p.Put(buf)
+	buf[0] = udpFragmentFirst
+	binary.BigEndian.PutUint32(buf[1:udpFragmentFirstHdr], uint32(len(frame)))
+	head := udpFragmentFirstHdr
+	for len(frame) > 0 {
+		n := copy(buf[head:], frame)
+		frame = frame[n:]
+		if _, err := w.Write(buf[:head+n]); err != nil {
+			return err
+		}
+		buf[0], head = udpFragmentNext, 1
+	}
+	return nil
+}
+
+// udpFrameReader reads the frames of a UDP session off r, joining the
+// fragments of those spanning several records.
+type udpFrameReader struct {
+	r     io.Reader
+	rbuf  []byte // a record
+	frame []byte // reassembly, allocated on the first fragmented frame
+}
+
+func newUDPFrameReader(r io.Reader) *udpFrameReader {
+	return &udpFrameReader{r: r, rbuf: p.Get(p.RelayBufferSize)}
+}
+
+// next returns the next frame, valid until the following call. A frame
+// failing to reassemble is dropped with ErrMalformedUDPFrame, the
+// following one can still be read.
+func (fr *udpFrameReader) next() ([]byte, error) {
+	n, err := fr.r.Read(fr.rbuf)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || (fr.rbuf[0] != udpFragmentFirst && fr.rbuf[0] != udpFragmentNext) {
+		return fr.rbuf[:n], nil
+	}
+	if fr.rbuf[0] != udpFragmentFirst || n < udpFragmentFirstHdr {
+		return nil, ErrMalformedUDPFrame
+	}
+
+	size := int(binary.BigEndian.Uint32(fr.rbuf[1:udpFragmentFirstHdr]))
+	if size > maxUDPFrame {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMalformedUDPFrame, size)
+	}
+	if fr.frame == nil {
+		fr.frame = make([]byte, 0, maxUDPFrame)
+	}
+	frame := append(fr.frame[:0], fr.rbuf[udpFragmentFirstHdr:n]...)
+	for len(frame) < size {
+		n, err := fr.r.Read(fr.rbuf)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 || fr.rbuf[0] != udpFragmentNext || len(frame)+n-1 > size {
+			return nil, ErrMalformedUDPFrame
+		}
+		frame = append(frame, fr.rbuf[1:n]...)
+	}
+	if len(frame) != size {
+		return nil, ErrMalformedUDPFrame
+	}
+	return frame, nil
+}
+
+func (fr *udpFrameReader) release() {
+	p.Put(fr.rbuf)
+}
+
+// snellPacketConn relays datagrams over a Snell UDP session, up to 65507
+// bytes each: frames exceeding one record are fragmented, see
+// udpFragmentFirst.
+type snellPacketConn struct {
+	net.Conn
+	wmux   sync.Mutex
+	frames *udpFrameReader
+}
+
+func (pc *snellPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > maxUDPPayload {
+		return 0, ErrDatagramTooLarge
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	iport, err := strconv.Atoi(port)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+
+	buf.WriteByte(CommandUDPForward)
+	if ip := net.ParseIP(host); ip != nil {
+		buf.WriteByte(0)
+		if ip4 := ip.To4(); ip4 != nil {
+			buf.WriteByte(4)
+			buf.Write(ip4)
+		} else {
+			buf.WriteByte(6)
+			buf.Write(ip.To16())
+		}
+	} else {
+		if len(host) > 255 {
+			return 0, errors.New("UDP target host too long")
+		}
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	}
+	buf.Write([]byte{byte(iport >> 8), byte(iport)})
+	buf.Write(b)
+
+	pc.wmux.Lock()
+	defer pc.wmux.Unlock()
+	if err := writeUDPFrame(pc.Conn, buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (pc *snellPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		frame, err := pc.frames.next()
+		if errors.Is(err, ErrMalformedUDPFrame) {
+			log.Warningf("UDP over TCP dropped response: %v\n", err)
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		n := len(frame)
+
+		var iplen int
+		if n > 0 {
+			switch frame[0] {
+			case 4:
+				iplen = net.IPv4len
+			case 6:
+				iplen = net.IPv6len
+			}
+		}
+		if iplen == 0 || n < 1+iplen+2 {
+			log.Warningf("UDP over TCP malformed response of %d bytes\n", n)
+			continue
+		}
+
+		head := 1 + iplen
+		ip := make(net.IP, iplen)
+		copy(ip, frame[1:head])
+		port := int(frame[head])<<8 | int(frame[head+1])
+		head += 2
+
+		return copy(b, frame[head:n]), &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+}
+
+func (pc *snellPacketConn) Close() error {
+	pc.frames.release()
+	return pc.Conn.Close()
+}
+
+// newUDPSession opens a dedicated (never pooled) session and issues the UDP
+// command, the server acknowledgement is consumed by the first read.
+func (s *SnellClient) newUDPSession() (*snellPacketConn, error) {
+	c, err := s.newSession()
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{Version, CommandUDP, byte(len(s.clientID))}, s.clientID...)
+	if _, err := c.Write(header); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &snellPacketConn{
+		Conn:   c,
+		frames: newUDPFrameReader(c),
+	}, nil
+}
+
+// DialUDP opens a UDP session with the server and waits for it to accept
+// it, the returned PacketConn then relays datagrams to any target, one per
+// WriteTo. A refusal by the server is returned as an *AppError. ctx bounds
+// the handshake only.
+func (s *SnellClient) DialUDP(ctx context.Context) (net.PacketConn, error) {
+	pc, err := s.newUDPSession()
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		pc.SetReadDeadline(deadline)
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			pc.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	err = pc.Conn.(*clientSession).awaitReply(false)
+	close(stop)
+	<-stopped
+	if err != nil {
+		pc.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	pc.SetReadDeadline(time.Time{})
+	return pc, nil
+}
+
+type udpNAT struct {
+	mux   sync.Mutex
+	flows map[string]*udpFlow
+}
+
+// udpFlowQueue is how many datagrams of a local client may wait for its
+// session, further ones are dropped.
+const udpFlowQueue = 64
+
+// udpFlow is the NAT entry of a local client. Its datagrams are queued and
+// sent by a goroutine of its own, so that neither dialing the session nor a
+// slow write stalls the listener reading datagrams of every client.
+type udpFlow struct {
+	out chan udpDatagram
+}
+
+type udpDatagram struct {
+	payload []byte
+	target  string
+}
+
+// udpReplyFunc delivers a datagram received from the tunnel back to the
+// local client.
+type udpReplyFunc func(payload []byte, from *net.UDPAddr) error
+
+// udpReplyOpener sets up the reply path of a new flow, release is called
+// once the flow ended and may be nil.
+type udpReplyOpener func() (reply udpReplyFunc, release func())
+
+func (s *SnellClient) handleSnellUDP(pc net.PacketConn, payload []byte, target socks5.Addr, src net.Addr) {
+	s.relayUDP(src.String(), payload, target.String(), func() (udpReplyFunc, func()) {
+		return func(b []byte, from *net.UDPAddr) error {
+			packet, err := socks5.EncodeUDPPacket(socks5.ParseAddrToSocksAddr(from), b)
+			if err != nil {
+				return nil
+			}
+			_, err = pc.WriteTo(packet, src)
+			return err
+		}, nil
+	})
+}
+
+func (s *SnellClient) handleRedirUDP(payload []byte, target, src *net.UDPAddr) {
+	s.relayUDP(src.String(), payload, target.String(), func() (udpReplyFunc, func()) {
+		r := redir.NewUDPReplier(src)
+		return r.WriteBack, func() { r.Close() }
+	})
+}
+
+// relayUDP queues payload for target on the flow of the local client key,
+// creating the flow on demand with the reply path open returns. It never
+// blocks.
+func (s *SnellClient) relayUDP(key string, payload []byte, target string, open udpReplyOpener) {
+	s.nat.mux.Lock()
+	flow, ok := s.nat.flows[key]
+	if !ok {
+		flow = &udpFlow{out: make(chan udpDatagram, udpFlowQueue)}
+		s.nat.flows[key] = flow
+		go s.runUDPFlow(key, flow, open)
+	}
+	s.nat.mux.Unlock()
+
+	select {
+	case flow.out <- udpDatagram{payload: append([]byte(nil), payload...), target: target}:
+	default:
+		log.V(1).Infof("UDP queue of %s full, datagram dropped\n", key)
+	}
+}
+
+// endUDPFlow removes flow from the NAT, unless a newer flow of key took its
+// place already. Datagrams still queued on it are dropped.
+func (s *SnellClient) endUDPFlow(key string, flow *udpFlow) {
+	s.nat.mux.Lock()
+	if s.nat.flows[key] == flow {
+		delete(s.nat.flows, key)
+	}
+	s.nat.mux.Unlock()
+}
+
+// runUDPFlow dials the session of flow and forwards its queued datagrams
+// until the session ends.
+func (s *SnellClient) runUDPFlow(key string, flow *udpFlow, open udpReplyOpener) {
+	reply, release := open()
+	if release != nil {
+		defer release()
+	}
+
+	sess, err := s.newUDPSession()
+	if err != nil {
+		s.endUDPFlow(key, flow)
+		log.Warningf("Failed to create UDP session for %s: %v\n", key, err)
+		return
+	}
+	log.V(1).Infof("New UDP session from %s\n", key)
+
+	sess.SetReadDeadline(time.Now().Add(UDPSessionTimeout))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleUDPIngress(key, flow, sess, reply)
+	}()
+
+	for {
+		select {
+		case d := <-flow.out:
+			sess.SetReadDeadline(time.Now().Add(UDPSessionTimeout))
+			if _, err := sess.WriteTo(d.payload, udpTarget(d.target)); err != nil {
+				log.Warningf("UDP failed to forward to %s: %v\n", d.target, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *SnellClient) handleUDPIngress(key string, flow *udpFlow, sess *snellPacketConn, reply udpReplyFunc) {
+	defer func() {
+		s.endUDPFlow(key, flow)
+		sess.Close()
+		log.V(1).Infof("UDP session from %s done\n", key)
+	}()
+
+	buf := p.Get(maxUDPPayload)
+	defer p.Put(buf)
+
+	for {
+		n, from, err := sess.ReadFrom(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				log.V(1).Infof("UDP session read error: %v\n", err)
+			}
+			return
+		}
+		sess.SetReadDeadline(time.Now().Add(UDPSessionTimeout))
+
+		if err := reply(buf[:n], from.(*net.UDPAddr)); err != nil {
+			log.Warningf("UDP failed to write back to %s: %v\n", key, err)
+			return
+		}
+	}
+}
+
+// udpTarget is a net.Addr for targets which may not be resolved locally.
+type udpTarget string
+
+func (a udpTarget) Network() string { return "udp" }
+func (a udpTarget) String() string  { return string(a) }
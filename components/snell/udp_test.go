@@ -0,0 +1,235 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// records keeps every write as a record and reads them back one at a time,
+// as a cipher stream does.
+type records struct {
+	list [][]byte
+}
+
+func (r *records) Write(b []byte) (int, error) {
+	r.list = append(r.list, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (r *records) Read(b []byte) (int, error) {
+	if len(r.list) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, r.list[0])
+	r.list = r.list[1:]
+	return n, nil
+}
+
+func TestUDPFrameFragmentation(t *testing.T) {
+	for _, size := range []int{1, aead.MaxPayloadSize, aead.MaxPayloadSize + 1, 3*aead.MaxPayloadSize + 7, maxUDPFrame} {
+		frame := bytes.Repeat([]byte{4}, size) // an address type, never a marker
+		frame[size-1] = byte(size)
+		var r records
+		if err := writeUDPFrame(&r, frame); err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range r.list {
+			if len(rec) > aead.MaxPayloadSize {
+				t.Fatalf("frame of %d bytes: record of %d bytes", size, len(rec))
+			}
+		}
+		if fits := size <= aead.MaxPayloadSize; fits != (len(r.list) == 1) {
+			t.Fatalf("frame of %d bytes sent in %d records", size, len(r.list))
+		}
+
+		fr := newUDPFrameReader(&r)
+		got, err := fr.next()
+		if err != nil || !bytes.Equal(got, frame) {
+			t.Fatalf("frame of %d bytes: read back %d bytes, %v", size, len(got), err)
+		}
+		fr.release()
+	}
+
+	var r records
+	if err := writeUDPFrame(&r, make([]byte, maxUDPFrame+1)); !errors.Is(err, ErrDatagramTooLarge) {
+		t.Fatalf("got %v, want ErrDatagramTooLarge", err)
+	}
+}
+
+func TestUDPFrameMalformed(t *testing.T) {
+	first := func(size uint32, data ...byte) []byte {
+		b := []byte{udpFragmentFirst, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], size)
+		return append(b, data...)
+	}
+	valid := []byte{4, 127, 0, 0, 1, 0, 53, 'x'}
+	for _, tc := range []struct {
+		name string
+		list [][]byte
+	}{
+		{"huge length", [][]byte{first(1 << 31)}},
+		{"just over the maximum", [][]byte{first(maxUDPFrame + 1)}},
+		{"stray next", [][]byte{{udpFragmentNext, 1, 2}}},
+		{"short first", [][]byte{{udpFragmentFirst, 0, 0}}},
+		{"overflow", [][]byte{first(4, 1, 2), {udpFragmentNext, 3, 4, 5}}},
+		{"interleaved", [][]byte{first(4, 1, 2), valid}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &records{list: append(tc.list, valid)}
+			fr := newUDPFrameReader(r)
+			defer fr.release()
+			if _, err := fr.next(); !errors.Is(err, ErrMalformedUDPFrame) {
+				t.Fatalf("got %v, want ErrMalformedUDPFrame", err)
+			}
+			if fr.frame != nil && cap(fr.frame) > maxUDPFrame {
+				t.Fatalf("reassembly buffer of %d bytes", cap(fr.frame))
+			}
+			// the session goes on with the next frame
+			for {
+				got, err := fr.next()
+				if err != nil {
+					t.Fatalf("frame after the malformed one: %v", err)
+				}
+				if bytes.Equal(got, valid) {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestUDPDatagramSizes(t *testing.T) {
+	_, server := startServer(t)
+	sc := startClient(t, server)
+	echo := udpEcho(t)
+
+	pc, err := sc.DialUDP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	buf := make([]byte, maxUDPPayload+1)
+	for _, size := range []int{1, 16383, 16384, maxUDPPayload} {
+		msg := make([]byte, size)
+		for i := range msg {
+			msg[i] = byte(i * 13)
+		}
+		if _, err := pc.WriteTo(msg, echo); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if from.String() != echo.String() || !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("%d bytes: got %d bytes from %v", size, n, from)
+		}
+	}
+
+	if _, err := pc.WriteTo(make([]byte, maxUDPPayload+1), echo); !errors.Is(err, ErrDatagramTooLarge) {
+		t.Fatalf("got %v, want ErrDatagramTooLarge", err)
+	}
+}
+
+// TestDNSOverUDPSession resolves a name through a UDP session, from the
+// session handshake to the answer datagram.
+func TestDNSOverUDPSession(t *testing.T) {
+	_, server := startServer(t)
+	sc := startClient(t, server)
+	dns := startFakeDNS(t)
+	dns.set("tunnel.test.", fakeRecord{ip: net.IPv4(10, 1, 2, 3), ttl: 60})
+
+	pc, err := sc.DialUDP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x5e11, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("tunnel.test."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := net.ResolveUDPAddr("udp", dns.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.WriteTo(query, to); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 512)
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.String() != to.String() {
+		t.Fatalf("answer from %v, want %v", from, to)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != q.ID || len(resp.Answers) != 1 {
+		t.Fatalf("answer %+v", resp)
+	}
+	a, ok := resp.Answers[0].Body.(*dnsmessage.AResource)
+	if !ok || net.IP(a.A[:]).String() != "10.1.2.3" {
+		t.Fatalf("answer %v", resp.Answers[0].Body)
+	}
+}
+
+// TestDialUDPNotAccepted checks a session the server does not accept, as
+// with the wrong PSK, fails within ctx.
+func TestDialUDPNotAccepted(t *testing.T) {
+	_, server := startServer(t)
+	sc, err := NewSnellClient("127.0.0.1:0", server, "", "", "wrong psk", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sc.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := sc.DialUDP(ctx); err == nil {
+		t.Fatal("session opened with the wrong PSK")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("failed after %v, past its context", d)
+	}
+}
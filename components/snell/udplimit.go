@@ -0,0 +1,185 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"sync"
+	"time"
+)
+
+// UDPLimits bounds what a single client, told apart by its source address,
+// may push through the UDP relay across all of its sessions. Datagrams
+// over a limit are dropped. Zero fields mean no limit.
+type UDPLimits struct {
+	// MaxFlows bounds the distinct targets in use at once, datagrams to a
+	// further target are dropped until a session ends.
+	MaxFlows int
+	// MaxDatagramsPerSec and MaxBytesPerSec bound the client to target
+	// traffic, allowing bursts of one second worth, at least one datagram
+	// of the largest size.
+	MaxDatagramsPerSec float64
+	MaxBytesPerSec     float64
+}
+
+// UDPClientStats is a snapshot of the UDP relay counters of a client.
+type UDPClientStats struct {
+	Flows   int
+	Dropped uint64
+}
+
+// maxUDPPayload is the largest UDP datagram over IPv4.
+const maxUDPPayload = 65507
+
+// tokenBucket refills at rate per second up to burst.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, minBurst float64) tokenBucket {
+	burst := rate
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return tokenBucket{rate: rate, burst: burst}
+}
+
+func (b *tokenBucket) take(n float64, now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = b.burst
+	} else {
+		b.tokens += b.rate * now.Sub(b.last).Seconds()
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+type udpClient struct {
+	flows    map[string]int // target -> sessions using it
+	dgrams   tokenBucket
+	bytes    tokenBucket
+	dropped  uint64
+	sessions int
+}
+
+// udpLimiter enforces UDPLimits, shared by all UDP sessions of a server.
+type udpLimiter struct {
+	limits  UDPLimits
+	mux     sync.Mutex
+	clients map[string]*udpClient
+	dropped uint64
+}
+
+func newUDPLimiter(l UDPLimits) *udpLimiter {
+	return &udpLimiter{limits: l, clients: map[string]*udpClient{}}
+}
+
+// open registers a UDP session of client, it must be balanced by close.
+func (l *udpLimiter) open(client string) *udpSessionLimiter {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	c := l.clients[client]
+	if c == nil {
+		c = &udpClient{
+			flows:  map[string]int{},
+			dgrams: newTokenBucket(l.limits.MaxDatagramsPerSec, 1),
+			bytes:  newTokenBucket(l.limits.MaxBytesPerSec, maxUDPPayload),
+		}
+		l.clients[client] = c
+	}
+	c.sessions++
+	return &udpSessionLimiter{l: l, client: client, c: c, targets: map[string]bool{}}
+}
+
+// udpSessionLimiter is the view of a single UDP session on the limiter.
+type udpSessionLimiter struct {
+	l       *udpLimiter
+	client  string
+	c       *udpClient
+	targets map[string]bool
+}
+
+// allow reports whether a datagram of size bytes to target may be sent,
+// counting it as dropped otherwise.
+func (s *udpSessionLimiter) allow(target string, size int) bool {
+	l := s.l
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	ok := true
+	if !s.targets[target] {
+		if l.limits.MaxFlows > 0 && s.c.flows[target] == 0 && len(s.c.flows) >= l.limits.MaxFlows {
+			ok = false
+		} else {
+			s.targets[target] = true
+			s.c.flows[target]++
+		}
+	}
+	if ok {
+		now := time.Now()
+		ok = s.c.bytes.take(float64(size), now) && s.c.dgrams.take(1, now)
+	}
+	if !ok {
+		s.c.dropped++
+		l.dropped++
+	}
+	return ok
+}
+
+// close releases the flows of the session.
+func (s *udpSessionLimiter) close() {
+	l := s.l
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for target := range s.targets {
+		if s.c.flows[target]--; s.c.flows[target] == 0 {
+			delete(s.c.flows, target)
+		}
+	}
+	if s.c.sessions--; s.c.sessions == 0 {
+		delete(l.clients, s.client)
+	}
+}
+
+func (l *udpLimiter) stats() (flows int, dropped uint64) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for _, c := range l.clients {
+		flows += len(c.flows)
+	}
+	return flows, l.dropped
+}
+
+func (l *udpLimiter) clientStats() map[string]UDPClientStats {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	m := make(map[string]UDPClientStats, len(l.clients))
+	for name, c := range l.clients {
+		m[name] = UDPClientStats{Flows: len(c.flows), Dropped: c.dropped}
+	}
+	return m
+}
@@ -0,0 +1,119 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package snell
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUDPLimiterFlows(t *testing.T) {
+	l := newUDPLimiter(UDPLimits{MaxFlows: 2})
+	a, b := l.open("client"), l.open("client")
+	if !a.allow("1.1.1.1:53", 40) || !b.allow("8.8.8.8:53", 40) {
+		t.Fatal("flows under the limit dropped")
+	}
+	if !b.allow("1.1.1.1:53", 40) {
+		t.Fatal("target already in use by the client counted as a new flow")
+	}
+	if a.allow("9.9.9.9:53", 40) {
+		t.Fatal("flow over the limit allowed")
+	}
+	if other := l.open("other"); !other.allow("9.9.9.9:53", 40) {
+		t.Fatal("limit shared across clients")
+	}
+	if st := l.clientStats()["client"]; st.Flows != 2 || st.Dropped != 1 {
+		t.Fatalf("stats %+v, want 2 flows and 1 dropped", st)
+	}
+
+	b.close() // 1.1.1.1 stays in use by a
+	if !a.allow("9.9.9.9:53", 40) {
+		t.Fatal("flow slot not released by the session ending")
+	}
+}
+
+func TestUDPLimiterRates(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		limits UDPLimits
+		size   int
+		want   int
+	}{
+		{"datagrams", UDPLimits{MaxDatagramsPerSec: 50}, 10, 50},
+		{"bytes", UDPLimits{MaxBytesPerSec: 100000}, 1000, 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newUDPLimiter(tc.limits).open("client")
+			allowed := 0
+			for i := 0; i < 1000; i++ { // a flood well within a second
+				if s.allow("1.1.1.1:53", tc.size) {
+					allowed++
+				}
+			}
+			// the burst of one second, plus what refilled meanwhile
+			if allowed < tc.want || allowed > tc.want+tc.want/5 {
+				t.Fatalf("%d of the flood allowed, want about %d", allowed, tc.want)
+			}
+		})
+	}
+}
+
+func TestUDPFloodLimited(t *testing.T) {
+	s, server := startServer(t, WithUDPLimits(UDPLimits{MaxFlows: 1, MaxDatagramsPerSec: 20}))
+	sc := startClient(t, server)
+	echo, other := udpEcho(t), udpEcho(t)
+
+	pc, err := sc.DialUDP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	const flood = 200
+	for i := 0; i < flood; i++ {
+		if _, err := pc.WriteTo([]byte("flood"), echo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pc.WriteTo([]byte("second flow"), other)
+
+	replies := 0
+	buf := make([]byte, 64)
+	for {
+		pc.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if from.String() == other.String() {
+			t.Fatal("datagram of a flow over the limit relayed")
+		}
+		replies++
+	}
+	if replies == 0 || replies > 30 {
+		t.Fatalf("%d datagrams of the flood relayed, want about 20", replies)
+	}
+
+	st := s.Stats()
+	if st.UDPFlows != 1 || st.UDPDropped < flood-30 {
+		t.Fatalf("stats: %d flows, %d dropped", st.UDPFlows, st.UDPDropped)
+	}
+	for client, cs := range s.UDPClientStats() {
+		if cs.Flows != 1 || cs.Dropped != st.UDPDropped {
+			t.Fatalf("client %s stats %+v", client, cs)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"sync"
 
 	log "github.com/golang/glog"
 )
@@ -29,6 +30,9 @@ type SockListener struct {
 	address  string
 	closed   bool
 	callback SocksCallback
+
+	mux sync.Mutex
+	udp *SockUDPListener
 }
 
 func NewSocksProxy(addr string, cb SocksCallback) (*SockListener, error) {
@@ -37,7 +41,7 @@ func NewSocksProxy(addr string, cb SocksCallback) (*SockListener, error) {
 		return nil, err
 	}
 
-	sl := &SockListener{l, addr, false, cb}
+	sl := &SockListener{Listener: l, address: addr, callback: cb}
 	go func() {
 		log.Infof("SOCKS proxy listening at: %s\n", addr)
 		for {
@@ -48,7 +52,7 @@ func NewSocksProxy(addr string, cb SocksCallback) (*SockListener, error) {
 				}
 				continue
 			}
-			go handleSocks(c, sl.callback)
+			go sl.handleSocks(c)
 		}
 	}()
 
@@ -64,7 +68,22 @@ func (l *SockListener) Address() string {
 	return l.address
 }
 
-func handleSocks(conn net.Conn, cb SocksCallback) {
+// SetUDPRelay makes UDP ASSOCIATE requests open associations on ul, which
+// only relays datagrams of clients holding one. Without a relay set, the
+// requests are acknowledged and nothing else happens.
+func (l *SockListener) SetUDPRelay(ul *SockUDPListener) {
+	l.mux.Lock()
+	l.udp = ul
+	l.mux.Unlock()
+}
+
+func (l *SockListener) udpRelay() *SockUDPListener {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.udp
+}
+
+func (l *SockListener) handleSocks(conn net.Conn) {
 	target, command, err := ServerHandshake(conn)
 	if err != nil {
 		conn.Close()
@@ -75,8 +94,13 @@ func handleSocks(conn net.Conn, cb SocksCallback) {
 	}
 	if command == CmdUDPAssociate {
 		defer conn.Close()
+		// the association lasts as long as the TCP connection
+		if ul := l.udpRelay(); ul != nil {
+			release := ul.associate(conn.RemoteAddr(), target)
+			defer release()
+		}
 		io.Copy(ioutil.Discard, conn)
 		return
 	}
-	cb(conn, target)
+	l.callback(conn, target)
 }
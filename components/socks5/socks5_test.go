@@ -0,0 +1,137 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnect(t *testing.T) {
+	targets := make(chan string, 1)
+	sl, err := NewSocksProxy("127.0.0.1:0", func(c net.Conn, addr Addr) {
+		targets <- addr.String()
+		c.Write([]byte("hi"))
+		c.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+
+	c, err := net.Dial("tcp", sl.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := ClientHandshake(c, ParseAddr("example.com:443"), CmdConnect); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-targets; got != "example.com:443" {
+		t.Fatalf("target %q, want example.com:443", got)
+	}
+	b := make([]byte, 2)
+	if _, err := c.Read(b); err != nil || string(b) != "hi" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+}
+
+func TestUDPRequiresAssociation(t *testing.T) {
+	type datagram struct {
+		payload string
+		src     string
+	}
+	got := make(chan datagram, 16)
+	ul, err := NewSocksUDPProxy("127.0.0.1:0", func(pc net.PacketConn, payload []byte, target Addr, src net.Addr) {
+		got <- datagram{string(payload), src.String()}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+	sl, err := NewSocksProxy("127.0.0.1:0", func(c net.Conn, addr Addr) { c.Close() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	sl.SetUDPRelay(ul)
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	relay := ul.LocalAddr()
+	send := func(from *net.UDPConn, payload string) {
+		t.Helper()
+		packet, _ := EncodeUDPPacket(ParseAddr("192.0.2.1:53"), []byte(payload))
+		if _, err := from.WriteTo(packet, relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(payload string) {
+		t.Helper()
+		select {
+		case d := <-got:
+			if d.payload != payload {
+				t.Fatalf("relayed %q from %s, want %q", d.payload, d.src, payload)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%q not relayed", payload)
+		}
+	}
+
+	send(client, "before association")
+
+	tcp, err := net.Dial("tcp", sl.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientHandshake(tcp, ParseAddrToSocksAddr(client.LocalAddr()), CmdUDPAssociate); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !ul.associated(client.LocalAddr()) {
+		if time.Now().After(deadline) {
+			t.Fatal("association not registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	send(other, "from another port")
+	send(client, "associated")
+	expect("associated")
+
+	tcp.Close()
+	for ul.associated(client.LocalAddr()) {
+		if time.Now().After(deadline) {
+			t.Fatal("association outlived its TCP connection")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	send(client, "after close")
+	select {
+	case d := <-got:
+		t.Fatalf("relayed %q from %s without association", d.payload, d.src)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
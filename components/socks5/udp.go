@@ -0,0 +1,139 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package socks5
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/golang/glog"
+
+	p "github.com/icpz/open-snell/components/utils/pool"
+)
+
+const maxUDPPacketSize = 65535
+
+// SocksUDPCallback handles one datagram relayed by a SOCKS client, the
+// payload is only valid during the call.
+type SocksUDPCallback func(pc net.PacketConn, payload []byte, target Addr, src net.Addr)
+
+type SockUDPListener struct {
+	net.PacketConn
+	address  string
+	closed   bool
+	callback SocksUDPCallback
+
+	mux          sync.Mutex
+	associations map[*association]struct{}
+}
+
+// association is a live UDP ASSOCIATE request, datagrams are accepted from
+// its ip only, and from its port as well if the client declared one.
+type association struct {
+	ip   net.IP
+	port int
+}
+
+// NewSocksUDPProxy serves the UDP ASSOCIATE relay, it is meant to listen on
+// the same address as the TCP proxy since that is what ServerHandshake
+// reports as the relay address.
+func NewSocksUDPProxy(addr string, cb SocksUDPCallback) (*SockUDPListener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sl := &SockUDPListener{
+		PacketConn:   pc,
+		address:      addr,
+		callback:     cb,
+		associations: map[*association]struct{}{},
+	}
+	go func() {
+		log.Infof("SOCKS UDP relay listening at: %s\n", addr)
+		buf := p.Get(maxUDPPacketSize)
+		defer p.Put(buf)
+		for {
+			n, src, err := pc.ReadFrom(buf)
+			if err != nil {
+				if sl.closed {
+					break
+				}
+				continue
+			}
+			if !sl.associated(src) {
+				log.V(1).Infof("SOCKS UDP drop packet from %s: no association\n", src.String())
+				continue
+			}
+			target, payload, err := DecodeUDPPacket(buf[:n])
+			if err != nil {
+				log.V(1).Infof("SOCKS UDP drop packet from %s: %v\n", src.String(), err)
+				continue
+			}
+			sl.callback(pc, payload, target, src)
+		}
+	}()
+
+	return sl, nil
+}
+
+// associate accepts datagrams from client, the peer of the TCP connection
+// the UDP ASSOCIATE request came on, until release is called. As RFC 1928
+// requires, datagrams from any other address are dropped. declared is the
+// address the client said it would send from, only its port is used since
+// clients behind a NAT do not know their public address.
+func (l *SockUDPListener) associate(client net.Addr, declared Addr) (release func()) {
+	a := &association{}
+	if ta, ok := client.(*net.TCPAddr); ok {
+		a.ip = ta.IP
+	}
+	if ua := declared.UDPAddr(); ua != nil {
+		a.port = ua.Port
+	}
+
+	l.mux.Lock()
+	l.associations[a] = struct{}{}
+	l.mux.Unlock()
+	return func() {
+		l.mux.Lock()
+		delete(l.associations, a)
+		l.mux.Unlock()
+	}
+}
+
+// associated reports whether src belongs to a live association.
+func (l *SockUDPListener) associated(src net.Addr) bool {
+	ua, ok := src.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for a := range l.associations {
+		if a.ip.Equal(ua.IP) && (a.port == 0 || a.port == ua.Port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *SockUDPListener) Close() {
+	l.closed = true
+	l.PacketConn.Close()
+}
+
+func (l *SockUDPListener) Address() string {
+	return l.address
+}
@@ -0,0 +1,167 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ws
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/icpz/open-snell/components/aead"
+)
+
+// wsPair returns both ends of a WebSocket connection, dialed through Dial
+// and accepted from a Listener.
+func wsPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	l := NewListener(&net.TCPAddr{})
+	srv := httptest.NewServer(l)
+	t.Cleanup(func() {
+		l.Close()
+		srv.Close()
+	})
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	client, err := Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upgraded connection not accepted")
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+func TestSnellOverWebSocket(t *testing.T) {
+	ciph, err := aead.NewCipher("chacha20-poly1305", []byte("ws test psk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc, ws := wsPair(t)
+	client := aead.NewConn(wc, ciph, aead.WithRole(aead.RoleClient))
+	server := aead.NewConn(ws, ciph, aead.WithRole(aead.RoleServer))
+
+	// large enough to span several records
+	msg := bytes.Repeat([]byte("over websocket "), 10000)
+	go client.Write(msg)
+	got := make([]byte, len(msg))
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("payload corrupted on the way to the server")
+	}
+
+	if _, err := server.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	got = make([]byte, 5)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, got); err != nil || string(got) != "reply" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestReadSpansMessages(t *testing.T) {
+	client, server := wsPair(t)
+
+	client.Write([]byte("abc"))
+	// text messages are no part of the stream
+	client.(*Conn).ws.WriteMessage(websocket.TextMessage, []byte("skipped"))
+	client.Write([]byte{})
+	client.Write([]byte("defgh"))
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 8)
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abcdefgh" {
+		t.Fatalf("got %q across messages", got)
+	}
+
+	// and a message larger than the buffer is read in parts
+	client.Write([]byte("0123456789"))
+	part := make([]byte, 4)
+	var all []byte
+	for len(all) < 10 {
+		n, err := server.Read(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, part[:n]...)
+	}
+	if string(all) != "0123456789" {
+		t.Fatalf("got %q in parts", all)
+	}
+}
+
+func TestCloseIsEOF(t *testing.T) {
+	client, server := wsPair(t)
+
+	client.Write([]byte("last"))
+	client.Close()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("got %v on close, want a clean EOF", err)
+	}
+	if string(got) != "last" {
+		t.Fatalf("got %q before the close", got)
+	}
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read succeeded past the close")
+	}
+}
+
+func TestListenerCloseUnblocksAccept(t *testing.T) {
+	l := NewListener(&net.TCPAddr{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrListenerClosed) {
+			t.Fatalf("got %v, want ErrListenerClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept still blocked after Close")
+	}
+	if _, err := l.Accept(); !errors.Is(err, ErrListenerClosed) {
+		t.Fatalf("got %v from a closed listener", err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package pool
+
+import (
+	"sync"
+)
+
+// Budget caps the bytes of buffers held at once, turning memory pressure
+// into backpressure: reservations over the limit wait or are refused
+// instead of allocating. It only accounts, the buffers themselves still
+// come from Get or elsewhere.
+type Budget struct {
+	limit int64
+
+	mux     sync.Mutex
+	cond    *sync.Cond
+	used    int64
+	refused uint64
+	closed  bool
+}
+
+// NewBudget returns a budget of limit bytes.
+func NewBudget(limit int64) *Budget {
+	b := &Budget{limit: limit}
+	b.cond = sync.NewCond(&b.mux)
+	return b
+}
+
+// Acquire reserves n bytes, waiting for releases while they do not fit. It
+// reports false once the budget is closed, or if n exceeds the limit.
+func (b *Budget) Acquire(n int64) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if n > b.limit {
+		b.refused++
+		return false
+	}
+	for b.used+n > b.limit && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// TryAcquire reserves n bytes if they fit right now.
+func (b *Budget) TryAcquire(n int64) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.closed || b.used+n > b.limit {
+		b.refused++
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// Release returns n bytes reserved by Acquire or TryAcquire.
+func (b *Budget) Release(n int64) {
+	b.mux.Lock()
+	b.used -= n
+	b.cond.Broadcast()
+	b.mux.Unlock()
+}
+
+// Close wakes the callers waiting in Acquire for good.
+func (b *Budget) Close() {
+	b.mux.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mux.Unlock()
+}
+
+// Stats returns the bytes reserved, the limit and how many reservations
+// were refused.
+func (b *Budget) Stats() (used, limit int64, refused uint64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.used, b.limit, b.refused
+}
@@ -0,0 +1,57 @@
+/*
+ * This file is part of open-snell.
+ * open-snell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ * open-snell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ * You should have received a copy of the GNU General Public License
+ * along with open-snell.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package pool
+
+import "sync"
+
+// Fixed hands out buffers of one size, at most n at once: past that Get
+// waits for a Put, so its users hold at most size*n bytes between them.
+// Buffers are allocated on first use and kept for reuse afterwards.
+type Fixed struct {
+	size int
+	free chan []byte
+	pair sync.Mutex // serializes GetPair
+}
+
+// NewFixed returns a pool of n buffers of size bytes.
+func NewFixed(size, n int) *Fixed {
+	f := &Fixed{size: size, free: make(chan []byte, n)}
+	for i := 0; i < n; i++ {
+		f.free <- nil
+	}
+	return f
+}
+
+// Get returns a buffer, waiting while all of them are in use.
+func (f *Fixed) Get() []byte {
+	buf := <-f.free
+	if buf == nil {
+		buf = make([]byte, f.size)
+	}
+	return buf
+}
+
+// GetPair returns two buffers taken at once: users getting pairs never
+// each hold one while waiting for another.
+func (f *Fixed) GetPair() ([]byte, []byte) {
+	f.pair.Lock()
+	defer f.pair.Unlock()
+	return f.Get(), f.Get()
+}
+
+// Put returns a buffer obtained from Get.
+func (f *Fixed) Put(buf []byte) {
+	f.free <- buf[:f.size]
+}